@@ -0,0 +1,54 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kubernetes-csi/csi-driver-nfs/pkg/nfs"
+)
+
+// doctorCommand is the subcommand of node diagnostics, e.g. kubectl exec csi-nfs-node-xxx -c nfs -- /nfsplugin doctor
+const doctorCommand = "doctor"
+
+// runDoctor parses flags of doctor subcommand and returns exit code of the checks
+func runDoctor(args []string) int {
+	fs := flag.NewFlagSet(doctorCommand, flag.ExitOnError)
+	servers := fs.String("servers", "", "comma separated nfs servers to check in addition to servers of volumes on the node, e.g. servers of storage classes")
+	nodeStateFile := fs.String("node-state-file", "/csi/node-state.json", "node state file of node plugin, servers and volumes recorded in it are checked")
+	kataDirectVolumeRootPath := fs.String("kata-direct-volume-root-path", nfs.DefaultKataDirectVolumeRootPath, "root directory where kata direct volumes are registered")
+	timeout := fs.Duration("timeout", nfs.DefaultDoctorTimeout, "time to wait for each stat on nfs mount and dial to nfs server")
+	_ = fs.Parse(args)
+
+	opts := &nfs.DoctorOptions{
+		NodeStateFile:            *nodeStateFile,
+		KataDirectVolumeRootPath: *kataDirectVolumeRootPath,
+		Timeout:                  *timeout,
+	}
+	if *servers != "" {
+		opts.Servers = strings.Split(*servers, ",")
+	}
+	if err := nfs.RunDoctor(context.Background(), os.Stdout, opts); err != nil {
+		fmt.Fprintf(os.Stderr, "\n%v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -19,6 +19,7 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
 	"github.com/kubernetes-csi/csi-driver-nfs/pkg/nfs"
 
@@ -26,18 +27,73 @@ import (
 )
 
 var (
-	endpoint              = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
-	nodeID                = flag.String("nodeid", "", "node id")
-	mountPermissions      = flag.Uint64("mount-permissions", 0, "mounted folder permissions")
-	driverName            = flag.String("drivername", nfs.DefaultDriverName, "name of the driver")
-	workingMountDir       = flag.String("working-mount-dir", "/tmp", "working directory for provisioner to mount nfs shares temporarily")
-	defaultOnDeletePolicy = flag.String("default-ondelete-policy", "", "default policy for deleting subdirectory when deleting a volume")
+	endpoint                     = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
+	nodeID                       = flag.String("nodeid", "", "node id")
+	mountPermissions             = flag.Uint64("mount-permissions", 0, "mounted folder permissions")
+	driverName                   = flag.String("drivername", nfs.DefaultDriverName, "name of the driver")
+	workingMountDir              = flag.String("working-mount-dir", "/tmp", "working directory for provisioner to mount nfs shares temporarily")
+	defaultOnDeletePolicy        = flag.String("default-ondelete-policy", "", "default policy for deleting subdirectory when deleting a volume, available values: delete, retain, archive")
+	quotaMountDir                = flag.String("quota-mount-dir", "", "local directory where the backing filesystem of nfs exports is mounted, required for project quota")
+	krb5KeytabPath               = flag.String("krb5-keytab-path", nfs.DefaultKrb5KeytabPath, "path of the keytab used by rpc.gssd, keytabs in node stage secrets of volumes are merged into it for kerberos mount")
+	metricsAddress               = flag.String("metrics-address", "", "address(e.g. 0.0.0.0:29654) to serve prometheus metrics at /metrics, metrics are not served if empty")
+	mountTimeout                 = flag.Duration("mount-timeout", time.Minute, "time to wait for a single mount attempt, no timeout if set as 0, mount is retried with exponential backoff on transient errors, e.g. connection refused")
+	staleMountCheckInterval      = flag.Duration("stale-mount-check-interval", 0, "interval of checking mounts published by node plugin, corrupted mounts(e.g. stale file handle) are remounted, mounts are not checked if set as 0")
+	kataDirectVolumeRootPath     = flag.String("kata-direct-volume-root-path", nfs.DefaultKataDirectVolumeRootPath, "root directory where kata direct volumes are registered, it should be the direct volume directory of kata runtime on the node")
+	kataDirectVolumeGCInterval   = flag.Duration("kata-direct-volume-gc-interval", 10*time.Minute, "interval of removing kata direct volumes whose target path does not exist, orphaned kata direct volumes are not removed periodically if set as 0")
+	enableTopology               = flag.Bool("enable-topology", false, "report zone(topology.kubernetes.io/zone label) of the node in NodeGetInfo, it's required by serverMap parameter of storage class")
+	kubeconfig                   = flag.String("kubeconfig", "", "absolute path to the kubeconfig file used to get zone of the node, in-cluster config is used if empty")
+	defaultMountOptions          = flag.String("default-mount-options", "", "comma separated mount options(e.g. nfsvers=4.1,hard,noatime) applied on node publish, options specified in pv or volume context take precedence")
+	allowedMountOptions          = flag.String("allowed-mount-options", "", "comma separated mount options(e.g. nfsvers,hard,sec=krb5p) allowed in volumes, options are matched by key or full option, all mount options of nfs(5) are allowed if empty")
+	forbiddenMountOptions        = flag.String("forbidden-mount-options", "", "comma separated mount options(e.g. nolock,sec=sys) forbidden in volumes, options are matched by key or full option")
+	enableOrphanGC               = flag.Bool("enable-orphan-gc", false, "find subdirectories(pvc-*) without persistent volume on shares of storage classes of the driver periodically in controller, they are reported in logs and metrics")
+	orphanGCInterval             = flag.Duration("orphan-gc-interval", time.Hour, "interval of orphan garbage collection")
+	orphanGCGracePeriod          = flag.Duration("orphan-gc-grace-period", 24*time.Hour, "subdirectories modified in the grace period are not treated as orphans")
+	orphanGCRemove               = flag.Bool("orphan-gc-remove", false, "remove orphaned subdirectories found by orphan garbage collection, each orphan is only removed after it is reported by the previous collection and listed in .csi-nfs-orphans-acknowledged of the share, orphans are only reported if false")
+	volumeStatsCacheTTL          = flag.Duration("volume-stats-cache-ttl", time.Minute, "time to cache NodeGetVolumeStats results of a volume on node, so that statfs is not issued against nfs server on every kubelet poll")
+	disableVolumeStatsCache      = flag.Bool("disable-volume-stats-cache", false, "disable caching of NodeGetVolumeStats results, statfs is issued on every call")
+	leaderElection               = flag.Bool("leader-election", false, "enable leader election in controller, controller loops(e.g. orphan garbage collection) only run in the leader replica")
+	leaderElectionNamespace      = flag.String("leader-election-namespace", "", "namespace of the leader election lease, namespace of the pod is used if empty")
+	leaderElectionLeaseDuration  = flag.Duration("leader-election-lease-duration", nfs.DefaultLeaderElectionLeaseDuration, "duration that non-leader replicas wait before forcing to acquire leadership")
+	leaderElectionRenewDeadline  = flag.Duration("leader-election-renew-deadline", nfs.DefaultLeaderElectionRenewDeadline, "duration that the leader retries refreshing leadership before giving up")
+	leaderElectionRetryPeriod    = flag.Duration("leader-election-retry-period", nfs.DefaultLeaderElectionRetryPeriod, "duration between attempts of acquiring and renewing leadership")
+	leaderElectionHandoffTimeout = flag.Duration("leader-election-handoff-timeout", nfs.DefaultLeaderElectionHandoffTimeout, "time to wait for in-flight operations on SIGTERM before releasing the lease, it should be less than terminationGracePeriodSeconds of controller pod")
+	enableEvents                 = flag.Bool("enable-events", false, "emit events on pvc(or pv if pvc is unknown) of failed CreateVolume, DeleteVolume and NodePublishVolume calls, and on pv of remounted stale mounts")
+	staticVolumeAdoptionInterval = flag.Duration("static-volume-adoption-interval", 0, "interval of registering pre-provisioned volumes of the driver in controller, so they are listed with volume conditions in ListVolumes, static volumes are not adopted if set as 0")
+	volumeIDVersion              = flag.Int("volume-id-version", nfs.DefaultVolumeIDVersion, "version of volume ID of new volumes, 2: {server}#{share}#{subdir}, 3: {server}#{share}#{subdir}#{uuid}#{onDelete}, version 3 is used for volumes with subDir parameter or retain/archive onDelete, volume IDs of all versions are parsed")
+	trashPurgeInterval           = flag.Duration("trash-purge-interval", 0, "interval of removing expired subdirectories of volumes deleted with retainFor parameter in controller, trash is not purged if set as 0")
+	enableMountHealthProbe       = flag.Bool("enable-mount-health-probe", false, "report the plugin unhealthy in Probe if nfs mounts of volumes hang or their nfs servers are unreachable, the result is cached for 10s")
+	unmountTimeout               = flag.Duration("unmount-timeout", 30*time.Second, "time to wait for umount before retrying with umount -f, umount -l is used if umount -f does not finish in another timeout")
+	nodeStateFile                = flag.String("node-state-file", "", "file where volumes published on the node are recorded, they are reconciled against mount table and kata direct volumes after node plugin restarts, volumes are not recorded if empty")
+	gracefulShutdownTimeout      = flag.Duration("graceful-shutdown-timeout", nfs.DefaultGracefulShutdownTimeout, "time to wait for in-flight operations on SIGTERM before exiting, it should be less than terminationGracePeriodSeconds of the pod, exit immediately if set as 0, --leader-election-handoff-timeout is used if leader election is enabled")
+	enableNodeStage              = flag.Bool("enable-node-stage", false, "mount the nfs share once per volume on staging path of the node in NodeStageVolume, target paths of pods are bind mounted from the staging path")
+	shareCachePolicy             = flag.String("share-cache-policy", nfs.ShareCachePolicyShared, "whether mounts of the same server:export share the kernel superblock on the node, available values: shared, isolated(mounted with nosharecache), sharecache or nosharecache in mount options take precedence")
+	enableEncryption             = flag.Bool("enable-encryption", false, "publish volumes with encrypted parameter, gocryptfs runs in node plugin and plaintext mounts of encrypted volumes are broken when node plugin restarts")
+	encryptionMountDir           = flag.String("encryption-mount-dir", nfs.DefaultEncryptionMountDir, "directory where nfs shares of encrypted volumes are mounted on node before gocryptfs mounts their plaintext view on target paths")
+	maxConcurrentCreate          = flag.Int("max-concurrent-create", 0, "max concurrent CreateVolume calls in controller, calls over the limit wait until a running call finishes, no limit if set as 0")
+	maxConcurrentDelete          = flag.Int("max-concurrent-delete", 0, "max concurrent DeleteVolume calls in controller, calls over the limit wait until a running call finishes, no limit if set as 0")
+	usageReportInterval          = flag.Duration("usage-report-interval", 0, "interval of computing used bytes of persistent volumes and namespaces on nfs servers in controller, they are reported in metrics, disabled if set as 0")
+	usageReportMaxFilesPerSecond = flag.Int("usage-report-max-files-per-second", nfs.DefaultUsageReportMaxFilesPerSecond, "max number of files stat on nfs servers per second by usage report, no limit if set as 0")
+	usageReportConfigMap         = flag.String("usage-report-configmap", "", "name of ConfigMap in the namespace of controller where usage report is written, volumes using the most bytes are kept if the report exceeds 900KiB, usage is only reported in metrics if empty")
+	enableBlockVolume            = flag.Bool("enable-block-volume", false, "support volumes with block volume mode, a sparse file of the requested size is created on the nfs share and attached to a loop device on the node")
+	blockVolumeMountDir          = flag.String("block-volume-mount-dir", nfs.DefaultBlockVolumeMountDir, "directory where nfs shares of block volumes are mounted on node before their sparse files are attached to loop devices, it should be a host path mounted with bidirectional propagation so loop devices could be detached after node plugin restarts")
+	enableInTreeMigration        = flag.Bool("enable-in-tree-migration", false, "publish in-tree nfs persistent volumes translated by CSI migration, server and share are read from volume handle {server}:{path} if they are not in volume context")
+	volumeRegistryResyncInterval = flag.Duration("volume-registry-resync-interval", 0, "interval of rebuilding volumes known by controller from persistent volumes of the driver, ListVolumes and ControllerGetVolume are only advertised if it's set")
+	logFormat                    = flag.String("log-format", nfs.LogFormatText, "format of logs, available values: text, json, logs of CSI calls carry requestID, volumeID, targetPath and server in both formats")
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == doctorCommand {
+		os.Exit(runDoctor(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == migrateInTreeCommand {
+		os.Exit(runMigrateInTree(os.Args[2:]))
+	}
 	klog.InitFlags(nil)
 	_ = flag.Set("logtostderr", "true")
 	flag.Parse()
+	if err := nfs.InitLogging(*logFormat); err != nil {
+		klog.Fatalf("failed to initialize logging: %v", err)
+	}
 	if *nodeID == "" {
 		klog.Warning("nodeid is empty")
 	}
@@ -48,12 +104,59 @@ func main() {
 
 func handle() {
 	driverOptions := nfs.DriverOptions{
-		NodeID:                *nodeID,
-		DriverName:            *driverName,
-		Endpoint:              *endpoint,
-		MountPermissions:      *mountPermissions,
-		WorkingMountDir:       *workingMountDir,
-		DefaultOnDeletePolicy: *defaultOnDeletePolicy,
+		NodeID:                       *nodeID,
+		DriverName:                   *driverName,
+		Endpoint:                     *endpoint,
+		MountPermissions:             *mountPermissions,
+		WorkingMountDir:              *workingMountDir,
+		DefaultOnDeletePolicy:        *defaultOnDeletePolicy,
+		QuotaMountDir:                *quotaMountDir,
+		Krb5KeytabPath:               *krb5KeytabPath,
+		MetricsAddress:               *metricsAddress,
+		UnmountTimeout:               *unmountTimeout,
+		NodeStateFile:                *nodeStateFile,
+		GracefulShutdownTimeout:      *gracefulShutdownTimeout,
+		MountTimeout:                 *mountTimeout,
+		StaleMountCheckInterval:      *staleMountCheckInterval,
+		KataDirectVolumeRootPath:     *kataDirectVolumeRootPath,
+		KataDirectVolumeGCInterval:   *kataDirectVolumeGCInterval,
+		EnableTopology:               *enableTopology,
+		Kubeconfig:                   *kubeconfig,
+		DefaultMountOptions:          *defaultMountOptions,
+		AllowedMountOptions:          *allowedMountOptions,
+		ForbiddenMountOptions:        *forbiddenMountOptions,
+		EnableOrphanGC:               *enableOrphanGC,
+		OrphanGCInterval:             *orphanGCInterval,
+		OrphanGCGracePeriod:          *orphanGCGracePeriod,
+		OrphanGCRemove:               *orphanGCRemove,
+		VolumeStatsCacheTTL:          *volumeStatsCacheTTL,
+		LeaderElection:               *leaderElection,
+		LeaderElectionNamespace:      *leaderElectionNamespace,
+		LeaderElectionLeaseDuration:  *leaderElectionLeaseDuration,
+		LeaderElectionRenewDeadline:  *leaderElectionRenewDeadline,
+		LeaderElectionRetryPeriod:    *leaderElectionRetryPeriod,
+		LeaderElectionHandoffTimeout: *leaderElectionHandoffTimeout,
+		EnableEvents:                 *enableEvents,
+		StaticVolumeAdoptionInterval: *staticVolumeAdoptionInterval,
+		VolumeIDVersion:              *volumeIDVersion,
+		TrashPurgeInterval:           *trashPurgeInterval,
+		EnableMountHealthProbe:       *enableMountHealthProbe,
+		EnableNodeStage:              *enableNodeStage,
+		ShareCachePolicy:             *shareCachePolicy,
+		EncryptionMountDir:           *encryptionMountDir,
+		EnableEncryption:             *enableEncryption,
+		MaxConcurrentCreate:          *maxConcurrentCreate,
+		MaxConcurrentDelete:          *maxConcurrentDelete,
+		UsageReportInterval:          *usageReportInterval,
+		UsageReportMaxFilesPerSecond: *usageReportMaxFilesPerSecond,
+		UsageReportConfigMap:         *usageReportConfigMap,
+		EnableBlockVolume:            *enableBlockVolume,
+		BlockVolumeMountDir:          *blockVolumeMountDir,
+		EnableInTreeMigration:        *enableInTreeMigration,
+		VolumeRegistryResyncInterval: *volumeRegistryResyncInterval,
+	}
+	if *disableVolumeStatsCache {
+		driverOptions.VolumeStatsCacheTTL = 0
 	}
 	d := nfs.NewDriver(&driverOptions)
 	d.Run(false)
@@ -0,0 +1,57 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kubernetes-csi/csi-driver-nfs/pkg/nfs"
+)
+
+// migrateInTreeCommand is the subcommand rewriting in-tree nfs PVs to CSI PVs,
+// e.g. kubectl exec csi-nfs-controller-xxx -c nfs -- /nfsplugin migrate-in-tree --dry-run=false
+const migrateInTreeCommand = "migrate-in-tree"
+
+// runMigrateInTree parses flags of migrate-in-tree subcommand and returns exit code of the migration
+func runMigrateInTree(args []string) int {
+	fs := flag.NewFlagSet(migrateInTreeCommand, flag.ExitOnError)
+	kubeconfig := fs.String("kubeconfig", "", "absolute path to the kubeconfig file, in-cluster config is used if empty")
+	driverName := fs.String("drivername", nfs.DefaultDriverName, "name of the driver of migrated CSI persistent volumes")
+	pvs := fs.String("pvs", "", "comma separated names of in-tree nfs persistent volumes to migrate, all in-tree nfs persistent volumes are migrated if empty")
+	dryRun := fs.Bool("dry-run", true, "only print persistent volumes which would be migrated")
+	timeout := fs.Duration("timeout", nfs.DefaultInTreeMigrationTimeout, "time to wait for deletion of each in-tree persistent volume before it's created as CSI persistent volume")
+	_ = fs.Parse(args)
+
+	opts := &nfs.InTreeMigrationOptions{
+		Kubeconfig: *kubeconfig,
+		DriverName: *driverName,
+		DryRun:     *dryRun,
+		Timeout:    *timeout,
+	}
+	if *pvs != "" {
+		opts.PersistentVolumes = strings.Split(*pvs, ",")
+	}
+	if err := nfs.RunInTreeMigration(context.Background(), os.Stdout, opts); err != nil {
+		fmt.Fprintf(os.Stderr, "\n%v\n", err)
+		return 1
+	}
+	return 0
+}
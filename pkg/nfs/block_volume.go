@@ -0,0 +1,372 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DefaultBlockVolumeMountDir is where nfs shares of block volumes are mounted on node, it's private to node plugin and
+	// should be a host path since loop devices are kept by kernel after node plugin restarts, their shares are needed to detach them
+	DefaultBlockVolumeMountDir = "/var/lib/kubelet/plugins/csi-nfsplugin/block"
+	// sparse file in the subdirectory of block volume, it's attached to a loop device on node
+	blockVolumeFileName = "block.img"
+	// directory under block volume mount dir where target paths of published block volumes are recorded
+	blockVolumeTargetsDirName = "targets"
+	// volume type of kata direct volume of block volume, kata runtime hot plugs the loop device into the guest
+	kataVolumeTypeBlock = "block"
+)
+
+// runLosetup runs losetup and returns its combined output, could be replaced in unit tests
+var runLosetup = func(args ...string) ([]byte, error) {
+	return exec.Command("losetup", args...).CombinedOutput()
+}
+
+// errReadOnlyLoopDevice is returned if the loop device of block volume is attached read-only and a read-write device is requested
+var errReadOnlyLoopDevice = errors.New("loop device is attached read-only")
+
+// isBlockVolumeCapability returns true if any of volCaps requests a block volume
+func isBlockVolumeCapability(volCaps []*csi.VolumeCapability) bool {
+	for _, c := range volCaps {
+		if c.GetBlock() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// isMultiWriterAccessMode returns true if the access mode allows concurrent writers, block volumes could not be published
+// with these modes since nothing coordinates writes of loop devices attached to the same file on different nodes or pods
+func isMultiWriterAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return mode == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER || mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER
+}
+
+// hashPath returns the sha256 of path in hex, it's used as file name of volume id or target path
+func hashPath(path string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(path)))
+}
+
+// getBlockMountPath returns where the nfs share of block volume is mounted, the share is mounted and its sparse file is
+// attached to a loop device once per volume on the node
+func getBlockMountPath(blockVolumeMountDir, volumeID string) string {
+	return filepath.Join(blockVolumeMountDir, hashPath(volumeID))
+}
+
+// getBlockTargetsDir returns the directory where target paths of block volume published on the node are recorded,
+// the loop device is detached after the volume is unpublished from its last target path
+func getBlockTargetsDir(blockVolumeMountDir, volumeID string) string {
+	return filepath.Join(blockVolumeMountDir, blockVolumeTargetsDirName, hashPath(volumeID))
+}
+
+// addBlockTarget records targetPath in targetsDir of block volume
+func addBlockTarget(targetsDir, targetPath string) error {
+	if err := os.MkdirAll(targetsDir, 0750); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(targetsDir, hashPath(targetPath)), []byte(targetPath), 0640)
+}
+
+// removeBlockTarget removes the record of targetPath in targetsDir of block volume, returns the number of other target
+// paths the volume is still published on, targetsDir is removed after the last target path is removed
+func removeBlockTarget(targetsDir, targetPath string) (int, error) {
+	if err := os.Remove(filepath.Join(targetsDir, hashPath(targetPath))); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	entries, err := os.ReadDir(targetsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if len(entries) == 0 {
+		if err := os.Remove(targetsDir); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+	return len(entries), nil
+}
+
+// createBlockVolumeFile creates the sparse file of block volume with size in dir, the file is extended if it's smaller than size,
+// e.g. it's copied from a smaller source volume
+func createBlockVolumeFile(dir string, size int64) error {
+	path := filepath.Join(dir, blockVolumeFileName)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() >= size {
+		return nil
+	}
+	return f.Truncate(size)
+}
+
+// findLoopDevice returns the loop device attached to file and whether it's read-only,
+// empty string is returned if file is not attached
+func findLoopDevice(file string) (string, bool, error) {
+	out, err := runLosetup("--list", "--noheadings", "--output", "NAME,RO", "--associated", file)
+	if err != nil {
+		return "", false, fmt.Errorf("losetup failed: %v, output: %s", err, string(out))
+	}
+	// e.g. /dev/loop0     0
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && strings.HasPrefix(fields[0], "/dev/") {
+			return fields[0], fields[1] == "1", nil
+		}
+	}
+	return "", false, nil
+}
+
+// attachLoopDevice attaches file to a free loop device, the loop device already attached to file is reused since file is
+// attached once per volume on the node, e.g. by another target path or a previous failed NodePublishVolume.
+// errReadOnlyLoopDevice is returned if a read-only loop device is attached and readOnly is false.
+func attachLoopDevice(file string, readOnly bool) (string, error) {
+	device, deviceReadOnly, err := findLoopDevice(file)
+	if err != nil {
+		return "", err
+	}
+	if device != "" {
+		if deviceReadOnly && !readOnly {
+			return "", fmt.Errorf("%w: %s", errReadOnlyLoopDevice, device)
+		}
+		return device, nil
+	}
+	args := []string{"--find", "--show"}
+	if readOnly {
+		args = append(args, "--read-only")
+	}
+	out, err := runLosetup(append(args, file)...)
+	if err != nil {
+		return "", fmt.Errorf("losetup failed: %v, output: %s", err, string(out))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// detachLoopDevice detaches the loop device of file. Dirty pages of the device are written to the file by kernel on detach,
+// and the device is detached on last close if it's still open, so the file is consistent without fsck on next attach.
+func detachLoopDevice(file string) error {
+	device, _, err := findLoopDevice(file)
+	if err != nil || device == "" {
+		return err
+	}
+	if out, err := runLosetup("--detach", device); err != nil {
+		return fmt.Errorf("losetup failed to detach %s: %v, output: %s", device, err, string(out))
+	}
+	return nil
+}
+
+// publishBlockVolume mounts the nfs share of block volume on a path private to node plugin, attaches the sparse file
+// of the volume to a loop device and bind mounts the device on targetPath, or registers the device as kata direct volume.
+// The share and the loop device are shared by all target paths of the volume on the node.
+func (ns *NodeServer) publishBlockVolume(ctx context.Context, volumeID, targetPath string, volCap *csi.VolumeCapability, cfg *volumeMountConfig, readOnly bool, secrets map[string]string) (retErr error) {
+	logger := klog.FromContext(ctx)
+	if !ns.Driver.enableBlockVolume {
+		return status.Error(codes.InvalidArgument, "block volume capability not supported")
+	}
+	if cfg.encrypted {
+		return status.Errorf(codes.InvalidArgument, "%s is not supported by block volume", paramEncrypted)
+	}
+	if mode := volCap.GetAccessMode().GetMode(); isMultiWriterAccessMode(mode) {
+		return status.Errorf(codes.InvalidArgument, "access mode %s is not supported by block volume", mode)
+	}
+
+	if notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath); err == nil && !notMnt {
+		logger.V(2).Info("NodePublishVolume: block volume is already published", "targetPath", targetPath)
+		return nil
+	}
+
+	// target paths of the volume share the nfs share and the loop device, they are published one by one
+	lockKey := fmt.Sprintf("%s-block", volumeID)
+	if acquired := ns.Driver.volumeLocks.TryAcquire(lockKey); !acquired {
+		return status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer ns.Driver.volumeLocks.Release(lockKey)
+
+	// targetPath is recorded first, so the share is not unmounted and the loop device is not detached on failure
+	// if the volume is published on other target paths
+	if err := addBlockTarget(getBlockTargetsDir(ns.Driver.blockVolumeMountDir, volumeID), targetPath); err != nil {
+		return status.Errorf(codes.Internal, "failed to record target path of block volume: %v", err)
+	}
+	defer func() {
+		if retErr != nil {
+			if err := ns.releaseBlockVolume(ctx, volumeID, targetPath); err != nil {
+				logger.Info("failed to release block volume after failed publish", "err", err)
+			}
+		}
+	}()
+
+	blockMountPath := getBlockMountPath(ns.Driver.blockVolumeMountDir, volumeID)
+	notMnt, _, err := ns.prepareTargetPath(ctx, blockMountPath, 0750)
+	if err != nil {
+		return err
+	}
+	// share mounted by another target path or a previous failed NodePublishVolume is reused
+	if notMnt {
+		if err := ns.mountVolume(ctx, volumeID, blockMountPath, volCap, cfg, readOnly, secrets); err != nil {
+			return err
+		}
+	}
+
+	file := filepath.Join(blockMountPath, blockVolumeFileName)
+	if _, err := os.Stat(file); err != nil {
+		if os.IsNotExist(err) {
+			return status.Errorf(codes.FailedPrecondition, "%s of block volume(%s) does not exist, the volume is not provisioned as block volume", blockVolumeFileName, volumeID)
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+	device, err := attachLoopDevice(file, readOnly)
+	if err != nil {
+		if errors.Is(err, errReadOnlyLoopDevice) {
+			return status.Errorf(codes.FailedPrecondition, "block volume(%s) is published read-only on the node, it could not be published read-write on %s: %v", volumeID, targetPath, err)
+		}
+		return status.Errorf(codes.Internal, "failed to attach %s to loop device: %v", file, err)
+	}
+	logger.V(2).Info("NodePublishVolume: block volume is attached", "file", file, "device", device)
+
+	// kubelet expects the device on targetPath, which is a file instead of a directory
+	var created string
+	if _, err := os.Lstat(targetPath); os.IsNotExist(err) {
+		created = getTopmostMissingDir(targetPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0750); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	f, err := os.OpenFile(targetPath, os.O_CREATE, 0660)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	f.Close()
+	defer func() {
+		if retErr != nil {
+			removeCreatedTargetPath(ctx, targetPath, created)
+		}
+	}()
+
+	v := nodeVolume{VolumeID: volumeID, TargetPath: targetPath, BlockMountPath: blockMountPath, LoopDevice: device, ReadOnly: readOnly}
+	if cfg.kataDirectVolume {
+		mountInfo := &kataMountInfo{
+			VolumeType: kataVolumeTypeBlock,
+			Device:     device,
+			Metadata:   map[string]string{"volumeID": volumeID},
+		}
+		for k, val := range cfg.kataMetadata {
+			mountInfo.Metadata[k] = val
+		}
+		if err := addDirectVolume(ctx, ns.Driver.kataDirectVolumeRootPath, targetPath, mountInfo); err != nil {
+			return status.Errorf(codes.Internal, "failed to add kata direct volume on %s: %v", targetPath, err)
+		}
+		v.KataMountInfo = mountInfo
+	} else if err := bindMount(ctx, ns.mounter, device, targetPath, readOnly); err != nil {
+		return status.Errorf(codes.Internal, "failed to bind mount %s on %s: %v", device, targetPath, err)
+	}
+	ns.nodeState.set(ctx, v)
+	return nil
+}
+
+// unpublishBlockVolume releases block volume after targetPath is unmounted, it's no-op if the volume is not a block volume
+func (ns *NodeServer) unpublishBlockVolume(ctx context.Context, volumeID, targetPath string) error {
+	lockKey := fmt.Sprintf("%s-block", volumeID)
+	if acquired := ns.Driver.volumeLocks.TryAcquire(lockKey); !acquired {
+		return status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer ns.Driver.volumeLocks.Release(lockKey)
+	if err := ns.releaseBlockVolume(ctx, volumeID, targetPath); err != nil {
+		return status.Errorf(codes.Internal, "failed to detach block volume on %q: %v", targetPath, err)
+	}
+	return nil
+}
+
+// releaseBlockVolume removes the record of targetPath, the loop device of block volume is detached and its nfs share is
+// unmounted if the volume is not published on other target paths of the node
+func (ns *NodeServer) releaseBlockVolume(ctx context.Context, volumeID, targetPath string) error {
+	left, err := removeBlockTarget(getBlockTargetsDir(ns.Driver.blockVolumeMountDir, volumeID), targetPath)
+	if err != nil {
+		return err
+	}
+	if left > 0 {
+		klog.FromContext(ctx).V(2).Info("block volume is still published on other target paths", "targetPaths", left)
+		return nil
+	}
+	blockMountPath := getBlockMountPath(ns.Driver.blockVolumeMountDir, volumeID)
+	if _, err := os.Lstat(blockMountPath); os.IsNotExist(err) {
+		return nil
+	}
+	file := filepath.Join(blockMountPath, blockVolumeFileName)
+	if _, err := os.Stat(file); err == nil {
+		if err := detachLoopDevice(file); err != nil {
+			return err
+		}
+	}
+	return ns.unmountPrivateShare(ctx, blockMountPath)
+}
+
+// getBlockVolumeStats returns the size of the sparse file of block volume as total bytes, false is returned if the volume
+// is not published as block volume on the node. Statfs of target path would return stats of devtmpfs where the device is.
+func (ns *NodeServer) getBlockVolumeStats(volumeID string) ([]*csi.VolumeUsage, bool, error) {
+	fi, err := os.Stat(filepath.Join(getBlockMountPath(ns.Driver.blockVolumeMountDir, volumeID), blockVolumeFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Total: fi.Size()}}, true, nil
+}
+
+// reconcileBlockTarget checks the loop device of block volume after node plugin restarts, loop devices are kept by kernel,
+// the device is bind mounted on target path again if it's not mounted
+func (ns *NodeServer) reconcileBlockTarget(ctx context.Context, v nodeVolume) {
+	logger := klog.FromContext(ctx)
+	device, _, err := findLoopDevice(filepath.Join(v.BlockMountPath, blockVolumeFileName))
+	if err != nil {
+		logger.Error(err, "failed to find loop device of block volume")
+		return
+	}
+	if device == "" {
+		logger.Info("loop device of block volume is detached, restart the pod to publish it again", "device", v.LoopDevice)
+		return
+	}
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(v.TargetPath)
+	if err != nil {
+		logger.Error(err, "failed to check mount point")
+		return
+	}
+	if notMnt {
+		logger.Info("block volume is not mounted, bind mounting loop device again", "device", device)
+		if err := bindMount(ctx, ns.mounter, device, v.TargetPath, v.ReadOnly); err != nil {
+			logger.Error(err, "failed to bind mount loop device", "device", device)
+		}
+	}
+}
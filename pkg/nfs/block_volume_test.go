@@ -0,0 +1,259 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+)
+
+// fakeLosetup replaces runLosetup with loop devices attached in memory,
+// it returns a func listing attached files with their loop devices
+func fakeLosetup(t *testing.T) func() map[string]string {
+	// device is emptied on detach since builtin delete is shadowed by onDelete value of the package
+	devices := map[string]string{}
+	readOnly := map[string]bool{}
+	origRunLosetup := runLosetup
+	t.Cleanup(func() { runLosetup = origRunLosetup })
+	runLosetup = func(args ...string) ([]byte, error) {
+		arg := args[len(args)-1]
+		switch args[0] {
+		case "--list":
+			if device := devices[arg]; device != "" {
+				ro := 0
+				if readOnly[device] {
+					ro = 1
+				}
+				return []byte(fmt.Sprintf("%s     %d\n", device, ro)), nil
+			}
+			return nil, nil
+		case "--find":
+			var used int
+			for _, device := range devices {
+				if device != "" {
+					used++
+				}
+			}
+			devices[arg] = fmt.Sprintf("/dev/loop%d", used)
+			readOnly[devices[arg]] = args[2] == "--read-only"
+			return []byte(devices[arg] + "\n"), nil
+		case "--detach":
+			for file, device := range devices {
+				if device == arg {
+					devices[file] = ""
+				}
+			}
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unexpected losetup args %v", args)
+	}
+	return func() map[string]string {
+		attached := map[string]string{}
+		for file, device := range devices {
+			if device != "" {
+				attached[file] = device
+			}
+		}
+		return attached
+	}
+}
+
+func TestPublishBlockVolume(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip on windows")
+	}
+	attached := fakeLosetup(t)
+	d := NewEmptyDriver("")
+	d.blockVolumeMountDir = t.TempDir()
+	d.kataDirectVolumeRootPath = t.TempDir()
+	fakeMounter := mount.NewFakeMounter(nil)
+	ns := NewNodeServer(d, fakeMounter)
+	targetPath := filepath.Join(t.TempDir(), "pod", "volumeDevices", "vol")
+	blockMountPath := getBlockMountPath(d.blockVolumeMountDir, "vol_1")
+	file := filepath.Join(blockMountPath, blockVolumeFileName)
+	// sparse file is on the nfs share, it's gone after the share is unmounted
+	fakeMounter.UnmountFunc = func(path string) error {
+		if path == blockMountPath {
+			return os.RemoveAll(file)
+		}
+		return nil
+	}
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:   "vol_1",
+		TargetPath: targetPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		VolumeContext: map[string]string{paramServer: "server", paramShare: "/share"},
+	}
+
+	_, err := ns.NodePublishVolume(context.TODO(), req)
+	assert.Equal(t, status.Error(codes.InvalidArgument, "block volume capability not supported"), err)
+
+	// the share is not provisioned as block volume
+	d.enableBlockVolume = true
+	_, err = ns.NodePublishVolume(context.TODO(), req)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.NoFileExists(t, targetPath)
+	assert.Empty(t, attached())
+	assert.NoDirExists(t, getBlockTargetsDir(d.blockVolumeMountDir, "vol_1"))
+
+	// writes of multiple writers are not coordinated
+	req.VolumeCapability.AccessMode.Mode = csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER
+	_, err = ns.NodePublishVolume(context.TODO(), req)
+	assert.Equal(t, status.Error(codes.InvalidArgument, "access mode SINGLE_NODE_MULTI_WRITER is not supported by block volume"), err)
+	req.VolumeCapability.AccessMode.Mode = csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+
+	assert.NoError(t, os.MkdirAll(blockMountPath, 0750))
+	assert.NoError(t, createBlockVolumeFile(blockMountPath, 1<<20))
+	fakeMounter.ResetLog()
+	_, err = ns.NodePublishVolume(context.TODO(), req)
+	assert.NoError(t, err)
+	assert.FileExists(t, targetPath)
+	assert.Equal(t, map[string]string{file: "/dev/loop0"}, attached())
+	assert.Equal(t, []mount.FakeAction{
+		{Action: "mount", Target: blockMountPath, Source: "server:/share", FSType: "nfs"},
+		{Action: "mount", Target: targetPath, Source: "/dev/loop0"},
+	}, fakeMounter.GetLog())
+
+	// published target path is not mounted again
+	fakeMounter.ResetLog()
+	_, err = ns.NodePublishVolume(context.TODO(), req)
+	assert.NoError(t, err)
+	assert.Empty(t, fakeMounter.GetLog())
+
+	// size of the sparse file is returned instead of stats of the device
+	resp, err := ns.NodeGetVolumeStats(context.TODO(), &csi.NodeGetVolumeStatsRequest{VolumeId: "vol_1", VolumePath: targetPath})
+	assert.NoError(t, err)
+	assert.Equal(t, []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Total: 1 << 20}}, resp.GetUsage())
+
+	// the share and the loop device are shared by another target path of the volume
+	otherTargetPath := filepath.Join(t.TempDir(), "pod", "volumeDevices", "vol")
+	req.TargetPath = otherTargetPath
+	fakeMounter.ResetLog()
+	_, err = ns.NodePublishVolume(context.TODO(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{file: "/dev/loop0"}, attached())
+	assert.Equal(t, []mount.FakeAction{
+		{Action: "mount", Target: otherTargetPath, Source: "/dev/loop0"},
+	}, fakeMounter.GetLog())
+
+	_, err = ns.NodeUnpublishVolume(context.TODO(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol_1", TargetPath: targetPath})
+	assert.NoError(t, err)
+	assert.NoFileExists(t, targetPath)
+	assert.Equal(t, map[string]string{file: "/dev/loop0"}, attached())
+	assert.FileExists(t, file)
+
+	_, err = ns.NodeUnpublishVolume(context.TODO(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol_1", TargetPath: otherTargetPath})
+	assert.NoError(t, err)
+	assert.Empty(t, attached())
+	assert.NoFileExists(t, otherTargetPath)
+	assert.NoDirExists(t, blockMountPath)
+	assert.NoDirExists(t, getBlockTargetsDir(d.blockVolumeMountDir, "vol_1"))
+
+	// read-only loop device could not be published read-write
+	req.TargetPath = targetPath
+	req.Readonly = true
+	assert.NoError(t, os.MkdirAll(blockMountPath, 0750))
+	assert.NoError(t, createBlockVolumeFile(blockMountPath, 1<<20))
+	_, err = ns.NodePublishVolume(context.TODO(), req)
+	assert.NoError(t, err)
+	req.TargetPath = otherTargetPath
+	req.Readonly = false
+	_, err = ns.NodePublishVolume(context.TODO(), req)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.NoFileExists(t, otherTargetPath)
+	assert.Equal(t, map[string]string{file: "/dev/loop0"}, attached())
+	_, err = ns.NodeUnpublishVolume(context.TODO(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol_1", TargetPath: targetPath})
+	assert.NoError(t, err)
+	assert.Empty(t, attached())
+
+	// loop device is registered as kata direct volume
+	req.TargetPath = targetPath
+	req.VolumeContext[paramKataDirectVolume] = "true"
+	assert.NoError(t, os.MkdirAll(blockMountPath, 0750))
+	assert.NoError(t, createBlockVolumeFile(blockMountPath, 1<<20))
+	_, err = ns.NodePublishVolume(context.TODO(), req)
+	assert.NoError(t, err)
+	mountInfo, err := getDirectVolume(d.kataDirectVolumeRootPath, targetPath)
+	assert.NoError(t, err)
+	assert.Equal(t, &kataMountInfo{VolumeType: kataVolumeTypeBlock, Device: "/dev/loop0", Metadata: map[string]string{"volumeID": "vol_1"}}, mountInfo)
+	_, err = ns.NodeUnpublishVolume(context.TODO(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol_1", TargetPath: targetPath})
+	assert.NoError(t, err)
+	assert.Empty(t, attached())
+	_, err = getDirectVolume(d.kataDirectVolumeRootPath, targetPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCreateBlockVolumeFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, blockVolumeFileName)
+	assert.NoError(t, createBlockVolumeFile(dir, 1<<20))
+	fi, err := os.Stat(file)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1<<20), fi.Size())
+
+	// file copied from a smaller volume is extended, larger file is kept
+	assert.NoError(t, createBlockVolumeFile(dir, 2<<20))
+	fi, _ = os.Stat(file)
+	assert.Equal(t, int64(2<<20), fi.Size())
+	assert.NoError(t, createBlockVolumeFile(dir, 1<<20))
+	fi, _ = os.Stat(file)
+	assert.Equal(t, int64(2<<20), fi.Size())
+}
+
+func TestFindLoopDevice(t *testing.T) {
+	origRunLosetup := runLosetup
+	defer func() { runLosetup = origRunLosetup }()
+	tests := []struct {
+		output           string
+		err              error
+		expected         string
+		expectedReadOnly bool
+		errMsg           string
+	}{
+		{output: "/dev/loop3      0\n", expected: "/dev/loop3"},
+		{output: "/dev/loop4      1\n", expected: "/dev/loop4", expectedReadOnly: true},
+		{output: "", expected: ""},
+		{output: "losetup: /tmp/block/hash/block.img: No such file", err: fmt.Errorf("exit status 1"), errMsg: "losetup failed"},
+	}
+	for _, test := range tests {
+		runLosetup = func(args ...string) ([]byte, error) {
+			return []byte(test.output), test.err
+		}
+		device, readOnly, err := findLoopDevice("/tmp/block/hash/block.img")
+		if test.errMsg != "" {
+			assert.True(t, err != nil && strings.Contains(err.Error(), test.errMsg), "unexpected error %v", err)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, device)
+		assert.Equal(t, test.expectedReadOnly, readOnly)
+	}
+}
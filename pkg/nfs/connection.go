@@ -0,0 +1,69 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// mounts of the same server:export share the kernel superblock, which is the default of nfs client
+	ShareCachePolicyShared = "shared"
+	// every mount has its own superblock with nosharecache mount option
+	ShareCachePolicyIsolated = "isolated"
+	// maximum nconnect supported by linux nfs client
+	maxNConnect = 16
+)
+
+func validateShareCachePolicy(policy string) error {
+	switch policy {
+	case "", ShareCachePolicyShared, ShareCachePolicyIsolated:
+		return nil
+	default:
+		return fmt.Errorf("invalid share cache policy %s, supported values are %s, %s", policy, ShareCachePolicyShared, ShareCachePolicyIsolated)
+	}
+}
+
+// parseNConnect returns nconnect in parameters, 0 is returned if it's not set
+func parseNConnect(parameters map[string]string) (int, error) {
+	for k, v := range parameters {
+		if strings.ToLower(k) != paramNConnect || v == "" {
+			continue
+		}
+		nconnect, err := strconv.Atoi(v)
+		if err != nil || nconnect < 1 || nconnect > maxNConnect {
+			return 0, fmt.Errorf("invalid %s %s, it should be an integer in [1, %d]", paramNConnect, v, maxNConnect)
+		}
+		return nconnect, nil
+	}
+	return 0, nil
+}
+
+// applyConnectionMountOptions adds nconnect of the volume and nosharecache of isolated share cache policy,
+// nconnect, sharecache and nosharecache in mount options take precedence
+func applyConnectionMountOptions(mountOptions []string, nconnect int, shareCachePolicy string) []string {
+	var options []string
+	if nconnect > 0 {
+		options = append(options, fmt.Sprintf("nconnect=%d", nconnect))
+	}
+	if shareCachePolicy == ShareCachePolicyIsolated {
+		options = append(options, "nosharecache")
+	}
+	return mergeMountOptions(mountOptions, options)
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNConnect(t *testing.T) {
+	tests := []struct {
+		parameters map[string]string
+		expected   int
+		expectErr  bool
+	}{
+		{
+			parameters: map[string]string{paramServer: "server"},
+		},
+		{
+			parameters: map[string]string{"nconnect": ""},
+		},
+		{
+			parameters: map[string]string{"nConnect": "4"},
+			expected:   4,
+		},
+		{
+			parameters: map[string]string{"nconnect": "0"},
+			expectErr:  true,
+		},
+		{
+			parameters: map[string]string{"nconnect": "17"},
+			expectErr:  true,
+		},
+		{
+			parameters: map[string]string{"nconnect": "four"},
+			expectErr:  true,
+		},
+	}
+	for _, test := range tests {
+		nconnect, err := parseNConnect(test.parameters)
+		if (err != nil) != test.expectErr || nconnect != test.expected {
+			t.Errorf("parseNConnect(%v) = %d, %v, expected %d, error: %v", test.parameters, nconnect, err, test.expected, test.expectErr)
+		}
+	}
+}
+
+func TestApplyConnectionMountOptions(t *testing.T) {
+	tests := []struct {
+		desc             string
+		mountOptions     []string
+		nconnect         int
+		shareCachePolicy string
+		expected         []string
+	}{
+		{
+			desc:         "default policy",
+			mountOptions: []string{"nfsvers=4.1"},
+			expected:     []string{"nfsvers=4.1"},
+		},
+		{
+			desc:             "nconnect and isolated policy",
+			mountOptions:     []string{"nfsvers=4.1"},
+			nconnect:         4,
+			shareCachePolicy: ShareCachePolicyIsolated,
+			expected:         []string{"nfsvers=4.1", "nconnect=4", "nosharecache"},
+		},
+		{
+			desc:             "mount options take precedence",
+			mountOptions:     []string{"nconnect=2,sharecache"},
+			nconnect:         4,
+			shareCachePolicy: ShareCachePolicyIsolated,
+			expected:         []string{"nconnect=2", "sharecache"},
+		},
+	}
+	for _, test := range tests {
+		if result := applyConnectionMountOptions(test.mountOptions, test.nconnect, test.shareCachePolicy); !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("test[%s]: unexpected mount options %v, expected %v", test.desc, result, test.expected)
+		}
+	}
+}
+
+func TestValidateShareCachePolicy(t *testing.T) {
+	for _, policy := range []string{"", ShareCachePolicyShared, ShareCachePolicyIsolated} {
+		if err := validateShareCachePolicy(policy); err != nil {
+			t.Errorf("unexpected error %v for policy %q", err, policy)
+		}
+	}
+	if err := validateShareCachePolicy("none"); err == nil {
+		t.Errorf("expected error for invalid policy")
+	}
+}
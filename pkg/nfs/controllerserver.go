@@ -17,14 +17,18 @@ limitations under the License.
 package nfs
 
 import (
+	"errors"
 	"fmt"
-	"io/fs"
+	"hash/fnv"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"golang.org/x/net/context"
@@ -33,6 +37,7 @@ import (
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"k8s.io/klog/v2"
+	"k8s.io/kubernetes/pkg/volume"
 )
 
 // ControllerServer controller server setting
@@ -40,6 +45,9 @@ type ControllerServer struct {
 	Driver *Driver
 }
 
+// number of GetCapacity calls, it makes internal mount path of each call unique
+var getCapacityCalls uint64
+
 // nfsVolume is an internal representation of a volume
 // created by the provisioner.
 type nfsVolume struct {
@@ -59,6 +67,10 @@ type nfsVolume struct {
 	uuid string
 	// on delete action
 	onDelete string
+	// retention period of deleted volume in trash, subdirectory is removed on deletion if empty
+	retainFor string
+	// remove empty parent directories of nested subDir on deletion
+	pruneParents bool
 }
 
 // nfsSnapshot is an internal representation of a volume snapshot
@@ -76,10 +88,14 @@ type nfsSnapshot struct {
 	uuid string
 	// Source volume.
 	src string
+	// compression of snapshot archive, it's not in snapshot id and found by archive name
+	compression string
+	// archive or incremental, it's not in snapshot id and found by files of the snapshot
+	format string
 }
 
 func (snap nfsSnapshot) archiveName() string {
-	return fmt.Sprintf("%v.tar.gz", snap.src)
+	return snap.src + getSnapshotArchiveExtension(snap.compression)
 }
 
 // Ordering of elements in the CSI volume id.
@@ -111,26 +127,62 @@ const (
 )
 
 // CreateVolume create a volume
-func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (_ *csi.CreateVolumeResponse, retErr error) {
+	logger := klog.FromContext(ctx)
+	defer func() {
+		cs.Driver.recordPVCEvent(req.GetParameters(), eventReasonCreateVolumeFailed, retErr)
+	}()
 	name := req.GetName()
 	if len(name) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "CreateVolume name must be provided")
 	}
+	if acquired := cs.Driver.volumeLocks.TryAcquire(name); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, name)
+	}
+	defer cs.Driver.volumeLocks.Release(name)
+	release, err := cs.Driver.createVolumeLimiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
-	if err := isValidVolumeCapabilities(req.GetVolumeCapabilities()); err != nil {
+	if err := isValidVolumeCapabilities(req.GetVolumeCapabilities(), cs.Driver.enableBlockVolume); err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
+	// mount options of storage class are validated on provisioning, so that invalid options do not fail on pod start
+	for _, c := range req.GetVolumeCapabilities() {
+		if err := cs.Driver.mountOptionPolicy.validate(c.GetMount().GetMountFlags()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err := validateFSTypeMountOptions(c.GetMount().GetFsType(), c.GetMount().GetMountFlags()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
 
 	mountPermissions := cs.Driver.mountPermissions
+	var enableQuota bool
 	reqCapacity := req.GetCapacityRange().GetRequiredBytes()
 	parameters := req.GetParameters()
 	if parameters == nil {
 		parameters = make(map[string]string)
 	}
+	var server, exportManager, squash, restoreServer, restoreShare string
+	var serverMap map[string]string
+	uid, gid := -1, -1
 	// validate parameters (case-insensitive)
 	for k, v := range parameters {
 		switch strings.ToLower(k) {
+		case paramServerMap:
+			var err error
+			if serverMap, err = parseServerMap(v); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
 		case paramServer:
+			server = v
+		case paramRestoreServer:
+			restoreServer = v
+		case paramRestoreShare:
+			restoreShare = v
 		case paramShare:
 		case paramSubDir:
 		case paramOnDelete:
@@ -145,15 +197,166 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 					return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("invalid mountPermissions %s in storage class", v))
 				}
 			}
+		case fsGroupChangePolicyField:
+			if err := validateFSGroupChangePolicy(v); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+		case paramEnableQuota:
+			if v != "" {
+				var err error
+				if enableQuota, err = strconv.ParseBool(v); err != nil {
+					return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("invalid enableQuota %s in storage class", v))
+				}
+			}
+		case paramKataDirectVolume:
+			if _, err := strconv.ParseBool(v); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("invalid kataDirectVolume %s in storage class", v))
+			}
+		case paramExportManager:
+			if v != "" && !strings.EqualFold(v, exportManagerGanesha) {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid exportManager %s in storage class, supported value is %s", v, exportManagerGanesha)
+			}
+			exportManager = strings.ToLower(v)
+		case paramSquash:
+			if err := validateSquashValue(v); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			squash = v
+		case paramThroughputLimit:
+		case paramIOPSLimit:
+			// validated by parseQoSLimits
+		case paramUID:
+			var err error
+			if uid, err = parseOwnerID(paramUID, v); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+		case paramGID:
+			var err error
+			if gid, err = parseOwnerID(paramGID, v); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+		case paramEncrypted:
+			if _, err := strconv.ParseBool(v); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid encrypted %s in storage class", v)
+			}
+		case paramExpectRootSquash:
+		case paramAnonUID:
+		case paramAnonGID:
+			// validated by parseSquashExpectation, verified in NodePublishVolume
+		case paramNConnect:
+			if _, err := parseNConnect(map[string]string{k: v}); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+		case paramServerAddressPolicy:
+			if err := validateServerAddressPolicy(v); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+		case paramRetainFor:
+		case paramSubDirMaxDepth:
+		case paramPruneEmptyParents:
+			// validated by newNFSVolume
 		default:
+			if strings.HasPrefix(strings.ToLower(k), kataMetadataPrefix) {
+				continue
+			}
 			return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("invalid parameter %q in storage class", k))
 		}
 	}
 
+	// server and share in provisioner secret override storage class, so that filer addresses of tenants are not in storage class
+	secretServer, secretShare := getServerShareFromSecrets(req.GetSecrets())
+	if secretServer != "" {
+		if serverMap != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%s in secret and %s in storage class could not be both set", paramServer, paramServerMap)
+		}
+		logger.V(2).Info("CreateVolume: server of volume is read from secret")
+		setKeyValueInMap(parameters, paramServer, secretServer)
+	}
+	if secretShare != "" {
+		logger.V(2).Info("CreateVolume: share of volume is read from secret")
+		setKeyValueInMap(parameters, paramShare, secretShare)
+	}
+
+	if err := validateQoSLimits(parameters); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := parseSquashExpectation(parameters); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var accessibleTopology []*csi.Topology
+	if serverMap != nil {
+		zone, zoneServer, found := pickServerByTopology(serverMap, req.GetAccessibilityRequirements())
+		switch {
+		case found:
+			logger.V(2).Info("CreateVolume: server is picked in zone", "server", zoneServer, "zone", zone)
+			setKeyValueInMap(parameters, paramServer, zoneServer)
+			accessibleTopology = []*csi.Topology{{Segments: map[string]string{topologyKeyZone: zone}}}
+		case server != "":
+			logger.V(2).Info("CreateVolume: no zone in accessibility requirements is in server map, server parameter is used", "serverMapParameter", paramServerMap)
+		default:
+			return nil, status.Errorf(codes.ResourceExhausted, "no zone in accessibility requirements %v is in %s", req.GetAccessibilityRequirements(), paramServerMap)
+		}
+	}
+
+	if req.GetVolumeContentSource().GetSnapshot() != nil {
+		// snapshot archive is read from the server in snapshot id, volume is restored to restoreServer and restoreShare
+		if restoreServer != "" {
+			if serverMap != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "%s and %s could not be both set in storage class", paramRestoreServer, paramServerMap)
+			}
+			logger.V(2).Info("CreateVolume: volume is restored to server", "server", restoreServer)
+			setKeyValueInMap(parameters, paramServer, restoreServer)
+		}
+		if restoreShare != "" {
+			logger.V(2).Info("CreateVolume: volume is restored to share", "share", restoreShare)
+			setKeyValueInMap(parameters, paramShare, restoreShare)
+		}
+	}
+
+	isBlock := isBlockVolumeCapability(req.GetVolumeCapabilities())
+	if isBlock && reqCapacity <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "requested capacity is required by block volume")
+	}
+
 	nfsVol, err := newNFSVolume(name, reqCapacity, parameters, cs.Driver.defaultOnDeletePolicy)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
+	nfsVol.id = encodeVolumeID(nfsVol, cs.Driver.volumeIDVersion)
+	// DeleteVolume and ControllerExpandVolume are locked by volume id, the lock of name only serializes CreateVolume
+	if acquired := cs.Driver.volumeLocks.TryAcquire(nfsVol.id); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, nfsVol.id)
+	}
+	defer cs.Driver.volumeLocks.Release(nfsVol.id)
+	// volume id is only known here, so logs of internal mount and copy carry it as well
+	logger = logger.WithValues("volumeID", nfsVol.id, "server", nfsVol.server)
+	ctx = klog.NewContext(ctx, logger)
+	if enableQuota && cs.Driver.quota == nil {
+		return nil, status.Error(codes.InvalidArgument, "enableQuota requires --quota-mount-dir to be set on the driver")
+	}
+	var ganesha *ganeshaConfig
+	if exportManager == exportManagerGanesha {
+		if ganesha, err = getGaneshaConfig(req.GetSecrets()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if ganesha == nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%s is required in provisioner secret with exportManager %s", ganeshaDBusAddressField, exportManagerGanesha)
+		}
+		if nfsVol.subDir == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "exportManager %s requires a subdirectory", exportManagerGanesha)
+		}
+	} else if squash != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s is only supported with exportManager %s", paramSquash, exportManagerGanesha)
+	}
+
+	undeleteFrom, pvcNamespace, err := cs.Driver.getUndeleteSource(ctx, parameters)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if undeleteFrom != "" && req.GetVolumeContentSource() != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%s annotation could not be set with volume content source", undeleteFromAnnotation)
+	}
 
 	var volCap *csi.VolumeCapability
 	if len(req.GetVolumeCapabilities()) > 0 {
@@ -165,20 +368,29 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	}
 	defer func() {
 		if err = cs.internalUnmount(ctx, nfsVol); err != nil {
-			klog.Warningf("failed to unmount nfs server: %v", err.Error())
+			logger.Info("failed to unmount nfs server", "err", err)
 		}
 	}()
 
 	// Create subdirectory under base-dir
 	internalVolumePath := getInternalVolumePath(cs.Driver.workingMountDir, nfsVol)
+	if undeleteFrom != "" {
+		logger.V(2).Info("CreateVolume: volume is undeleted from trash", "undeleteFrom", undeleteFrom)
+		if err = restoreFromTrash(ctx, getInternalMountPath(cs.Driver.workingMountDir, nfsVol), undeleteFrom, pvcNamespace, internalVolumePath); err != nil {
+			return nil, err
+		}
+	}
 	if err = os.MkdirAll(internalVolumePath, 0777); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to make subdirectory: %v", err.Error())
 	}
 
-	if mountPermissions > 0 {
-		// Reset directory permissions because of umask problems
-		if err = os.Chmod(internalVolumePath, os.FileMode(mountPermissions)); err != nil {
-			klog.Warningf("failed to chmod subdirectory: %v", err.Error())
+	if enableQuota {
+		if reqCapacity > 0 {
+			if err = cs.Driver.quota.setQuota(ctx, nfsVol, reqCapacity); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to set quota on subdirectory: %v", err)
+			}
+		} else {
+			logger.V(2).Info("skip setting quota on volume since requested capacity is 0", "volumeID", nfsVol.id)
 		}
 	}
 
@@ -188,34 +400,87 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		}
 	}
 
+	if isBlock {
+		// the file copied from volume content source is extended to the requested capacity
+		logger.V(2).Info("CreateVolume: creating sparse file of block volume", "bytes", reqCapacity)
+		if err = createBlockVolumeFile(internalVolumePath, reqCapacity); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to create %s of block volume: %v", blockVolumeFileName, err)
+		}
+	}
+
+	if mountPermissions > 0 {
+		// Reset directory permissions because of umask problems,
+		// it's applied after copying volume content since copy preserves permissions of the source directory
+		if err = os.Chmod(internalVolumePath, os.FileMode(mountPermissions)); err != nil {
+			logger.Info("failed to chmod subdirectory", "err", err, "path", internalVolumePath)
+		}
+	}
+	if uid >= 0 || gid >= 0 {
+		// ownership of the subdirectory is set for the runtime user of the application, independent of fsGroup on node
+		logger.V(2).Info("setting ownership of subdirectory", "path", internalVolumePath, "uid", uid, "gid", gid)
+		if err = os.Chown(internalVolumePath, uid, gid); err != nil {
+			if os.IsPermission(err) {
+				return nil, status.Errorf(codes.PermissionDenied, "failed to set ownership of subdirectory to uid(%d) gid(%d), root of controller may be squashed by nfs server: %v", uid, gid, err)
+			}
+			return nil, status.Errorf(codes.Internal, "failed to set ownership of subdirectory to uid(%d) gid(%d): %v", uid, gid, err)
+		}
+	}
+
 	setKeyValueInMap(parameters, paramSubDir, nfsVol.subDir)
+	if ganesha != nil {
+		pseudoPath, err := createGaneshaExport(ctx, ganesha, nfsVol, getInternalMountPath(cs.Driver.workingMountDir, nfsVol), squash)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to create export of volume(%s): %v", nfsVol.id, err)
+		}
+		// node mounts the dedicated export of the volume instead of subdirectory of the base share
+		setKeyValueInMap(parameters, paramShare, pseudoPath)
+		setKeyValueInMap(parameters, paramSubDir, "")
+	}
+	cs.Driver.volumes.add(nfsVol)
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      nfsVol.id,
-			CapacityBytes: 0, // by setting it to zero, Provisioner will use PVC requested size as PV size
-			VolumeContext: parameters,
-			ContentSource: req.GetVolumeContentSource(),
+			VolumeId:           nfsVol.id,
+			CapacityBytes:      0, // by setting it to zero, Provisioner will use PVC requested size as PV size
+			VolumeContext:      parameters,
+			ContentSource:      req.GetVolumeContentSource(),
+			AccessibleTopology: accessibleTopology,
 		},
 	}, nil
 }
 
 // DeleteVolume delete a volume
-func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (_ *csi.DeleteVolumeResponse, retErr error) {
+	logger := klog.FromContext(ctx)
+	defer func() {
+		if !skipEvent(retErr) && cs.Driver.eventRecorder != nil {
+			cs.Driver.recordPVEvent(cs.Driver.getPVNameOfVolumeID(ctx, req.GetVolumeId()), eventReasonDeleteVolumeFailed, retErr)
+		}
+	}()
 	volumeID := req.GetVolumeId()
 	if volumeID == "" {
 		return nil, status.Error(codes.InvalidArgument, "volume id is empty")
 	}
+	if acquired := cs.Driver.volumeLocks.TryAcquire(volumeID); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer cs.Driver.volumeLocks.Release(volumeID)
+	release, err := cs.Driver.deleteVolumeLimiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
 	nfsVol, err := getNfsVolFromID(volumeID)
 	if err != nil {
 		// An invalid ID should be treated as doesn't exist
-		klog.Warningf("failed to get nfs volume for volume id %v deletion: %v", volumeID, err)
+		logger.Info("failed to get nfs volume for volume id deletion", "err", err)
 		return &csi.DeleteVolumeResponse{}, nil
 	}
 
 	var volCap *csi.VolumeCapability
 	mountOptions := getMountOptions(req.GetSecrets())
 	if mountOptions != "" {
-		klog.V(2).Infof("DeleteVolume: found mountOptions(%s) for volume(%s)", mountOptions, volumeID)
+		logger.V(2).Info("DeleteVolume: found mountOptions for volume", "mountOptions", mountOptions)
 		volCap = &csi.VolumeCapability{
 			AccessType: &csi.VolumeCapability_Mount{
 				Mount: &csi.VolumeCapability_MountVolume{
@@ -225,6 +490,11 @@ func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 		}
 	}
 
+	ganesha, err := getGaneshaConfig(req.GetSecrets())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	if nfsVol.onDelete == "" {
 		nfsVol.onDelete = cs.Driver.defaultOnDeletePolicy
 	}
@@ -236,36 +506,104 @@ func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 		}
 		defer func() {
 			if err = cs.internalUnmount(ctx, nfsVol); err != nil {
-				klog.Warningf("failed to unmount nfs server: %v", err.Error())
+				logger.Info("failed to unmount nfs server", "err", err)
 			}
 		}()
 
+		if ganesha != nil {
+			// subdirectory is still exported until the export is removed
+			if err = removeGaneshaExport(ctx, ganesha, nfsVol, getInternalMountPath(cs.Driver.workingMountDir, nfsVol)); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to remove export of volume(%s): %v", volumeID, err)
+			}
+		}
+
 		internalVolumePath := getInternalVolumePath(cs.Driver.workingMountDir, nfsVol)
+		if cs.Driver.quota != nil {
+			cleared, err := cs.Driver.quota.clearQuota(ctx, nfsVol)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to clear quota of volume(%s): %v", volumeID, err)
+			}
+			if cleared {
+				logger.V(2).Info("DeleteVolume: quota of volume is cleared")
+			}
+		}
 
 		if strings.EqualFold(nfsVol.onDelete, archive) {
 			archivedNfsVol := *nfsVol
-			archivedNfsVol.subDir = "archived-" + nfsVol.subDir
+			archivedNfsVol.subDir = getArchivedSubDir(nfsVol, time.Now())
 			archivedInternalVolumePath := getArchivedInternalVolumePath(cs.Driver.workingMountDir, nfsVol, &archivedNfsVol)
 
+			if _, err = os.Stat(internalVolumePath); os.IsNotExist(err) {
+				logger.V(2).Info("DeleteVolume: subdirectory does not exist, it may have been archived already", "path", internalVolumePath)
+				return &csi.DeleteVolumeResponse{}, nil
+			}
 			// archive subdirectory under base-dir
-			klog.V(2).Infof("archiving subdirectory %s --> %s", internalVolumePath, archivedInternalVolumePath)
+			logger.V(2).Info("archiving subdirectory", "path", internalVolumePath, "archivePath", archivedInternalVolumePath)
 			if err = os.Rename(internalVolumePath, archivedInternalVolumePath); err != nil {
 				return nil, status.Errorf(codes.Internal, "archive subdirectory(%s, %s) failed with %v", internalVolumePath, archivedInternalVolumePath, err.Error())
 			}
+		} else if nfsVol.retainFor != "" {
+			// subdirectory is removed by trash purge after retainFor
+			pvcNamespace, pvcUID := cs.Driver.getPVCOfVolume(ctx, nfsVol)
+			if pvcNamespace == "" {
+				logger.Info("DeleteVolume: pvc of volume is unknown, subdirectory in trash could not be restored")
+			}
+			if err = moveToTrash(ctx, getInternalMountPath(cs.Driver.workingMountDir, nfsVol), internalVolumePath, nfsVol.subDir, pvcNamespace, pvcUID, nfsVol.retainFor, time.Now()); err != nil {
+				return nil, status.Errorf(codes.Internal, "move subdirectory(%s) to trash failed with %v", internalVolumePath, err.Error())
+			}
 		} else {
 			// delete subdirectory under base-dir
-			klog.V(2).Infof("removing subdirectory at %v", internalVolumePath)
+			logger.V(2).Info("removing subdirectory", "path", internalVolumePath)
 			if err = os.RemoveAll(internalVolumePath); err != nil {
 				return nil, status.Errorf(codes.Internal, "delete subdirectory(%s) failed with %v", internalVolumePath, err.Error())
 			}
+			if cs.Driver.quota != nil {
+				if err = cs.Driver.quota.releaseProjectID(nfsVol); err != nil {
+					logger.Info("failed to release project id of volume", "err", err)
+				}
+			}
+		}
+		if nfsVol.pruneParents && !strings.EqualFold(nfsVol.onDelete, archive) {
+			if err = pruneEmptyParents(ctx, getInternalMountPath(cs.Driver.workingMountDir, nfsVol), internalVolumePath); err != nil {
+				logger.Info("failed to prune empty parent directories", "err", err, "path", internalVolumePath)
+			}
 		}
 	} else {
-		klog.V(2).Infof("DeleteVolume: volume(%s) is set to retain, not deleting/archiving subdirectory", volumeID)
+		logger.V(2).Info("DeleteVolume: volume is set to retain, not deleting/archiving subdirectory")
+		if nfsVol.subDir != "" {
+			// the retained subdirectory has no pv after deletion, it's marked so orphan garbage collection never removes
+			// it, volume could not be deleted without the marker only if orphans are removed
+			if err = cs.markRetained(ctx, nfsVol, volCap); err != nil {
+				if cs.Driver.orphanGCRemove {
+					return nil, status.Errorf(codes.Internal, "failed to mark retained subdirectory of volume(%s): %v", volumeID, err)
+				}
+				logger.Info("DeleteVolume: failed to mark retained subdirectory", "err", err)
+			}
+		}
+		if ganesha != nil {
+			if err = removeGaneshaExport(ctx, ganesha, nfsVol, ""); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to remove export of volume(%s): %v", volumeID, err)
+			}
+		}
 	}
 
+	cs.Driver.volumes.remove(volumeID)
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
+// markRetained writes the retained marker into subdirectory of the volume
+func (cs *ControllerServer) markRetained(ctx context.Context, nfsVol *nfsVolume, volCap *csi.VolumeCapability) error {
+	if err := cs.internalMount(ctx, nfsVol, nil, volCap); err != nil {
+		return fmt.Errorf("failed to mount nfs server: %v", err)
+	}
+	defer func() {
+		if err := cs.internalUnmount(ctx, nfsVol); err != nil {
+			klog.FromContext(ctx).Info("failed to unmount nfs server", "err", err)
+		}
+	}()
+	return writeRetainedMarker(getInternalVolumePath(cs.Driver.workingMountDir, nfsVol), nfsVol.id)
+}
+
 func (cs *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
 	return nil, status.Error(codes.Unimplemented, "")
 }
@@ -274,15 +612,40 @@ func (cs *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
+// ControllerGetVolume returns the volume with its condition, the volume is abnormal if its subdirectory does not exist on nfs server
 func (cs *ControllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	// volume id of adopted static volume is not in the format of provisioned volume
+	nfsVol := cs.Driver.volumes.get(volumeID)
+	if nfsVol == nil {
+		var err error
+		if nfsVol, err = getNfsVolFromID(volumeID); err != nil {
+			return nil, status.Errorf(codes.NotFound, "failed to get nfs volume from volume id %s: %v", volumeID, err)
+		}
+		// volumes created before controller restarts are listed after they are queried
+		cs.Driver.volumes.add(nfsVol)
+	}
+
+	conditions := cs.getVolumeConditions(ctx, []*nfsVolume{nfsVol})
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      nfsVol.id,
+			CapacityBytes: nfsVol.size,
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			VolumeCondition: conditions[nfsVol.id],
+		},
+	}, nil
 }
 
 func (cs *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
 	if len(req.GetVolumeId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
-	if err := isValidVolumeCapabilities(req.GetVolumeCapabilities()); err != nil {
+	if err := isValidVolumeCapabilities(req.GetVolumeCapabilities(), cs.Driver.enableBlockVolume); err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
@@ -294,12 +657,158 @@ func (cs *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 	}, nil
 }
 
+// ListVolumes lists volumes known by controller with their conditions,
+// volumes are rebuilt from persistent volumes of the driver when controller starts
 func (cs *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	start := 0
+	if req.GetStartingToken() != "" {
+		var err error
+		if start, err = strconv.Atoi(req.GetStartingToken()); err != nil || start < 0 {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q", req.GetStartingToken())
+		}
+	}
+
+	// volumes created before controller restarts are missing until the registry is rebuilt from persistent volumes
+	if !cs.Driver.volumes.synced() {
+		return nil, status.Error(codes.Unavailable, "volume registry is not synced from persistent volumes yet")
+	}
+	vols := cs.Driver.volumes.list()
+	total := len(vols)
+	if start > total {
+		return nil, status.Errorf(codes.Aborted, "starting token %d is greater than total number of volumes %d", start, total)
+	}
+	end := total
+	if req.GetMaxEntries() > 0 && start+int(req.GetMaxEntries()) < end {
+		end = start + int(req.GetMaxEntries())
+	}
+	vols = vols[start:end]
+
+	conditions := cs.getVolumeConditions(ctx, vols)
+	entries := make([]*csi.ListVolumesResponse_Entry, 0, len(vols))
+	for _, vol := range vols {
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:      vol.id,
+				CapacityBytes: vol.size,
+			},
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				VolumeCondition: conditions[vol.id],
+			},
+		})
+	}
+	resp := &csi.ListVolumesResponse{Entries: entries}
+	if end < total {
+		resp.NextToken = strconv.Itoa(end)
+	}
+	return resp, nil
 }
 
+// GetCapacity returns free space of the nfs share in storage class parameters
 func (cs *ControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	var server, baseDir, mountOptions, secretName, secretNamespace string
+	var serverMap map[string]string
+	for k, v := range req.GetParameters() {
+		switch strings.ToLower(k) {
+		case paramServer:
+			server = v
+		case paramShare:
+			baseDir = v
+		case mountOptionsField:
+			mountOptions = v
+		case paramServerMap:
+			var err error
+			if serverMap, err = parseServerMap(v); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+		case provisionerSecretNameKey:
+			secretName = v
+		case provisionerSecretNSKey:
+			secretNamespace = v
+		}
+	}
+	// server is resolved like CreateVolume, secrets are not passed to GetCapacity so the provisioner secret is read
+	if secretName != "" && secretNamespace != "" {
+		secrets, err := cs.getProvisionerSecret(ctx, secretNamespace, secretName)
+		if err != nil {
+			return nil, err
+		}
+		secretServer, secretShare := getServerShareFromSecrets(secrets)
+		if secretServer != "" {
+			if serverMap != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "%s in secret and %s in storage class could not be both set", paramServer, paramServerMap)
+			}
+			server = secretServer
+		}
+		if secretShare != "" {
+			baseDir = secretShare
+		}
+	}
+	if serverMap != nil {
+		if zoneServer, ok := serverMap[req.GetAccessibleTopology().GetSegments()[topologyKeyZone]]; ok {
+			server = zoneServer
+		}
+	}
+	if server == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%v is a required parameter", paramServer)
+	}
+
+	var volCap *csi.VolumeCapability
+	if mountOptions != "" {
+		volCap = &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{
+					MountFlags: []string{mountOptions},
+				},
+			},
+		}
+	}
+	// the share is mounted at a separate path with its own lock key on each call, so concurrent calls of
+	// different topologies or storage classes of the same share are not aborted by each other
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(getVolumeIDFromNfsVol(&nfsVolume{server: server, baseDir: baseDir})))
+	shareVol := &nfsVolume{
+		server:  server,
+		baseDir: baseDir,
+		uuid:    fmt.Sprintf("get-capacity-%x-%d", h.Sum32(), atomic.AddUint64(&getCapacityCalls, 1)),
+	}
+	shareVol.id = getVolumeIDFromNfsVol(shareVol)
+
+	if err := cs.internalMount(ctx, shareVol, nil, volCap); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mount nfs server: %v", err)
+	}
+	defer func() {
+		if err := cs.internalUnmount(ctx, shareVol); err != nil {
+			klog.FromContext(ctx).Info("failed to unmount nfs server after getting capacity", "err", err)
+		}
+	}()
+
+	sharePath := getInternalMountPath(cs.Driver.workingMountDir, shareVol)
+	volumeMetrics, err := volume.NewMetricsStatFS(sharePath).GetMetrics()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get metrics of %s: %v", sharePath, err)
+	}
+	available, ok := volumeMetrics.Available.AsInt64()
+	if !ok {
+		return nil, status.Errorf(codes.Internal, "failed to transform available size(%v)", volumeMetrics.Available)
+	}
+	klog.FromContext(ctx).V(4).Info("GetCapacity: available capacity", "server", server, "share", baseDir, "availableBytes", available)
+	return &csi.GetCapacityResponse{AvailableCapacity: available}, nil
+}
+
+// getProvisionerSecret returns the provisioner secret of storage class in GetCapacity, templates in secret name and
+// namespace could not be resolved since there is no pvc
+func (cs *ControllerServer) getProvisionerSecret(ctx context.Context, namespace, name string) (map[string]string, error) {
+	if strings.Contains(namespace, "${") || strings.Contains(name, "${") {
+		return nil, status.Errorf(codes.InvalidArgument, "provisioner secret %s/%s with templates could not be read in GetCapacity", namespace, name)
+	}
+	if cs.Driver.kubeClient == nil {
+		return nil, status.Errorf(codes.Unavailable, "kube client is not created to read provisioner secret %s/%s", namespace, name)
+	}
+	secrets, err := (&kubeResourceClient{client: cs.Driver.kubeClient}).getSecret(ctx, namespace, name)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get provisioner secret %s/%s: %v", namespace, name, err)
+	}
+	return secrets, nil
 }
 
 // ControllerGetCapabilities implements the default GRPC callout.
@@ -311,6 +820,7 @@ func (cs *ControllerServer) ControllerGetCapabilities(ctx context.Context, req *
 }
 
 func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	logger := klog.FromContext(ctx)
 	if len(req.GetName()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot name must be provided")
 	}
@@ -332,7 +842,7 @@ func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 	}
 	defer func() {
 		if err = cs.internalUnmount(ctx, snapVol); err != nil {
-			klog.Warningf("failed to unmount snapshot nfs server: %v", err)
+			logger.Info("failed to unmount snapshot nfs server", "err", err)
 		}
 	}()
 	snapInternalVolPath := getInternalVolumePath(cs.Driver.workingMountDir, snapVol)
@@ -342,29 +852,56 @@ func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 	if err := validateSnapshot(snapInternalVolPath, snapshot); err != nil {
 		return nil, err
 	}
+	cs.Driver.volumes.addSnapshotShare(snapshot.server, snapshot.baseDir)
 
 	if err = cs.internalMount(ctx, srcVol, nil, nil); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to mount src nfs server: %v", err)
 	}
 	defer func() {
 		if err = cs.internalUnmount(ctx, srcVol); err != nil {
-			klog.Warningf("failed to unmount src nfs server: %v", err)
+			logger.Info("failed to unmount src nfs server", "err", err)
 		}
 	}()
 
 	srcPath := getInternalVolumePath(cs.Driver.workingMountDir, srcVol)
+	if snapshot.format == snapshotFormatIncremental {
+		metadata, err := readIncrementalSnapshotMetadata(snapInternalVolPath, snapshot)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, status.Errorf(codes.Internal, "failed to read snapshot metadata: %v", err)
+		}
+		// snapshot is created already, unchanged files of next snapshots are linked to it
+		if metadata == nil {
+			shareRoot := getInternalMountPath(cs.Driver.workingMountDir, snapVol)
+			if metadata, err = createIncrementalSnapshot(ctx, srcPath, shareRoot, snapInternalVolPath, snapshot, srcVol.id); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to create incremental snapshot: %v", err)
+			}
+			logger.V(2).Info("created incremental snapshot", "parent", metadata.Parent, "sizeBytes", metadata.SizeBytes, "storedBytes", metadata.StoredBytes)
+		}
+		return &csi.CreateSnapshotResponse{
+			Snapshot: &csi.Snapshot{
+				SnapshotId:     snapshot.id,
+				SourceVolumeId: srcVol.id,
+				SizeBytes:      metadata.SizeBytes,
+				CreationTime:   timestamppb.New(metadata.CreationTime),
+				ReadyToUse:     true,
+			},
+		}, nil
+	}
+
 	dstPath := filepath.Join(snapInternalVolPath, snapshot.archiveName())
-	klog.V(2).Infof("archiving %v -> %v", srcPath, dstPath)
-	out, err := exec.Command("tar", "-C", srcPath, "-czvf", dstPath, ".").CombinedOutput()
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to create archive for snapshot: %v: %v", err, string(out))
+	logger.V(2).Info("archiving volume", "srcPath", srcPath, "dstPath", dstPath, "compression", snapshot.compression)
+	if err = createSnapshotArchive(srcPath, dstPath, snapshot.compression); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create archive for snapshot: %v", err)
+	}
+	logger.V(2).Info("archived volume", "srcPath", srcPath, "dstPath", dstPath)
+	if err = writeSnapshotSourceVolumeID(snapInternalVolPath, snapshot, srcVol.id); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to record source volume of snapshot: %v", err)
 	}
-	klog.V(2).Infof("archived %s -> %s", srcPath, dstPath)
 
 	var snapshotSize int64
 	fi, err := os.Stat(dstPath)
 	if err != nil {
-		klog.Warningf("failed to determine snapshot size: %v", err)
+		logger.Info("failed to determine snapshot size", "err", err)
 	} else {
 		snapshotSize = fi.Size()
 	}
@@ -380,20 +917,21 @@ func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 }
 
 func (cs *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	logger := klog.FromContext(ctx)
 	if len(req.GetSnapshotId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Snapshot ID is required for deletion")
 	}
 	snap, err := getNfsSnapFromID(req.GetSnapshotId())
 	if err != nil {
 		// An invalid ID should be treated as doesn't exist
-		klog.Warningf("failed to get nfs snapshot for id %v deletion: %v", req.GetSnapshotId(), err)
+		logger.Info("failed to get nfs snapshot for id deletion", "err", err)
 		return &csi.DeleteSnapshotResponse{}, nil
 	}
 
 	var volCap *csi.VolumeCapability
 	mountOptions := getMountOptions(req.GetSecrets())
 	if mountOptions != "" {
-		klog.V(2).Infof("DeleteSnapshot: found mountOptions(%s) for snapshot(%s)", mountOptions, req.GetSnapshotId())
+		logger.V(2).Info("DeleteSnapshot: found mountOptions for snapshot", "mountOptions", mountOptions)
 		volCap = &csi.VolumeCapability{
 			AccessType: &csi.VolumeCapability_Mount{
 				Mount: &csi.VolumeCapability_MountVolume{
@@ -408,13 +946,13 @@ func (cs *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteS
 	}
 	defer func() {
 		if err = cs.internalUnmount(ctx, vol); err != nil {
-			klog.Warningf("failed to unmount nfs server after snapshot deletion: %v", err)
+			logger.Info("failed to unmount nfs server after snapshot deletion", "err", err)
 		}
 	}()
 
 	// delete snapshot archive
 	internalVolumePath := getInternalVolumePath(cs.Driver.workingMountDir, vol)
-	klog.V(2).Infof("Removing snapshot archive at %v", internalVolumePath)
+	logger.V(2).Info("Removing snapshot archive", "path", internalVolumePath)
 	if err = os.RemoveAll(internalVolumePath); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to delete subdirectory: %v", err.Error())
 	}
@@ -422,22 +960,116 @@ func (cs *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteS
 	return &csi.DeleteSnapshotResponse{}, nil
 }
 
+// ListSnapshots lists snapshots on the nfs server, snapshots of a source volume are searched under the share of that
+// source volume, all snapshots are searched under shares of known volumes and shares where snapshots are created
+// when neither snapshot id nor source volume id is provided
 func (cs *ControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	start := 0
+	if req.GetStartingToken() != "" {
+		var err error
+		if start, err = strconv.Atoi(req.GetStartingToken()); err != nil || start < 0 {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q", req.GetStartingToken())
+		}
+	}
+
+	var entries []*csi.ListSnapshotsResponse_Entry
+	switch {
+	case req.GetSnapshotId() != "":
+		snap, err := getNfsSnapFromID(req.GetSnapshotId())
+		if err != nil {
+			klog.FromContext(ctx).V(2).Info("ListSnapshots: failed to get nfs snapshot from id", "err", err)
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		snapshot, err := cs.getSnapshot(ctx, snap, req.GetSourceVolumeId(), req.GetSecrets())
+		if err != nil {
+			return nil, err
+		}
+		if snapshot != nil {
+			entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: snapshot})
+		}
+	case req.GetSourceVolumeId() != "":
+		srcVol, err := getNfsVolFromID(req.GetSourceVolumeId())
+		if err != nil {
+			klog.FromContext(ctx).V(2).Info("ListSnapshots: failed to get nfs volume from id", "err", err)
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		if entries, err = cs.listSnapshotsOfVolume(ctx, srcVol, req.GetSecrets()); err != nil {
+			return nil, err
+		}
+	default:
+		if !cs.Driver.volumes.synced() {
+			return nil, status.Error(codes.Unavailable, "volume registry is not synced from persistent volumes yet")
+		}
+		entries = cs.listAllSnapshots(ctx, req.GetSecrets())
+	}
+
+	if start > len(entries) {
+		return nil, status.Errorf(codes.Aborted, "starting token %d is greater than total number of snapshots %d", start, len(entries))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].GetSnapshot().GetSnapshotId() < entries[j].GetSnapshot().GetSnapshotId()
+	})
+	end := len(entries)
+	if req.GetMaxEntries() > 0 && start+int(req.GetMaxEntries()) < end {
+		end = start + int(req.GetMaxEntries())
+	}
+	resp := &csi.ListSnapshotsResponse{Entries: entries[start:end]}
+	if end < len(entries) {
+		resp.NextToken = strconv.Itoa(end)
+	}
+	return resp, nil
 }
 
+// ControllerExpandVolume expand volume
 func (cs *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	logger := klog.FromContext(ctx)
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if req.GetCapacityRange() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Capacity Range missing in request")
+	}
+	if req.GetVolumeCapability().GetBlock() != nil {
+		// loop devices attached on nodes are not resized with the file
+		return nil, status.Error(codes.InvalidArgument, "expansion of block volume is not supported")
+	}
+	if acquired := cs.Driver.volumeLocks.TryAcquire(volumeID); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer cs.Driver.volumeLocks.Release(volumeID)
+
+	nfsVol, err := getNfsVolFromID(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "failed to get nfs volume from volume id %s: %v", volumeID, err)
+	}
+
+	volSizeBytes := req.GetCapacityRange().GetRequiredBytes()
+	if cs.Driver.quota != nil {
+		resized, err := cs.Driver.quota.resizeQuota(ctx, nfsVol, volSizeBytes)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to resize quota of volume(%s): %v", volumeID, err)
+		}
+		if resized {
+			logger.V(2).Info("ControllerExpandVolume: quota of volume is resized", "bytes", volSizeBytes)
+		}
+	}
+	logger.V(2).Info("ControllerExpandVolume successfully", "currentQuota", volSizeBytes)
+
+	return &csi.ControllerExpandVolumeResponse{CapacityBytes: volSizeBytes}, nil
 }
 
 // Mount nfs server at base-dir
 func (cs *ControllerServer) internalMount(ctx context.Context, vol *nfsVolume, volumeContext map[string]string, volCap *csi.VolumeCapability) error {
-	if volCap == nil {
-		volCap = &csi.VolumeCapability{
-			AccessType: &csi.VolumeCapability_Mount{
-				Mount: &csi.VolumeCapability_MountVolume{},
-			},
-		}
+	// the share of block volume is mounted as filesystem to create its sparse file
+	mountVol := &csi.VolumeCapability_MountVolume{}
+	if volCap.GetMount() != nil {
+		mountVol = volCap.GetMount()
+	}
+	// controller writes the share even if the volume is read-only for pods, e.g. ReadOnlyMany pvc
+	volCap = &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: mountVol},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
 	}
 
 	sharePath := filepath.Join(string(filepath.Separator) + vol.baseDir)
@@ -448,13 +1080,22 @@ func (cs *ControllerServer) internalMount(ctx context.Context, vol *nfsVolume, v
 		paramShare:  sharePath,
 	}
 	for k, v := range volumeContext {
-		// don't set subDir field since only nfs-server:/share should be mounted in CreateVolume/DeleteVolume
-		if strings.ToLower(k) != paramSubDir {
+		// don't set subDir field since only nfs-server:/share should be mounted in CreateVolume/DeleteVolume,
+		// squash of the export is only verified on node publish of the volume,
+		// the share is mounted on controller even if it's published as kata direct volume,
+		// and cipher directory of encrypted volume is created, copied and removed as is on controller,
+		// pvc/pv of the volume are not set so failure of internal mount is only recorded by the calling operation
+		key := strings.ToLower(k)
+		switch {
+		case key == paramSubDir, key == paramExpectRootSquash, key == paramAnonUID, key == paramAnonGID:
+		case key == paramKataDirectVolume, strings.HasPrefix(key, kataMetadataPrefix), key == paramEncrypted:
+		case key == pvcNamespaceKey, key == pvcNameKey, key == pvNameKey:
+		default:
 			volContext[k] = v
 		}
 	}
 
-	klog.V(2).Infof("internally mounting %s:%s at %s", vol.server, sharePath, targetPath)
+	klog.FromContext(ctx).V(2).Info("internally mounting", "server", vol.server, "share", sharePath, "targetPath", targetPath)
 	_, err := cs.Driver.ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
 		TargetPath:       targetPath,
 		VolumeContext:    volContext,
@@ -469,7 +1110,7 @@ func (cs *ControllerServer) internalUnmount(ctx context.Context, vol *nfsVolume)
 	targetPath := getInternalMountPath(cs.Driver.workingMountDir, vol)
 
 	// Unmount nfs server at base-dir
-	klog.V(4).Infof("internally unmounting %v", targetPath)
+	klog.FromContext(ctx).V(4).Info("internally unmounting", "targetPath", targetPath)
 	_, err := cs.Driver.ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
 		VolumeId:   vol.id,
 		TargetPath: targetPath,
@@ -477,7 +1118,211 @@ func (cs *ControllerServer) internalUnmount(ctx context.Context, vol *nfsVolume)
 	return err
 }
 
+// getSnapshot returns the snapshot if its archive exists on the nfs server and its source volume is srcVolumeID if it's
+// not empty, otherwise nil. Source volume of archive created before source volume is recorded is matched by its name
+// among srcVolumeID and known volumes, the snapshot is not returned if its source volume is unknown.
+func (cs *ControllerServer) getSnapshot(ctx context.Context, snap *nfsSnapshot, srcVolumeID string, secrets map[string]string) (*csi.Snapshot, error) {
+	vol := volumeFromSnapshot(snap)
+	if err := cs.internalMount(ctx, vol, nil, getVolCapFromSecrets(secrets)); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mount nfs server for snapshot listing: %v", err)
+	}
+	defer func() {
+		if err := cs.internalUnmount(ctx, vol); err != nil {
+			klog.FromContext(ctx).Info("failed to unmount nfs server after snapshot listing", "err", err)
+		}
+	}()
+
+	snapPath := getInternalVolumePath(cs.Driver.workingMountDir, vol)
+	info, err := findSnapshot(snapPath, snap)
+	if err != nil {
+		if os.IsNotExist(err) {
+			klog.FromContext(ctx).V(2).Info("snapshot does not exist", "source", snap.src, "path", snapPath)
+			return nil, nil
+		}
+		return nil, status.Errorf(codes.Internal, "failed to stat snapshot under %s: %v", snapPath, err)
+	}
+	source := info.sourceVolumeID
+	if source == "" {
+		source = cs.getUnrecordedSnapshotSource(snap, srcVolumeID)
+	}
+	if source == "" {
+		klog.FromContext(ctx).V(4).Info("skip snapshot whose source volume is unknown", "snapshotID", snap.id)
+		return nil, nil
+	}
+	if srcVolumeID != "" && source != srcVolumeID {
+		klog.FromContext(ctx).V(4).Info("skip snapshot of another source volume", "snapshotID", snap.id, "sourceVolumeID", source)
+		return nil, nil
+	}
+	return newCSISnapshot(snap, source, info), nil
+}
+
+// getUnrecordedSnapshotSource returns the source volume of snapshot whose source volume is not recorded, it's
+// srcVolumeID or a known volume whose name is the source name of the snapshot, empty string if none matches
+func (cs *ControllerServer) getUnrecordedSnapshotSource(snap *nfsSnapshot, srcVolumeID string) string {
+	if srcVolumeID != "" {
+		if vol, err := getNfsVolFromID(srcVolumeID); err == nil && getVolumeName(vol) == snap.src {
+			return srcVolumeID
+		}
+		return ""
+	}
+	for _, vol := range cs.Driver.volumes.list() {
+		if getVolumeName(vol) == snap.src {
+			return vol.id
+		}
+	}
+	return ""
+}
+
+// listSnapshotsOfVolume searches snapshot archives of the source volume under its share
+func (cs *ControllerServer) listSnapshotsOfVolume(ctx context.Context, srcVol *nfsVolume, secrets map[string]string) ([]*csi.ListSnapshotsResponse_Entry, error) {
+	// mount the share root of source volume
+	shareVol := &nfsVolume{
+		id:      srcVol.id,
+		server:  srcVol.server,
+		baseDir: srcVol.baseDir,
+		uuid:    "list-snapshots-" + getVolumeName(srcVol),
+	}
+	if err := cs.internalMount(ctx, shareVol, nil, getVolCapFromSecrets(secrets)); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mount nfs server for snapshot listing: %v", err)
+	}
+	defer func() {
+		if err := cs.internalUnmount(ctx, shareVol); err != nil {
+			klog.FromContext(ctx).Info("failed to unmount nfs server after snapshot listing", "err", err)
+		}
+	}()
+
+	sharePath := getInternalMountPath(cs.Driver.workingMountDir, shareVol)
+	dirEntries, err := os.ReadDir(sharePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read directory %s: %v", sharePath, err)
+	}
+	var entries []*csi.ListSnapshotsResponse_Entry
+	for _, d := range dirEntries {
+		if !d.IsDir() {
+			continue
+		}
+		snap, err := newNFSSnapshot(d.Name(), nil, srcVol)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		info, err := findSnapshot(filepath.Join(sharePath, d.Name()), snap)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				klog.FromContext(ctx).Info("failed to stat snapshot", "snapshot", d.Name(), "err", err)
+			}
+			continue
+		}
+		if info.sourceVolumeID != "" && info.sourceVolumeID != srcVol.id {
+			continue
+		}
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: newCSISnapshot(snap, srcVol.id, info)})
+	}
+	return entries, nil
+}
+
+// listAllSnapshots lists snapshots under shares in volume registry, shares which could not be mounted are skipped
+func (cs *ControllerServer) listAllSnapshots(ctx context.Context, secrets map[string]string) []*csi.ListSnapshotsResponse_Entry {
+	var entries []*csi.ListSnapshotsResponse_Entry
+	for _, share := range cs.Driver.volumes.listShares() {
+		shareEntries, err := cs.listSnapshotsOnShare(ctx, share, secrets)
+		if err != nil {
+			klog.FromContext(ctx).Info("skip listing snapshots on share", "share", share.id, "err", err)
+			continue
+		}
+		entries = append(entries, shareEntries...)
+	}
+	return entries
+}
+
+// listSnapshotsOnShare lists snapshots under the share root, source volume of incremental snapshot is read from its
+// metadata and source volume of archive is read from the file next to it, archives created before the source volume
+// is recorded are listed if their source volume is known on the same share
+func (cs *ControllerServer) listSnapshotsOnShare(ctx context.Context, share *nfsVolume, secrets map[string]string) ([]*csi.ListSnapshotsResponse_Entry, error) {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(share.id))
+	shareVol := &nfsVolume{
+		id:      share.id,
+		server:  share.server,
+		baseDir: share.baseDir,
+		uuid:    fmt.Sprintf("list-snapshots-%x", h.Sum32()),
+	}
+	logger := klog.FromContext(ctx).WithValues("share", share.id)
+	if err := cs.internalMount(ctx, shareVol, nil, getVolCapFromSecrets(secrets)); err != nil {
+		return nil, fmt.Errorf("failed to mount nfs server for snapshot listing: %v", err)
+	}
+	defer func() {
+		if err := cs.internalUnmount(ctx, shareVol); err != nil {
+			logger.Info("failed to unmount nfs server after snapshot listing", "err", err)
+		}
+	}()
+
+	knownVolumes := map[string]string{}
+	for _, vol := range cs.Driver.volumes.list() {
+		if getShareKey(vol.server, vol.baseDir) == share.id {
+			knownVolumes[getVolumeName(vol)] = vol.id
+		}
+	}
+
+	sharePath := getInternalMountPath(cs.Driver.workingMountDir, shareVol)
+	dirEntries, err := os.ReadDir(sharePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %v", sharePath, err)
+	}
+	var entries []*csi.ListSnapshotsResponse_Entry
+	for _, d := range dirEntries {
+		if !d.IsDir() {
+			continue
+		}
+		dir := filepath.Join(sharePath, d.Name())
+		snapEntries, err := os.ReadDir(dir)
+		if err != nil {
+			logger.Info("failed to read snapshot directory", "snapshot", d.Name(), "err", err)
+			continue
+		}
+		for _, e := range snapEntries {
+			snap := &nfsSnapshot{server: share.server, baseDir: share.baseDir, uuid: d.Name()}
+			var srcVolumeID string
+			var info *snapshotInfo
+			if src := strings.TrimSuffix(e.Name(), incrementalSnapshotMetadataExt); src != e.Name() && src != "" {
+				snap.src = src
+				metadata, err := readIncrementalSnapshotMetadata(dir, snap)
+				if err != nil {
+					logger.Info("failed to read metadata of snapshot", "snapshot", d.Name(), "err", err)
+					continue
+				}
+				snap.format = snapshotFormatIncremental
+				srcVolumeID = metadata.SourceVolumeID
+				info = &snapshotInfo{sizeBytes: metadata.SizeBytes, creationTime: metadata.CreationTime}
+			} else if src, compression, ok := getSnapshotArchiveSource(e.Name()); ok {
+				snap.src, snap.compression, snap.format = src, compression, snapshotFormatArchive
+				if srcVolumeID, err = readSnapshotSourceVolumeID(dir, snap); err != nil {
+					if !os.IsNotExist(err) {
+						logger.Info("failed to read source volume of snapshot", "snapshot", d.Name(), "err", err)
+						continue
+					}
+					if srcVolumeID = knownVolumes[src]; srcVolumeID == "" {
+						logger.V(4).Info("skip snapshot whose source volume is unknown", "snapshot", d.Name(), "sourceVolumeID", src)
+						continue
+					}
+				}
+				fi, err := e.Info()
+				if err != nil {
+					logger.Info("failed to stat snapshot", "snapshot", d.Name(), "err", err)
+					continue
+				}
+				info = &snapshotInfo{sizeBytes: fi.Size(), creationTime: fi.ModTime()}
+			} else {
+				continue
+			}
+			snap.id = getSnapshotIDFromNfsSnapshot(snap)
+			entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: newCSISnapshot(snap, srcVolumeID, info)})
+		}
+	}
+	return entries, nil
+}
+
 func (cs *ControllerServer) copyFromSnapshot(ctx context.Context, req *csi.CreateVolumeRequest, dstVol *nfsVolume) error {
+	logger := klog.FromContext(ctx)
 	snap, err := getNfsSnapFromID(req.VolumeContentSource.GetSnapshot().GetSnapshotId())
 	if err != nil {
 		return status.Error(codes.NotFound, err.Error())
@@ -494,7 +1339,7 @@ func (cs *ControllerServer) copyFromSnapshot(ctx context.Context, req *csi.Creat
 	}
 	defer func() {
 		if err = cs.internalUnmount(ctx, snapVol); err != nil {
-			klog.Warningf("failed to unmount src nfs server after snapshot volume copy: %v", err)
+			logger.Info("failed to unmount src nfs server after snapshot volume copy", "err", err)
 		}
 	}()
 	if err = cs.internalMount(ctx, dstVol, nil, volCap); err != nil {
@@ -502,31 +1347,57 @@ func (cs *ControllerServer) copyFromSnapshot(ctx context.Context, req *csi.Creat
 	}
 	defer func() {
 		if err = cs.internalUnmount(ctx, dstVol); err != nil {
-			klog.Warningf("failed to unmount dst nfs server after snapshot volume copy: %v", err)
+			logger.Info("failed to unmount dst nfs server after snapshot volume copy", "err", err)
 		}
 	}()
 
+	if _, err = findSnapshot(getInternalVolumePath(cs.Driver.workingMountDir, snapVol), snap); err != nil {
+		return status.Errorf(codes.Internal, "failed to find snapshot: %v", err)
+	}
+	dstPath := getInternalVolumePath(cs.Driver.workingMountDir, dstVol)
+	canServerSide := canCopyOnServer(snapVol, dstVol, getInternalMountPath(cs.Driver.workingMountDir, snapVol), getInternalMountPath(cs.Driver.workingMountDir, dstVol))
+	// restore is throttled by throughputLimit of the new volume as cloning
+	limits, err := parseQoSLimits(req.GetParameters())
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if snap.format == snapshotFormatIncremental {
+		// copy tree of incremental snapshot to dst path
+		treePath := filepath.Join(getInternalVolumePath(cs.Driver.workingMountDir, snapVol), snap.treeName())
+		logger.V(2).Info("copy volume from incremental snapshot", "srcPath", treePath, "dstPath", dstPath, "serverSide", canServerSide)
+		if err = copyDir(ctx, treePath, dstPath, defaultCopyParallelism, limits.newCopyLimiter(), canServerSide); err != nil {
+			return status.Errorf(codes.Internal, "failed to copy volume for snapshot: %v", err)
+		}
+		logger.V(2).Info("volume copied from snapshot", "srcPath", treePath, "dstPath", dstPath)
+		return nil
+	}
+
 	// untar snapshot archive to dst path
 	snapPath := filepath.Join(getInternalVolumePath(cs.Driver.workingMountDir, snapVol), snap.archiveName())
-	dstPath := getInternalVolumePath(cs.Driver.workingMountDir, dstVol)
-	klog.V(2).Infof("copy volume from snapshot %v -> %v", snapPath, dstPath)
-	out, err := exec.Command("tar", "-xzvf", snapPath, "-C", dstPath).CombinedOutput()
+	// compressed archive is decompressed through the controller
+	serverSide := snap.compression == snapshotCompressionNone && canServerSide
+	logger.V(2).Info("copy volume from snapshot", "srcPath", snapPath, "dstPath", dstPath, "serverSide", serverSide)
+	if serverSide {
+		err = extractSnapshotArchiveOnServer(ctx, snapPath, dstPath, limits.newCopyLimiter())
+	} else {
+		err = extractSnapshotArchive(ctx, snapPath, dstPath, snap.compression, limits.newCopyLimiter())
+	}
 	if err != nil {
-		return status.Errorf(codes.Internal, "failed to copy volume for snapshot: %v: %v", err, string(out))
+		return status.Errorf(codes.Internal, "failed to copy volume for snapshot: %v", err)
 	}
-	klog.V(2).Infof("volume copied from snapshot %v -> %v", snapPath, dstPath)
+	logger.V(2).Info("volume copied from snapshot", "srcPath", snapPath, "dstPath", dstPath)
 	return nil
 }
 
 func (cs *ControllerServer) copyFromVolume(ctx context.Context, req *csi.CreateVolumeRequest, dstVol *nfsVolume) error {
+	logger := klog.FromContext(ctx)
 	srcVol, err := getNfsVolFromID(req.GetVolumeContentSource().GetVolume().GetVolumeId())
 	if err != nil {
 		return status.Error(codes.NotFound, err.Error())
 	}
-	// Note that the source path must include trailing '/.', can't use 'filepath.Join()' as it performs path cleaning
-	srcPath := fmt.Sprintf("%v/.", getInternalVolumePath(cs.Driver.workingMountDir, srcVol))
+	srcPath := getInternalVolumePath(cs.Driver.workingMountDir, srcVol)
 	dstPath := getInternalVolumePath(cs.Driver.workingMountDir, dstVol)
-	klog.V(2).Infof("copy volume from volume %v -> %v", srcPath, dstPath)
+	logger.V(2).Info("copy volume from volume", "srcPath", srcPath, "dstPath", dstPath)
 
 	var volCap *csi.VolumeCapability
 	if len(req.GetVolumeCapabilities()) > 0 {
@@ -537,7 +1408,7 @@ func (cs *ControllerServer) copyFromVolume(ctx context.Context, req *csi.CreateV
 	}
 	defer func() {
 		if err = cs.internalUnmount(ctx, srcVol); err != nil {
-			klog.Warningf("failed to unmount nfs server: %v", err)
+			logger.Info("failed to unmount nfs server", "err", err)
 		}
 	}()
 	if err = cs.internalMount(ctx, dstVol, nil, volCap); err != nil {
@@ -545,16 +1416,20 @@ func (cs *ControllerServer) copyFromVolume(ctx context.Context, req *csi.CreateV
 	}
 	defer func() {
 		if err = cs.internalUnmount(ctx, dstVol); err != nil {
-			klog.Warningf("failed to unmount dst nfs server: %v", err)
+			logger.Info("failed to unmount dst nfs server", "err", err)
 		}
 	}()
 
-	// recursive 'cp' with '-a' to handle symlinks
-	out, err := exec.Command("cp", "-a", srcPath, dstPath).CombinedOutput()
+	// copy is throttled by throughputLimit of the new volume, so that cloning doesn't saturate nfs server
+	limits, err := parseQoSLimits(req.GetParameters())
 	if err != nil {
-		return status.Errorf(codes.Internal, "failed to copy volume %v: %v", err, string(out))
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	serverSide := canCopyOnServer(srcVol, dstVol, getInternalMountPath(cs.Driver.workingMountDir, srcVol), getInternalMountPath(cs.Driver.workingMountDir, dstVol))
+	if err = copyDir(ctx, srcPath, dstPath, defaultCopyParallelism, limits.newCopyLimiter(), serverSide); err != nil {
+		return status.Errorf(codes.Internal, "failed to copy volume: %v", err)
 	}
-	klog.V(2).Infof("copied %s -> %s", srcPath, dstPath)
+	logger.V(2).Info("copied volume", "srcPath", srcPath, "dstPath", dstPath)
 	return nil
 }
 
@@ -574,12 +1449,24 @@ func (cs *ControllerServer) copyVolume(ctx context.Context, req *csi.CreateVolum
 func newNFSSnapshot(name string, params map[string]string, vol *nfsVolume) (*nfsSnapshot, error) {
 	server := vol.server
 	baseDir := vol.baseDir
+	compression := defaultSnapshotCompression
+	format := snapshotFormatArchive
 	for k, v := range params {
 		switch strings.ToLower(k) {
 		case paramServer:
 			server = v
 		case paramShare:
 			baseDir = v
+		case paramSnapshotCompression:
+			if err := validateSnapshotCompression(v); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			compression = v
+		case paramSnapshotFormat:
+			if err := validateSnapshotFormat(v); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			format = v
 		default:
 			return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("invalid parameter %q in snapshot storage class", k))
 		}
@@ -589,9 +1476,11 @@ func newNFSSnapshot(name string, params map[string]string, vol *nfsVolume) (*nfs
 		return nil, fmt.Errorf("%v is a required parameter", paramServer)
 	}
 	snapshot := &nfsSnapshot{
-		server:  server,
-		baseDir: baseDir,
-		uuid:    name,
+		server:      server,
+		baseDir:     baseDir,
+		uuid:        name,
+		compression: compression,
+		format:      format,
 	}
 	if vol.subDir != "" {
 		snapshot.src = vol.subDir
@@ -608,8 +1497,9 @@ func newNFSSnapshot(name string, params map[string]string, vol *nfsVolume) (*nfs
 
 // newNFSVolume Convert VolumeCreate parameters to an nfsVolume
 func newNFSVolume(name string, size int64, params map[string]string, defaultOnDeletePolicy string) (*nfsVolume, error) {
-	var server, baseDir, subDir, onDelete string
-	subDirReplaceMap := map[string]string{}
+	var server, baseDir, subDir, onDelete, retainFor, subDirMaxDepth, pruneEmptyParents string
+	// volume name is the pv name, it's used when pv name is not provided by extra create metadata
+	subDirReplaceMap := map[string]string{pvNameMetadata: name}
 
 	// validate parameters (case-insensitive)
 	for k, v := range params {
@@ -622,6 +1512,12 @@ func newNFSVolume(name string, size int64, params map[string]string, defaultOnDe
 			subDir = v
 		case paramOnDelete:
 			onDelete = v
+		case paramRetainFor:
+			retainFor = v
+		case paramSubDirMaxDepth:
+			subDirMaxDepth = v
+		case paramPruneEmptyParents:
+			pruneEmptyParents = v
 		case pvcNamespaceKey:
 			subDirReplaceMap[pvcNamespaceMetadata] = v
 		case pvcNameKey:
@@ -646,9 +1542,22 @@ func newNFSVolume(name string, size int64, params map[string]string, defaultOnDe
 	} else {
 		// replace pv/pvc name namespace metadata in subDir
 		vol.subDir = replaceWithMap(subDir, subDirReplaceMap)
+		if strings.Contains(vol.subDir, pvcNameMetadata) || strings.Contains(vol.subDir, pvcNamespaceMetadata) {
+			return nil, fmt.Errorf("pvc metadata in %v(%s) could not be resolved, --extra-create-metadata should be enabled on csi-provisioner", paramSubDir, subDir)
+		}
+		var err error
+		if vol.subDir, err = validateSubDir(vol.subDir, subDirMaxDepth); err != nil {
+			return nil, err
+		}
 		// make volume id unique if subDir is provided
 		vol.uuid = name
 	}
+	if pruneEmptyParents != "" {
+		var err error
+		if vol.pruneParents, err = strconv.ParseBool(pruneEmptyParents); err != nil {
+			return nil, fmt.Errorf("invalid %s %s in storage class", paramPruneEmptyParents, pruneEmptyParents)
+		}
+	}
 
 	if err := validateOnDeleteValue(onDelete); err != nil {
 		return nil, err
@@ -658,6 +1567,12 @@ func newNFSVolume(name string, size int64, params map[string]string, defaultOnDe
 	if onDelete != "" {
 		vol.onDelete = onDelete
 	}
+	if retainFor != "" {
+		if err := validateRetainFor(retainFor, vol.onDelete); err != nil {
+			return nil, err
+		}
+		vol.retainFor = retainFor
+	}
 
 	vol.id = getVolumeIDFromNfsVol(vol)
 	return vol, nil
@@ -686,22 +1601,63 @@ func getInternalVolumePath(workingMountDir string, vol *nfsVolume) string {
 	return filepath.Join(getInternalMountPath(workingMountDir, vol), vol.subDir)
 }
 
+// validateSubDir returns the cleaned subDir, nested subDir (e.g. team-a/ns/pvc) is allowed, it must stay under
+// the share and not have more than maxDepth levels if maxDepth is set
+func validateSubDir(subDir, maxDepth string) (string, error) {
+	cleaned := strings.Trim(path.Clean("/"+subDir), "/")
+	if cleaned == "" || cleaned != strings.Trim(subDir, "/") {
+		return "", fmt.Errorf("invalid %s %q, it should be a relative path without . or .. elements", paramSubDir, subDir)
+	}
+	if strings.Contains(cleaned, separator) {
+		return "", fmt.Errorf("invalid %s %q, it should not contain %s", paramSubDir, subDir, separator)
+	}
+	if maxDepth == "" {
+		return cleaned, nil
+	}
+	depth, err := strconv.Atoi(maxDepth)
+	if err != nil || depth <= 0 {
+		return "", fmt.Errorf("invalid %s %s in storage class, it should be a positive integer", paramSubDirMaxDepth, maxDepth)
+	}
+	if levels := len(strings.Split(cleaned, "/")); levels > depth {
+		return "", fmt.Errorf("%s %q has %d levels, exceeds %s %d", paramSubDir, subDir, levels, paramSubDirMaxDepth, depth)
+	}
+	return cleaned, nil
+}
+
+// pruneEmptyParents removes empty parent directories of volumePath up to sharePath, sharePath itself is kept.
+// Non-empty parents are kept, a concurrent CreateVolume which is creating a sibling under the parent fails and is retried.
+func pruneEmptyParents(ctx context.Context, sharePath, volumePath string) error {
+	sharePath = filepath.Clean(sharePath)
+	for dir := filepath.Dir(filepath.Clean(volumePath)); dir != sharePath && strings.HasPrefix(dir, sharePath+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			// EEXIST is returned instead of ENOTEMPTY on some platforms
+			if errors.Is(err, syscall.ENOTEMPTY) || errors.Is(err, syscall.EEXIST) {
+				return nil
+			}
+			return err
+		}
+		klog.FromContext(ctx).V(2).Info("removed empty parent directory", "path", dir)
+	}
+	return nil
+}
+
+// getArchivedSubDir returns the sub directory a volume is archived to: archived-{pv name}-{timestamp},
+// the archived sub directory is in the same parent directory as the volume sub directory
+func getArchivedSubDir(vol *nfsVolume, now time.Time) string {
+	archivedName := fmt.Sprintf("archived-%s-%s", filepath.Base(getVolumeName(vol)), now.UTC().Format(archiveTimeFormat))
+	return filepath.Join(filepath.Dir(vol.subDir), archivedName)
+}
+
 func getArchivedInternalVolumePath(workingMountDir string, vol *nfsVolume, archVol *nfsVolume) string {
 	return filepath.Join(getInternalMountPath(workingMountDir, vol), archVol.subDir)
 }
 
 // Given a nfsVolume, return a CSI volume id
 func getVolumeIDFromNfsVol(vol *nfsVolume) string {
-	idElements := make([]string, totalIDElements)
-	idElements[idServer] = strings.Trim(vol.server, "/")
-	idElements[idBaseDir] = strings.Trim(vol.baseDir, "/")
-	idElements[idSubDir] = strings.Trim(vol.subDir, "/")
-	idElements[idUUID] = vol.uuid
-	if strings.EqualFold(vol.onDelete, retain) || strings.EqualFold(vol.onDelete, archive) {
-		idElements[idOnDelete] = vol.onDelete
-	}
-
-	return strings.Join(idElements, separator)
+	return encodeVolumeID(vol, volumeIDV3)
 }
 
 // Given a nfsSnapshot, return a CSI snapshot id.
@@ -723,39 +1679,8 @@ func getSnapshotIDFromNfsSnapshot(snap *nfsSnapshot) string {
 //		    nfs-server.default.svc.cluster.local#share#subdir#pvc-4bcbf944-b6f7-4bd0-b50f-3c3dd00efc64#retain
 //	  old volumeID: nfs-server.default.svc.cluster.local/share/pvc-4bcbf944-b6f7-4bd0-b50f-3c3dd00efc64
 func getNfsVolFromID(id string) (*nfsVolume, error) {
-	var server, baseDir, subDir, uuid, onDelete string
-	segments := strings.Split(id, separator)
-	if len(segments) < 3 {
-		klog.V(2).Infof("could not split %s into server, baseDir and subDir with separator(%s)", id, separator)
-		// try with separator "/"
-		volRegex := regexp.MustCompile("^([^/]+)/(.*)/([^/]+)$")
-		tokens := volRegex.FindStringSubmatch(id)
-		if tokens == nil || len(tokens) < 4 {
-			return nil, fmt.Errorf("could not split %s into server, baseDir and subDir with separator(%s)", id, "/")
-		}
-		server = tokens[1]
-		baseDir = tokens[2]
-		subDir = tokens[3]
-	} else {
-		server = segments[0]
-		baseDir = segments[1]
-		subDir = segments[2]
-		if len(segments) >= 4 {
-			uuid = segments[3]
-		}
-		if len(segments) >= 5 {
-			onDelete = segments[4]
-		}
-	}
-
-	return &nfsVolume{
-		id:       id,
-		server:   server,
-		baseDir:  baseDir,
-		subDir:   subDir,
-		uuid:     uuid,
-		onDelete: onDelete,
-	}, nil
+	vol, _, err := decodeVolumeID(id)
+	return vol, err
 }
 
 // Given a CSI snapshot ID, return a nfsSnapshot
@@ -777,35 +1702,91 @@ func getNfsSnapFromID(id string) (*nfsSnapshot, error) {
 	return &nfsSnapshot{}, fmt.Errorf("failed to create nfsSnapshot from snapshot ID")
 }
 
-// isValidVolumeCapabilities validates the given VolumeCapability array is valid
-func isValidVolumeCapabilities(volCaps []*csi.VolumeCapability) error {
+// newCSISnapshot converts a snapshot found on the nfs server to a csi snapshot
+func newCSISnapshot(snap *nfsSnapshot, srcVolumeID string, info *snapshotInfo) *csi.Snapshot {
+	return &csi.Snapshot{
+		SnapshotId:     snap.id,
+		SourceVolumeId: srcVolumeID,
+		SizeBytes:      info.sizeBytes,
+		CreationTime:   timestamppb.New(info.creationTime),
+		ReadyToUse:     true,
+	}
+}
+
+// getVolumeName returns the name of the volume which is used in snapshot archive name
+func getVolumeName(vol *nfsVolume) string {
+	if vol.uuid != "" {
+		return vol.uuid
+	}
+	return vol.subDir
+}
+
+// getVolCapFromSecrets returns volume capability with mountOptions in secrets, nil if mountOptions is not provided
+func getVolCapFromSecrets(secrets map[string]string) *csi.VolumeCapability {
+	mountOptions := getMountOptions(secrets)
+	if mountOptions == "" {
+		return nil
+	}
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{
+				MountFlags: []string{mountOptions},
+			},
+		},
+	}
+}
+
+// isValidVolumeCapabilities validates the given VolumeCapability array is valid,
+// block volume capability is only supported if enableBlockVolume is true, it could not be mixed with mount or requested
+// with multi writer access modes
+func isValidVolumeCapabilities(volCaps []*csi.VolumeCapability, enableBlockVolume bool) error {
 	if len(volCaps) == 0 {
 		return fmt.Errorf("volume capabilities missing in request")
 	}
+	block := isBlockVolumeCapability(volCaps)
+	if block && !enableBlockVolume {
+		return fmt.Errorf("block volume capability not supported")
+	}
 	for _, c := range volCaps {
 		if c.GetBlock() != nil {
-			return fmt.Errorf("block volume capability not supported")
+			if mode := c.GetAccessMode().GetMode(); isMultiWriterAccessMode(mode) {
+				return fmt.Errorf("access mode %s is not supported by block volume", mode)
+			}
+			continue
+		}
+		if block {
+			return fmt.Errorf("block and mount volume capabilities could not be both requested")
+		}
+		if _, err := getFSType(c.GetMount().GetFsType()); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-// Validate snapshot after internal mount
+// Validate snapshot after internal mount, only entries of the snapshot directory are checked
+// since tree of incremental snapshot could be large
 func validateSnapshot(snapInternalVolPath string, snap *nfsSnapshot) error {
-	return filepath.WalkDir(snapInternalVolPath, func(path string, d fs.DirEntry, err error) error {
-		if path == snapInternalVolPath {
-			// skip root
-			return nil
-		}
-		if err != nil {
-			return err
+	entries, err := os.ReadDir(snapInternalVolPath)
+	if err != nil {
+		return err
+	}
+	desired := snap.archiveName()
+	if snap.format == snapshotFormatIncremental {
+		desired = snap.treeName()
+	}
+	for _, d := range entries {
+		isIncremental := isIncrementalSnapshotEntryOf(d.Name(), snap)
+		if (snap.format == snapshotFormatIncremental && isIncremental) || (snap.format != snapshotFormatIncremental && (d.Name() == snap.archiveName() || d.Name() == snap.sourceVolumeIDName())) {
+			continue
 		}
-		if d.Name() != snap.archiveName() {
-			// there should be just one archive in the snapshot path and archive name should match
-			return status.Errorf(codes.AlreadyExists, "snapshot with the same name but different source volume ID already exists: found %q, desired %q", d.Name(), snap.archiveName())
+		if isIncremental || isSnapshotArchiveOf(d.Name(), snap) {
+			return status.Errorf(codes.AlreadyExists, "snapshot with the same name but different format or compression already exists: found %q, desired %q", d.Name(), desired)
 		}
-		return nil
-	})
+		// there should be just one archive in the snapshot path and archive name should match
+		return status.Errorf(codes.AlreadyExists, "snapshot with the same name but different source volume ID already exists: found %q, desired %q", d.Name(), desired)
+	}
+	return nil
 }
 
 // Volume for snapshot internal mount/unmount
@@ -19,12 +19,16 @@ package nfs
 import (
 	"archive/tar"
 	"compress/gzip"
+	"hash/fnv"
 	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"fmt"
 
@@ -34,6 +38,8 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	mount "k8s.io/mount-utils"
 )
 
@@ -152,6 +158,65 @@ func TestCreateVolume(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "server picked by topology in serverMap",
+			req: &csi.CreateVolumeRequest{
+				Name: testCSIVolume,
+				VolumeCapabilities: []*csi.VolumeCapability{
+					{
+						AccessType: &csi.VolumeCapability_Mount{
+							Mount: &csi.VolumeCapability_MountVolume{},
+						},
+						AccessMode: &csi.VolumeCapability_AccessMode{
+							Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+						},
+					},
+				},
+				Parameters: map[string]string{
+					"serverMap": "zone-a=server-a;zone-b=server-b",
+					paramShare:  testBaseDir,
+				},
+				AccessibilityRequirements: &csi.TopologyRequirement{
+					Requisite: []*csi.Topology{{Segments: map[string]string{topologyKeyZone: "zone-b"}}},
+				},
+			},
+			resp: &csi.CreateVolumeResponse{
+				Volume: &csi.Volume{
+					VolumeId: "server-b#test-base-dir#volume-name##",
+					VolumeContext: map[string]string{
+						"serverMap": "zone-a=server-a;zone-b=server-b",
+						paramServer: "server-b",
+						paramShare:  testBaseDir,
+						paramSubDir: testCSIVolume,
+					},
+					AccessibleTopology: []*csi.Topology{{Segments: map[string]string{topologyKeyZone: "zone-b"}}},
+				},
+			},
+		},
+		{
+			name: "[Error] no zone in serverMap",
+			req: &csi.CreateVolumeRequest{
+				Name: testCSIVolume,
+				VolumeCapabilities: []*csi.VolumeCapability{
+					{
+						AccessType: &csi.VolumeCapability_Mount{
+							Mount: &csi.VolumeCapability_MountVolume{},
+						},
+						AccessMode: &csi.VolumeCapability_AccessMode{
+							Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+						},
+					},
+				},
+				Parameters: map[string]string{
+					"serverMap": "zone-a=server-a",
+					paramShare:  testBaseDir,
+				},
+				AccessibilityRequirements: &csi.TopologyRequirement{
+					Requisite: []*csi.Topology{{Segments: map[string]string{topologyKeyZone: "zone-b"}}},
+				},
+			},
+			expectErr: true,
+		},
 		{
 			name: "name empty",
 			req: &csi.CreateVolumeRequest{
@@ -214,6 +279,50 @@ func TestCreateVolume(t *testing.T) {
 			},
 			expectErr: true,
 		},
+		{
+			name: "[Error] invalid enableQuota",
+			req: &csi.CreateVolumeRequest{
+				Name: testCSIVolume,
+				VolumeCapabilities: []*csi.VolumeCapability{
+					{
+						AccessType: &csi.VolumeCapability_Mount{
+							Mount: &csi.VolumeCapability_MountVolume{},
+						},
+						AccessMode: &csi.VolumeCapability_AccessMode{
+							Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+						},
+					},
+				},
+				Parameters: map[string]string{
+					paramServer:      testServer,
+					paramShare:       testBaseDir,
+					paramEnableQuota: "invalid",
+				},
+			},
+			expectErr: true,
+		},
+		{
+			name: "[Error] enableQuota without quota mount dir",
+			req: &csi.CreateVolumeRequest{
+				Name: testCSIVolume,
+				VolumeCapabilities: []*csi.VolumeCapability{
+					{
+						AccessType: &csi.VolumeCapability_Mount{
+							Mount: &csi.VolumeCapability_MountVolume{},
+						},
+						AccessMode: &csi.VolumeCapability_AccessMode{
+							Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+						},
+					},
+				},
+				Parameters: map[string]string{
+					paramServer:      testServer,
+					paramShare:       testBaseDir,
+					paramEnableQuota: "true",
+				},
+			},
+			expectErr: true,
+		},
 	}
 
 	for _, test := range cases {
@@ -254,6 +363,7 @@ func TestDeleteVolume(t *testing.T) {
 		req                  *csi.DeleteVolumeRequest
 		resp                 *csi.DeleteVolumeResponse
 		expectedDeleteSubDir bool
+		expectedArchive      bool
 		expectedErr          error
 	}{
 		{
@@ -295,6 +405,7 @@ func TestDeleteVolume(t *testing.T) {
 			resp:                 &csi.DeleteVolumeResponse{},
 			expectedErr:          nil,
 			expectedDeleteSubDir: true,
+			expectedArchive:      true,
 		},
 	}
 
@@ -327,6 +438,16 @@ func TestDeleteVolume(t *testing.T) {
 					t.Errorf("test %q failed: expected volume subdirectory not deleted, it was deleted", test.desc)
 				}
 			}
+			if test.expectedArchive {
+				archived, _ := filepath.Glob(filepath.Join(cs.Driver.workingMountDir, testCSIVolume, "archived-"+testCSIVolume+"-*"))
+				if len(archived) != 1 {
+					t.Errorf("test %q failed: expected volume subdirectory archived, found %v", test.desc, archived)
+				}
+				// retry on archived volume should succeed
+				if _, err := cs.DeleteVolume(context.TODO(), test.req); err != nil {
+					t.Errorf("test %q failed: retry on archived volume failed: %v", test.desc, err)
+				}
+			}
 		})
 	}
 }
@@ -371,6 +492,48 @@ func TestControllerGetCapabilities(t *testing.T) {
 							},
 						},
 					},
+					{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{
+								Type: csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+							},
+						},
+					},
+					{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{
+								Type: csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+							},
+						},
+					},
+					{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{
+								Type: csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+							},
+						},
+					},
+					{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{
+								Type: csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+							},
+						},
+					},
+					{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{
+								Type: csi.ControllerServiceCapability_RPC_GET_VOLUME,
+							},
+						},
+					},
+					{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{
+								Type: csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+							},
+						},
+					},
 				},
 			},
 			expectedErr: nil,
@@ -382,6 +545,7 @@ func TestControllerGetCapabilities(t *testing.T) {
 		t.Run(test.desc, func(t *testing.T) {
 			// Setup
 			cs := initTestController(t)
+			cs.Driver = NewDriver(&DriverOptions{VolumeRegistryResyncInterval: time.Minute})
 
 			// Run
 			resp, err := cs.ControllerGetCapabilities(context.TODO(), test.req)
@@ -552,9 +716,10 @@ func TestIsValidVolumeCapabilities(t *testing.T) {
 	}
 
 	cases := []struct {
-		desc      string
-		volCaps   []*csi.VolumeCapability
-		expectErr error
+		desc              string
+		volCaps           []*csi.VolumeCapability
+		enableBlockVolume bool
+		expectErr         error
 	}{
 		{
 			volCaps:   mountVolumeCapabilities,
@@ -564,14 +729,73 @@ func TestIsValidVolumeCapabilities(t *testing.T) {
 			volCaps:   blockVolumeCapabilities,
 			expectErr: fmt.Errorf("block volume capability not supported"),
 		},
+		{
+			desc:              "block volume enabled",
+			volCaps:           blockVolumeCapabilities,
+			enableBlockVolume: true,
+			expectErr:         nil,
+		},
+		{
+			desc:              "block and mount",
+			volCaps:           append(append([]*csi.VolumeCapability{}, mountVolumeCapabilities...), blockVolumeCapabilities...),
+			enableBlockVolume: true,
+			expectErr:         fmt.Errorf("block and mount volume capabilities could not be both requested"),
+		},
+		{
+			desc: "multi node multi writer block volume",
+			volCaps: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+				},
+			},
+			enableBlockVolume: true,
+			expectErr:         fmt.Errorf("access mode MULTI_NODE_MULTI_WRITER is not supported by block volume"),
+		},
+		{
+			desc: "single node multi writer block volume",
+			volCaps: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER},
+				},
+			},
+			enableBlockVolume: true,
+			expectErr:         fmt.Errorf("access mode SINGLE_NODE_MULTI_WRITER is not supported by block volume"),
+		},
+		{
+			desc: "multi node reader only block volume",
+			volCaps: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+				},
+			},
+			enableBlockVolume: true,
+			expectErr:         nil,
+		},
 		{
 			volCaps:   []*csi.VolumeCapability{},
 			expectErr: fmt.Errorf("volume capabilities missing in request"),
 		},
+		{
+			desc: "nfs4 fsType",
+			volCaps: []*csi.VolumeCapability{
+				{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "nfs4"}}},
+			},
+			expectErr: nil,
+		},
+		{
+			desc: "unsupported fsType",
+			volCaps: []*csi.VolumeCapability{
+				{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}}},
+			},
+			expectErr: fmt.Errorf("invalid fsType ext4, supported values are [nfs nfs4]"),
+		},
 	}
 
 	for _, test := range cases {
-		err := isValidVolumeCapabilities(test.volCaps)
+		err := isValidVolumeCapabilities(test.volCaps, test.enableBlockVolume)
 		if !reflect.DeepEqual(err, test.expectErr) {
 			t.Errorf("[test: %s] Unexpected error: %v, expected error: %v", test.desc, err, test.expectErr)
 		}
@@ -616,6 +840,68 @@ func TestGetInternalMountPath(t *testing.T) {
 	}
 }
 
+func TestGetArchivedSubDir(t *testing.T) {
+	now := time.Date(2023, 11, 22, 10, 20, 30, 0, time.UTC)
+	cases := []struct {
+		desc     string
+		vol      *nfsVolume
+		expected string
+	}{
+		{
+			desc:     "subDir is pv name",
+			vol:      &nfsVolume{subDir: "pvc-name"},
+			expected: "archived-pvc-name-20231122-102030",
+		},
+		{
+			desc:     "subDir with pv name",
+			vol:      &nfsVolume{subDir: "subdir", uuid: "pvc-name"},
+			expected: "archived-pvc-name-20231122-102030",
+		},
+		{
+			desc:     "nested subDir with pv name",
+			vol:      &nfsVolume{subDir: "namespace/subdir", uuid: "pvc-name"},
+			expected: "namespace/archived-pvc-name-20231122-102030",
+		},
+	}
+
+	for _, test := range cases {
+		result := getArchivedSubDir(test.vol, now)
+		if result != test.expected {
+			t.Errorf("test[%s]: unexpected output: %v, expected result: %v", test.desc, result, test.expected)
+		}
+	}
+}
+
+func TestPruneEmptyParents(t *testing.T) {
+	share := t.TempDir()
+	for _, dir := range []string{"team-a/ns-1/pvc-1", "team-a/ns-2/pvc-2", "team-b/ns-3/pvc-3"} {
+		if err := os.MkdirAll(filepath.Join(share, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{"team-a/ns-1/pvc-1", "team-b/ns-3/pvc-3"} {
+		volumePath := filepath.Join(share, dir)
+		if err := os.Remove(volumePath); err != nil {
+			t.Fatal(err)
+		}
+		if err := pruneEmptyParents(context.TODO(), share, volumePath); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	for dir, exists := range map[string]bool{
+		"":                  true,
+		"team-a":            true,
+		"team-a/ns-1":       false,
+		"team-a/ns-2/pvc-2": true,
+		"team-b":            false,
+	} {
+		if _, err := os.Stat(filepath.Join(share, dir)); (err == nil) != exists {
+			t.Errorf("unexpected stat error of %q: %v, expected exists: %v", dir, err, exists)
+		}
+	}
+}
+
 func TestNewNFSVolume(t *testing.T) {
 	cases := []struct {
 		desc      string
@@ -666,6 +952,36 @@ func TestNewNFSVolume(t *testing.T) {
 				onDelete: "delete",
 			},
 		},
+		{
+			desc: "subDir with pv metadata is specified without extra create metadata",
+			name: "pv-name",
+			size: 100,
+			params: map[string]string{
+				paramServer: "//nfs-server.default.svc.cluster.local",
+				paramShare:  "share",
+				paramSubDir: fmt.Sprintf("subdir-%s", pvNameMetadata),
+			},
+			expectVol: &nfsVolume{
+				id:       "nfs-server.default.svc.cluster.local#share#subdir-pv-name#pv-name#",
+				server:   "//nfs-server.default.svc.cluster.local",
+				baseDir:  "share",
+				subDir:   "subdir-pv-name",
+				size:     100,
+				uuid:     "pv-name",
+				onDelete: "delete",
+			},
+		},
+		{
+			desc: "subDir with pvc metadata is specified without extra create metadata",
+			name: "pv-name",
+			size: 100,
+			params: map[string]string{
+				paramServer: "//nfs-server.default.svc.cluster.local",
+				paramShare:  "share",
+				paramSubDir: fmt.Sprintf("subdir-%s", pvcNamespaceMetadata),
+			},
+			expectErr: fmt.Errorf("pvc metadata in %v(%s) could not be resolved, --extra-create-metadata should be enabled on csi-provisioner", paramSubDir, fmt.Sprintf("subdir-%s", pvcNamespaceMetadata)),
+		},
 		{
 			desc: "subDir not specified",
 			name: "pv-name",
@@ -700,6 +1016,95 @@ func TestNewNFSVolume(t *testing.T) {
 			expectVol: nil,
 			expectErr: fmt.Errorf("invalid value %s for OnDelete, supported values are %v", "invalid", supportedOnDeleteValues),
 		},
+		{
+			desc: "retainFor is specified",
+			name: "pv-name",
+			params: map[string]string{
+				paramServer:    "//nfs-server.default.svc.cluster.local",
+				paramShare:     "share",
+				paramRetainFor: "72h",
+			},
+			expectVol: &nfsVolume{
+				id:        "nfs-server.default.svc.cluster.local#share#pv-name###retainFor=72h",
+				server:    "//nfs-server.default.svc.cluster.local",
+				baseDir:   "share",
+				subDir:    "pv-name",
+				onDelete:  "delete",
+				retainFor: "72h",
+			},
+		},
+		{
+			desc: "retainFor with retain onDelete",
+			params: map[string]string{
+				paramServer:    "//nfs-server.default.svc.cluster.local",
+				paramShare:     "share",
+				paramOnDelete:  "retain",
+				paramRetainFor: "72h",
+			},
+			expectErr: fmt.Errorf("%s requires %s %s, got %s", paramRetainFor, paramOnDelete, "delete", "retain"),
+		},
+		{
+			desc: "invalid retainFor",
+			params: map[string]string{
+				paramServer:    "//nfs-server.default.svc.cluster.local",
+				paramShare:     "share",
+				paramRetainFor: "-1h",
+			},
+			expectErr: fmt.Errorf("invalid %s %s, it should be a positive duration, e.g. 72h", paramRetainFor, "-1h"),
+		},
+		{
+			desc: "nested subDir with pruneEmptyParents",
+			name: "pv-name",
+			params: map[string]string{
+				paramServer:            "//nfs-server.default.svc.cluster.local",
+				paramShare:             "share",
+				paramSubDir:            fmt.Sprintf("/team-a/%s/%s/", pvcNamespaceMetadata, pvcNameMetadata),
+				paramSubDirMaxDepth:    "3",
+				paramPruneEmptyParents: "true",
+				pvcNameKey:             "pvcname",
+				pvcNamespaceKey:        "pvcnamespace",
+			},
+			expectVol: &nfsVolume{
+				id:           "nfs-server.default.svc.cluster.local#share#team-a/pvcnamespace/pvcname#pv-name##prune",
+				server:       "//nfs-server.default.svc.cluster.local",
+				baseDir:      "share",
+				subDir:       "team-a/pvcnamespace/pvcname",
+				uuid:         "pv-name",
+				onDelete:     "delete",
+				pruneParents: true,
+			},
+		},
+		{
+			desc: "nested subDir exceeds subDirMaxDepth",
+			name: "pv-name",
+			params: map[string]string{
+				paramServer:         "//nfs-server.default.svc.cluster.local",
+				paramShare:          "share",
+				paramSubDir:         "team-a/ns/pvc",
+				paramSubDirMaxDepth: "2",
+			},
+			expectErr: fmt.Errorf("%s %q has %d levels, exceeds %s %d", paramSubDir, "team-a/ns/pvc", 3, paramSubDirMaxDepth, 2),
+		},
+		{
+			desc: "subDir out of share",
+			name: "pv-name",
+			params: map[string]string{
+				paramServer: "//nfs-server.default.svc.cluster.local",
+				paramShare:  "share",
+				paramSubDir: "team-a/../../pvc",
+			},
+			expectErr: fmt.Errorf("invalid %s %q, it should be a relative path without . or .. elements", paramSubDir, "team-a/../../pvc"),
+		},
+		{
+			desc: "invalid pruneEmptyParents",
+			name: "pv-name",
+			params: map[string]string{
+				paramServer:            "//nfs-server.default.svc.cluster.local",
+				paramShare:             "share",
+				paramPruneEmptyParents: "yes",
+			},
+			expectErr: fmt.Errorf("invalid %s %s in storage class", paramPruneEmptyParents, "yes"),
+		},
 	}
 
 	for _, test := range cases {
@@ -911,24 +1316,309 @@ func TestCopyVolume(t *testing.T) {
 	}
 }
 
-func TestCreateSnapshot(t *testing.T) {
-	cases := []struct {
-		desc      string
-		req       *csi.CreateSnapshotRequest
-		expResp   *csi.CreateSnapshotResponse
-		expectErr bool
-		prepare   func() error
-		cleanup   func() error
-	}{
-		{
-			desc: "create snapshot with valid request",
-			req: &csi.CreateSnapshotRequest{
-				SourceVolumeId: "nfs-server.default.svc.cluster.local#share#subdir#src-pv-name",
-				Name:           "snapshot-name",
+func TestCreateVolumeFromSnapshotWithRestoreServer(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.workingMountDir = t.TempDir()
+	snapDir := filepath.Join(cs.Driver.workingMountDir, "snapshot-name", "snapshot-name")
+	if err := os.MkdirAll(snapDir, 0777); err != nil {
+		t.Fatalf("failed to make snapshot dir: %v", err)
+	}
+	file, err := os.Create(filepath.Join(snapDir, "src-pv-name.tar.gz"))
+	if err != nil {
+		t.Fatalf("failed to create snapshot archive: %v", err)
+	}
+	gzipWriter := gzip.NewWriter(file)
+	if err := tar.NewWriter(gzipWriter).Close(); err != nil {
+		t.Fatalf("failed to write snapshot archive: %v", err)
+	}
+	gzipWriter.Close()
+	file.Close()
+
+	req := &csi.CreateVolumeRequest{
+		Name: "restored-pv-name",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
 			},
-			expResp: &csi.CreateSnapshotResponse{
-				Snapshot: &csi.Snapshot{
-					SnapshotId:     "nfs-server.default.svc.cluster.local#share#snapshot-name#snapshot-name#src-pv-name",
+		},
+		Parameters: map[string]string{
+			paramServer:     "cheap-nfs-server",
+			paramShare:      "snapshots",
+			"restoreServer": "dr-nfs-server",
+			"restoreShare":  "restored",
+			paramOnDelete:   retain,
+		},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{
+					SnapshotId: "cheap-nfs-server#snapshots#snapshot-name#snapshot-name#src-pv-name",
+				},
+			},
+		},
+	}
+	resp, err := cs.CreateVolume(context.TODO(), req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expectedID := "dr-nfs-server#restored#restored-pv-name##retain"
+	if resp.Volume.VolumeId != expectedID {
+		t.Errorf("unexpected volume id %s, expected %s", resp.Volume.VolumeId, expectedID)
+	}
+	if server := resp.Volume.VolumeContext[paramServer]; server != "dr-nfs-server" {
+		t.Errorf("unexpected server %s in volume context", server)
+	}
+	if share := resp.Volume.VolumeContext[paramShare]; share != "restored" {
+		t.Errorf("unexpected share %s in volume context", share)
+	}
+
+	req.Parameters[paramServerMap] = "zone-a=nfs-server-a"
+	if _, err := cs.CreateVolume(context.TODO(), req); err == nil {
+		t.Errorf("expected error with both restoreServer and serverMap")
+	}
+}
+
+func TestCreateVolumeWithServerInSecret(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.workingMountDir = t.TempDir()
+	req := &csi.CreateVolumeRequest{
+		Name: "tenant-pv-name",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+			},
+		},
+		Parameters: map[string]string{
+			paramShare:    testBaseDir,
+			paramOnDelete: retain,
+		},
+		Secrets: map[string]string{
+			"Server": "tenant-nfs-server",
+			"Share":  "tenant-share",
+		},
+	}
+	resp, err := cs.CreateVolume(context.TODO(), req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expectedID := "tenant-nfs-server#tenant-share#tenant-pv-name##retain"
+	if resp.Volume.VolumeId != expectedID {
+		t.Errorf("unexpected volume id %s, expected %s", resp.Volume.VolumeId, expectedID)
+	}
+	if server := resp.Volume.VolumeContext[paramServer]; server != "tenant-nfs-server" {
+		t.Errorf("unexpected server %s in volume context", server)
+	}
+
+	req.Parameters[paramServerMap] = "zone-a=nfs-server-a"
+	if _, err := cs.CreateVolume(context.TODO(), req); err == nil {
+		t.Errorf("expected error with both server in secret and serverMap")
+	}
+}
+
+func TestInternalMount(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.workingMountDir = t.TempDir()
+	mounter := cs.Driver.ns.mounter.(*mount.FakeMounter)
+	vol := &nfsVolume{id: "test-server#test-base-dir#volume-name##", server: testServer, baseDir: testBaseDir, subDir: testCSIVolume}
+	volumeContext := map[string]string{
+		paramSubDir:        testCSIVolume,
+		"kataDirectVolume": "true",
+		paramEncrypted:     "true",
+		"kataMetadata/io.katacontainers.fs-opt.block_device": "file",
+	}
+	if err := cs.internalMount(context.TODO(), vol, volumeContext, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// share is mounted on controller instead of being published as kata direct volume or decrypted by gocryptfs
+	targetPath := getInternalMountPath(cs.Driver.workingMountDir, vol)
+	assert.Equal(t, []mount.FakeAction{{Action: "mount", Target: targetPath, Source: "test-server:/test-base-dir", FSType: "nfs"}}, mounter.GetLog())
+	assert.NoError(t, cs.internalUnmount(context.TODO(), vol))
+
+	// share is mounted as writable for read-only access mode
+	mounter.ResetLog()
+	volCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"nfsvers=4.1"}}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+	}
+	if err := cs.internalMount(context.TODO(), vol, nil, volCap); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mountPoints, err := mounter.List()
+	assert.NoError(t, err)
+	assert.Len(t, mountPoints, 1)
+	assert.Equal(t, []string{"nfsvers=4.1"}, mountPoints[0].Opts)
+	assert.NoError(t, cs.internalUnmount(context.TODO(), vol))
+}
+
+func TestCreateVolumeLockedByVolumeID(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.workingMountDir = t.TempDir()
+	req := &csi.CreateVolumeRequest{
+		Name: "locked-pv-name",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+			},
+		},
+		Parameters: map[string]string{
+			paramServer:   testServer,
+			paramShare:    testBaseDir,
+			paramOnDelete: retain,
+		},
+	}
+	volumeID := "test-server#test-base-dir#locked-pv-name##retain"
+	// volume is being deleted
+	cs.Driver.volumeLocks.TryAcquire(volumeID)
+	_, err := cs.CreateVolume(context.TODO(), req)
+	assert.Equal(t, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID), err)
+
+	cs.Driver.volumeLocks.Release(volumeID)
+	resp, err := cs.CreateVolume(context.TODO(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, volumeID, resp.GetVolume().GetVolumeId())
+}
+
+func TestCreateVolumeWithVolumeIDVersion(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.workingMountDir = t.TempDir()
+	cs.Driver.volumeIDVersion = volumeIDV2
+	req := &csi.CreateVolumeRequest{
+		Name: "v2-pv-name",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+			},
+		},
+		Parameters: map[string]string{
+			paramServer: testServer,
+			paramShare:  testBaseDir,
+		},
+	}
+	resp, err := cs.CreateVolume(context.TODO(), req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expectedID := testServer + "#" + testBaseDir + "#v2-pv-name"
+	if resp.Volume.VolumeId != expectedID {
+		t.Errorf("unexpected volume id %s, expected %s", resp.Volume.VolumeId, expectedID)
+	}
+	if _, err := cs.DeleteVolume(context.TODO(), &csi.DeleteVolumeRequest{VolumeId: resp.Volume.VolumeId}); err != nil {
+		t.Errorf("unexpected error deleting volume %s: %v", resp.Volume.VolumeId, err)
+	}
+}
+
+func TestCreateVolumeWithOwner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip on windows")
+	}
+	cs := initTestController(t)
+	cs.Driver.workingMountDir = t.TempDir()
+	// chown to the current user and group is allowed without root
+	uid, gid := os.Getuid(), os.Getgid()
+	req := &csi.CreateVolumeRequest{
+		Name: "owner-pv-name",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+			},
+		},
+		Parameters: map[string]string{
+			paramServer: testServer,
+			paramShare:  testBaseDir,
+			paramUID:    strconv.Itoa(uid),
+			paramGID:    strconv.Itoa(gid),
+		},
+	}
+	if _, err := cs.CreateVolume(context.TODO(), req); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	fi, err := os.Stat(filepath.Join(cs.Driver.workingMountDir, "owner-pv-name", "owner-pv-name"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileUID, fileGID, ok := getFileOwner(fi); !ok || fileUID != uid || fileGID != gid {
+		t.Errorf("unexpected owner %d:%d, expected %d:%d", fileUID, fileGID, uid, gid)
+	}
+
+	req.Name = "invalid-owner-pv-name"
+	req.Parameters[paramUID] = "-1"
+	if _, err := cs.CreateVolume(context.TODO(), req); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("unexpected error %v, expected InvalidArgument", err)
+	}
+}
+
+func TestCreateBlockVolume(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.workingMountDir = t.TempDir()
+	req := &csi.CreateVolumeRequest{
+		Name: "block-pv-name",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+		},
+		Parameters: map[string]string{paramServer: testServer, paramShare: testBaseDir},
+	}
+	_, err := cs.CreateVolume(context.TODO(), req)
+	assert.Equal(t, status.Error(codes.InvalidArgument, "block volume capability not supported"), err)
+
+	cs.Driver.enableBlockVolume = true
+	_, err = cs.CreateVolume(context.TODO(), req)
+	assert.Equal(t, status.Error(codes.InvalidArgument, "requested capacity is required by block volume"), err)
+
+	req.CapacityRange = &csi.CapacityRange{RequiredBytes: 1 << 20}
+	req.VolumeCapabilities[0].AccessMode.Mode = csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
+	_, err = cs.CreateVolume(context.TODO(), req)
+	assert.Equal(t, status.Error(codes.InvalidArgument, "access mode MULTI_NODE_MULTI_WRITER is not supported by block volume"), err)
+
+	req.VolumeCapabilities[0].AccessMode.Mode = csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+	_, err = cs.CreateVolume(context.TODO(), req)
+	assert.NoError(t, err)
+	fi, err := os.Stat(filepath.Join(cs.Driver.workingMountDir, "block-pv-name", "block-pv-name", blockVolumeFileName))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1<<20), fi.Size())
+}
+
+func TestCreateVolumeWithForbiddenMountOption(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.mountOptionPolicy = newMountOptionPolicy("", "nolock")
+	req := &csi.CreateVolumeRequest{
+		Name: "forbidden-mount-option-pv-name",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"nfsvers=4.1,nolock"}}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+			},
+		},
+		Parameters: map[string]string{paramServer: testServer, paramShare: testBaseDir},
+	}
+	_, err := cs.CreateVolume(context.TODO(), req)
+	assert.Equal(t, status.Error(codes.InvalidArgument, `mount option "nolock" is forbidden by the driver`), err)
+}
+
+func TestCreateSnapshot(t *testing.T) {
+	cases := []struct {
+		desc      string
+		req       *csi.CreateSnapshotRequest
+		expResp   *csi.CreateSnapshotResponse
+		expectErr bool
+		prepare   func() error
+		cleanup   func() error
+	}{
+		{
+			desc: "create snapshot with valid request",
+			req: &csi.CreateSnapshotRequest{
+				SourceVolumeId: "nfs-server.default.svc.cluster.local#share#subdir#src-pv-name",
+				Name:           "snapshot-name",
+			},
+			expResp: &csi.CreateSnapshotResponse{
+				Snapshot: &csi.Snapshot{
+					SnapshotId:     "nfs-server.default.svc.cluster.local#share#snapshot-name#snapshot-name#src-pv-name",
 					SourceVolumeId: "nfs-server.default.svc.cluster.local#share#subdir#src-pv-name",
 					ReadyToUse:     true,
 					SizeBytes:      1,                 // doesn't match exact size, just denotes non-zero size expected
@@ -1056,6 +1746,551 @@ func TestDeleteSnapshot(t *testing.T) {
 	}
 }
 
+func TestListSnapshots(t *testing.T) {
+	snapshotID := "nfs-server.default.svc.cluster.local#share#snapshot-name#snapshot-name#src-pv-name"
+	srcVolumeID := "nfs-server.default.svc.cluster.local#share#subdir#src-pv-name"
+	createArchive := func(path string) func() error {
+		return func() error {
+			if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+				return err
+			}
+			return os.WriteFile(path, []byte("archive"), 0777)
+		}
+	}
+	createRecordedArchive := func(path, srcVolumeID string) func() error {
+		return func() error {
+			if err := createArchive(path)(); err != nil {
+				return err
+			}
+			return os.WriteFile(strings.TrimSuffix(path, ".tar.gz")+snapshotSourceVolumeIDExt, []byte(srcVolumeID), 0777)
+		}
+	}
+	cases := []struct {
+		desc           string
+		req            *csi.ListSnapshotsRequest
+		expectedIDs    []string
+		expectedSource string
+		nextToken      string
+		expectedErr    error
+		prepare        func() error
+		cleanup        func() error
+	}{
+		{
+			desc:           "list snapshot by snapshot id",
+			req:            &csi.ListSnapshotsRequest{SnapshotId: snapshotID},
+			expectedIDs:    []string{snapshotID},
+			expectedSource: srcVolumeID,
+			prepare:        createRecordedArchive("/tmp/snapshot-name/snapshot-name/src-pv-name.tar.gz", srcVolumeID),
+			cleanup:        func() error { return os.RemoveAll("/tmp/snapshot-name") },
+		},
+		{
+			desc:           "list snapshot by snapshot id and source volume id",
+			req:            &csi.ListSnapshotsRequest{SnapshotId: snapshotID, SourceVolumeId: srcVolumeID},
+			expectedIDs:    []string{snapshotID},
+			expectedSource: srcVolumeID,
+			prepare:        createRecordedArchive("/tmp/snapshot-name/snapshot-name/src-pv-name.tar.gz", srcVolumeID),
+			cleanup:        func() error { return os.RemoveAll("/tmp/snapshot-name") },
+		},
+		{
+			desc:    "list snapshot by snapshot id and mismatched source volume id",
+			req:     &csi.ListSnapshotsRequest{SnapshotId: snapshotID, SourceVolumeId: "nfs-server.default.svc.cluster.local#share#subdir#other-pv-name"},
+			prepare: createRecordedArchive("/tmp/snapshot-name/snapshot-name/src-pv-name.tar.gz", srcVolumeID),
+			cleanup: func() error { return os.RemoveAll("/tmp/snapshot-name") },
+		},
+		{
+			desc:           "list snapshot whose source volume is not recorded by snapshot id and source volume id",
+			req:            &csi.ListSnapshotsRequest{SnapshotId: snapshotID, SourceVolumeId: srcVolumeID},
+			expectedIDs:    []string{snapshotID},
+			expectedSource: srcVolumeID,
+			prepare:        createArchive("/tmp/snapshot-name/snapshot-name/src-pv-name.tar.gz"),
+			cleanup:        func() error { return os.RemoveAll("/tmp/snapshot-name") },
+		},
+		{
+			desc:    "list snapshot whose source volume is unknown by snapshot id",
+			req:     &csi.ListSnapshotsRequest{SnapshotId: snapshotID},
+			prepare: createArchive("/tmp/snapshot-name/snapshot-name/src-pv-name.tar.gz"),
+			cleanup: func() error { return os.RemoveAll("/tmp/snapshot-name") },
+		},
+		{
+			desc: "list nonexisting snapshot by snapshot id",
+			req:  &csi.ListSnapshotsRequest{SnapshotId: snapshotID},
+		},
+		{
+			desc: "list snapshot by invalid snapshot id",
+			req:  &csi.ListSnapshotsRequest{SnapshotId: "incorrect-snap-id"},
+		},
+		{
+			desc: "list snapshots by source volume id",
+			req:  &csi.ListSnapshotsRequest{SourceVolumeId: srcVolumeID},
+			expectedIDs: []string{
+				"nfs-server.default.svc.cluster.local#share#snapshot-1#snapshot-1#src-pv-name",
+				"nfs-server.default.svc.cluster.local#share#snapshot-2#snapshot-2#src-pv-name",
+			},
+			prepare: func() error {
+				for _, name := range []string{"snapshot-1", "snapshot-2"} {
+					if err := createArchive(filepath.Join("/tmp/list-snapshots-src-pv-name", name, "src-pv-name.tar.gz"))(); err != nil {
+						return err
+					}
+				}
+				return createArchive("/tmp/list-snapshots-src-pv-name/snapshot-3/other-pv-name.tar.gz")()
+			},
+			cleanup: func() error { return os.RemoveAll("/tmp/list-snapshots-src-pv-name") },
+		},
+		{
+			desc:        "list snapshots by source volume id with max entries",
+			req:         &csi.ListSnapshotsRequest{SourceVolumeId: srcVolumeID, MaxEntries: 1},
+			expectedIDs: []string{"nfs-server.default.svc.cluster.local#share#snapshot-1#snapshot-1#src-pv-name"},
+			nextToken:   "1",
+			prepare: func() error {
+				for _, name := range []string{"snapshot-1", "snapshot-2"} {
+					if err := createArchive(filepath.Join("/tmp/list-snapshots-src-pv-name", name, "src-pv-name.tar.gz"))(); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			cleanup: func() error { return os.RemoveAll("/tmp/list-snapshots-src-pv-name") },
+		},
+		{
+			desc:        "list snapshots by source volume id with starting token",
+			req:         &csi.ListSnapshotsRequest{SourceVolumeId: srcVolumeID, StartingToken: "1"},
+			expectedIDs: []string{"nfs-server.default.svc.cluster.local#share#snapshot-2#snapshot-2#src-pv-name"},
+			prepare: func() error {
+				for _, name := range []string{"snapshot-1", "snapshot-2"} {
+					if err := createArchive(filepath.Join("/tmp/list-snapshots-src-pv-name", name, "src-pv-name.tar.gz"))(); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			cleanup: func() error { return os.RemoveAll("/tmp/list-snapshots-src-pv-name") },
+		},
+		{
+			desc: "list snapshots without snapshot id and source volume id",
+			req:  &csi.ListSnapshotsRequest{},
+		},
+		{
+			desc:        "list snapshots with invalid starting token",
+			req:         &csi.ListSnapshotsRequest{StartingToken: "invalid"},
+			expectedErr: status.Errorf(codes.Aborted, "invalid starting token %q", "invalid"),
+		},
+	}
+	for _, test := range cases {
+		t.Run(test.desc, func(t *testing.T) {
+			if test.prepare != nil {
+				if err := test.prepare(); err != nil {
+					t.Errorf(`[test: %s] prepare failed: "%v"`, test.desc, err)
+				}
+			}
+			cs := initTestController(t)
+			resp, err := cs.ListSnapshots(context.TODO(), test.req)
+			if !reflect.DeepEqual(err, test.expectedErr) {
+				t.Errorf("[test: %s] unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+			}
+			if err == nil {
+				var ids []string
+				for _, entry := range resp.GetEntries() {
+					assert.True(t, entry.GetSnapshot().GetReadyToUse())
+					assert.NotZero(t, entry.GetSnapshot().GetSizeBytes())
+					assert.NotEmpty(t, entry.GetSnapshot().GetSourceVolumeId())
+					if test.expectedSource != "" {
+						assert.Equal(t, test.expectedSource, entry.GetSnapshot().GetSourceVolumeId())
+					}
+					ids = append(ids, entry.GetSnapshot().GetSnapshotId())
+				}
+				assert.Equal(t, test.expectedIDs, ids)
+				assert.Equal(t, test.nextToken, resp.GetNextToken())
+			}
+			if test.cleanup != nil {
+				if err := test.cleanup(); err != nil {
+					t.Errorf(`[test: %s] cleanup failed: "%v"`, test.desc, err)
+				}
+			}
+		})
+	}
+}
+
+func TestListAllSnapshots(t *testing.T) {
+	cs := initTestController(t)
+	srcVolumeID := "nfs-server.default.svc.cluster.local#share#subdir#src-pv-name"
+	srcVol, err := getNfsVolFromID(srcVolumeID)
+	if err != nil {
+		t.Fatalf("failed to get nfs volume: %v", err)
+	}
+	cs.Driver.volumes.add(srcVol)
+	cs.Driver.volumes.addSnapshotShare("snapshot-server", "/snapshots/")
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte("nfs-server.default.svc.cluster.local:share"))
+	sharePath := filepath.Join("/tmp", fmt.Sprintf("list-snapshots-%x", h.Sum32()))
+	h = fnv.New32a()
+	_, _ = h.Write([]byte("snapshot-server:snapshots"))
+	snapshotSharePath := filepath.Join("/tmp", fmt.Sprintf("list-snapshots-%x", h.Sum32()))
+	defer os.RemoveAll(sharePath)
+	defer os.RemoveAll(snapshotSharePath)
+
+	files := map[string]string{
+		// archive created before source volume is recorded
+		filepath.Join(sharePath, "snapshot-1", "src-pv-name.tar.gz"):    "archive",
+		filepath.Join(sharePath, "snapshot-2", "other-pv-name.tar.zst"): "archive",
+		filepath.Join(sharePath, "snapshot-2", "other-pv-name.source"):  "nfs-server#share#other#other-pv-name",
+		// source volume of the archive is unknown
+		filepath.Join(sharePath, "snapshot-3", "unknown-pv-name.tar"):               "archive",
+		filepath.Join(snapshotSharePath, "snapshot-4", "src-pv-name.snapshot.json"): `{"sourceVolumeID":"` + srcVolumeID + `","sizeBytes":10}`,
+	}
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0777); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(snapshotSharePath, "snapshot-4", "src-pv-name"), 0777); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+
+	resp, err := cs.ListSnapshots(context.TODO(), &csi.ListSnapshotsRequest{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sources := map[string]string{}
+	for _, entry := range resp.GetEntries() {
+		sources[entry.GetSnapshot().GetSnapshotId()] = entry.GetSnapshot().GetSourceVolumeId()
+	}
+	expected := map[string]string{
+		"nfs-server.default.svc.cluster.local#share#snapshot-1#snapshot-1#src-pv-name":   srcVolumeID,
+		"nfs-server.default.svc.cluster.local#share#snapshot-2#snapshot-2#other-pv-name": "nfs-server#share#other#other-pv-name",
+		"snapshot-server#snapshots#snapshot-4#snapshot-4#src-pv-name":                    srcVolumeID,
+	}
+	assert.Equal(t, expected, sources)
+
+	resp, err = cs.ListSnapshots(context.TODO(), &csi.ListSnapshotsRequest{MaxEntries: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.Len(t, resp.GetEntries(), 2)
+	assert.Equal(t, "2", resp.GetNextToken())
+
+	cs.Driver.volumes.setSynced(false)
+	_, err = cs.ListSnapshots(context.TODO(), &csi.ListSnapshotsRequest{})
+	assert.Equal(t, status.Error(codes.Unavailable, "volume registry is not synced from persistent volumes yet"), err)
+}
+
+func TestControllerExpandVolume(t *testing.T) {
+	cases := []struct {
+		desc        string
+		req         *csi.ControllerExpandVolumeRequest
+		expResp     *csi.ControllerExpandVolumeResponse
+		expectedErr error
+	}{
+		{
+			desc:        "Volume ID missing",
+			req:         &csi.ControllerExpandVolumeRequest{},
+			expectedErr: status.Error(codes.InvalidArgument, "Volume ID missing in request"),
+		},
+		{
+			desc: "Capacity Range missing",
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId: "vol_1",
+			},
+			expectedErr: status.Error(codes.InvalidArgument, "Capacity Range missing in request"),
+		},
+		{
+			desc: "Invalid volume ID",
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId:      "vol_1",
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 10000},
+			},
+			expectedErr: status.Errorf(codes.NotFound, "failed to get nfs volume from volume id %s: %v", "vol_1", fmt.Errorf("could not split %s into server, baseDir and subDir with separator(%s)", "vol_1", "/")),
+		},
+		{
+			desc: "Valid request",
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId:      newTestVolumeID,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 10000},
+			},
+			expResp: &csi.ControllerExpandVolumeResponse{CapacityBytes: 10000},
+		},
+		{
+			desc: "Block volume",
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId:         newTestVolumeID,
+				CapacityRange:    &csi.CapacityRange{RequiredBytes: 10000},
+				VolumeCapability: &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}},
+			},
+			expectedErr: status.Error(codes.InvalidArgument, "expansion of block volume is not supported"),
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.desc, func(t *testing.T) {
+			cs := initTestController(t)
+			resp, err := cs.ControllerExpandVolume(context.TODO(), test.req)
+			if !reflect.DeepEqual(err, test.expectedErr) {
+				t.Errorf("[test: %s] unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+			}
+			if !reflect.DeepEqual(resp, test.expResp) {
+				t.Errorf("[test: %s] got resp %+v, expected %+v", test.desc, resp, test.expResp)
+			}
+		})
+	}
+}
+
+func TestControllerGetVolume(t *testing.T) {
+	cases := []struct {
+		desc              string
+		volumeID          string
+		createSubDir      bool
+		expectedCondition *csi.VolumeCondition
+		expectedErr       error
+	}{
+		{
+			desc:        "Volume ID missing",
+			expectedErr: status.Error(codes.InvalidArgument, "Volume ID missing in request"),
+		},
+		{
+			desc:        "Invalid volume ID",
+			volumeID:    "vol_1",
+			expectedErr: status.Errorf(codes.NotFound, "failed to get nfs volume from volume id %s: %v", "vol_1", fmt.Errorf("could not split %s into server, baseDir and subDir with separator(%s)", "vol_1", "/")),
+		},
+		{
+			desc:              "subdirectory exists",
+			volumeID:          newTestVolumeWithVolumeID,
+			createSubDir:      true,
+			expectedCondition: &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"},
+		},
+		{
+			desc:              "subdirectory does not exist",
+			volumeID:          newTestVolumeWithVolumeID,
+			expectedCondition: &csi.VolumeCondition{Abnormal: true, Message: "subdirectory volume-name does not exist on nfs server test-server:test-base-dir"},
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.desc, func(t *testing.T) {
+			cs := initTestController(t)
+			cs.Driver.workingMountDir = t.TempDir()
+			if test.createSubDir {
+				if err := os.MkdirAll(filepath.Join(cs.Driver.workingMountDir, "volume-condition-volume-name", testCSIVolume), 0777); err != nil {
+					t.Fatal(err)
+				}
+			}
+			resp, err := cs.ControllerGetVolume(context.TODO(), &csi.ControllerGetVolumeRequest{VolumeId: test.volumeID})
+			if !reflect.DeepEqual(err, test.expectedErr) {
+				t.Errorf("[test: %s] unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+			}
+			if err == nil {
+				assert.Equal(t, test.volumeID, resp.GetVolume().GetVolumeId(), test.desc)
+				assert.Equal(t, test.expectedCondition, resp.GetStatus().GetVolumeCondition(), test.desc)
+				assert.NotNil(t, cs.Driver.volumes.get(test.volumeID), test.desc)
+			}
+		})
+	}
+}
+
+func TestListVolumes(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.workingMountDir = t.TempDir()
+	volumeIDs := []string{
+		"test-server#test-base-dir#volume-1#volume-1#",
+		"test-server#test-base-dir#volume-2#volume-2#",
+		"test-server#test-base-dir#volume-3#volume-3#",
+	}
+	for _, id := range volumeIDs {
+		vol, err := getNfsVolFromID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs.Driver.volumes.add(vol)
+	}
+	// only volume-1 and volume-2 exist, the share is mounted at the mount path of the first volume
+	for _, subDir := range []string{"volume-1", "volume-2"} {
+		if err := os.MkdirAll(filepath.Join(cs.Driver.workingMountDir, "volume-condition-volume-1", subDir), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := cs.ListVolumes(context.TODO(), &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, resp.GetEntries(), 3)
+	assert.Empty(t, resp.GetNextToken())
+	for i, entry := range resp.GetEntries() {
+		assert.Equal(t, volumeIDs[i], entry.GetVolume().GetVolumeId())
+		assert.Equal(t, i == 2, entry.GetStatus().GetVolumeCondition().GetAbnormal(), volumeIDs[i])
+	}
+
+	resp, err = cs.ListVolumes(context.TODO(), &csi.ListVolumesRequest{MaxEntries: 2})
+	assert.NoError(t, err)
+	assert.Len(t, resp.GetEntries(), 2)
+	assert.Equal(t, "2", resp.GetNextToken())
+
+	resp, err = cs.ListVolumes(context.TODO(), &csi.ListVolumesRequest{StartingToken: "2"})
+	assert.NoError(t, err)
+	assert.Len(t, resp.GetEntries(), 1)
+	assert.Equal(t, volumeIDs[2], resp.GetEntries()[0].GetVolume().GetVolumeId())
+
+	_, err = cs.ListVolumes(context.TODO(), &csi.ListVolumesRequest{StartingToken: "4"})
+	assert.Equal(t, status.Errorf(codes.Aborted, "starting token %d is greater than total number of volumes %d", 4, 3), err)
+
+	_, err = cs.ListVolumes(context.TODO(), &csi.ListVolumesRequest{StartingToken: "invalid"})
+	assert.Equal(t, status.Errorf(codes.Aborted, "invalid starting token %q", "invalid"), err)
+}
+
+func TestSyncProvisionedVolumes(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.name = DefaultDriverName
+	cs.Driver.volumes.setSynced(false)
+	_, err := cs.ListVolumes(context.TODO(), &csi.ListVolumesRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	provisioned := func(pv v1.PersistentVolume) v1.PersistentVolume {
+		pv.Annotations = map[string]string{provisionedByAnnotation: DefaultDriverName}
+		pv.Spec.Capacity = v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")}
+		return pv
+	}
+	lister := &fakeKubeResourceClient{pvs: []v1.PersistentVolume{
+		provisioned(newTestPV("pvc-1", "server#share#pvc-1#pvc-1#")),
+		provisioned(newTestPV("pvc-2", "server#share#pvc-2#pvc-2#")),
+		provisioned(newTestPV("pvc-3", "server#share#pvc-3#pvc-3#", withDriver("other.csi.k8s.io"))),
+		provisioned(newTestPV("pvc-4", "invalid")),
+		newTestPV("static", "server#share#static#static#"),
+	}}
+	synced, err := cs.syncProvisionedVolumes(context.TODO(), lister, map[string]bool{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"server#share#pvc-1#pvc-1#": true, "server#share#pvc-2#pvc-2#": true}, synced)
+	assert.True(t, cs.Driver.volumes.synced())
+	assert.Equal(t, int64(1<<30), cs.Driver.volumes.get("server#share#pvc-1#pvc-1#").size)
+
+	// volume created after pvs are listed is kept, volume whose pv is deleted is removed
+	vol, err := getNfsVolFromID("server#share#pvc-5#pvc-5#")
+	assert.NoError(t, err)
+	cs.Driver.volumes.add(vol)
+	lister.pvs = lister.pvs[1:]
+	synced, err = cs.syncProvisionedVolumes(context.TODO(), lister, synced)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"server#share#pvc-2#pvc-2#": true}, synced)
+	assert.Nil(t, cs.Driver.volumes.get("server#share#pvc-1#pvc-1#"))
+	assert.NotNil(t, cs.Driver.volumes.get("server#share#pvc-5#pvc-5#"))
+
+	// list volumes capabilities are only advertised if the registry is rebuilt from pvs
+	resp, err := cs.ControllerGetCapabilities(context.TODO(), &csi.ControllerGetCapabilitiesRequest{})
+	assert.NoError(t, err)
+	for _, c := range resp.GetCapabilities() {
+		assert.NotEqual(t, csi.ControllerServiceCapability_RPC_LIST_VOLUMES, c.GetRpc().GetType())
+	}
+}
+
+func TestGetCapacity(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.workingMountDir = t.TempDir()
+
+	_, err := cs.GetCapacity(context.TODO(), &csi.GetCapacityRequest{Parameters: map[string]string{paramShare: testBaseDir}})
+	assert.Equal(t, status.Errorf(codes.InvalidArgument, "%v is a required parameter", paramServer), err)
+
+	resp, err := cs.GetCapacity(context.TODO(), &csi.GetCapacityRequest{
+		Parameters: map[string]string{paramServer: testServer, paramShare: testBaseDir, mountOptionsField: "nfsvers=4.1", paramSubDir: "subdir"},
+	})
+	assert.NoError(t, err)
+	assert.Greater(t, resp.GetAvailableCapacity(), int64(0))
+
+	// server of the zone in serverMap is mounted
+	mounter := cs.Driver.ns.mounter.(*mount.FakeMounter)
+	mounter.ResetLog()
+	_, err = cs.GetCapacity(context.TODO(), &csi.GetCapacityRequest{
+		Parameters:         map[string]string{paramServerMap: "zone-a=server-a;zone-b=server-b", paramShare: testBaseDir},
+		AccessibleTopology: &csi.Topology{Segments: map[string]string{topologyKeyZone: "zone-b"}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "server-b:/"+testBaseDir, mounter.GetLog()[0].Source)
+
+	// provisioner secret could not be read without kube client
+	_, err = cs.GetCapacity(context.TODO(), &csi.GetCapacityRequest{
+		Parameters: map[string]string{paramShare: testBaseDir, provisionerSecretNameKey: "nfs-secret", provisionerSecretNSKey: "default"},
+	})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = cs.GetCapacity(context.TODO(), &csi.GetCapacityRequest{
+		Parameters: map[string]string{paramShare: testBaseDir, provisionerSecretNameKey: "${pvc.name}", provisionerSecretNSKey: "default"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// calls of the same share are not aborted by each other
+	shareID := getVolumeIDFromNfsVol(&nfsVolume{server: testServer, baseDir: testBaseDir})
+	assert.True(t, cs.Driver.volumeLocks.TryAcquire(shareID))
+	defer cs.Driver.volumeLocks.Release(shareID)
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cs.GetCapacity(context.TODO(), &csi.GetCapacityRequest{Parameters: map[string]string{paramServer: testServer, paramShare: testBaseDir}})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+}
+
+func TestVolumeOperationInProgress(t *testing.T) {
+	cs := initTestController(t)
+	capacityRange := &csi.CapacityRange{RequiredBytes: 10000}
+
+	cases := []struct {
+		desc    string
+		lockKey string
+		call    func() error
+	}{
+		{
+			desc:    "CreateVolume",
+			lockKey: testCSIVolume,
+			call: func() error {
+				_, err := cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+					Name: testCSIVolume,
+					VolumeCapabilities: []*csi.VolumeCapability{
+						{
+							AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+							AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+						},
+					},
+					Parameters: map[string]string{paramServer: testServer, paramShare: testBaseDir},
+				})
+				return err
+			},
+		},
+		{
+			desc:    "DeleteVolume",
+			lockKey: newTestVolumeID,
+			call: func() error {
+				_, err := cs.DeleteVolume(context.TODO(), &csi.DeleteVolumeRequest{VolumeId: newTestVolumeID})
+				return err
+			},
+		},
+		{
+			desc:    "ControllerExpandVolume",
+			lockKey: newTestVolumeID,
+			call: func() error {
+				_, err := cs.ControllerExpandVolume(context.TODO(), &csi.ControllerExpandVolumeRequest{VolumeId: newTestVolumeID, CapacityRange: capacityRange})
+				return err
+			},
+		},
+	}
+
+	for _, test := range cases {
+		if !cs.Driver.volumeLocks.TryAcquire(test.lockKey) {
+			t.Fatalf("[test: %s] failed to acquire lock of %s", test.desc, test.lockKey)
+		}
+		expectedErr := status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, test.lockKey)
+		if err := test.call(); !reflect.DeepEqual(err, expectedErr) {
+			t.Errorf("[test: %s] unexpected error: %v, expected error: %v", test.desc, err, expectedErr)
+		}
+		cs.Driver.volumeLocks.Release(test.lockKey)
+	}
+}
+
 func matchCreateSnapshotResponse(e, r *csi.CreateSnapshotResponse) error {
 	if e == nil && r == nil {
 		return nil
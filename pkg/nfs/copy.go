@@ -0,0 +1,247 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// number of files copied concurrently when cloning a volume
+	defaultCopyParallelism = 8
+	// interval of copy progress logging
+	copyProgressInterval = 30 * time.Second
+)
+
+// errServerSideCopyNotSupported is returned by copyFileRange if file system of the files does not support it
+var errServerSideCopyNotSupported = errors.New("server-side copy is not supported")
+
+// canCopyOnServer returns true if src and dst volumes are in the same export mounted with NFSv4.2 or later,
+// data copied between them by copy_file_range is copied by COPY operation on nfs server
+func canCopyOnServer(srcVol, dstVol *nfsVolume, srcMountPath, dstMountPath string) bool {
+	if strings.Trim(srcVol.server, "/") != strings.Trim(dstVol.server, "/") || strings.Trim(srcVol.baseDir, "/") != strings.Trim(dstVol.baseDir, "/") {
+		return false
+	}
+	return supportsServerSideCopy(srcMountPath) && supportsServerSideCopy(dstMountPath)
+}
+
+// copyProgress records the progress of a directory copy
+type copyProgress struct {
+	files int64
+	bytes int64
+}
+
+// copyDir copies the content of srcDir into dstDir, at most parallelism files are copied concurrently.
+// Directories, regular files and symlinks are copied with their mode, ownership and modification time preserved.
+// Data copied by all files is throttled by limiter if it's not nil.
+// Files are copied by copy_file_range if serverSide is true, it falls back to copy through the controller
+// for files which could not be copied on server.
+func copyDir(ctx context.Context, srcDir, dstDir string, parallelism int, limiter *rate.Limiter, serverSide bool) error {
+	logger := klog.FromContext(ctx)
+	if parallelism <= 0 {
+		parallelism = defaultCopyParallelism
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	progress := &copyProgress{}
+	start := time.Now()
+	go func() {
+		ticker := time.NewTicker(copyProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				logger.V(2).Info("copying directory", "srcDir", srcDir, "dstDir", dstDir,
+					"files", atomic.LoadInt64(&progress.files), "bytes", atomic.LoadInt64(&progress.bytes), "elapsed", time.Since(start).Round(time.Second))
+			}
+		}
+	}()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	setErr := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+	files := make(chan string)
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rel := range files {
+				n, err := copyFile(ctx, filepath.Join(srcDir, rel), filepath.Join(dstDir, rel), limiter, serverSide)
+				if err != nil {
+					setErr(err)
+					continue
+				}
+				atomic.AddInt64(&progress.files, 1)
+				atomic.AddInt64(&progress.bytes, n)
+			}
+		}()
+	}
+
+	// directory attributes are applied after all files are copied since copying files changes directory modification time
+	var dirs []string
+	walkErr := filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(dstDir, rel)
+		switch {
+		case d.IsDir():
+			if err := os.MkdirAll(dst, 0777); err != nil {
+				return err
+			}
+			dirs = append(dirs, rel)
+		case d.Type()&fs.ModeSymlink != 0:
+			if err := copySymlink(ctx, path, dst); err != nil {
+				return err
+			}
+		case d.Type().IsRegular():
+			select {
+			case files <- rel:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		default:
+			logger.Info("skip copying since file type is not supported", "path", path, "type", d.Type())
+		}
+		return nil
+	})
+	close(files)
+	wg.Wait()
+	if walkErr != nil {
+		setErr(walkErr)
+	}
+	if firstErr != nil {
+		return fmt.Errorf("failed to copy %s to %s: %w", srcDir, dstDir, firstErr)
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		fi, err := os.Lstat(filepath.Join(srcDir, dirs[i]))
+		if err != nil {
+			return err
+		}
+		if err := copyAttributes(ctx, filepath.Join(dstDir, dirs[i]), fi); err != nil {
+			return err
+		}
+	}
+	logger.V(2).Info("copied directory", "srcDir", srcDir, "dstDir", dstDir, "files", progress.files, "bytes", progress.bytes, "elapsed", time.Since(start).Round(time.Second), "serverSide", serverSide)
+	return nil
+}
+
+// copyFile copies a regular file and returns the number of bytes copied
+func copyFile(ctx context.Context, src, dst string, limiter *rate.Limiter, serverSide bool) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+	n, err := copyFileData(ctx, out, in, fi.Size(), limiter, serverSide)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, copyAttributes(ctx, dst, fi)
+}
+
+// copyFileData copies size bytes of in to out, data is copied on server if serverSide is true,
+// it falls back to copy through the controller if server-side copy is not supported
+func copyFileData(ctx context.Context, out, in *os.File, size int64, limiter *rate.Limiter, serverSide bool) (int64, error) {
+	if serverSide {
+		n, err := copyFileRange(ctx, out, in, 0, size, limiter)
+		if !errors.Is(err, errServerSideCopyNotSupported) {
+			return n, err
+		}
+		klog.FromContext(ctx).V(4).Info("server-side copy is not supported, copying through the controller", "path", in.Name())
+	}
+	return io.Copy(out, newRateLimitedReader(ctx, in, limiter))
+}
+
+// copySymlink recreates the symlink src at dst
+func copySymlink(ctx context.Context, src, dst string) error {
+	link, err := os.Readlink(src)
+	if err != nil {
+		return err
+	}
+	if err := os.Symlink(link, dst); err != nil {
+		return err
+	}
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if uid, gid, ok := getFileOwner(fi); ok {
+		if err := os.Lchown(dst, uid, gid); err != nil {
+			klog.FromContext(ctx).Info("failed to preserve ownership", "path", dst, "err", err)
+		}
+	}
+	return nil
+}
+
+// copyAttributes applies mode, ownership and modification time of fi on path
+func copyAttributes(ctx context.Context, path string, fi os.FileInfo) error {
+	if uid, gid, ok := getFileOwner(fi); ok {
+		// ownership could not be preserved on nfs share with root squash, it's not fatal
+		if err := os.Lchown(path, uid, gid); err != nil {
+			klog.FromContext(ctx).Info("failed to preserve ownership", "path", path, "err", err)
+		}
+	}
+	if err := os.Chmod(path, fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(path, fi.ModTime(), fi.ModTime())
+}
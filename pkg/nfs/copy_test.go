@@ -0,0 +1,124 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestCopyDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip on windows")
+	}
+	mtime := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	prepare := func(t *testing.T, src string) {
+		if err := os.MkdirAll(filepath.Join(src, "dir", "nested"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(src, "file"), []byte("file"), 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(src, "dir", "nested", "file"), []byte("nested file"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("dir/nested/file", filepath.Join(src, "link")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(filepath.Join(src, "dir"), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(src, "dir"), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(src, "file"), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		desc        string
+		parallelism int
+		serverSide  bool
+		missingSrc  bool
+		expectErr   bool
+	}{
+		{
+			desc:        "copy with default parallelism",
+			parallelism: 0,
+		},
+		{
+			desc:        "copy with single worker",
+			parallelism: 1,
+		},
+		{
+			desc:        "copy with more workers than files",
+			parallelism: 16,
+		},
+		{
+			desc:       "copy with server-side copy",
+			serverSide: true,
+		},
+		{
+			desc:       "copy from nonexisting source",
+			missingSrc: true,
+			expectErr:  true,
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.desc, func(t *testing.T) {
+			src := filepath.Join(t.TempDir(), "src")
+			dst := t.TempDir()
+			if !test.missingSrc {
+				prepare(t, src)
+			}
+
+			err := copyDir(context.TODO(), src, dst, test.parallelism, nil, test.serverSide)
+			if (err != nil) != test.expectErr {
+				t.Fatalf("unexpected error: %v, expected error: %v", err, test.expectErr)
+			}
+			if test.expectErr {
+				return
+			}
+
+			content, err := os.ReadFile(filepath.Join(dst, "dir", "nested", "file"))
+			assert.NoError(t, err)
+			assert.Equal(t, "nested file", string(content))
+
+			fi, err := os.Stat(filepath.Join(dst, "file"))
+			assert.NoError(t, err)
+			assert.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+			assert.True(t, mtime.Equal(fi.ModTime()))
+
+			fi, err = os.Stat(filepath.Join(dst, "dir"))
+			assert.NoError(t, err)
+			assert.Equal(t, os.FileMode(0750), fi.Mode().Perm())
+			assert.True(t, mtime.Equal(fi.ModTime()))
+
+			link, err := os.Readlink(filepath.Join(dst, "link"))
+			assert.NoError(t, err)
+			assert.Equal(t, "dir/nested/file", link)
+		})
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DefaultKataDirectVolumeRootPath is the default root directory of kata direct volumes, kata runtime looks up
+	// the mount info of a volume under {root}/{base64 url encoded volume path}/mountInfo.json
+	DefaultKataDirectVolumeRootPath = "/run/kata-containers/shared/direct-volumes"
+	kataMountInfoFileName           = "mountInfo.json"
+	// volume context keys with this prefix are passed to kata agent as metadata of direct volume, prefix is trimmed
+	kataMetadataPrefix = "katametadata/"
+)
+
+// kataMountInfo is the mount info of kata direct volume, kata agent mounts the volume in the guest with it
+type kataMountInfo struct {
+	VolumeType string            `json:"volume-type"`
+	Device     string            `json:"device"`
+	FsType     string            `json:"fstype"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	Options    []string          `json:"options,omitempty"`
+}
+
+func getDirectVolumeDir(rootPath, volumePath string) string {
+	return filepath.Join(rootPath, base64.URLEncoding.EncodeToString([]byte(volumePath)))
+}
+
+// addDirectVolume registers mountInfo of volumePath as kata direct volume
+func addDirectVolume(ctx context.Context, rootPath, volumePath string, mountInfo *kataMountInfo) error {
+	if err := validateMountInfo(mountInfo); err != nil {
+		return err
+	}
+	dir := getDirectVolumeDir(rootPath, volumePath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	content, err := json.Marshal(mountInfo)
+	if err != nil {
+		return err
+	}
+	klog.FromContext(ctx).V(2).Info("adding kata direct volume", "volumePath", volumePath, "mountInfo", string(content))
+	return os.WriteFile(filepath.Join(dir, kataMountInfoFileName), content, 0600)
+}
+
+// getDirectVolume returns mount info of kata direct volume registered on volumePath
+func getDirectVolume(rootPath, volumePath string) (*kataMountInfo, error) {
+	content, err := os.ReadFile(filepath.Join(getDirectVolumeDir(rootPath, volumePath), kataMountInfoFileName))
+	if err != nil {
+		return nil, err
+	}
+	mountInfo := &kataMountInfo{}
+	if err := json.Unmarshal(content, mountInfo); err != nil {
+		return nil, fmt.Errorf("failed to parse mount info of kata direct volume %s: %v", volumePath, err)
+	}
+	return mountInfo, nil
+}
+
+// listDirectVolumes returns volume paths of all kata direct volumes under rootPath,
+// entries whose directory name is not a base64 url encoded path are skipped
+func listDirectVolumes(ctx context.Context, rootPath string) ([]string, error) {
+	entries, err := os.ReadDir(rootPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var volumePaths []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		volumePath, err := base64.URLEncoding.DecodeString(entry.Name())
+		if err != nil {
+			klog.FromContext(ctx).Info("skip invalid kata direct volume entry", "entry", entry.Name(), "err", err)
+			continue
+		}
+		volumePaths = append(volumePaths, string(volumePath))
+	}
+	return volumePaths, nil
+}
+
+// validateMountInfo checks whether mountInfo could be used by kata agent to mount the nfs share
+func validateMountInfo(mountInfo *kataMountInfo) error {
+	if mountInfo == nil {
+		return fmt.Errorf("mount info is nil")
+	}
+	if mountInfo.VolumeType == "" {
+		return fmt.Errorf("volume-type is empty in mount info")
+	}
+	// raw block device is passed to the guest without filesystem
+	if mountInfo.FsType == "" && mountInfo.VolumeType != kataVolumeTypeBlock {
+		return fmt.Errorf("fstype is empty in mount info")
+	}
+	if mountInfo.FsType == fsTypeNFS || mountInfo.FsType == fsTypeNFS4 {
+		if server, path, found := strings.Cut(mountInfo.Device, ":"); !found || server == "" || path == "" {
+			return fmt.Errorf("device %q in mount info is not in format of {server}:{path}", mountInfo.Device)
+		}
+	} else if mountInfo.Device == "" {
+		return fmt.Errorf("device is empty in mount info")
+	}
+	for _, option := range mountInfo.Options {
+		if option == "" || strings.Contains(option, ",") {
+			return fmt.Errorf("invalid option %q in mount info", option)
+		}
+	}
+	return nil
+}
+
+// removeDirectVolume removes the kata direct volume of volumePath, it's no-op if the volume is not registered
+func removeDirectVolume(ctx context.Context, rootPath, volumePath string) error {
+	dir := getDirectVolumeDir(rootPath, volumePath)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	klog.FromContext(ctx).V(2).Info("removing kata direct volume", "volumePath", volumePath)
+	return os.RemoveAll(dir)
+}
+
+// splitMountOptions splits comma separated mount options, e.g. ["nfsvers=4.1,hard", "ro"] -> ["nfsvers=4.1", "hard", "ro"]
+func splitMountOptions(mountOptions []string) []string {
+	var options []string
+	for _, o := range mountOptions {
+		for _, option := range strings.Split(o, ",") {
+			if option = strings.TrimSpace(option); option != "" {
+				options = append(options, option)
+			}
+		}
+	}
+	return options
+}
+
+// publishDirectVolume registers the nfs share as kata direct volume on targetPath instead of mounting it on host,
+// kata agent mounts the share in the guest with mountOptions. The registered mount info is returned.
+func (ns *NodeServer) publishDirectVolume(ctx context.Context, volumeID, source, targetPath, fsType string, mountOptions []string, metadata map[string]string, mountPermissions uint64) (*kataMountInfo, error) {
+	if err := os.MkdirAll(targetPath, os.FileMode(mountPermissions)); err != nil {
+		return nil, err
+	}
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	metadata["volumeID"] = volumeID
+	mountInfo := &kataMountInfo{
+		VolumeType: "nfs",
+		Device:     source,
+		FsType:     fsType,
+		Metadata:   metadata,
+		Options:    splitMountOptions(mountOptions),
+	}
+	if err := addDirectVolume(ctx, ns.Driver.kataDirectVolumeRootPath, targetPath, mountInfo); err != nil {
+		return nil, err
+	}
+	return mountInfo, nil
+}
+
+// runDirectVolumeGC removes orphaned kata direct volumes on start and every interval until ctx is done
+func (ns *NodeServer) runDirectVolumeGC(ctx context.Context, interval time.Duration) {
+	logger := klog.FromContext(ctx).WithName("kata-direct-volume-gc")
+	ctx = klog.NewContext(ctx, logger)
+	logger.V(2).Info("removing orphaned kata direct volumes", "rootPath", ns.Driver.kataDirectVolumeRootPath, "interval", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := gcDirectVolumes(ctx, ns.Driver.kataDirectVolumeRootPath); err != nil {
+			logger.Error(err, "failed to remove orphaned kata direct volumes")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// gcDirectVolumes removes kata direct volumes whose volume path does not exist, e.g. left by node crash.
+// Volume path is the target path under pod directory, it's removed by kubelet after pod is gone.
+func gcDirectVolumes(ctx context.Context, rootPath string) error {
+	logger := klog.FromContext(ctx)
+	volumePaths, err := listDirectVolumes(ctx, rootPath)
+	if err != nil {
+		return err
+	}
+	for _, volumePath := range volumePaths {
+		if _, err := os.Stat(volumePath); !os.IsNotExist(err) {
+			continue
+		}
+		logger.V(2).Info("kata direct volume is orphaned since volume path does not exist", "volumePath", volumePath)
+		if err := removeDirectVolume(ctx, rootPath, volumePath); err != nil {
+			logger.Error(err, "failed to remove orphaned kata direct volume", "volumePath", volumePath)
+		}
+	}
+	return nil
+}
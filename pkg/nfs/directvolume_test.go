@@ -0,0 +1,176 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestSplitMountOptions(t *testing.T) {
+	tests := []struct {
+		mountOptions []string
+		expected     []string
+	}{
+		{
+			mountOptions: nil,
+			expected:     nil,
+		},
+		{
+			mountOptions: []string{"nfsvers=4.1,proto=tcp", "ro"},
+			expected:     []string{"nfsvers=4.1", "proto=tcp", "ro"},
+		},
+		{
+			mountOptions: []string{"rsize=1048576, wsize=1048576,", ""},
+			expected:     []string{"rsize=1048576", "wsize=1048576"},
+		},
+	}
+
+	for _, test := range tests {
+		result := splitMountOptions(test.mountOptions)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("splitMountOptions(%v) = %v, expected: %v", test.mountOptions, result, test.expected)
+		}
+	}
+}
+
+func TestPublishKataDirectVolume(t *testing.T) {
+	ns, err := getTestNodeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.Driver.kataDirectVolumeRootPath = t.TempDir()
+	targetPath := filepath.Join(t.TempDir(), "target")
+	volCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"nfsvers=4.1,proto=tcp"}}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+	_, err = ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "vol_1",
+		TargetPath:       targetPath,
+		VolumeCapability: volCap,
+		VolumeContext: map[string]string{
+			"server":                "server",
+			"share":                 "share",
+			"subDir":                "subdir",
+			mountOptionsField:       "wsize=1048576",
+			paramKataDirectVolume:   "true",
+			"kataMetadata/tenantID": "tenant",
+		},
+	})
+	assert.NoError(t, err)
+
+	mountInfo, err := getDirectVolume(ns.Driver.kataDirectVolumeRootPath, targetPath)
+	assert.NoError(t, err)
+	expected := &kataMountInfo{
+		VolumeType: "nfs",
+		Device:     "server:share/subdir",
+		FsType:     "nfs",
+		Metadata:   map[string]string{"tenantID": "tenant", "volumeID": "vol_1"},
+		Options:    []string{"nfsvers=4.1", "proto=tcp", "wsize=1048576"},
+	}
+	assert.Equal(t, expected, mountInfo)
+
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol_1", TargetPath: targetPath})
+	assert.NoError(t, err)
+	_, err = os.Stat(getDirectVolumeDir(ns.Driver.kataDirectVolumeRootPath, targetPath))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestListDirectVolumes(t *testing.T) {
+	rootPath := t.TempDir()
+	volumePaths, err := listDirectVolumes(context.TODO(), filepath.Join(rootPath, "not-exist"))
+	assert.NoError(t, err)
+	assert.Empty(t, volumePaths)
+
+	mountInfo := &kataMountInfo{VolumeType: "nfs", Device: "server:/share", FsType: "nfs"}
+	for _, volumePath := range []string{"/var/lib/kubelet/pods/pod1/volumes/vol1/mount", "/var/lib/kubelet/pods/pod2/volumes/vol2/mount"} {
+		assert.NoError(t, addDirectVolume(context.TODO(), rootPath, volumePath, mountInfo))
+	}
+	// not a base64 url encoded path
+	assert.NoError(t, os.MkdirAll(filepath.Join(rootPath, "invalid!"), 0700))
+
+	volumePaths, err = listDirectVolumes(context.TODO(), rootPath)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"/var/lib/kubelet/pods/pod1/volumes/vol1/mount", "/var/lib/kubelet/pods/pod2/volumes/vol2/mount"}, volumePaths)
+}
+
+func TestValidateMountInfo(t *testing.T) {
+	tests := []struct {
+		desc        string
+		mountInfo   *kataMountInfo
+		expectedErr error
+	}{
+		{
+			desc:      "valid mount info",
+			mountInfo: &kataMountInfo{VolumeType: "nfs", Device: "server:/share", FsType: "nfs", Options: []string{"nfsvers=4.1"}},
+		},
+		{
+			desc:        "nil mount info",
+			expectedErr: fmt.Errorf("mount info is nil"),
+		},
+		{
+			desc:        "empty volume type",
+			mountInfo:   &kataMountInfo{Device: "server:/share", FsType: "nfs"},
+			expectedErr: fmt.Errorf("volume-type is empty in mount info"),
+		},
+		{
+			desc:        "empty fstype",
+			mountInfo:   &kataMountInfo{VolumeType: "nfs", Device: "server:/share"},
+			expectedErr: fmt.Errorf("fstype is empty in mount info"),
+		},
+		{
+			desc:        "invalid nfs device",
+			mountInfo:   &kataMountInfo{VolumeType: "nfs", Device: "server", FsType: "nfs"},
+			expectedErr: fmt.Errorf("device \"server\" in mount info is not in format of {server}:{path}"),
+		},
+		{
+			desc:        "comma separated option",
+			mountInfo:   &kataMountInfo{VolumeType: "nfs", Device: "server:/share", FsType: "nfs", Options: []string{"nfsvers=4.1,hard"}},
+			expectedErr: fmt.Errorf("invalid option \"nfsvers=4.1,hard\" in mount info"),
+		},
+	}
+
+	for _, test := range tests {
+		err := validateMountInfo(test.mountInfo)
+		assert.Equal(t, test.expectedErr, err, test.desc)
+	}
+}
+
+func TestGCDirectVolumes(t *testing.T) {
+	rootPath := t.TempDir()
+	existingPath := filepath.Join(t.TempDir(), "target")
+	assert.NoError(t, os.MkdirAll(existingPath, 0755))
+	orphanedPath := filepath.Join(t.TempDir(), "orphaned")
+
+	mountInfo := &kataMountInfo{VolumeType: "nfs", Device: "server:/share", FsType: "nfs"}
+	for _, volumePath := range []string{existingPath, orphanedPath} {
+		assert.NoError(t, addDirectVolume(context.TODO(), rootPath, volumePath, mountInfo))
+	}
+
+	assert.NoError(t, gcDirectVolumes(context.TODO(), rootPath))
+	volumePaths, err := listDirectVolumes(context.TODO(), rootPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{existingPath}, volumePaths)
+}
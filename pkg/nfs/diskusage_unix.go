@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// getFileDiskUsage returns bytes allocated by the file and its id, the id is only meaningful if the file has hard links
+func getFileDiskUsage(fi os.FileInfo) (int64, fileID, bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.Size(), fileID{}, false
+	}
+	return int64(stat.Blocks) * 512, fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, !fi.IsDir() && stat.Nlink > 1
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/apimachinery/pkg/util/sets"
+	mount "k8s.io/mount-utils"
+)
+
+const (
+	// DefaultDoctorTimeout is the time to wait for each stat on mount point and dial in doctor checks
+	DefaultDoctorTimeout = 5 * time.Second
+	rpcbindPort          = "111"
+)
+
+// DoctorOptions are options of the doctor subcommand
+type DoctorOptions struct {
+	// nfs servers checked in addition to servers of volumes on the node
+	Servers                  []string
+	NodeStateFile            string
+	KataDirectVolumeRootPath string
+	Timeout                  time.Duration
+}
+
+// nfsClientTools are executables of nfs client packages used by node plugin, missing optional tools are reported as warnings
+var nfsClientTools = []struct {
+	name     string
+	required bool
+	usage    string
+}{
+	{name: "mount.nfs", required: true, usage: "mount nfs shares"},
+	{name: "rpcbind", usage: "NFSv3 mounts"},
+	{name: "rpc.statd", usage: "file locking of NFSv3 mounts"},
+	{name: "rpc.gssd", usage: "kerberos mounts"},
+	{name: "gocryptfs", usage: "encrypted volumes"},
+}
+
+// doctor runs diagnostic checks and writes results to w, could be customized in unit tests
+type doctor struct {
+	opts       *DoctorOptions
+	w          io.Writer
+	failures   int
+	sections   int
+	lookPath   func(file string) (string, error)
+	dialTCP    func(ctx context.Context, address string, timeout time.Duration) error
+	listMounts func() (map[string]string, error)
+}
+
+// RunDoctor checks nfs client tools, reachability of nfs servers, nfs mounts and kata direct volumes on the node,
+// it's run in node pod by `nfsplugin doctor`. Error is returned if any check fails, warnings are only reported.
+func RunDoctor(ctx context.Context, w io.Writer, opts *DoctorOptions) error {
+	d := &doctor{
+		opts:       opts,
+		w:          w,
+		lookPath:   exec.LookPath,
+		dialTCP:    dialTCP,
+		listMounts: listNFSMounts,
+	}
+	return d.run(ctx)
+}
+
+func dialTCP(ctx context.Context, address string, timeout time.Duration) error {
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (d *doctor) ok(format string, args ...interface{}) {
+	fmt.Fprintf(d.w, "[OK]   "+format+"\n", args...)
+}
+
+func (d *doctor) warn(format string, args ...interface{}) {
+	fmt.Fprintf(d.w, "[WARN] "+format+"\n", args...)
+}
+
+func (d *doctor) fail(format string, args ...interface{}) {
+	d.failures++
+	fmt.Fprintf(d.w, "[FAIL] "+format+"\n", args...)
+}
+
+func (d *doctor) section(title string) {
+	if d.sections > 0 {
+		fmt.Fprintln(d.w)
+	}
+	d.sections++
+	fmt.Fprintf(d.w, "== %s\n", title)
+}
+
+func (d *doctor) run(ctx context.Context) error {
+	if d.opts.Timeout <= 0 {
+		d.opts.Timeout = DefaultDoctorTimeout
+	}
+	var volumes []nodeVolume
+	if state := newNodeState(d.opts.NodeStateFile); state != nil {
+		if err := state.load(); err != nil {
+			d.warn("failed to load node state file %s: %v", d.opts.NodeStateFile, err)
+		}
+		volumes = state.list()
+	}
+	mounts, listErr := d.listMounts()
+
+	d.checkClientTools(ctx)
+	d.checkServers(ctx, volumes, mounts)
+	d.checkMounts(volumes, mounts, listErr)
+	d.dumpDirectVolumes(ctx)
+
+	if d.failures > 0 {
+		return fmt.Errorf("%d checks failed", d.failures)
+	}
+	return nil
+}
+
+func (d *doctor) checkClientTools(ctx context.Context) {
+	d.section("nfs client")
+	for _, tool := range nfsClientTools {
+		path, err := d.lookPath(tool.name)
+		switch {
+		case err == nil:
+			d.ok("%s is installed at %s", tool.name, path)
+		case tool.required:
+			d.fail("%s is not found, it's required to %s, install nfs-common(debian) or nfs-utils(rhel) in node plugin image", tool.name, tool.usage)
+		default:
+			d.warn("%s is not found, it's required by %s", tool.name, tool.usage)
+		}
+	}
+	if err := d.dialTCP(ctx, net.JoinHostPort("127.0.0.1", rpcbindPort), d.opts.Timeout); err != nil {
+		d.warn("rpcbind is not running on the node, it's required by NFSv3 mounts: %v", err)
+	} else {
+		d.ok("rpcbind is running on the node")
+	}
+}
+
+// checkServers dials nfs port of servers in options, node state file and mount table
+func (d *doctor) checkServers(ctx context.Context, volumes []nodeVolume, mounts map[string]string) {
+	d.section("nfs servers")
+	servers := sets.NewString() //nolint:staticcheck
+	for _, server := range d.opts.Servers {
+		servers.Insert(getServerList(server)...)
+	}
+	for _, v := range volumes {
+		if v.Server != "" {
+			servers.Insert(v.Server)
+		}
+	}
+	for _, source := range mounts {
+		if server := getServerOfMountSource(source); server != "" {
+			servers.Insert(server)
+		}
+	}
+	if servers.Len() == 0 {
+		d.ok("no nfs server to check, set --servers to check servers of storage classes")
+		return
+	}
+	for _, server := range servers.List() {
+		address := net.JoinHostPort(strings.Trim(server, "[]"), nfsPort)
+		if err := d.dialTCP(ctx, address, d.opts.Timeout); err != nil {
+			d.fail("nfs server %s is unreachable on TCP %s: %v", server, nfsPort, err)
+		} else {
+			d.ok("nfs server %s is reachable on TCP %s", server, nfsPort)
+		}
+	}
+}
+
+// checkMounts stats nfs mounts in mount table, and reports volumes in node state file which are not mounted
+func (d *doctor) checkMounts(volumes []nodeVolume, mounts map[string]string, listErr error) {
+	d.section("nfs mounts")
+	if listErr != nil {
+		d.fail("failed to list nfs mounts: %v", listErr)
+		return
+	}
+	if len(mounts) == 0 {
+		d.ok("no nfs mount on the node")
+	}
+	mountPoints := make([]string, 0, len(mounts))
+	for mountPoint := range mounts {
+		mountPoints = append(mountPoints, mountPoint)
+	}
+	sort.Strings(mountPoints)
+	for _, mountPoint := range mountPoints {
+		err := probeMount(mountPoint, d.opts.Timeout)
+		switch {
+		case err == nil:
+			d.ok("%s on %s", mounts[mountPoint], mountPoint)
+		case mount.IsCorruptedMnt(err):
+			d.fail("stale mount %s on %s: %v, restart pods of the volume or enable --stale-mount-check-interval", mounts[mountPoint], mountPoint, err)
+		default:
+			d.fail("mount %s on %s is not responding: %v", mounts[mountPoint], mountPoint, err)
+		}
+	}
+	for _, v := range volumes {
+		if v.KataMountInfo != nil || v.Pending {
+			continue
+		}
+		if _, ok := mounts[v.TargetPath]; !ok && v.CipherPath == "" && v.StagingPath == "" {
+			d.warn("volume %s is recorded on %s in node state file but not mounted", v.VolumeID, v.TargetPath)
+		}
+	}
+}
+
+// dumpDirectVolumes writes mount info of kata direct volumes, volumes whose volume path does not exist are orphaned
+func (d *doctor) dumpDirectVolumes(ctx context.Context) {
+	d.section("kata direct volumes")
+	rootPath := d.opts.KataDirectVolumeRootPath
+	volumePaths, err := listDirectVolumes(ctx, rootPath)
+	if err != nil {
+		d.fail("failed to list kata direct volumes under %s: %v", rootPath, err)
+		return
+	}
+	if len(volumePaths) == 0 {
+		d.ok("no kata direct volume under %s", rootPath)
+		return
+	}
+	sort.Strings(volumePaths)
+	for _, volumePath := range volumePaths {
+		mountInfo, err := getDirectVolume(rootPath, volumePath)
+		if err != nil {
+			d.fail("failed to read kata direct volume %s: %v", volumePath, err)
+			continue
+		}
+		if _, err := os.Stat(volumePath); os.IsNotExist(err) {
+			d.warn("orphaned kata direct volume %s: device %s, options %v, volume path does not exist", volumePath, mountInfo.Device, mountInfo.Options)
+			continue
+		}
+		d.ok("kata direct volume %s: device %s, options %v, metadata %v", volumePath, mountInfo.Device, mountInfo.Options, mountInfo.Metadata)
+	}
+}
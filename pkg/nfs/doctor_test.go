@@ -0,0 +1,101 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestDoctor(t *testing.T) {
+	origProbeMount := probeMount
+	defer func() { probeMount = origProbeMount }()
+	probeMount = func(targetPath string, timeout time.Duration) error {
+		switch targetPath {
+		case "/stale":
+			return syscall.ESTALE
+		case "/hung":
+			return fmt.Errorf("stat %s timed out after %v", targetPath, timeout)
+		}
+		return nil
+	}
+
+	stateFile := filepath.Join(t.TempDir(), "node-state.json")
+	state := newNodeState(stateFile)
+	state.set(context.TODO(), nodeVolume{VolumeID: "vol_1", TargetPath: "/healthy", Server: "server-1", Source: "server-1:/share"})
+	state.set(context.TODO(), nodeVolume{VolumeID: "vol_2", TargetPath: "/unmounted", Server: "server-2", Source: "server-2:/share"})
+	kataRoot := t.TempDir()
+	kataTarget := t.TempDir()
+	for _, volumePath := range []string{kataTarget, "/removed"} {
+		if err := addDirectVolume(context.TODO(), kataRoot, volumePath, &kataMountInfo{VolumeType: "nfs", Device: "server-1:/share", FsType: "nfs"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	d := &doctor{
+		opts: &DoctorOptions{Servers: []string{"server-3,server-1"}, NodeStateFile: stateFile, KataDirectVolumeRootPath: kataRoot},
+		w:    &out,
+		lookPath: func(file string) (string, error) {
+			if file == "gocryptfs" {
+				return "", exec.ErrNotFound
+			}
+			return "/sbin/" + file, nil
+		},
+		dialTCP: func(_ context.Context, address string, _ time.Duration) error {
+			if strings.HasPrefix(address, "server-3:") {
+				return fmt.Errorf("connection refused")
+			}
+			return nil
+		},
+		listMounts: func() (map[string]string, error) {
+			return map[string]string{"/healthy": "server-1:/share", "/stale": "server-1:/share", "/hung": "server-4:/share"}, nil
+		},
+	}
+	err := d.run(context.Background())
+	if err == nil || err.Error() != "3 checks failed" {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	for _, expected := range []string{
+		"[OK]   mount.nfs is installed at /sbin/mount.nfs",
+		"[WARN] gocryptfs is not found",
+		"[OK]   rpcbind is running on the node",
+		"[OK]   nfs server server-1 is reachable on TCP 2049",
+		"[OK]   nfs server server-2 is reachable on TCP 2049",
+		"[FAIL] nfs server server-3 is unreachable on TCP 2049",
+		"[OK]   nfs server server-4 is reachable on TCP 2049",
+		"[OK]   server-1:/share on /healthy",
+		"[FAIL] stale mount server-1:/share on /stale",
+		"[FAIL] mount server-4:/share on /hung is not responding",
+		"[WARN] volume vol_2 is recorded on /unmounted in node state file but not mounted",
+		"[OK]   kata direct volume " + kataTarget + ": device server-1:/share",
+		"[WARN] orphaned kata direct volume /removed",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("%q is not found in output:\n%s", expected, out.String())
+		}
+	}
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DefaultEncryptionMountDir is where nfs shares of encrypted volumes are mounted on node, it's private to node plugin
+	DefaultEncryptionMountDir = "/tmp/encryption"
+	// key of the passphrase of encrypted volume in node publish secret
+	encryptionKeyField = "encryptionkey"
+	// config file created by gocryptfs -init in the cipher directory
+	gocryptfsConfFile = "gocryptfs.conf"
+	// exit code of gocryptfs if the passphrase is wrong
+	gocryptfsExitPasswordIncorrect = 12
+)
+
+// runGocryptfs runs gocryptfs and returns its combined output, could be replaced in unit tests.
+// Output is written to a file instead of a pipe, so it does not wait for the daemonized mount process
+// which inherits stdout and stderr.
+var runGocryptfs = func(args ...string) ([]byte, error) {
+	out, err := os.CreateTemp("", "gocryptfs-out-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	cmd := exec.Command("gocryptfs", args...)
+	cmd.Stdout, cmd.Stderr = out, out
+	runErr := cmd.Run()
+	output, _ := os.ReadFile(out.Name())
+	return output, runErr
+}
+
+// getCipherPath returns where the nfs share of encrypted volume published on targetPath is mounted
+func getCipherPath(encryptionMountDir, targetPath string) string {
+	return filepath.Join(encryptionMountDir, fmt.Sprintf("%x", sha256.Sum256([]byte(targetPath))))
+}
+
+func getEncryptionKey(secrets map[string]string) string {
+	for k, v := range secrets {
+		if strings.ToLower(k) == encryptionKeyField {
+			return v
+		}
+	}
+	return ""
+}
+
+// publishEncryptedVolume mounts the plaintext view of the nfs share decrypted by gocryptfs on targetPath.
+// The share is mounted on a cipher path private to node plugin, or the staging path is used if the volume is staged.
+func (ns *NodeServer) publishEncryptedVolume(ctx context.Context, volumeID, stagingPath, targetPath string, volCap *csi.VolumeCapability, cfg *volumeMountConfig, readOnly bool, secrets map[string]string) (retErr error) {
+	logger := klog.FromContext(ctx)
+	key := getEncryptionKey(secrets)
+	if key == "" {
+		return status.Errorf(codes.InvalidArgument, "%s is required in node publish secret of encrypted volume", encryptionKeyField)
+	}
+
+	cipherPath := stagingPath
+	if stagingPath != "" {
+		notMnt, err := ns.mounter.IsLikelyNotMountPoint(stagingPath)
+		if err != nil && !os.IsNotExist(err) {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if err != nil || notMnt {
+			return status.Errorf(codes.FailedPrecondition, "volume(%s) is not staged on %s", volumeID, stagingPath)
+		}
+	} else {
+		cipherPath = getCipherPath(ns.Driver.encryptionMountDir, targetPath)
+		notMnt, err := ns.mounter.IsLikelyNotMountPoint(cipherPath)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return status.Error(codes.Internal, err.Error())
+			}
+			if err := os.MkdirAll(cipherPath, 0750); err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+			notMnt = true
+		}
+		// share mounted by a previous failed NodePublishVolume is reused
+		if notMnt {
+			if err := ns.mountVolume(ctx, volumeID, cipherPath, volCap, cfg, readOnly, secrets); err != nil {
+				return err
+			}
+			defer func() {
+				if retErr != nil {
+					_ = ns.unmountPrivateShare(ctx, cipherPath)
+				}
+			}()
+		}
+	}
+
+	logger.V(2).Info("NodePublishVolume: mounting encrypted volume", "cipherPath", cipherPath, "readOnly", readOnly)
+	if err := mountGocryptfs(ctx, cipherPath, targetPath, key, readOnly); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == gocryptfsExitPasswordIncorrect {
+			return status.Errorf(codes.PermissionDenied, "%s in node publish secret could not decrypt volume(%s)", encryptionKeyField, volumeID)
+		}
+		return status.Errorf(codes.Internal, "failed to mount encrypted volume on %s: %v", targetPath, err)
+	}
+	if stagingPath != "" {
+		ns.stagedTargets.Store(targetPath, stagingPath)
+	}
+	ns.nodeState.set(ctx, nodeVolume{VolumeID: volumeID, TargetPath: targetPath, CipherPath: cipherPath, ReadOnly: readOnly})
+	return nil
+}
+
+// mountGocryptfs initializes the cipher directory with key if it's not initialized, and mounts its plaintext view on targetPath.
+// The key is passed in a temporary file which is removed after mount.
+func mountGocryptfs(ctx context.Context, cipherPath, targetPath, key string, readOnly bool) error {
+	keyFile, err := os.CreateTemp("", "gocryptfs-key-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(keyFile.Name())
+	_, err = keyFile.WriteString(key)
+	if closeErr := keyFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	conf := filepath.Join(cipherPath, gocryptfsConfFile)
+	if _, err := os.Stat(conf); os.IsNotExist(err) {
+		if readOnly {
+			return fmt.Errorf("%s does not exist, encrypted volume could not be initialized on read-only mount", conf)
+		}
+		klog.FromContext(ctx).V(2).Info("initializing encrypted volume", "cipherPath", cipherPath)
+		if out, err := runGocryptfs("-init", "-q", "-passfile", keyFile.Name(), cipherPath); err != nil {
+			// the volume could be initialized on another node at the same time
+			if _, statErr := os.Stat(conf); statErr != nil {
+				return fmt.Errorf("failed to initialize encrypted volume on %s: %w, output: %s", cipherPath, err, string(out))
+			}
+		}
+	}
+
+	args := []string{"-q", "-passfile", keyFile.Name(), "-allow_other"}
+	if readOnly {
+		args = append(args, "-ro")
+	}
+	args = append(args, cipherPath, targetPath)
+	if out, err := runGocryptfs(args...); err != nil {
+		return fmt.Errorf("gocryptfs failed: %w, output: %s", err, string(out))
+	}
+	return nil
+}
+
+// unmountPrivateShare unmounts the nfs share mounted on a path private to node plugin,
+// e.g. cipher path of encrypted volume or mount path of block volume
+func (ns *NodeServer) unmountPrivateShare(ctx context.Context, path string) error {
+	if err := ns.cleanupMountPoint(ctx, path); err != nil {
+		klog.FromContext(ctx).Error(err, "failed to unmount private share", "path", path)
+		return err
+	}
+	ns.mountTracker.remove(path)
+	ns.nodeState.remove(ctx, path)
+	return nil
+}
+
+// unpublishEncryptedVolume unmounts the nfs share of encrypted volume after its plaintext view on targetPath is unmounted,
+// it's no-op if the volume is not encrypted or it's staged
+func (ns *NodeServer) unpublishEncryptedVolume(ctx context.Context, targetPath string) error {
+	cipherPath := getCipherPath(ns.Driver.encryptionMountDir, targetPath)
+	if _, err := os.Lstat(cipherPath); os.IsNotExist(err) {
+		return nil
+	}
+	return ns.unmountPrivateShare(ctx, cipherPath)
+}
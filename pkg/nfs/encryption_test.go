@@ -0,0 +1,130 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+)
+
+func TestPublishEncryptedVolume(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip on windows")
+	}
+	var calls [][]string
+	var wrongKey bool
+	origRunGocryptfs := runGocryptfs
+	defer func() { runGocryptfs = origRunGocryptfs }()
+	runGocryptfs = func(args ...string) ([]byte, error) {
+		// key file path is random
+		args = append([]string{}, args...)
+		for i := range args {
+			if args[i] == "-passfile" {
+				if key, err := os.ReadFile(args[i+1]); err != nil || string(key) != "secret" {
+					t.Errorf("unexpected key %q in key file, error: %v", key, err)
+				}
+				args[i+1] = "keyfile"
+			}
+		}
+		calls = append(calls, args)
+		if wrongKey && args[0] != "-init" {
+			return []byte("Password incorrect."), exec.Command("sh", "-c", "exit 12").Run()
+		}
+		return nil, nil
+	}
+
+	d := NewEmptyDriver("")
+	d.encryptionMountDir = t.TempDir()
+	fakeMounter := mount.NewFakeMounter(nil)
+	ns := NewNodeServer(d, fakeMounter)
+	targetPath := filepath.Join(t.TempDir(), "mount")
+	cipherPath := getCipherPath(d.encryptionMountDir, targetPath)
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:   "vol_1",
+		TargetPath: targetPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+		VolumeContext: map[string]string{paramServer: "server", paramShare: "/share", paramEncrypted: "true"},
+	}
+
+	_, err := ns.NodePublishVolume(context.TODO(), req)
+	assert.Equal(t, status.Error(codes.InvalidArgument, "encrypted volume requires --enable-encryption on node driver"), err)
+
+	d.enableEncryption = true
+	_, err = ns.NodePublishVolume(context.TODO(), req)
+	assert.Equal(t, status.Error(codes.InvalidArgument, "encryptionkey is required in node publish secret of encrypted volume"), err)
+
+	req.Secrets = map[string]string{"encryptionKey": "secret"}
+	_, err = ns.NodePublishVolume(context.TODO(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"-init", "-q", "-passfile", "keyfile", cipherPath},
+		{"-q", "-passfile", "keyfile", "-allow_other", cipherPath, targetPath},
+	}, calls)
+	assert.Equal(t, []mount.FakeAction{{Action: "mount", Target: cipherPath, Source: "server:/share", FSType: "nfs"}}, fakeMounter.GetLog())
+
+	_, err = ns.NodeUnpublishVolume(context.TODO(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol_1", TargetPath: targetPath})
+	assert.NoError(t, err)
+	_, err = os.Stat(cipherPath)
+	assert.True(t, os.IsNotExist(err), "cipher path should be removed")
+	assert.Empty(t, ns.mountTracker.list())
+
+	// the share is unmounted if the key is wrong
+	calls, wrongKey = nil, true
+	fakeMounter.ResetLog()
+	_, err = ns.NodePublishVolume(context.TODO(), req)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Len(t, calls, 2)
+	assert.Equal(t, []mount.FakeAction{
+		{Action: "mount", Target: cipherPath, Source: "server:/share", FSType: "nfs"},
+		{Action: "unmount", Target: cipherPath},
+	}, fakeMounter.GetLog())
+	assert.Empty(t, ns.mountTracker.list())
+}
+
+func TestMountGocryptfs(t *testing.T) {
+	var calls [][]string
+	origRunGocryptfs := runGocryptfs
+	defer func() { runGocryptfs = origRunGocryptfs }()
+	runGocryptfs = func(args ...string) ([]byte, error) {
+		calls = append(calls, args)
+		return nil, nil
+	}
+
+	cipherPath := t.TempDir()
+	err := mountGocryptfs(context.TODO(), cipherPath, "/target", "secret", true)
+	assert.Error(t, err, "volume could not be initialized on read-only mount")
+	assert.Empty(t, calls)
+
+	// initialized volume is not initialized again
+	assert.NoError(t, os.WriteFile(filepath.Join(cipherPath, gocryptfsConfFile), []byte("{}"), 0400))
+	assert.NoError(t, mountGocryptfs(context.TODO(), cipherPath, "/target", "secret", true))
+	assert.Len(t, calls, 1)
+	assert.Equal(t, []string{"-allow_other", "-ro", cipherPath, "/target"}, calls[0][3:])
+}
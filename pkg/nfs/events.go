@@ -0,0 +1,142 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+const (
+	eventReasonCreateVolumeFailed      = "CreateVolumeFailed"
+	eventReasonDeleteVolumeFailed      = "DeleteVolumeFailed"
+	eventReasonNodePublishVolumeFailed = "NodePublishVolumeFailed"
+	eventReasonNodeStageVolumeFailed   = "NodeStageVolumeFailed"
+	eventReasonStaleMountRemounted     = "StaleMountRemounted"
+	eventReasonStaleMountRemountFailed = "StaleMountRemountFailed"
+	// directory of kubelet where csi volumes of pods are published, e.g. /var/lib/kubelet/pods/{uid}/volumes/kubernetes.io~csi/{pv}/mount
+	kubeletCSIVolumeDir = "kubernetes.io~csi"
+)
+
+// newEventRecorder returns a recorder which emits events on pvc/pv of failed CSI calls
+func newEventRecorder(kubeconfig, driverName, nodeID string) (record.EventRecorder, kubernetes.Interface, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get kube config: %v", err)
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create kube client: %v", err)
+	}
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: driverName, Host: nodeID}), client, nil
+}
+
+// skipEvent returns true if the error is retried by sidecars or kubelet without user action
+func skipEvent(err error) bool {
+	return err == nil || status.Code(err) == codes.Aborted
+}
+
+// recordPVCEvent emits a warning event on the pvc in volume parameters, returns false if events are disabled
+// or pvc is unknown(e.g. --extra-create-metadata is not set on csi-provisioner)
+func (n *Driver) recordPVCEvent(parameters map[string]string, reason string, err error) bool {
+	if n.eventRecorder == nil || skipEvent(err) {
+		return false
+	}
+	var namespace, name string
+	for k, v := range parameters {
+		switch strings.ToLower(k) {
+		case pvcNamespaceKey:
+			namespace = v
+		case pvcNameKey:
+			name = v
+		}
+	}
+	if namespace == "" || name == "" {
+		return false
+	}
+	n.eventRecorder.Event(&v1.ObjectReference{Kind: "PersistentVolumeClaim", APIVersion: "v1", Namespace: namespace, Name: name}, v1.EventTypeWarning, reason, status.Convert(err).Message())
+	return true
+}
+
+// recordPVEvent emits a warning event on the pv, it's no op if events are disabled or pv is unknown
+func (n *Driver) recordPVEvent(pvName, reason string, err error) {
+	if n.eventRecorder == nil || skipEvent(err) || pvName == "" {
+		return
+	}
+	n.recordPVWarning(pvName, reason, status.Convert(err).Message())
+}
+
+// recordPVWarning emits a warning event with message on the pv, it's no op if events are disabled or pv is unknown
+func (n *Driver) recordPVWarning(pvName, reason, message string) {
+	if n.eventRecorder == nil || pvName == "" {
+		return
+	}
+	n.eventRecorder.Event(&v1.ObjectReference{Kind: "PersistentVolume", APIVersion: "v1", Name: pvName}, v1.EventTypeWarning, reason, message)
+}
+
+// getPVNameOfVolumeID returns the pv name of a provisioned volume, sub directory is named after pv by default,
+// empty string is returned if pv of the sub directory does not have the volume id
+func (n *Driver) getPVNameOfVolumeID(ctx context.Context, volumeID string) string {
+	if n.eventRecorder == nil || n.kubeClient == nil {
+		return ""
+	}
+	vol, err := getNfsVolFromID(volumeID)
+	if err != nil || vol.subDir == "" || strings.Contains(vol.subDir, "/") {
+		return ""
+	}
+	pv, err := n.kubeClient.CoreV1().PersistentVolumes().Get(ctx, vol.subDir, metav1.GetOptions{})
+	if err != nil {
+		klog.FromContext(ctx).V(4).Info("failed to get pv of volume", "pv", vol.subDir, "volumeID", volumeID, "err", err)
+		return ""
+	}
+	if pv.Spec.CSI == nil || pv.Spec.CSI.VolumeHandle != volumeID {
+		return ""
+	}
+	return pv.Name
+}
+
+// getPVNameOfPublish returns pv name in volume context, or the pv name in target path of kubelet
+func getPVNameOfPublish(volumeContext map[string]string, targetPath string) string {
+	for k, v := range volumeContext {
+		if strings.ToLower(k) == pvNameKey && v != "" {
+			return v
+		}
+	}
+	// ephemeral volume has no pv
+	if strings.EqualFold(volumeContext[ephemeralField], "true") {
+		return ""
+	}
+	if filepath.Base(filepath.Dir(filepath.Dir(targetPath))) == kubeletCSIVolumeDir {
+		return filepath.Base(filepath.Dir(targetPath))
+	}
+	return ""
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestGetPVNameOfPublish(t *testing.T) {
+	tests := []struct {
+		desc          string
+		volumeContext map[string]string
+		targetPath    string
+		expected      string
+	}{
+		{
+			desc:          "pv name in volume context",
+			volumeContext: map[string]string{pvNameKey: "pvc-a"},
+			targetPath:    "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pvc-b/mount",
+			expected:      "pvc-a",
+		},
+		{
+			desc:          "pv name in target path",
+			volumeContext: map[string]string{paramServer: "server"},
+			targetPath:    "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pv-static/mount",
+			expected:      "pv-static",
+		},
+		{
+			desc:          "ephemeral volume",
+			volumeContext: map[string]string{ephemeralField: "true"},
+			targetPath:    "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/inline/mount",
+		},
+		{
+			desc:       "unknown target path",
+			targetPath: "/tmp/target",
+		},
+	}
+	for _, test := range tests {
+		if name := getPVNameOfPublish(test.volumeContext, test.targetPath); name != test.expected {
+			t.Errorf("test[%s]: unexpected pv name %s, expected %s", test.desc, name, test.expected)
+		}
+	}
+}
+
+func TestRecordEvents(t *testing.T) {
+	d := NewEmptyDriver("")
+	parameters := map[string]string{pvcNamespaceKey: "default", pvcNameKey: "pvc-a"}
+	if d.recordPVCEvent(parameters, eventReasonCreateVolumeFailed, status.Error(codes.Internal, "failed")) {
+		t.Errorf("event is recorded with events disabled")
+	}
+
+	recorder := record.NewFakeRecorder(10)
+	d.eventRecorder = recorder
+	if d.recordPVCEvent(parameters, eventReasonCreateVolumeFailed, status.Error(codes.Aborted, "in progress")) {
+		t.Errorf("event is recorded for aborted operation")
+	}
+	if d.recordPVCEvent(map[string]string{}, eventReasonCreateVolumeFailed, status.Error(codes.Internal, "failed")) {
+		t.Errorf("event is recorded without pvc")
+	}
+	if !d.recordPVCEvent(parameters, eventReasonCreateVolumeFailed, status.Error(codes.Internal, "mkdir failed")) {
+		t.Errorf("event is not recorded on pvc")
+	}
+	d.recordPVEvent("pvc-a", eventReasonNodePublishVolumeFailed, status.Error(codes.Internal, "mount failed"))
+
+	expected := []string{
+		"Warning CreateVolumeFailed mkdir failed",
+		"Warning NodePublishVolumeFailed mount failed",
+	}
+	for _, e := range expected {
+		if event := <-recorder.Events; event != e {
+			t.Errorf("unexpected event %q, expected %q", event, e)
+		}
+	}
+}
+
+func TestCreateVolumeFailureEvent(t *testing.T) {
+	cs := initTestController(t)
+	recorder := record.NewFakeRecorder(10)
+	cs.Driver.eventRecorder = recorder
+	req := &csi.CreateVolumeRequest{
+		Name: "pvc-event",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+			},
+		},
+		Parameters: map[string]string{
+			paramServer:     testServer,
+			paramShare:      testBaseDir,
+			"unknown":       "value",
+			pvcNamespaceKey: "default",
+			pvcNameKey:      "data",
+		},
+	}
+	if _, err := cs.CreateVolume(context.TODO(), req); err == nil {
+		t.Fatalf("expected error of invalid parameter")
+	}
+	expected := `Warning CreateVolumeFailed invalid parameter "unknown" in storage class`
+	if event := <-recorder.Events; event != expected {
+		t.Errorf("unexpected event %q, expected %q", event, expected)
+	}
+
+	// failure of internal mount is only recorded as CreateVolumeFailed on the pvc
+	cs.Driver.ns = NewNodeServer(cs.Driver, &fakeMounter{})
+	req.Parameters = map[string]string{
+		paramServer:     "error_mount",
+		paramShare:      testBaseDir,
+		pvcNamespaceKey: "default",
+		pvcNameKey:      "data",
+		pvNameKey:       "pvc-event",
+	}
+	if _, err := cs.CreateVolume(context.TODO(), req); err == nil {
+		t.Fatalf("expected error of internal mount")
+	}
+	if event := <-recorder.Events; !strings.HasPrefix(event, "Warning CreateVolumeFailed ") {
+		t.Errorf("unexpected event %q of internal mount failure", event)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("unexpected event %q of internal mount failure", <-recorder.Events)
+	}
+}
@@ -0,0 +1,301 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"golang.org/x/net/context"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// exportManager value which creates a dedicated NFS-Ganesha export per volume
+	exportManagerGanesha = "ganesha"
+
+	// keys in provisioner secret to manage exports of NFS-Ganesha
+	ganeshaDBusAddressField = "ganeshadbusaddress"
+	ganeshaExportPathField  = "ganeshaexportpath"
+	ganeshaPseudoRootField  = "ganeshapseudoroot"
+
+	ganeshaDBusService   = "org.ganesha.nfsd"
+	ganeshaDBusPath      = "/org/ganesha/nfsd/ExportMgr"
+	ganeshaDBusInterface = "org.ganesha.nfsd.exportmgr"
+
+	// directory under the base share where export config files of volumes are written,
+	// NFS-Ganesha reads the config file from the same directory on its own filesystem
+	ganeshaExportConfigDir = ".ganesha-exports"
+	// export ids below are left for exports managed outside of the driver
+	ganeshaMinExportID = 1000
+)
+
+var supportedSquashValues = []string{"", "root_squash", "root_id_squash", "all_squash", "no_root_squash"}
+
+func validateSquashValue(squash string) error {
+	for _, v := range supportedSquashValues {
+		if strings.EqualFold(v, squash) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid value %s for %s, supported values are %v", squash, paramSquash, supportedSquashValues)
+}
+
+// ganeshaConfig is parsed from provisioner secret
+type ganeshaConfig struct {
+	// D-Bus address of NFS-Ganesha, e.g. tcp:host=10.0.0.1,port=55556
+	dbusAddress string
+	// local path of the base share on NFS-Ganesha server
+	exportPath string
+	// parent of NFSv4 pseudo paths of volume exports
+	pseudoRoot string
+}
+
+// getGaneshaConfig returns nil if D-Bus address of NFS-Ganesha is not in secrets
+func getGaneshaConfig(secrets map[string]string) (*ganeshaConfig, error) {
+	config := &ganeshaConfig{pseudoRoot: "/"}
+	for k, v := range secrets {
+		switch strings.ToLower(k) {
+		case ganeshaDBusAddressField:
+			config.dbusAddress = v
+		case ganeshaExportPathField:
+			config.exportPath = v
+		case ganeshaPseudoRootField:
+			if v != "" {
+				config.pseudoRoot = v
+			}
+		}
+	}
+	if config.dbusAddress == "" {
+		return nil, nil
+	}
+	if !path.IsAbs(config.exportPath) {
+		return nil, fmt.Errorf("%s(%s) in secret must be an absolute path", ganeshaExportPathField, config.exportPath)
+	}
+	if !path.IsAbs(config.pseudoRoot) {
+		return nil, fmt.Errorf("%s(%s) in secret must be an absolute path", ganeshaPseudoRootField, config.pseudoRoot)
+	}
+	return config, nil
+}
+
+// ganeshaExport is an export listed by NFS-Ganesha
+type ganeshaExport struct {
+	id   uint16
+	path string
+}
+
+// ganeshaClient manages exports of NFS-Ganesha
+type ganeshaClient interface {
+	listExports() ([]ganeshaExport, error)
+	// addExport loads the export with exportID from configPath on NFS-Ganesha server
+	addExport(configPath string, exportID uint16) error
+	removeExport(exportID uint16) error
+	close() error
+}
+
+// newGaneshaClient connects to NFS-Ganesha at D-Bus address, could be replaced in unit tests
+var newGaneshaClient = func(address string) (ganeshaClient, error) {
+	return newGaneshaDBusClient(address)
+}
+
+// ganeshaLock serializes export id allocation of volumes
+var ganeshaLock sync.Mutex
+
+type ganeshaDBusClient struct {
+	conn *dbus.Conn
+}
+
+func newGaneshaDBusClient(address string) (*ganeshaDBusClient, error) {
+	conn, err := dbus.Dial(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to D-Bus %s: %v", address, err)
+	}
+	if err = conn.Auth(nil); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to authenticate to D-Bus %s: %v", address, err)
+	}
+	if err = conn.Hello(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to say hello to D-Bus %s: %v", address, err)
+	}
+	return &ganeshaDBusClient{conn: conn}, nil
+}
+
+func (c *ganeshaDBusClient) call(method string, args ...interface{}) *dbus.Call {
+	return c.conn.Object(ganeshaDBusService, ganeshaDBusPath).Call(ganeshaDBusInterface+"."+method, 0, args...)
+}
+
+func (c *ganeshaDBusClient) listExports() ([]ganeshaExport, error) {
+	call := c.call("ShowExports")
+	if call.Err != nil {
+		return nil, fmt.Errorf("ShowExports failed with %v", call.Err)
+	}
+	// reply of ShowExports is (timestamp, [(id, path, ...)])
+	if len(call.Body) < 2 {
+		return nil, fmt.Errorf("unexpected reply of ShowExports: %v", call.Body)
+	}
+	entries, ok := call.Body[1].([][]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected exports in reply of ShowExports: %v", call.Body[1])
+	}
+	var exports []ganeshaExport
+	for _, entry := range entries {
+		if len(entry) < 2 {
+			continue
+		}
+		id, idOK := entry[0].(uint16)
+		exportPath, pathOK := entry[1].(string)
+		if idOK && pathOK {
+			exports = append(exports, ganeshaExport{id: id, path: exportPath})
+		}
+	}
+	return exports, nil
+}
+
+func (c *ganeshaDBusClient) addExport(configPath string, exportID uint16) error {
+	if call := c.call("AddExport", configPath, fmt.Sprintf("EXPORT(Export_Id=%d)", exportID)); call.Err != nil {
+		return fmt.Errorf("AddExport(%s, %d) failed with %v", configPath, exportID, call.Err)
+	}
+	return nil
+}
+
+func (c *ganeshaDBusClient) removeExport(exportID uint16) error {
+	if call := c.call("RemoveExport", exportID); call.Err != nil {
+		return fmt.Errorf("RemoveExport(%d) failed with %v", exportID, call.Err)
+	}
+	return nil
+}
+
+func (c *ganeshaDBusClient) close() error {
+	return c.conn.Close()
+}
+
+// getGaneshaExportConfigName returns name of the export config file of the volume
+func getGaneshaExportConfigName(vol *nfsVolume) string {
+	return strings.ReplaceAll(strings.Trim(vol.subDir, "/"), "/", "-") + ".conf"
+}
+
+// getGaneshaExportConfig returns export block of the volume in NFS-Ganesha config format
+func getGaneshaExportConfig(exportID uint16, exportPath, pseudoPath, squash string) string {
+	config := fmt.Sprintf("EXPORT {\n\tExport_Id = %d;\n\tPath = %q;\n\tPseudo = %q;\n\tAccess_Type = RW;\n", exportID, exportPath, pseudoPath)
+	if squash != "" {
+		config += fmt.Sprintf("\tSquash = %s;\n", strings.ToLower(squash))
+	}
+	return config + "\tProtocols = 4;\n\tFSAL {\n\t\tName = VFS;\n\t}\n}\n"
+}
+
+// allocateGaneshaExportID returns the first export id not used by exports
+func allocateGaneshaExportID(exports []ganeshaExport) (uint16, error) {
+	used := map[uint16]bool{}
+	for _, e := range exports {
+		used[e.id] = true
+	}
+	for id := ganeshaMinExportID; id <= 0xffff; id++ {
+		if !used[uint16(id)] {
+			return uint16(id), nil
+		}
+	}
+	return 0, fmt.Errorf("no export id is available")
+}
+
+// createGaneshaExport creates a dedicated export of the volume subdirectory and returns its pseudo path,
+// the export config file is written under internalMountPath where the base share is mounted
+func createGaneshaExport(ctx context.Context, config *ganeshaConfig, vol *nfsVolume, internalMountPath, squash string) (string, error) {
+	logger := klog.FromContext(ctx)
+	exportPath := path.Join(config.exportPath, vol.subDir)
+	pseudoPath := path.Join(config.pseudoRoot, vol.subDir)
+
+	client, err := newGaneshaClient(config.dbusAddress)
+	if err != nil {
+		return "", err
+	}
+	defer client.close()
+
+	ganeshaLock.Lock()
+	defer ganeshaLock.Unlock()
+	exports, err := client.listExports()
+	if err != nil {
+		return "", err
+	}
+	for _, e := range exports {
+		if e.path == exportPath {
+			logger.V(2).Info("export already exists", "exportID", e.id, "exportPath", exportPath)
+			return pseudoPath, nil
+		}
+	}
+	exportID, err := allocateGaneshaExportID(exports)
+	if err != nil {
+		return "", err
+	}
+
+	configDir := filepath.Join(internalMountPath, ganeshaExportConfigDir)
+	if err := os.MkdirAll(configDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to make export config directory: %v", err)
+	}
+	configName := getGaneshaExportConfigName(vol)
+	configFile := filepath.Join(configDir, configName)
+	if err := os.WriteFile(configFile, []byte(getGaneshaExportConfig(exportID, exportPath, pseudoPath, squash)), 0644); err != nil {
+		return "", fmt.Errorf("failed to write export config %s: %v", configFile, err)
+	}
+	logger.V(2).Info("adding export", "exportID", exportID, "exportPath", exportPath, "pseudoPath", pseudoPath)
+	if err := client.addExport(path.Join(config.exportPath, ganeshaExportConfigDir, configName), exportID); err != nil {
+		if removeErr := os.Remove(configFile); removeErr != nil {
+			logger.Info("failed to remove export config", "path", configFile, "err", removeErr)
+		}
+		return "", err
+	}
+	return pseudoPath, nil
+}
+
+// removeGaneshaExport removes the export of the volume subdirectory if it exists,
+// the export config file is also removed if internalMountPath is not empty
+func removeGaneshaExport(ctx context.Context, config *ganeshaConfig, vol *nfsVolume, internalMountPath string) error {
+	exportPath := path.Join(config.exportPath, vol.subDir)
+
+	client, err := newGaneshaClient(config.dbusAddress)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+
+	ganeshaLock.Lock()
+	defer ganeshaLock.Unlock()
+	exports, err := client.listExports()
+	if err != nil {
+		return err
+	}
+	for _, e := range exports {
+		if e.path == exportPath {
+			klog.FromContext(ctx).V(2).Info("removing export", "exportID", e.id, "exportPath", exportPath)
+			if err := client.removeExport(e.id); err != nil {
+				return err
+			}
+		}
+	}
+	if internalMountPath != "" {
+		configFile := filepath.Join(internalMountPath, ganeshaExportConfigDir, getGaneshaExportConfigName(vol))
+		if err := os.Remove(configFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove export config %s: %v", configFile, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+)
+
+type fakeGaneshaClient struct {
+	exports map[uint16]string
+	// export config files loaded by addExport
+	configs []string
+}
+
+func (c *fakeGaneshaClient) listExports() ([]ganeshaExport, error) {
+	var exports []ganeshaExport
+	for id, path := range c.exports {
+		exports = append(exports, ganeshaExport{id: id, path: path})
+	}
+	return exports, nil
+}
+
+func (c *fakeGaneshaClient) addExport(configPath string, exportID uint16) error {
+	if _, ok := c.exports[exportID]; ok {
+		return fmt.Errorf("export id %d already exists", exportID)
+	}
+	c.exports[exportID] = fmt.Sprintf("export from %s", configPath)
+	c.configs = append(c.configs, configPath)
+	return nil
+}
+
+func (c *fakeGaneshaClient) removeExport(exportID uint16) error {
+	if _, ok := c.exports[exportID]; !ok {
+		return fmt.Errorf("export id %d does not exist", exportID)
+	}
+	exports := map[uint16]string{}
+	for id, path := range c.exports {
+		if id != exportID {
+			exports[id] = path
+		}
+	}
+	c.exports = exports
+	return nil
+}
+
+func (c *fakeGaneshaClient) close() error {
+	return nil
+}
+
+func setFakeGaneshaClient(t *testing.T, client *fakeGaneshaClient) {
+	original := newGaneshaClient
+	newGaneshaClient = func(address string) (ganeshaClient, error) {
+		return client, nil
+	}
+	t.Cleanup(func() { newGaneshaClient = original })
+}
+
+func TestGetGaneshaConfig(t *testing.T) {
+	tests := []struct {
+		desc      string
+		secrets   map[string]string
+		expected  *ganeshaConfig
+		expectErr bool
+	}{
+		{
+			desc:    "no dbus address",
+			secrets: map[string]string{"mountOptions": "nfsvers=4.1"},
+		},
+		{
+			desc:     "default pseudo root",
+			secrets:  map[string]string{"ganeshaDBusAddress": "tcp:host=10.0.0.1,port=55556", "ganeshaExportPath": "/export"},
+			expected: &ganeshaConfig{dbusAddress: "tcp:host=10.0.0.1,port=55556", exportPath: "/export", pseudoRoot: "/"},
+		},
+		{
+			desc:     "pseudo root",
+			secrets:  map[string]string{"ganeshaDBusAddress": "tcp:host=10.0.0.1,port=55556", "ganeshaExportPath": "/export", "ganeshaPseudoRoot": "/csi"},
+			expected: &ganeshaConfig{dbusAddress: "tcp:host=10.0.0.1,port=55556", exportPath: "/export", pseudoRoot: "/csi"},
+		},
+		{
+			desc:      "relative export path",
+			secrets:   map[string]string{"ganeshaDBusAddress": "tcp:host=10.0.0.1,port=55556", "ganeshaExportPath": "export"},
+			expectErr: true,
+		},
+		{
+			desc:      "relative pseudo root",
+			secrets:   map[string]string{"ganeshaDBusAddress": "tcp:host=10.0.0.1,port=55556", "ganeshaExportPath": "/export", "ganeshaPseudoRoot": "csi"},
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		config, err := getGaneshaConfig(test.secrets)
+		if (err != nil) != test.expectErr {
+			t.Errorf("test[%s]: unexpected error %v", test.desc, err)
+		}
+		if !reflect.DeepEqual(config, test.expected) {
+			t.Errorf("test[%s]: unexpected config %v, expected %v", test.desc, config, test.expected)
+		}
+	}
+}
+
+func TestAllocateGaneshaExportID(t *testing.T) {
+	id, err := allocateGaneshaExportID([]ganeshaExport{{id: 1, path: "/export"}, {id: 1000, path: "/export/a"}, {id: 1002, path: "/export/b"}})
+	if err != nil || id != 1001 {
+		t.Errorf("unexpected id %d, error %v", id, err)
+	}
+}
+
+func TestGetGaneshaExportConfig(t *testing.T) {
+	expected := `EXPORT {
+	Export_Id = 1000;
+	Path = "/export/pvc-a";
+	Pseudo = "/csi/pvc-a";
+	Access_Type = RW;
+	Squash = no_root_squash;
+	Protocols = 4;
+	FSAL {
+		Name = VFS;
+	}
+}
+`
+	if config := getGaneshaExportConfig(1000, "/export/pvc-a", "/csi/pvc-a", "No_Root_Squash"); config != expected {
+		t.Errorf("unexpected config %s, expected %s", config, expected)
+	}
+}
+
+func TestCreateDeleteVolumeWithGaneshaExport(t *testing.T) {
+	client := &fakeGaneshaClient{exports: map[uint16]string{1: "/export"}}
+	setFakeGaneshaClient(t, client)
+	cs := initTestController(t)
+	cs.Driver.workingMountDir = t.TempDir()
+	secrets := map[string]string{"ganeshaDBusAddress": "tcp:host=10.0.0.1,port=55556", "ganeshaExportPath": "/export", "ganeshaPseudoRoot": "/csi"}
+
+	req := &csi.CreateVolumeRequest{
+		Name: "pvc-ganesha",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+			},
+		},
+		Parameters: map[string]string{
+			paramServer:        testServer,
+			paramShare:         testBaseDir,
+			paramExportManager: "Ganesha",
+			paramSquash:        "root_squash",
+		},
+		Secrets: secrets,
+	}
+	resp, err := cs.CreateVolume(context.TODO(), req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if share := resp.Volume.VolumeContext[paramShare]; share != "/csi/pvc-ganesha" {
+		t.Errorf("unexpected share %s in volume context", share)
+	}
+	if subDir := resp.Volume.VolumeContext[paramSubDir]; subDir != "" {
+		t.Errorf("unexpected subdir %s in volume context", subDir)
+	}
+	if !reflect.DeepEqual(client.configs, []string{"/export/.ganesha-exports/pvc-ganesha.conf"}) {
+		t.Errorf("unexpected export configs %v", client.configs)
+	}
+	configFile := filepath.Join(cs.Driver.workingMountDir, "pvc-ganesha", ganeshaExportConfigDir, "pvc-ganesha.conf")
+	if _, err := os.Stat(configFile); err != nil {
+		t.Errorf("export config is not written: %v", err)
+	}
+	// export is added only once if CreateVolume is retried
+	client.exports[1000] = "/export/pvc-ganesha"
+	if _, err := cs.CreateVolume(context.TODO(), req); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(client.exports) != 2 {
+		t.Errorf("unexpected exports %v", client.exports)
+	}
+
+	if _, err := cs.DeleteVolume(context.TODO(), &csi.DeleteVolumeRequest{VolumeId: resp.Volume.VolumeId, Secrets: secrets}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(client.exports, map[uint16]string{1: "/export"}) {
+		t.Errorf("unexpected exports %v after DeleteVolume", client.exports)
+	}
+
+	req.Secrets = nil
+	if _, err := cs.CreateVolume(context.TODO(), req); err == nil {
+		t.Errorf("expected error without %s in secret", ganeshaDBusAddressField)
+	}
+	req.Secrets = secrets
+	req.Parameters[paramExportManager] = ""
+	if _, err := cs.CreateVolume(context.TODO(), req); err == nil {
+		t.Errorf("expected error of %s without exportManager", paramSquash)
+	}
+}
@@ -0,0 +1,419 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"k8s.io/klog/v2"
+)
+
+// Ordering of elements in the CSI group snapshot id.
+// ID is of the form {server}#{baseDir}#{groupName}.
+const (
+	idGroupSnapServer = iota
+	idGroupSnapBaseDir
+	idGroupSnapName
+	totalIDGroupSnapElements // Always last
+)
+
+// nfsGroupSnapshot is an internal representation of a volume group snapshot,
+// archives of member snapshots are written to {baseDir}/{name}/{src}/ on the nfs server
+type nfsGroupSnapshot struct {
+	// Group snapshot id.
+	id string
+	// Address of the NFS server.
+	server string
+	// Base directory of the NFS server to create group snapshots under
+	baseDir string
+	// Group snapshot name.
+	name string
+	// compression of member snapshot archives
+	compression string
+}
+
+// newNFSGroupSnapshot converts VolumeGroupSnapshotClass parameters to a nfsGroupSnapshot, parameters are the
+// same as VolumeSnapshotClass, server and share default to the ones of the first source volume
+func newNFSGroupSnapshot(name string, params map[string]string, vol *nfsVolume) (*nfsGroupSnapshot, error) {
+	snap, err := newNFSSnapshot(name, params, vol)
+	if err != nil {
+		return nil, err
+	}
+	if snap.format == snapshotFormatIncremental {
+		return nil, status.Errorf(codes.InvalidArgument, "%s snapshotFormat is not supported by group snapshot", snapshotFormatIncremental)
+	}
+	group := &nfsGroupSnapshot{
+		server:      snap.server,
+		baseDir:     snap.baseDir,
+		name:        name,
+		compression: snap.compression,
+	}
+	group.id = getGroupSnapshotIDFromNfsGroupSnapshot(group)
+	return group, nil
+}
+
+// Given a nfsGroupSnapshot, return a CSI group snapshot id.
+func getGroupSnapshotIDFromNfsGroupSnapshot(group *nfsGroupSnapshot) string {
+	idElements := make([]string, totalIDGroupSnapElements)
+	idElements[idGroupSnapServer] = strings.Trim(group.server, "/")
+	idElements[idGroupSnapBaseDir] = strings.Trim(group.baseDir, "/")
+	idElements[idGroupSnapName] = group.name
+	return strings.Join(idElements, separator)
+}
+
+// Given a CSI group snapshot ID, return a nfsGroupSnapshot
+// sample group snapshot ID:
+//
+//	nfs-server.default.svc.cluster.local#share#groupsnapshot-3a8f1ab0-4f0e-4b8c-9be5-0a0c2d4c2e7e
+func getNfsGroupSnapFromID(id string) (*nfsGroupSnapshot, error) {
+	segments := strings.Split(id, separator)
+	if len(segments) == totalIDGroupSnapElements && segments[idGroupSnapName] != "" {
+		return &nfsGroupSnapshot{
+			id:      id,
+			server:  segments[idGroupSnapServer],
+			baseDir: segments[idGroupSnapBaseDir],
+			name:    segments[idGroupSnapName],
+		}, nil
+	}
+	return nil, fmt.Errorf("failed to create nfsGroupSnapshot from group snapshot ID")
+}
+
+// memberSnapshot returns the snapshot of source volume in the group, the snapshot is in the existing snapshot id format
+// with {groupName}/{src} as snapshot name, so it could be restored and deleted like a snapshot created by CreateSnapshot
+func (group *nfsGroupSnapshot) memberSnapshot(srcVol *nfsVolume) *nfsSnapshot {
+	snap := &nfsSnapshot{
+		server:      group.server,
+		baseDir:     group.baseDir,
+		src:         getVolumeName(srcVol),
+		compression: group.compression,
+	}
+	snap.uuid = group.name + "/" + snap.src
+	snap.id = getSnapshotIDFromNfsSnapshot(snap)
+	return snap
+}
+
+// isMember returns true if the snapshot is archived in the group directory
+func (group *nfsGroupSnapshot) isMember(snap *nfsSnapshot) bool {
+	return strings.Trim(snap.server, "/") == strings.Trim(group.server, "/") &&
+		strings.Trim(snap.baseDir, "/") == strings.Trim(group.baseDir, "/") &&
+		snap.uuid == group.name+"/"+snap.src
+}
+
+// Volume for group snapshot internal mount/unmount
+func volumeFromGroupSnapshot(group *nfsGroupSnapshot) *nfsVolume {
+	return &nfsVolume{
+		id:      group.id,
+		server:  group.server,
+		baseDir: group.baseDir,
+		subDir:  group.name,
+		uuid:    group.name,
+	}
+}
+
+// GroupControllerGetCapabilities returns the capabilities of group controller service
+func (cs *ControllerServer) GroupControllerGetCapabilities(ctx context.Context, req *csi.GroupControllerGetCapabilitiesRequest) (*csi.GroupControllerGetCapabilitiesResponse, error) {
+	return &csi.GroupControllerGetCapabilitiesResponse{
+		Capabilities: []*csi.GroupControllerServiceCapability{
+			{
+				Type: &csi.GroupControllerServiceCapability_Rpc{
+					Rpc: &csi.GroupControllerServiceCapability_RPC{
+						Type: csi.GroupControllerServiceCapability_RPC_CREATE_DELETE_GET_VOLUME_GROUP_SNAPSHOT,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// CreateVolumeGroupSnapshot archives all source volumes into one group directory on the nfs server,
+// nfs has no way to freeze writes, so operations on source volumes are blocked by volume locks and
+// archives of all source volumes are created at the same time to get captures as close as possible
+func (cs *ControllerServer) CreateVolumeGroupSnapshot(ctx context.Context, req *csi.CreateVolumeGroupSnapshotRequest) (*csi.CreateVolumeGroupSnapshotResponse, error) {
+	if len(req.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "CreateVolumeGroupSnapshot name must be provided")
+	}
+	if len(req.GetSourceVolumeIds()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "CreateVolumeGroupSnapshot source volume IDs must be provided")
+	}
+
+	var srcVols []*nfsVolume
+	for _, volumeID := range req.GetSourceVolumeIds() {
+		srcVol, err := getNfsVolFromID(volumeID)
+		if err != nil {
+			return nil, status.Errorf(codes.NotFound, "failed to get source volume %s: %v", volumeID, err)
+		}
+		srcVols = append(srcVols, srcVol)
+	}
+	group, err := newNFSGroupSnapshot(req.GetName(), req.GetParameters(), srcVols[0])
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to create nfsGroupSnapshot: %v", err)
+	}
+
+	snapshots := make(map[string]*nfsSnapshot, len(srcVols))
+	for _, srcVol := range srcVols {
+		snap := group.memberSnapshot(srcVol)
+		if snap.src == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "missing required source volume name in %s", srcVol.id)
+		}
+		if _, ok := snapshots[snap.src]; ok {
+			return nil, status.Errorf(codes.InvalidArgument, "source volumes with the same name %s could not be in one group snapshot", snap.src)
+		}
+		snapshots[snap.src] = snap
+	}
+
+	if acquired := cs.Driver.volumeLocks.TryAcquire(req.GetName()); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, req.GetName())
+	}
+	defer cs.Driver.volumeLocks.Release(req.GetName())
+	// block operations(e.g. expansion, deletion) on source volumes until all archives are created
+	for i, srcVol := range srcVols {
+		if acquired := cs.Driver.volumeLocks.TryAcquire(srcVol.id); !acquired {
+			for _, locked := range srcVols[:i] {
+				cs.Driver.volumeLocks.Release(locked.id)
+			}
+			return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, srcVol.id)
+		}
+	}
+	defer func() {
+		for _, srcVol := range srcVols {
+			cs.Driver.volumeLocks.Release(srcVol.id)
+		}
+	}()
+
+	groupVol := volumeFromGroupSnapshot(group)
+	if err = cs.internalMount(ctx, groupVol, nil, getVolCapFromSecrets(req.GetSecrets())); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mount group snapshot nfs server: %v", err)
+	}
+	defer func() {
+		if err := cs.internalUnmount(ctx, groupVol); err != nil {
+			klog.FromContext(ctx).Info("failed to unmount group snapshot nfs server", "err", err)
+		}
+	}()
+	groupPath := getInternalVolumePath(cs.Driver.workingMountDir, groupVol)
+	if err = os.MkdirAll(groupPath, 0777); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to make group snapshot directory: %v", err)
+	}
+	if err = validateGroupSnapshot(groupPath, snapshots); err != nil {
+		return nil, err
+	}
+	for _, snap := range snapshots {
+		snapPath := filepath.Join(groupPath, snap.src)
+		if err = os.MkdirAll(snapPath, 0777); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to make subdirectory: %v", err)
+		}
+		if err = validateSnapshot(snapPath, snap); err != nil {
+			return nil, err
+		}
+	}
+
+	// mount all source volumes before archiving, so that archiving of all volumes starts in one pass
+	var mounted []*nfsVolume
+	defer func() {
+		for _, srcVol := range mounted {
+			if err := cs.internalUnmount(ctx, srcVol); err != nil {
+				klog.FromContext(ctx).Info("failed to unmount src nfs server", "volumeID", srcVol.id, "err", err)
+			}
+		}
+	}()
+	for _, srcVol := range srcVols {
+		if err = cs.internalMount(ctx, srcVol, nil, nil); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to mount src nfs server of %s: %v", srcVol.id, err)
+		}
+		mounted = append(mounted, srcVol)
+	}
+
+	creationTime := timestamppb.Now()
+	errs := make([]error, len(srcVols))
+	var wg sync.WaitGroup
+	for i, srcVol := range srcVols {
+		wg.Add(1)
+		go func(i int, srcVol *nfsVolume) {
+			defer wg.Done()
+			snap := snapshots[getVolumeName(srcVol)]
+			srcPath := getInternalVolumePath(cs.Driver.workingMountDir, srcVol)
+			dstPath := filepath.Join(groupPath, snap.src, snap.archiveName())
+			klog.FromContext(ctx).V(2).Info("archiving", "src", srcPath, "dst", dstPath, "compression", snap.compression)
+			if err := createSnapshotArchive(srcPath, dstPath, snap.compression); err != nil {
+				errs[i] = fmt.Errorf("failed to create archive of %s: %v", srcVol.id, err)
+				return
+			}
+			if err := writeSnapshotSourceVolumeID(filepath.Join(groupPath, snap.src), snap, srcVol.id); err != nil {
+				errs[i] = fmt.Errorf("failed to record source volume of %s: %v", srcVol.id, err)
+				return
+			}
+			klog.FromContext(ctx).V(2).Info("archived", "src", srcPath, "dst", dstPath)
+		}(i, srcVol)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to create archive for group snapshot: %v", err)
+		}
+	}
+
+	resp := &csi.CreateVolumeGroupSnapshotResponse{
+		GroupSnapshot: &csi.VolumeGroupSnapshot{
+			GroupSnapshotId: group.id,
+			CreationTime:    creationTime,
+			ReadyToUse:      true,
+		},
+	}
+	for _, srcVol := range srcVols {
+		snap := snapshots[getVolumeName(srcVol)]
+		var snapshotSize int64
+		fi, err := os.Stat(filepath.Join(groupPath, snap.src, snap.archiveName()))
+		if err != nil {
+			klog.FromContext(ctx).Info("failed to determine snapshot size", "snapshotID", snap.id, "err", err)
+		} else {
+			snapshotSize = fi.Size()
+		}
+		resp.GroupSnapshot.Snapshots = append(resp.GroupSnapshot.Snapshots, &csi.Snapshot{
+			SnapshotId:      snap.id,
+			SourceVolumeId:  srcVol.id,
+			SizeBytes:       snapshotSize,
+			CreationTime:    creationTime,
+			ReadyToUse:      true,
+			GroupSnapshotId: group.id,
+		})
+	}
+	return resp, nil
+}
+
+// DeleteVolumeGroupSnapshot removes the group directory with archives of all member snapshots
+func (cs *ControllerServer) DeleteVolumeGroupSnapshot(ctx context.Context, req *csi.DeleteVolumeGroupSnapshotRequest) (*csi.DeleteVolumeGroupSnapshotResponse, error) {
+	if len(req.GetGroupSnapshotId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Group snapshot ID is required for deletion")
+	}
+	group, err := getNfsGroupSnapFromID(req.GetGroupSnapshotId())
+	if err != nil {
+		// An invalid ID should be treated as doesn't exist
+		klog.FromContext(ctx).Info("failed to get nfs group snapshot for deletion", "groupSnapshotID", req.GetGroupSnapshotId(), "err", err)
+		return &csi.DeleteVolumeGroupSnapshotResponse{}, nil
+	}
+	if err := validateGroupSnapshotMembers(group, req.GetSnapshotIds()); err != nil {
+		return nil, err
+	}
+
+	if acquired := cs.Driver.volumeLocks.TryAcquire(group.name); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, group.name)
+	}
+	defer cs.Driver.volumeLocks.Release(group.name)
+
+	vol := volumeFromGroupSnapshot(group)
+	if err = cs.internalMount(ctx, vol, nil, getVolCapFromSecrets(req.GetSecrets())); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mount nfs server for group snapshot deletion: %v", err)
+	}
+	defer func() {
+		if err := cs.internalUnmount(ctx, vol); err != nil {
+			klog.FromContext(ctx).Info("failed to unmount nfs server after group snapshot deletion", "err", err)
+		}
+	}()
+
+	internalVolumePath := getInternalVolumePath(cs.Driver.workingMountDir, vol)
+	klog.FromContext(ctx).V(2).Info("removing group snapshot archives", "path", internalVolumePath)
+	if err = os.RemoveAll(internalVolumePath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete subdirectory: %v", err.Error())
+	}
+	return &csi.DeleteVolumeGroupSnapshotResponse{}, nil
+}
+
+// GetVolumeGroupSnapshot returns the member snapshots whose archives exist in the group directory
+func (cs *ControllerServer) GetVolumeGroupSnapshot(ctx context.Context, req *csi.GetVolumeGroupSnapshotRequest) (*csi.GetVolumeGroupSnapshotResponse, error) {
+	if len(req.GetGroupSnapshotId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Group snapshot ID is required")
+	}
+	group, err := getNfsGroupSnapFromID(req.GetGroupSnapshotId())
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "failed to get nfs group snapshot from id %s: %v", req.GetGroupSnapshotId(), err)
+	}
+	if err := validateGroupSnapshotMembers(group, req.GetSnapshotIds()); err != nil {
+		return nil, err
+	}
+
+	vol := volumeFromGroupSnapshot(group)
+	if err = cs.internalMount(ctx, vol, nil, getVolCapFromSecrets(req.GetSecrets())); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mount nfs server for group snapshot: %v", err)
+	}
+	defer func() {
+		if err := cs.internalUnmount(ctx, vol); err != nil {
+			klog.FromContext(ctx).Info("failed to unmount nfs server after getting group snapshot", "err", err)
+		}
+	}()
+
+	groupPath := getInternalVolumePath(cs.Driver.workingMountDir, vol)
+	fi, err := os.Stat(groupPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "group snapshot %s does not exist", req.GetGroupSnapshotId())
+		}
+		return nil, status.Errorf(codes.Internal, "failed to stat group snapshot directory %s: %v", groupPath, err)
+	}
+	groupSnapshot := &csi.VolumeGroupSnapshot{
+		GroupSnapshotId: group.id,
+		CreationTime:    timestamppb.New(fi.ModTime()),
+		ReadyToUse:      true,
+	}
+	for _, snapshotID := range req.GetSnapshotIds() {
+		snap, _ := getNfsSnapFromID(snapshotID)
+		info, err := findSnapshot(filepath.Join(groupPath, snap.src), snap)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, status.Errorf(codes.NotFound, "snapshot archive of %s does not exist in group snapshot %s", snap.src, group.id)
+			}
+			return nil, status.Errorf(codes.Internal, "failed to stat snapshot archive of %s: %v", snap.src, err)
+		}
+		snapshot := newCSISnapshot(snap, info.sourceVolumeID, info)
+		snapshot.GroupSnapshotId = group.id
+		groupSnapshot.Snapshots = append(groupSnapshot.Snapshots, snapshot)
+	}
+	return &csi.GetVolumeGroupSnapshotResponse{GroupSnapshot: groupSnapshot}, nil
+}
+
+// validateGroupSnapshot returns AlreadyExists if the group directory has snapshots of other source volumes,
+// i.e. a group snapshot with the same name but different source volumes exists
+func validateGroupSnapshot(groupPath string, snapshots map[string]*nfsSnapshot) error {
+	entries, err := os.ReadDir(groupPath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to read group snapshot directory %s: %v", groupPath, err)
+	}
+	for _, entry := range entries {
+		if _, ok := snapshots[entry.Name()]; !ok {
+			return status.Errorf(codes.AlreadyExists, "group snapshot with the same name but different source volumes already exists: found %q", entry.Name())
+		}
+	}
+	return nil
+}
+
+// validateGroupSnapshotMembers returns InvalidArgument if any snapshot is not a member of the group
+func validateGroupSnapshotMembers(group *nfsGroupSnapshot, snapshotIDs []string) error {
+	for _, snapshotID := range snapshotIDs {
+		snap, err := getNfsSnapFromID(snapshotID)
+		if err != nil || !group.isMember(snap) {
+			return status.Errorf(codes.InvalidArgument, "snapshot %s is not in group snapshot %s", snapshotID, group.id)
+		}
+	}
+	return nil
+}
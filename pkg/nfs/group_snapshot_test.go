@@ -0,0 +1,249 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGetNfsGroupSnapFromID(t *testing.T) {
+	cases := []struct {
+		desc      string
+		id        string
+		expected  *nfsGroupSnapshot
+		expectErr bool
+	}{
+		{
+			desc: "valid id",
+			id:   "nfs-server.default.svc.cluster.local#share#group-name",
+			expected: &nfsGroupSnapshot{
+				id:      "nfs-server.default.svc.cluster.local#share#group-name",
+				server:  "nfs-server.default.svc.cluster.local",
+				baseDir: "share",
+				name:    "group-name",
+			},
+		},
+		{
+			desc:      "snapshot id",
+			id:        "nfs-server.default.svc.cluster.local#share#snapshot-name#snapshot-name#src-pv-name",
+			expectErr: true,
+		},
+		{
+			desc:      "empty group name",
+			id:        "nfs-server.default.svc.cluster.local#share#",
+			expectErr: true,
+		},
+	}
+	for _, test := range cases {
+		t.Run(test.desc, func(t *testing.T) {
+			group, err := getNfsGroupSnapFromID(test.id)
+			if (err != nil) != test.expectErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(group, test.expected) {
+				t.Errorf("got %+v, expected %+v", group, test.expected)
+			}
+		})
+	}
+}
+
+func TestVolumeGroupSnapshot(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.workingMountDir = t.TempDir()
+	srcVolumeIDs := []string{
+		"nfs-server.default.svc.cluster.local#share#subdir-a#src-pv-a",
+		"nfs-server.default.svc.cluster.local#share#subdir-b#src-pv-b",
+	}
+	for _, dir := range []string{"src-pv-a/subdir-a", "src-pv-b/subdir-b"} {
+		if err := os.MkdirAll(filepath.Join(cs.Driver.workingMountDir, dir), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(cs.Driver.workingMountDir, dir, "data"), []byte("data"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := cs.CreateVolumeGroupSnapshot(context.TODO(), &csi.CreateVolumeGroupSnapshotRequest{
+		Name:            "group-name",
+		SourceVolumeIds: srcVolumeIDs,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	groupID := "nfs-server.default.svc.cluster.local#share#group-name"
+	expectedSnapshotIDs := []string{
+		"nfs-server.default.svc.cluster.local#share#group-name/src-pv-a#group-name/src-pv-a#src-pv-a",
+		"nfs-server.default.svc.cluster.local#share#group-name/src-pv-b#group-name/src-pv-b#src-pv-b",
+	}
+	if resp.GroupSnapshot.GroupSnapshotId != groupID || !resp.GroupSnapshot.ReadyToUse {
+		t.Errorf("unexpected group snapshot %+v", resp.GroupSnapshot)
+	}
+	if len(resp.GroupSnapshot.Snapshots) != len(expectedSnapshotIDs) {
+		t.Fatalf("got %d snapshots, expected %d", len(resp.GroupSnapshot.Snapshots), len(expectedSnapshotIDs))
+	}
+	for i, snapshot := range resp.GroupSnapshot.Snapshots {
+		if snapshot.SnapshotId != expectedSnapshotIDs[i] || snapshot.SourceVolumeId != srcVolumeIDs[i] || snapshot.GroupSnapshotId != groupID || snapshot.SizeBytes == 0 {
+			t.Errorf("unexpected snapshot %+v", snapshot)
+		}
+	}
+	for _, archive := range []string{"src-pv-a/src-pv-a.tar.gz", "src-pv-b/src-pv-b.tar.gz"} {
+		if _, err := os.Stat(filepath.Join(cs.Driver.workingMountDir, "group-name", "group-name", archive)); err != nil {
+			t.Errorf("archive %s is not created: %v", archive, err)
+		}
+	}
+	for i, source := range []string{"src-pv-a/src-pv-a.source", "src-pv-b/src-pv-b.source"} {
+		data, err := os.ReadFile(filepath.Join(cs.Driver.workingMountDir, "group-name", "group-name", source))
+		if err != nil || string(data) != srcVolumeIDs[i] {
+			t.Errorf("got source volume %q of %s, expected %q, err: %v", string(data), source, srcVolumeIDs[i], err)
+		}
+	}
+
+	// member snapshot is restored from the archive in the group directory of the share like a snapshot created by CreateSnapshot
+	snap, err := getNfsSnapFromID(expectedSnapshotIDs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapVol := volumeFromSnapshot(snap)
+	archivePath, _ := filepath.Rel(getInternalMountPath(cs.Driver.workingMountDir, snapVol), filepath.Join(getInternalVolumePath(cs.Driver.workingMountDir, snapVol), snap.archiveName()))
+	if archivePath != "group-name/src-pv-a/src-pv-a.tar.gz" {
+		t.Errorf("got archive path %s of member snapshot", archivePath)
+	}
+
+	// retry with the same sources is idempotent
+	if _, err := cs.CreateVolumeGroupSnapshot(context.TODO(), &csi.CreateVolumeGroupSnapshotRequest{
+		Name:            "group-name",
+		SourceVolumeIds: srcVolumeIDs,
+	}); err != nil {
+		t.Errorf("unexpected error on retry: %v", err)
+	}
+	// same name with different sources
+	_, err = cs.CreateVolumeGroupSnapshot(context.TODO(), &csi.CreateVolumeGroupSnapshotRequest{
+		Name:            "group-name",
+		SourceVolumeIds: srcVolumeIDs[:1],
+	})
+	if status.Code(err) != codes.AlreadyExists {
+		t.Errorf("got %v, expected AlreadyExists", err)
+	}
+
+	getResp, err := cs.GetVolumeGroupSnapshot(context.TODO(), &csi.GetVolumeGroupSnapshotRequest{
+		GroupSnapshotId: groupID,
+		SnapshotIds:     expectedSnapshotIDs,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(getResp.GroupSnapshot.Snapshots) != len(expectedSnapshotIDs) {
+		t.Fatalf("got %d snapshots, expected %d", len(getResp.GroupSnapshot.Snapshots), len(expectedSnapshotIDs))
+	}
+	for i, snapshot := range getResp.GroupSnapshot.Snapshots {
+		if snapshot.SnapshotId != expectedSnapshotIDs[i] || snapshot.SourceVolumeId != srcVolumeIDs[i] || snapshot.GroupSnapshotId != groupID {
+			t.Errorf("unexpected snapshot %+v", snapshot)
+		}
+	}
+	_, err = cs.GetVolumeGroupSnapshot(context.TODO(), &csi.GetVolumeGroupSnapshotRequest{
+		GroupSnapshotId: groupID,
+		SnapshotIds:     []string{"nfs-server.default.svc.cluster.local#share#snapshot-name#snapshot-name#src-pv-a"},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v, expected InvalidArgument", err)
+	}
+
+	if _, err := cs.DeleteVolumeGroupSnapshot(context.TODO(), &csi.DeleteVolumeGroupSnapshotRequest{
+		GroupSnapshotId: groupID,
+		SnapshotIds:     expectedSnapshotIDs,
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cs.Driver.workingMountDir, "group-name", "group-name")); !os.IsNotExist(err) {
+		t.Errorf("group snapshot directory is not removed: %v", err)
+	}
+	_, err = cs.GetVolumeGroupSnapshot(context.TODO(), &csi.GetVolumeGroupSnapshotRequest{GroupSnapshotId: groupID})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("got %v, expected NotFound", err)
+	}
+	// deletion of nonexisting or invalid group snapshot succeeds
+	for _, id := range []string{groupID, "invalid-group-id"} {
+		if _, err := cs.DeleteVolumeGroupSnapshot(context.TODO(), &csi.DeleteVolumeGroupSnapshotRequest{GroupSnapshotId: id}); err != nil {
+			t.Errorf("unexpected error deleting %s: %v", id, err)
+		}
+	}
+}
+
+func TestCreateVolumeGroupSnapshotInvalidArgument(t *testing.T) {
+	cases := []struct {
+		desc string
+		req  *csi.CreateVolumeGroupSnapshotRequest
+	}{
+		{
+			desc: "name is missing",
+			req: &csi.CreateVolumeGroupSnapshotRequest{
+				SourceVolumeIds: []string{"nfs-server.default.svc.cluster.local#share#subdir#src-pv-name"},
+			},
+		},
+		{
+			desc: "source volumes are missing",
+			req:  &csi.CreateVolumeGroupSnapshotRequest{Name: "group-name"},
+		},
+		{
+			desc: "source volumes with the same name",
+			req: &csi.CreateVolumeGroupSnapshotRequest{
+				Name: "group-name",
+				SourceVolumeIds: []string{
+					"nfs-server.default.svc.cluster.local#share#subdir#src-pv-name",
+					"nfs-server-2.default.svc.cluster.local#share#subdir#src-pv-name",
+				},
+			},
+		},
+		{
+			desc: "invalid parameter",
+			req: &csi.CreateVolumeGroupSnapshotRequest{
+				Name:            "group-name",
+				SourceVolumeIds: []string{"nfs-server.default.svc.cluster.local#share#subdir#src-pv-name"},
+				Parameters:      map[string]string{"unknown": "value"},
+			},
+		},
+	}
+	for _, test := range cases {
+		t.Run(test.desc, func(t *testing.T) {
+			cs := initTestController(t)
+			cs.Driver.workingMountDir = t.TempDir()
+			_, err := cs.CreateVolumeGroupSnapshot(context.TODO(), test.req)
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("got %v, expected InvalidArgument", err)
+			}
+		})
+	}
+}
+
+func TestGroupControllerGetCapabilities(t *testing.T) {
+	cs := initTestController(t)
+	resp, err := cs.GroupControllerGetCapabilities(context.TODO(), &csi.GroupControllerGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(resp.Capabilities) != 1 || resp.Capabilities[0].GetRpc().GetType() != csi.GroupControllerServiceCapability_RPC_CREATE_DELETE_GET_VOLUME_GROUP_SNAPSHOT {
+		t.Errorf("unexpected capabilities %v", resp.Capabilities)
+	}
+}
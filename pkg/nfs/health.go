@@ -0,0 +1,121 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+const (
+	// time to cache the result of mount health check, so frequent probes don't stat mounts and dial servers every time
+	mountHealthCacheTTL = 10 * time.Second
+	// time to wait for each stat on mount point and dial to nfs server, it should be less than --probe-timeout of livenessprobe
+	mountHealthCheckTimeout = 2 * time.Second
+	nfsPort                 = "2049"
+)
+
+// mountHealthCache is the result of the last mount health check
+type mountHealthCache struct {
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// dialNFSServer checks nfs server is resolvable and reachable on nfs port, could be replaced in unit tests
+var dialNFSServer = func(ctx context.Context, server string, timeout time.Duration) error {
+	return dialTCP(ctx, net.JoinHostPort(strings.Trim(server, "[]"), nfsPort), timeout)
+}
+
+// checkMountHealth returns error if a nfs mount of volumes hangs or nfs server of the mounts is unreachable,
+// the result is cached for mountHealthCacheTTL
+func (ns *NodeServer) checkMountHealth(ctx context.Context) error {
+	ns.mountHealth.mu.Lock()
+	defer ns.mountHealth.mu.Unlock()
+	if !ns.mountHealth.checked.IsZero() && time.Since(ns.mountHealth.checked) < mountHealthCacheTTL {
+		return ns.mountHealth.err
+	}
+	ns.mountHealth.err = ns.probeMountHealth(ctx)
+	ns.mountHealth.checked = time.Now()
+	return ns.mountHealth.err
+}
+
+// probeMountHealth stats mount points and dials servers of published mounts and nfs mounts of volumes in mount table,
+// mounts made before node plugin restarts are only in mount table
+func (ns *NodeServer) probeMountHealth(ctx context.Context) error {
+	mounts := map[string]string{}
+	for targetPath, m := range ns.mountTracker.list() {
+		mounts[targetPath] = m.server
+	}
+	tableMounts, err := listNFSMounts()
+	if err != nil {
+		klog.FromContext(ctx).V(4).Info("failed to list nfs mounts", "err", err)
+	}
+	for mountPoint, source := range tableMounts {
+		if _, ok := mounts[mountPoint]; !ok && strings.Contains(mountPoint, kubeletCSIVolumeDir) {
+			mounts[mountPoint] = getServerOfMountSource(source)
+		}
+	}
+	servers := map[string]bool{}
+	for _, server := range mounts {
+		if server != "" {
+			servers[server] = true
+		}
+	}
+
+	// mounts and servers are checked concurrently, so probe returns in timeout with many volumes
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	addErr := func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	}
+	for mountPoint := range mounts {
+		wg.Add(1)
+		go func(mountPoint string) {
+			defer wg.Done()
+			// corrupted mount is remounted by stale mount reconciler, only hung mount is unhealthy
+			if err := probeMount(mountPoint, mountHealthCheckTimeout); err != nil && !os.IsNotExist(err) && !mount.IsCorruptedMnt(err) {
+				addErr(fmt.Errorf("mount %s is not responding: %v", mountPoint, err))
+			}
+		}(mountPoint)
+	}
+	for server := range servers {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			if err := dialNFSServer(ctx, server, mountHealthCheckTimeout); err != nil {
+				addErr(fmt.Errorf("nfs server %s is unreachable: %v", server, err))
+			}
+		}(server)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
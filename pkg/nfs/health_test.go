@@ -0,0 +1,110 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheckMountHealth(t *testing.T) {
+	const target = "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pv/mount"
+	tests := []struct {
+		desc      string
+		probeErr  error
+		dialErr   error
+		expectErr bool
+	}{
+		{
+			desc: "healthy mount",
+		},
+		{
+			desc:      "hung mount",
+			probeErr:  fmt.Errorf("stat %s timed out after %v", target, mountHealthCheckTimeout),
+			expectErr: true,
+		},
+		{
+			desc:     "stale file handle",
+			probeErr: &os.PathError{Op: "stat", Path: target, Err: syscall.ESTALE},
+		},
+		{
+			desc:     "target path removed",
+			probeErr: &os.PathError{Op: "stat", Path: target, Err: syscall.ENOENT},
+		},
+		{
+			desc:      "nfs server unreachable",
+			dialErr:   fmt.Errorf("dial tcp: lookup server: no such host"),
+			expectErr: true,
+		},
+	}
+
+	origProbeMount, origDialNFSServer := probeMount, dialNFSServer
+	defer func() { probeMount, dialNFSServer = origProbeMount, origDialNFSServer }()
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			var dialed []string
+			probeMount = func(string, time.Duration) error { return test.probeErr }
+			dialNFSServer = func(_ context.Context, server string, _ time.Duration) error {
+				dialed = append(dialed, server)
+				return test.dialErr
+			}
+			ns, err := getTestNodeServer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ns.mountTracker.add(target, publishedMount{volumeID: "vol_1", server: "server", source: "server:/share"})
+			if err := ns.checkMountHealth(context.TODO()); (err != nil) != test.expectErr {
+				t.Errorf("unexpected error: %v, expected error: %v", err, test.expectErr)
+			}
+			if len(dialed) != 1 || dialed[0] != "server" {
+				t.Errorf("unexpected dialed servers %v", dialed)
+			}
+			// result is cached
+			if err := ns.checkMountHealth(context.TODO()); (err != nil) != test.expectErr || len(dialed) != 1 {
+				t.Errorf("result is not cached, error: %v, dialed servers: %v", err, dialed)
+			}
+		})
+	}
+}
+
+func TestProbeWithMountHealth(t *testing.T) {
+	origProbeMount := probeMount
+	defer func() { probeMount = origProbeMount }()
+	probeMount = func(targetPath string, timeout time.Duration) error {
+		return fmt.Errorf("stat %s timed out after %v", targetPath, timeout)
+	}
+	ns, err := getTestNodeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.Driver.ns = &ns
+	ns.Driver.enableMountHealthProbe = true
+	ns.mountTracker.add("/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pv/mount", publishedMount{volumeID: "vol_1", source: "server:/share"})
+
+	ids := IdentityServer{Driver: ns.Driver}
+	if _, err := ids.Probe(context.TODO(), &csi.ProbeRequest{}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got %v, expected FailedPrecondition", err)
+	}
+}
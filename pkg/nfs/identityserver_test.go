@@ -86,6 +86,13 @@ func TestGetPluginCapabilities(t *testing.T) {
 				},
 			},
 		},
+		{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_GROUP_CONTROLLER_SERVICE,
+				},
+			},
+		},
 	}
 
 	d := NewEmptyDriver("")
@@ -99,4 +106,15 @@ func TestGetPluginCapabilities(t *testing.T) {
 	assert.Equal(t, resp.XXX_sizecache, int32(0))
 	assert.Equal(t, resp.Capabilities, expectedCap)
 
+	d.enableTopology = true
+	resp, err = fakeIdentityServer.GetPluginCapabilities(context.Background(), &req)
+	assert.NoError(t, err)
+	expectedCap = append(expectedCap, &csi.PluginCapability{
+		Type: &csi.PluginCapability_Service_{
+			Service: &csi.PluginCapability_Service{
+				Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+			},
+		},
+	})
+	assert.Equal(t, resp.Capabilities, expectedCap)
 }
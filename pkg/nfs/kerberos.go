@@ -0,0 +1,251 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// key of keytab content in node stage secret
+	keytabField = "keytab"
+	// default path of the machine keytab used by rpc.gssd
+	DefaultKrb5KeytabPath = "/etc/krb5.keytab"
+	gssdProcessName       = "rpc.gssd"
+	// keytab on the node before the driver writes it, saved in the keytab dir
+	originalKeytabName = "original"
+)
+
+var (
+	kerberosSecFlavors = []string{"krb5", "krb5i", "krb5p"}
+	// procDir is where rpc.gssd process is looked up, could be replaced in unit tests
+	procDir = "/proc"
+	// first bytes of keytab file of version 0x502
+	keytabVersion = []byte{0x05, 0x02}
+	// keytabMutex serializes updates of keytabs by concurrent NodeStageVolume and NodeUnstageVolume
+	keytabMutex sync.Mutex
+)
+
+// getKerberosSecFlavor returns the kerberos security flavor in sec= mount option, returns empty string if there is none
+func getKerberosSecFlavor(mountOptions []string) string {
+	for _, options := range mountOptions {
+		for _, option := range strings.Split(options, ",") {
+			option = strings.TrimSpace(option)
+			if !strings.HasPrefix(option, "sec=") {
+				continue
+			}
+			// multiple flavors could be specified as sec=krb5p:krb5i
+			for _, flavor := range strings.Split(strings.TrimPrefix(option, "sec="), ":") {
+				for _, v := range kerberosSecFlavors {
+					if flavor == v {
+						return flavor
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// checkKerberosMount checks whether rpc.gssd is running
+func checkKerberosMount(flavor string) error {
+	running, err := isProcessRunning(procDir, gssdProcessName)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to check %s process: %v", gssdProcessName, err)
+	}
+	if !running {
+		return status.Errorf(codes.FailedPrecondition, "%s is not running, it's required by mount option sec=%s", gssdProcessName, flavor)
+	}
+	return nil
+}
+
+// getKeytab returns the keytab in secrets, empty if there is none
+func getKeytab(secrets map[string]string) string {
+	for k, v := range secrets {
+		if strings.EqualFold(k, keytabField) {
+			return v
+		}
+	}
+	return ""
+}
+
+// getVolumeKeytabDir returns the directory where keytabs of volumes are kept, the keytab read by rpc.gssd is merged
+// from them and the keytab on the node before the driver writes it
+func getVolumeKeytabDir(keytabPath string) string {
+	return keytabPath + ".d"
+}
+
+func getVolumeKeytabPath(keytabPath, volumeID string) string {
+	return filepath.Join(getVolumeKeytabDir(keytabPath), fmt.Sprintf("%x.keytab", sha256.Sum256([]byte(volumeID))))
+}
+
+// writeVolumeKeytab writes the keytab in node stage secrets of the volume to its own file and merges keytabs of all
+// volumes into keytabPath, so principals of other volumes and the node are kept in the keytab used by rpc.gssd
+func writeVolumeKeytab(ctx context.Context, volumeID string, secrets map[string]string, keytabPath string) error {
+	keytab := getKeytab(secrets)
+	if keytab == "" {
+		return nil
+	}
+	if keytabPath == "" {
+		return status.Error(codes.InvalidArgument, "keytab is provided in secrets while krb5 keytab path is not set on the driver")
+	}
+	if !isKeytab([]byte(keytab)) {
+		return status.Error(codes.InvalidArgument, "keytab in secrets is not a keytab file of version 0x502")
+	}
+
+	keytabMutex.Lock()
+	defer keytabMutex.Unlock()
+	if err := saveOriginalKeytab(ctx, keytabPath); err != nil {
+		return status.Errorf(codes.Internal, "failed to save original keytab %s: %v", keytabPath, err)
+	}
+	if err := writeKeytab(ctx, getVolumeKeytabPath(keytabPath, volumeID), []byte(keytab)); err != nil {
+		return status.Errorf(codes.Internal, "failed to write keytab of volume %s: %v", volumeID, err)
+	}
+	if err := mergeKeytabs(ctx, keytabPath); err != nil {
+		return status.Errorf(codes.Internal, "failed to write keytab to %s: %v", keytabPath, err)
+	}
+	return nil
+}
+
+// removeVolumeKeytab removes the keytab of the volume after it's unstaged and merges keytabs of other volumes again
+func removeVolumeKeytab(ctx context.Context, volumeID, keytabPath string) error {
+	if keytabPath == "" {
+		return nil
+	}
+	keytabMutex.Lock()
+	defer keytabMutex.Unlock()
+	if err := os.Remove(getVolumeKeytabPath(keytabPath, volumeID)); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return mergeKeytabs(ctx, keytabPath)
+}
+
+// saveOriginalKeytab copies the keytab on the node to the keytab dir before it's replaced by merged keytab for the first
+// time, an empty file is saved if there is no keytab
+func saveOriginalKeytab(ctx context.Context, keytabPath string) error {
+	originalPath := filepath.Join(getVolumeKeytabDir(keytabPath), originalKeytabName)
+	if _, err := os.Stat(originalPath); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	content, err := os.ReadFile(keytabPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return writeKeytab(ctx, originalPath, content)
+}
+
+// mergeKeytabs writes entries of the original keytab and keytabs of all volumes into keytabPath
+func mergeKeytabs(ctx context.Context, keytabPath string) error {
+	dir := getVolumeKeytabDir(keytabPath)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	merged := append([]byte{}, keytabVersion...)
+	// original keytab first, entries of volumes are sorted by file name
+	names := []string{originalKeytabName}
+	for _, entry := range entries {
+		if name := entry.Name(); name != originalKeytabName && strings.HasSuffix(name, ".keytab") {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if !isKeytab(content) {
+			if len(content) > 0 {
+				klog.FromContext(ctx).Info("skip merging file which is not a keytab file of version 0x502", "file", name)
+			}
+			continue
+		}
+		merged = append(merged, content[len(keytabVersion):]...)
+	}
+	return writeKeytab(ctx, keytabPath, merged)
+}
+
+// isKeytab checks the version of keytab file, entries of keytabs of version 0x502 could be concatenated
+func isKeytab(content []byte) bool {
+	return bytes.HasPrefix(content, keytabVersion)
+}
+
+// writeKeytab replaces the keytab file with content if it's changed
+func writeKeytab(ctx context.Context, path string, content []byte) error {
+	logger := klog.FromContext(ctx)
+	if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, content) {
+		logger.V(4).Info("skip writing keytab since it is up to date", "path", path)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// write to a temp file first so that rpc.gssd never reads a partial keytab
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	logger.V(2).Info("updating keytab", "path", path)
+	return os.Rename(f.Name(), path)
+}
+
+// isProcessRunning checks whether there is a process with name under procDir
+func isProcessRunning(procDir, name string) (bool, error) {
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		comm, err := os.ReadFile(filepath.Join(procDir, entry.Name(), "comm"))
+		if err != nil {
+			// not a process directory, or the process has exited
+			continue
+		}
+		if strings.TrimSpace(string(comm)) == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
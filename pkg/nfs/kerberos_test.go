@@ -0,0 +1,188 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGetKerberosSecFlavor(t *testing.T) {
+	tests := []struct {
+		desc         string
+		mountOptions []string
+		expected     string
+	}{
+		{
+			desc:         "no mount options",
+			mountOptions: nil,
+			expected:     "",
+		},
+		{
+			desc:         "sec=sys",
+			mountOptions: []string{"nfsvers=4.1", "sec=sys"},
+			expected:     "",
+		},
+		{
+			desc:         "sec=krb5p",
+			mountOptions: []string{"nfsvers=4.1", "sec=krb5p"},
+			expected:     "krb5p",
+		},
+		{
+			desc:         "sec=krb5i in comma separated mount options",
+			mountOptions: []string{"nfsvers=4.1,sec=krb5i,hard"},
+			expected:     "krb5i",
+		},
+		{
+			desc:         "multiple flavors",
+			mountOptions: []string{"sec=sys:krb5"},
+			expected:     "krb5",
+		},
+	}
+
+	for _, test := range tests {
+		result := getKerberosSecFlavor(test.mountOptions)
+		if result != test.expected {
+			t.Errorf("test[%s]: unexpected output: %v, expected result: %v", test.desc, result, test.expected)
+		}
+	}
+}
+
+func TestCheckKerberosMount(t *testing.T) {
+	fakeProcDir := func(t *testing.T, comms ...string) string {
+		dir := t.TempDir()
+		for i, comm := range comms {
+			pidDir := filepath.Join(dir, string(rune('1'+i)))
+			if err := os.MkdirAll(pidDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(pidDir, "comm"), []byte(comm+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dir
+	}
+
+	tests := []struct {
+		desc        string
+		comms       []string
+		expectedErr error
+	}{
+		{
+			desc:        "rpc.gssd is not running",
+			comms:       []string{"nfsplugin"},
+			expectedErr: status.Error(codes.FailedPrecondition, "rpc.gssd is not running, it's required by mount option sec=krb5p"),
+		},
+		{
+			desc:  "rpc.gssd is running",
+			comms: []string{"nfsplugin", "rpc.gssd"},
+		},
+	}
+
+	origProcDir := procDir
+	defer func() { procDir = origProcDir }()
+	for _, test := range tests {
+		procDir = fakeProcDir(t, test.comms...)
+		err := checkKerberosMount("krb5p")
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+	}
+}
+
+func TestWriteVolumeKeytab(t *testing.T) {
+	keytabPath := filepath.Join(t.TempDir(), "etc", "krb5.keytab")
+	if err := os.MkdirAll(filepath.Dir(keytabPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// keytab of the node is kept in merged keytab
+	if err := os.WriteFile(keytabPath, []byte("\x05\x02host"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc        string
+		volumeID    string
+		secrets     map[string]string
+		keytabPath  string
+		expectedErr error
+	}{
+		{
+			desc:       "no keytab in secrets",
+			volumeID:   "vol-1",
+			keytabPath: keytabPath,
+		},
+		{
+			desc:        "keytab path is not set",
+			volumeID:    "vol-1",
+			secrets:     map[string]string{"Keytab": "\x05\x02vol-1"},
+			expectedErr: status.Error(codes.InvalidArgument, "keytab is provided in secrets while krb5 keytab path is not set on the driver"),
+		},
+		{
+			desc:        "invalid keytab",
+			volumeID:    "vol-1",
+			secrets:     map[string]string{"keytab": "fake keytab"},
+			keytabPath:  keytabPath,
+			expectedErr: status.Error(codes.InvalidArgument, "keytab in secrets is not a keytab file of version 0x502"),
+		},
+		{
+			desc:       "write keytab of volume",
+			volumeID:   "vol-1",
+			secrets:    map[string]string{"keytab": "\x05\x02vol-1"},
+			keytabPath: keytabPath,
+		},
+		{
+			desc:       "write keytab of another volume",
+			volumeID:   "vol-2",
+			secrets:    map[string]string{"keytab": "\x05\x02vol-2"},
+			keytabPath: keytabPath,
+		},
+	}
+	for _, test := range tests {
+		err := writeVolumeKeytab(context.TODO(), test.volumeID, test.secrets, test.keytabPath)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+	}
+
+	content, err := os.ReadFile(keytabPath)
+	assert.NoError(t, err)
+	merged := string(content)
+	assert.True(t, strings.HasPrefix(merged, "\x05\x02host"))
+	assert.Contains(t, merged, "vol-1")
+	assert.Contains(t, merged, "vol-2")
+	assert.Len(t, merged, len("\x05\x02hostvol-1vol-2"))
+	fi, err := os.Stat(keytabPath)
+	assert.NoError(t, err)
+	if fi != nil && os.PathSeparator == '/' {
+		assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	}
+
+	assert.NoError(t, removeVolumeKeytab(context.TODO(), "vol-1", keytabPath))
+	content, err = os.ReadFile(keytabPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "\x05\x02hostvol-2", string(content))
+	assert.NoError(t, removeVolumeKeytab(context.TODO(), "vol-1", keytabPath))
+}
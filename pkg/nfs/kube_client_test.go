@@ -0,0 +1,37 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+)
+
+// fakeKubeResourceClient returns storage classes and persistent volumes in memory
+type fakeKubeResourceClient struct {
+	storageClasses []storagev1.StorageClass
+	pvs            []v1.PersistentVolume
+}
+
+func (c *fakeKubeResourceClient) listStorageClasses(ctx context.Context) ([]storagev1.StorageClass, error) {
+	return c.storageClasses, nil
+}
+
+func (c *fakeKubeResourceClient) listPersistentVolumes(ctx context.Context) ([]v1.PersistentVolume, error) {
+	return c.pvs, nil
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+)
+
+const (
+	DefaultLeaderElectionLeaseDuration  = 15 * time.Second
+	DefaultLeaderElectionRenewDeadline  = 10 * time.Second
+	DefaultLeaderElectionRetryPeriod    = 5 * time.Second
+	DefaultLeaderElectionHandoffTimeout = 25 * time.Second
+	// namespace of the pod, used if --leader-election-namespace is empty
+	inClusterNamespacePath = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+var invalidLeaseNameChars = regexp.MustCompile(`[^a-zA-Z0-9-]`)
+
+// getLeaderElectionLeaseName returns the lease of controller plugin, e.g. nfs-csi-k8s-io-nfsplugin of nfs.csi.k8s.io,
+// it's different from the leases of sidecars which are named after the driver
+func getLeaderElectionLeaseName(driverName string) string {
+	return strings.ToLower(invalidLeaseNameChars.ReplaceAllString(driverName, "-")) + "-nfsplugin"
+}
+
+func getLeaderElectionNamespace(namespace string) string {
+	if namespace != "" {
+		return namespace
+	}
+	if data, err := os.ReadFile(inClusterNamespacePath); err == nil {
+		if ns := strings.TrimSpace(string(data)); ns != "" {
+			return ns
+		}
+	}
+	return metav1.NamespaceDefault
+}
+
+func (n *Driver) newLeaderElector(ctx context.Context, onStartedLeading func(ctx context.Context), onStoppedLeading func()) (*leaderelection.LeaderElector, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", n.kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get kube config: %v", err)
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kube client: %v", err)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hostname: %v", err)
+	}
+	// controller runs with host network, hostname is the same for replicas on the same node
+	identity := fmt.Sprintf("%s_%s", hostname, uuid.NewUUID())
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      getLeaderElectionLeaseName(n.name),
+			Namespace: getLeaderElectionNamespace(n.leaderElectionNamespace),
+		},
+		Client:     client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+	logger := klog.FromContext(ctx)
+	logger.V(2).Info("leader election on lease", "lease", klog.KRef(lock.LeaseMeta.Namespace, lock.LeaseMeta.Name), "identity", identity)
+	return leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   n.leaderElectionLeaseDuration,
+		RenewDeadline:   n.leaderElectionRenewDeadline,
+		RetryPeriod:     n.leaderElectionRetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            getLeaderElectionLeaseName(n.name),
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: onStartedLeading,
+			OnStoppedLeading: onStoppedLeading,
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					logger.V(2).Info("new leader of controller plugin", "leader", leader)
+				}
+			},
+		},
+	})
+}
+
+// runWithLeaderElection runs controller loops only when the replica is the leader, on SIGTERM, grpc server is stopped
+// gracefully to finish in-flight operations(e.g. CreateVolume) before the lease is released, so another replica takes over
+// immediately without waiting for the lease to expire
+func (n *Driver) runWithLeaderElection(ctx context.Context, s NonBlockingGRPCServer, runControllerLoops func(ctx context.Context)) {
+	logger := klog.FromContext(ctx).WithName("leader-election")
+	ctx, cancel := context.WithCancel(klog.NewContext(ctx, logger))
+	shuttingDown := make(chan struct{})
+	elector, err := n.newLeaderElector(ctx, func(ctx context.Context) {
+		logger.V(2).Info("started leading, running controller loops")
+		runControllerLoops(ctx)
+	}, func() {
+		select {
+		case <-shuttingDown:
+			logger.V(2).Info("leader lease is released")
+		default:
+			// controller loops could not be stopped safely, another replica may have started them
+			logger.Error(nil, "lost leader lease")
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		}
+	})
+	if err != nil {
+		logger.Error(err, "failed to start leader election")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
+	released := make(chan struct{})
+	go func() {
+		elector.Run(ctx)
+		close(released)
+	}()
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		sig := <-signals
+		logger.V(2).Info("received signal, waiting for in-flight operations before releasing leader lease", "signal", sig, "timeout", n.leaderElectionHandoffTimeout)
+		close(shuttingDown)
+		stopGRPCServer(ctx, s, n.leaderElectionHandoffTimeout)
+		cancel()
+		<-released
+		os.Exit(0)
+	}()
+}
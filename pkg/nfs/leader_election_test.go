@@ -0,0 +1,51 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"testing"
+)
+
+func TestGetLeaderElectionLeaseName(t *testing.T) {
+	tests := []struct {
+		driverName string
+		expected   string
+	}{
+		{
+			driverName: DefaultDriverName,
+			expected:   "nfs-csi-k8s-io-nfsplugin",
+		},
+		{
+			driverName: "NFS2.csi.k8s.io",
+			expected:   "nfs2-csi-k8s-io-nfsplugin",
+		},
+	}
+	for _, test := range tests {
+		if name := getLeaderElectionLeaseName(test.driverName); name != test.expected {
+			t.Errorf("unexpected lease name %s of driver %s, expected %s", name, test.driverName, test.expected)
+		}
+	}
+}
+
+func TestGetLeaderElectionNamespace(t *testing.T) {
+	if ns := getLeaderElectionNamespace("kube-system"); ns != "kube-system" {
+		t.Errorf("unexpected namespace %s", ns)
+	}
+	if ns := getLeaderElectionNamespace(""); ns == "" {
+		t.Errorf("namespace should not be empty")
+	}
+}
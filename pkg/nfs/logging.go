@@ -0,0 +1,181 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/klog/v2"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// InitLogging sets the output format of logs, klog text format is used by default.
+// Loggers in context of CSI calls carry requestID, method, volumeID, targetPath and server in both formats.
+func InitLogging(format string) error {
+	switch format {
+	case "", LogFormatText:
+		return nil
+	case LogFormatJSON:
+		klog.SetLoggerWithOptions(logr.New(newJSONLogSink(os.Stderr)), klog.ContextualLogger(true))
+		return nil
+	default:
+		return fmt.Errorf("invalid log format %s, supported values are %s, %s", format, LogFormatText, LogFormatJSON)
+	}
+}
+
+// jsonLogSink writes a JSON object per line, verbosity is filtered by -v flag of klog
+type jsonLogSink struct {
+	mu        *sync.Mutex
+	w         io.Writer
+	name      string
+	values    []interface{}
+	callDepth int
+}
+
+func newJSONLogSink(w io.Writer) *jsonLogSink {
+	return &jsonLogSink{mu: &sync.Mutex{}, w: w}
+}
+
+func (s *jsonLogSink) Init(info logr.RuntimeInfo) {
+	s.callDepth = info.CallDepth
+}
+
+func (s *jsonLogSink) Enabled(level int) bool {
+	return klog.V(klog.Level(level)).Enabled()
+}
+
+func (s *jsonLogSink) Info(level int, msg string, keysAndValues ...interface{}) {
+	s.write(level, nil, msg, keysAndValues)
+}
+
+func (s *jsonLogSink) Error(err error, msg string, keysAndValues ...interface{}) {
+	s.write(-1, err, msg, keysAndValues)
+}
+
+func (s *jsonLogSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
+	sink := *s
+	sink.values = append(append([]interface{}{}, s.values...), keysAndValues...)
+	return &sink
+}
+
+func (s *jsonLogSink) WithName(name string) logr.LogSink {
+	sink := *s
+	if sink.name != "" {
+		name = sink.name + "/" + name
+	}
+	sink.name = name
+	return &sink
+}
+
+func (s *jsonLogSink) WithCallDepth(depth int) logr.LogSink {
+	sink := *s
+	sink.callDepth += depth
+	return &sink
+}
+
+// write prints the entry, level is -1 for errors
+func (s *jsonLogSink) write(level int, err error, msg string, keysAndValues []interface{}) {
+	entry := map[string]interface{}{
+		"ts":  time.Now().UTC().Format(time.RFC3339Nano),
+		"msg": msg,
+	}
+	if level >= 0 {
+		entry["v"] = level
+	}
+	// Info/Error of logr.Logger and write
+	if _, file, line, ok := runtime.Caller(s.callDepth + 2); ok {
+		entry["caller"] = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+	if s.name != "" {
+		entry["logger"] = s.name
+	}
+	if err != nil {
+		entry["err"] = err.Error()
+	}
+	addLogValues(entry, s.values)
+	addLogValues(entry, keysAndValues)
+
+	data, marshalErr := json.Marshal(entry)
+	if marshalErr != nil {
+		data, _ = json.Marshal(map[string]interface{}{"ts": entry["ts"], "msg": msg, "err": fmt.Sprintf("failed to marshal log entry: %v", marshalErr)})
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, _ = s.w.Write(append(data, '\n'))
+}
+
+// addLogValues adds key value pairs into entry, values which could not be marshaled are formatted as strings
+func addLogValues(entry map[string]interface{}, keysAndValues []interface{}) {
+	for i := 0; i < len(keysAndValues); i += 2 {
+		key := fmt.Sprint(keysAndValues[i])
+		var value interface{} = "(MISSING)"
+		if i+1 < len(keysAndValues) {
+			value = keysAndValues[i+1]
+		}
+		switch v := value.(type) {
+		case error:
+			value = v.Error()
+		case fmt.Stringer:
+			value = v.String()
+		default:
+			if _, err := json.Marshal(v); err != nil {
+				value = fmt.Sprintf("%+v", v)
+			}
+		}
+		entry[key] = value
+	}
+}
+
+// getRequestLogValues returns volumeID, server, name, targetPath and snapshotID of CSI request as key value pairs of logger
+func getRequestLogValues(req interface{}) []interface{} {
+	var values []interface{}
+	var volumeID string
+	switch r := req.(type) {
+	case interface{ GetVolumeId() string }:
+		volumeID = r.GetVolumeId()
+	case interface{ GetSourceVolumeId() string }:
+		volumeID = r.GetSourceVolumeId()
+	}
+	if volumeID != "" {
+		values = append(values, "volumeID", volumeID)
+		if vol, err := getNfsVolFromID(volumeID); err == nil {
+			values = append(values, "server", vol.server)
+		}
+	}
+	if r, ok := req.(interface{ GetName() string }); ok && r.GetName() != "" {
+		values = append(values, "name", r.GetName())
+	}
+	if r, ok := req.(interface{ GetTargetPath() string }); ok && r.GetTargetPath() != "" {
+		values = append(values, "targetPath", r.GetTargetPath())
+	}
+	if r, ok := req.(interface{ GetSnapshotId() string }); ok && r.GetSnapshotId() != "" {
+		values = append(values, "snapshotID", r.GetSnapshotId())
+	}
+	return values
+}
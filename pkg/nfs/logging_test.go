@@ -0,0 +1,130 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/go-logr/logr"
+)
+
+func TestInitLogging(t *testing.T) {
+	for _, format := range []string{"", LogFormatText} {
+		if err := InitLogging(format); err != nil {
+			t.Errorf("unexpected error %v for format %q", err, format)
+		}
+	}
+	if err := InitLogging("xml"); err == nil {
+		t.Errorf("expected error for invalid format")
+	}
+}
+
+func TestJSONLogSink(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logr.New(newJSONLogSink(&buf)).WithName("nfs").WithValues("requestID", "id", "volumeID", "server#share#subdir")
+	logger.Info("mounting", "targetPath", "/target", "mountflags", []string{"nfsvers=4.1"})
+	logger.Error(fmt.Errorf("connection refused"), "failed to mount", "source", "server:/share")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected log lines %q", lines)
+	}
+	var info, errEntry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &info); err != nil {
+		t.Fatalf("failed to parse %s: %v", lines[0], err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &errEntry); err != nil {
+		t.Fatalf("failed to parse %s: %v", lines[1], err)
+	}
+
+	for k, v := range map[string]interface{}{
+		"msg":        "mounting",
+		"logger":     "nfs",
+		"requestID":  "id",
+		"volumeID":   "server#share#subdir",
+		"targetPath": "/target",
+		"mountflags": []interface{}{"nfsvers=4.1"},
+		"v":          float64(0),
+	} {
+		if !reflect.DeepEqual(info[k], v) {
+			t.Errorf("unexpected %s: %v, expected %v", k, info[k], v)
+		}
+	}
+	if caller, _ := info["caller"].(string); !strings.HasPrefix(caller, "logging_test.go:") {
+		t.Errorf("unexpected caller %v", info["caller"])
+	}
+	for k, v := range map[string]interface{}{
+		"msg":    "failed to mount",
+		"err":    "connection refused",
+		"source": "server:/share",
+	} {
+		if !reflect.DeepEqual(errEntry[k], v) {
+			t.Errorf("unexpected %s: %v, expected %v", k, errEntry[k], v)
+		}
+	}
+	if _, ok := errEntry["v"]; ok {
+		t.Errorf("unexpected verbosity in error entry")
+	}
+}
+
+func TestGetRequestLogValues(t *testing.T) {
+	tests := []struct {
+		desc     string
+		req      interface{}
+		expected []interface{}
+	}{
+		{
+			desc: "node publish request",
+			req:  &csi.NodePublishVolumeRequest{VolumeId: "server#share#subdir", TargetPath: "/target"},
+			expected: []interface{}{
+				"volumeID", "server#share#subdir", "server", "server", "targetPath", "/target",
+			},
+		},
+		{
+			desc:     "create volume request",
+			req:      &csi.CreateVolumeRequest{Name: "pvc-1"},
+			expected: []interface{}{"name", "pvc-1"},
+		},
+		{
+			desc: "create snapshot request",
+			req:  &csi.CreateSnapshotRequest{SourceVolumeId: "server#share#subdir", Name: "snapshot-1"},
+			expected: []interface{}{
+				"volumeID", "server#share#subdir", "server", "server", "name", "snapshot-1",
+			},
+		},
+		{
+			desc:     "invalid volume id",
+			req:      &csi.DeleteVolumeRequest{VolumeId: "invalid"},
+			expected: []interface{}{"volumeID", "invalid"},
+		},
+		{
+			desc: "request without volume",
+			req:  &csi.ProbeRequest{},
+		},
+	}
+	for _, test := range tests {
+		if values := getRequestLogValues(test.req); !reflect.DeepEqual(values, test.expected) {
+			t.Errorf("test[%s]: unexpected values %v, expected %v", test.desc, values, test.expected)
+		}
+	}
+}
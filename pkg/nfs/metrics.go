@@ -0,0 +1,103 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const metricsNamespace = "csi_nfs"
+
+var (
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of CSI operations in seconds",
+		// mount and copy of volume content could take minutes
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 15, 30, 60, 120, 300, 600, 1200},
+	}, []string{"method", "code"})
+	operationsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "operations_in_flight",
+		Help:      "Number of CSI operations in progress",
+	}, []string{"method"})
+	operationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "operation_errors_total",
+		Help:      "Number of failed CSI operations",
+	}, []string{"method", "code"})
+	operationQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "operation_queue_depth",
+		Help:      "Number of CSI operations waiting for the concurrency limit",
+	}, []string{"method"})
+	operationConcurrencyLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "operation_concurrency_limit",
+		Help:      "Max concurrent CSI operations, it's not reported for operations without limit",
+	}, []string{"method"})
+)
+
+func init() {
+	prometheus.MustRegister(operationDuration, operationsInFlight, operationErrors, operationQueueDepth, operationConcurrencyLimit)
+}
+
+// metricsGRPC records duration, in-flight count and errors of grpc calls
+func metricsGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	// e.g. /csi.v1.Node/NodePublishVolume -> NodePublishVolume
+	method := path.Base(info.FullMethod)
+	inFlight := operationsInFlight.WithLabelValues(method)
+	inFlight.Inc()
+	defer inFlight.Dec()
+
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	code := status.Code(err).String()
+	operationDuration.WithLabelValues(method, code).Observe(time.Since(start).Seconds())
+	if err != nil {
+		operationErrors.WithLabelValues(method, code).Inc()
+	}
+	return resp, err
+}
+
+// serveMetrics serves prometheus metrics on the address at /metrics
+func serveMetrics(ctx context.Context, address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	logger := klog.FromContext(ctx)
+	logger.Info("serving metrics", "address", listener.Addr(), "path", "/metrics")
+	go func() {
+		if err := http.Serve(listener, mux); err != nil && err != http.ErrServerClosed {
+			logger.Error(err, "failed to serve metrics")
+		}
+	}()
+	return nil
+}
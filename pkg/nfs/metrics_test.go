@@ -0,0 +1,107 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func getHistogramCount(t *testing.T, o prometheus.Observer) uint64 {
+	m := &dto.Metric{}
+	if err := o.(prometheus.Metric).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestMetricsGRPC(t *testing.T) {
+	tests := []struct {
+		desc         string
+		method       string
+		handlerErr   error
+		expectedCode string
+	}{
+		{
+			desc:         "successful call",
+			method:       "/csi.v1.Node/NodePublishVolume",
+			expectedCode: "OK",
+		},
+		{
+			desc:         "failed call",
+			method:       "/csi.v1.Controller/CreateVolume",
+			handlerErr:   status.Error(codes.Internal, "fake error"),
+			expectedCode: "Internal",
+		},
+	}
+
+	for _, test := range tests {
+		name := test.method[strings.LastIndex(test.method, "/")+1:]
+		durationBefore := getHistogramCount(t, operationDuration.WithLabelValues(name, test.expectedCode))
+		errorsBefore := testutil.ToFloat64(operationErrors.WithLabelValues(name, test.expectedCode))
+
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			m := &dto.Metric{}
+			assert.NoError(t, operationsInFlight.WithLabelValues(name).Write(m))
+			assert.Equal(t, float64(1), m.GetGauge().GetValue(), test.desc)
+			return nil, test.handlerErr
+		}
+		_, err := metricsGRPC(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: test.method}, handler)
+		assert.Equal(t, test.handlerErr, err, test.desc)
+
+		assert.Equal(t, durationBefore+1, getHistogramCount(t, operationDuration.WithLabelValues(name, test.expectedCode)), test.desc)
+		expectedErrors := errorsBefore
+		if test.handlerErr != nil {
+			expectedErrors++
+		}
+		assert.Equal(t, expectedErrors, testutil.ToFloat64(operationErrors.WithLabelValues(name, test.expectedCode)), test.desc)
+
+		m := &dto.Metric{}
+		assert.NoError(t, operationsInFlight.WithLabelValues(name).Write(m))
+		assert.Equal(t, float64(0), m.GetGauge().GetValue(), test.desc)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	assert.Error(t, serveMetrics(context.TODO(), "invalid-address"))
+
+	// serveMetrics does not return the listening address, so a fixed local port is used
+	address := "127.0.0.1:29699"
+	if err := serveMetrics(context.TODO(), address); err != nil {
+		t.Skipf("skip since %s is not available: %v", address, err)
+	}
+	operationErrors.WithLabelValues("TestServeMetrics", "Internal").Inc()
+	resp, err := http.Get("http://" + address + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), `csi_nfs_operation_errors_total{code="Internal",method="TestServeMetrics"}`)
+}
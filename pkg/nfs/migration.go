@@ -0,0 +1,251 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// DefaultInTreeMigrationTimeout is the time to wait for deletion of each in-tree PV before it's created as CSI PV
+	DefaultInTreeMigrationTimeout = 2 * time.Minute
+	// annotation on CSI PV rewritten from in-tree nfs PV
+	migratedFromInTreeAnnotation = "nfs.csi.k8s.io/migrated-from-in-tree"
+	inTreeMigrationPollInterval  = time.Second
+)
+
+// InTreeMigrationOptions are options of the migrate-in-tree subcommand
+type InTreeMigrationOptions struct {
+	Kubeconfig string
+	DriverName string
+	// names of in-tree PVs to migrate, all in-tree nfs PVs are migrated if empty
+	PersistentVolumes []string
+	// only print PVs which would be migrated
+	DryRun bool
+	// time to wait for deletion of each in-tree PV
+	Timeout time.Duration
+}
+
+// inTreePVClient replaces persistent volumes, it could be replaced in unit tests.
+// Only get, list, create, delete and patch are used, which are granted to controller by helm chart.
+type inTreePVClient interface {
+	listPersistentVolumes(ctx context.Context) ([]v1.PersistentVolume, error)
+	getPersistentVolume(ctx context.Context, name string) (*v1.PersistentVolume, error)
+	patchPersistentVolume(ctx context.Context, name string, patch []byte) error
+	deletePersistentVolume(ctx context.Context, name string) error
+	createPersistentVolume(ctx context.Context, pv *v1.PersistentVolume) error
+}
+
+func (c *kubeResourceClient) getPersistentVolume(ctx context.Context, name string) (*v1.PersistentVolume, error) {
+	return c.client.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c *kubeResourceClient) patchPersistentVolume(ctx context.Context, name string, patch []byte) error {
+	_, err := c.client.CoreV1().PersistentVolumes().Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+func (c *kubeResourceClient) deletePersistentVolume(ctx context.Context, name string) error {
+	return c.client.CoreV1().PersistentVolumes().Delete(ctx, name, metav1.DeleteOptions{})
+}
+
+func (c *kubeResourceClient) createPersistentVolume(ctx context.Context, pv *v1.PersistentVolume) error {
+	_, err := c.client.CoreV1().PersistentVolumes().Create(ctx, pv, metav1.CreateOptions{})
+	return err
+}
+
+// parseInTreeVolumeHandle returns server and path of in-tree volume handle in format of {server}:{path}
+func parseInTreeVolumeHandle(handle string) (string, string, bool) {
+	if strings.Contains(handle, separator) {
+		return "", "", false
+	}
+	i := strings.Index(handle, ":/")
+	if i <= 0 {
+		return "", "", false
+	}
+	return handle[:i], handle[i+1:], true
+}
+
+// getInTreeVolumeHandle returns volume handle of in-tree nfs volume source, it's the same as the mount source
+func getInTreeVolumeHandle(source *v1.NFSVolumeSource) string {
+	return fmt.Sprintf("%s:%s", source.Server, source.Path)
+}
+
+// getMigratedVolumeContext returns volume context of in-tree nfs PV translated by CSI migration shim, volume context
+// of the translated PV is empty, server and share are read from its volume handle. volumeContext is returned as is
+// if in-tree migration is disabled or server is set in volumeContext.
+func (ns *NodeServer) getMigratedVolumeContext(volumeID string, volumeContext map[string]string) map[string]string {
+	if !ns.Driver.enableInTreeMigration {
+		return volumeContext
+	}
+	for k := range volumeContext {
+		if strings.EqualFold(k, paramServer) {
+			return volumeContext
+		}
+	}
+	server, path, ok := parseInTreeVolumeHandle(volumeID)
+	if !ok {
+		return volumeContext
+	}
+	migrated := map[string]string{paramServer: server, paramShare: path}
+	for k, v := range volumeContext {
+		migrated[k] = v
+	}
+	return migrated
+}
+
+// buildCSIPersistentVolume returns CSI PV of the driver with the same name, spec and claimRef of in-tree nfs PV,
+// so that the bound PVC is still bound to it after the in-tree PV is replaced
+func buildCSIPersistentVolume(pv *v1.PersistentVolume, driverName string) *v1.PersistentVolume {
+	source := pv.Spec.NFS
+	csiPV := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pv.Name,
+			Labels:      pv.Labels,
+			Annotations: map[string]string{},
+		},
+		Spec: *pv.Spec.DeepCopy(),
+	}
+	for k, v := range pv.Annotations {
+		csiPV.Annotations[k] = v
+	}
+	csiPV.Annotations[migratedFromInTreeAnnotation] = getInTreeVolumeHandle(source)
+	csiPV.Spec.PersistentVolumeSource = v1.PersistentVolumeSource{
+		CSI: &v1.CSIPersistentVolumeSource{
+			Driver:       driverName,
+			VolumeHandle: getInTreeVolumeHandle(source),
+			ReadOnly:     source.ReadOnly,
+			VolumeAttributes: map[string]string{
+				paramServer: source.Server,
+				paramShare:  source.Path,
+			},
+		},
+	}
+	if csiPV.Spec.ClaimRef != nil {
+		csiPV.Spec.ClaimRef.ResourceVersion = ""
+	}
+	// recycler is not supported by CSI
+	if csiPV.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimRecycle {
+		csiPV.Spec.PersistentVolumeReclaimPolicy = v1.PersistentVolumeReclaimRetain
+	}
+	return csiPV
+}
+
+// RunInTreeMigration rewrites in-tree nfs PVs to CSI PVs of the driver, it's run by `nfsplugin migrate-in-tree`.
+// Each in-tree PV is set to Retain, deleted and created again with CSI volume source, its bound PVC is rebound by
+// PV controller since claimRef is kept. Running pods keep their mounts, the CSI PV is mounted on next pod start.
+func RunInTreeMigration(ctx context.Context, w io.Writer, opts *InTreeMigrationOptions) error {
+	client, err := newKubeResourceClient(opts.Kubeconfig)
+	if err != nil {
+		return err
+	}
+	return migrateInTreePVs(ctx, w, client, opts)
+}
+
+func migrateInTreePVs(ctx context.Context, w io.Writer, client inTreePVClient, opts *InTreeMigrationOptions) error {
+	pvs, err := client.listPersistentVolumes(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list persistent volumes: %v", err)
+	}
+	names := sets.NewString(opts.PersistentVolumes...)
+	var migrated, failed int
+	for i := range pvs {
+		pv := &pvs[i]
+		if pv.Spec.NFS == nil || (names.Len() > 0 && !names.Has(pv.Name)) {
+			continue
+		}
+		names.Delete(pv.Name)
+		if opts.DryRun {
+			fmt.Fprintf(w, "[dry-run] pv %s(%s) would be migrated to %s\n", pv.Name, getInTreeVolumeHandle(pv.Spec.NFS), opts.DriverName)
+			continue
+		}
+		if err := migrateInTreePV(ctx, w, client, pv, opts); err != nil {
+			fmt.Fprintf(w, "[FAIL] pv %s: %v\n", pv.Name, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(w, "[OK] pv %s(%s) is migrated to %s\n", pv.Name, getInTreeVolumeHandle(pv.Spec.NFS), opts.DriverName)
+		migrated++
+	}
+	for _, name := range names.List() {
+		fmt.Fprintf(w, "[FAIL] pv %s is not an in-tree nfs persistent volume\n", name)
+		failed++
+	}
+	fmt.Fprintf(w, "%d persistent volumes migrated, %d failed\n", migrated, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d persistent volumes failed to migrate", failed)
+	}
+	return nil
+}
+
+// migrateInTreePV replaces in-tree nfs PV with CSI PV of the same name, manifest of the in-tree PV is written to w
+// before it's deleted, so it could be created again manually if the CSI PV could not be created
+func migrateInTreePV(ctx context.Context, w io.Writer, client inTreePVClient, pv *v1.PersistentVolume, opts *InTreeMigrationOptions) error {
+	csiPV := buildCSIPersistentVolume(pv, opts.DriverName)
+	manifest, err := json.Marshal(pv)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "migrating pv %s, original manifest: %s\n", pv.Name, string(manifest))
+
+	// data is kept on the nfs server when the in-tree PV is deleted
+	if pv.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimRetain {
+		patch := fmt.Sprintf(`{"spec":{"persistentVolumeReclaimPolicy":%q}}`, v1.PersistentVolumeReclaimRetain)
+		if err := client.patchPersistentVolume(ctx, pv.Name, []byte(patch)); err != nil {
+			return fmt.Errorf("failed to set reclaim policy to Retain: %v", err)
+		}
+	}
+	if err := client.deletePersistentVolume(ctx, pv.Name); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete in-tree pv: %v", err)
+	}
+	// pv-protection finalizer blocks deletion while the PV is bound
+	if err := client.patchPersistentVolume(ctx, pv.Name, []byte(`{"metadata":{"finalizers":null}}`)); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to remove finalizers of in-tree pv: %v", err)
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultInTreeMigrationTimeout
+	}
+	err = wait.PollImmediateWithContext(ctx, inTreeMigrationPollInterval, timeout, func(ctx context.Context) (bool, error) {
+		if _, err := client.getPersistentVolume(ctx, pv.Name); err != nil {
+			if apierrors.IsNotFound(err) {
+				return true, nil
+			}
+			return false, err
+		}
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("in-tree pv is not deleted: %v", err)
+	}
+	if err := client.createPersistentVolume(ctx, csiPV); err != nil {
+		return fmt.Errorf("failed to create csi pv, create the in-tree pv again with the original manifest: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	mount "k8s.io/mount-utils"
+)
+
+// fakeInTreePVClient keeps PVs in memory, deleted PVs are kept until their finalizers are removed like pv-protection
+type fakeInTreePVClient struct {
+	// removed PVs are set as nil since builtin delete is shadowed by onDelete value of the package
+	pvs       map[string]*v1.PersistentVolume
+	deleting  map[string]bool
+	actions   []string
+	createErr error
+}
+
+func newFakeInTreePVClient(pvs ...v1.PersistentVolume) *fakeInTreePVClient {
+	c := &fakeInTreePVClient{pvs: map[string]*v1.PersistentVolume{}, deleting: map[string]bool{}}
+	for i := range pvs {
+		c.pvs[pvs[i].Name] = pvs[i].DeepCopy()
+	}
+	return c
+}
+
+func (c *fakeInTreePVClient) notFound(name string) error {
+	return apierrors.NewNotFound(schema.GroupResource{Resource: "persistentvolumes"}, name)
+}
+
+func (c *fakeInTreePVClient) listPersistentVolumes(ctx context.Context) ([]v1.PersistentVolume, error) {
+	var names []string
+	for name, pv := range c.pvs {
+		if pv != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var pvs []v1.PersistentVolume
+	for _, name := range names {
+		pvs = append(pvs, *c.pvs[name].DeepCopy())
+	}
+	return pvs, nil
+}
+
+func (c *fakeInTreePVClient) getPersistentVolume(ctx context.Context, name string) (*v1.PersistentVolume, error) {
+	if c.pvs[name] == nil {
+		return nil, c.notFound(name)
+	}
+	return c.pvs[name].DeepCopy(), nil
+}
+
+func (c *fakeInTreePVClient) patchPersistentVolume(ctx context.Context, name string, patch []byte) error {
+	c.actions = append(c.actions, "patch "+name+" "+string(patch))
+	pv := c.pvs[name]
+	if pv == nil {
+		return c.notFound(name)
+	}
+	var p struct {
+		Metadata *struct {
+			Finalizers []string `json:"finalizers"`
+		} `json:"metadata"`
+		Spec *struct {
+			PersistentVolumeReclaimPolicy v1.PersistentVolumeReclaimPolicy `json:"persistentVolumeReclaimPolicy"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return err
+	}
+	if p.Metadata != nil {
+		pv.Finalizers = p.Metadata.Finalizers
+	}
+	if p.Spec != nil {
+		pv.Spec.PersistentVolumeReclaimPolicy = p.Spec.PersistentVolumeReclaimPolicy
+	}
+	if c.deleting[name] && len(pv.Finalizers) == 0 {
+		c.pvs[name] = nil
+	}
+	return nil
+}
+
+func (c *fakeInTreePVClient) deletePersistentVolume(ctx context.Context, name string) error {
+	c.actions = append(c.actions, "delete "+name)
+	pv := c.pvs[name]
+	if pv == nil {
+		return c.notFound(name)
+	}
+	c.deleting[name] = true
+	if len(pv.Finalizers) == 0 {
+		c.pvs[name] = nil
+	}
+	return nil
+}
+
+func (c *fakeInTreePVClient) createPersistentVolume(ctx context.Context, pv *v1.PersistentVolume) error {
+	c.actions = append(c.actions, "create "+pv.Name)
+	if c.createErr != nil {
+		return c.createErr
+	}
+	if c.pvs[pv.Name] != nil {
+		return apierrors.NewAlreadyExists(schema.GroupResource{Resource: "persistentvolumes"}, pv.Name)
+	}
+	c.deleting[pv.Name] = false
+	c.pvs[pv.Name] = pv.DeepCopy()
+	return nil
+}
+
+// withMigratedFields sets fields of a bound in-tree PV which are copied, changed or dropped by migration
+func withMigratedFields(pv *v1.PersistentVolume) {
+	pv.Labels = map[string]string{"app": "web"}
+	pv.Annotations = map[string]string{"pv.kubernetes.io/bound-by-controller": "yes"}
+	pv.Finalizers = []string{"kubernetes.io/pv-protection"}
+	pv.Spec.AccessModes = []v1.PersistentVolumeAccessMode{v1.ReadWriteMany}
+	pv.Spec.PersistentVolumeReclaimPolicy = v1.PersistentVolumeReclaimRecycle
+	pv.Spec.MountOptions = []string{"nfsvers=4.1"}
+	pv.Spec.ClaimRef.UID = "uid-1"
+	pv.Spec.ClaimRef.ResourceVersion = "100"
+}
+
+func TestParseInTreeVolumeHandle(t *testing.T) {
+	tests := []struct {
+		handle string
+		server string
+		path   string
+		ok     bool
+	}{
+		{handle: "10.0.0.1:/exports/data", server: "10.0.0.1", path: "/exports/data", ok: true},
+		{handle: "nfs.example.com:/", server: "nfs.example.com", path: "/", ok: true},
+		{handle: "[fd00::1]:/share", server: "[fd00::1]", path: "/share", ok: true},
+		{handle: ":/share"},
+		{handle: "server#share#subdir"},
+		{handle: "server#/share:/subdir"},
+		{handle: "vol_1"},
+	}
+	for _, test := range tests {
+		server, path, ok := parseInTreeVolumeHandle(test.handle)
+		assert.Equal(t, test.ok, ok, "handle: %s", test.handle)
+		assert.Equal(t, test.server, server, "handle: %s", test.handle)
+		assert.Equal(t, test.path, path, "handle: %s", test.handle)
+	}
+}
+
+func TestGetMigratedVolumeContext(t *testing.T) {
+	d := NewEmptyDriver("")
+	ns := NewNodeServer(d, mount.NewFakeMounter(nil))
+	assert.Nil(t, ns.getMigratedVolumeContext("10.0.0.1:/exports/data", nil))
+
+	d.enableInTreeMigration = true
+	tests := []struct {
+		volumeID      string
+		volumeContext map[string]string
+		expected      map[string]string
+	}{
+		{
+			volumeID: "10.0.0.1:/exports/data",
+			expected: map[string]string{paramServer: "10.0.0.1", paramShare: "/exports/data"},
+		},
+		{
+			volumeID:      "10.0.0.1:/exports/data",
+			volumeContext: map[string]string{"csi.storage.k8s.io/pv/name": "pv-1"},
+			expected:      map[string]string{paramServer: "10.0.0.1", paramShare: "/exports/data", "csi.storage.k8s.io/pv/name": "pv-1"},
+		},
+		{
+			volumeID:      "10.0.0.1:/exports/data",
+			volumeContext: map[string]string{"Server": "10.0.0.2", paramShare: "/other"},
+			expected:      map[string]string{"Server": "10.0.0.2", paramShare: "/other"},
+		},
+		{
+			volumeID: "vol_1",
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, ns.getMigratedVolumeContext(test.volumeID, test.volumeContext), "volumeID: %s, volumeContext: %v", test.volumeID, test.volumeContext)
+	}
+}
+
+func TestNodePublishInTreeVolume(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip on windows")
+	}
+	d := NewEmptyDriver("")
+	fakeMounter := mount.NewFakeMounter(nil)
+	ns := NewNodeServer(d, fakeMounter)
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:   "10.0.0.1:/exports/data",
+		TargetPath: filepath.Join(t.TempDir(), "mount"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+	}
+	_, err := ns.NodePublishVolume(context.TODO(), req)
+	assert.Error(t, err)
+
+	d.enableInTreeMigration = true
+	_, err = ns.NodePublishVolume(context.TODO(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, []mount.FakeAction{
+		{Action: "mount", Target: req.TargetPath, Source: "10.0.0.1:/exports/data", FSType: "nfs"},
+	}, fakeMounter.GetLog())
+}
+
+func TestBuildCSIPersistentVolume(t *testing.T) {
+	pv := newTestPV("pv-1", "", withInTreeNFS("10.0.0.1", "/exports/data"), withClaimRef("default", "pv-1-claim"), withMigratedFields)
+	csiPV := buildCSIPersistentVolume(&pv, DefaultDriverName)
+
+	assert.Equal(t, "pv-1", csiPV.Name)
+	assert.Equal(t, pv.Labels, csiPV.Labels)
+	assert.Equal(t, map[string]string{"pv.kubernetes.io/bound-by-controller": "yes", migratedFromInTreeAnnotation: "10.0.0.1:/exports/data"}, csiPV.Annotations)
+	assert.Empty(t, csiPV.Finalizers)
+	assert.Equal(t, &v1.CSIPersistentVolumeSource{
+		Driver:           DefaultDriverName,
+		VolumeHandle:     "10.0.0.1:/exports/data",
+		ReadOnly:         true,
+		VolumeAttributes: map[string]string{paramServer: "10.0.0.1", paramShare: "/exports/data"},
+	}, csiPV.Spec.CSI)
+	assert.Nil(t, csiPV.Spec.NFS)
+	assert.Equal(t, v1.PersistentVolumeReclaimRetain, csiPV.Spec.PersistentVolumeReclaimPolicy)
+	assert.Equal(t, []string{"nfsvers=4.1"}, csiPV.Spec.MountOptions)
+	assert.Equal(t, &v1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: "default", Name: "pv-1-claim", UID: "uid-1"}, csiPV.Spec.ClaimRef)
+	// the in-tree PV is not changed
+	assert.NotNil(t, pv.Spec.NFS)
+	assert.Equal(t, "100", pv.Spec.ClaimRef.ResourceVersion)
+
+	// the handle is decoded as a volume which is never removed
+	vol, version, err := decodeVolumeID(csiPV.Spec.CSI.VolumeHandle)
+	assert.NoError(t, err)
+	assert.Equal(t, volumeIDInTree, version)
+	assert.Equal(t, "10.0.0.1", vol.server)
+	assert.Equal(t, "exports/data", vol.baseDir)
+	assert.Equal(t, retain, vol.onDelete)
+}
+
+func TestMigrateInTreePVs(t *testing.T) {
+	csiPV := newTestPV("pv-csi", "server#share#pv-csi")
+	client := newFakeInTreePVClient(
+		newTestPV("pv-1", "", withInTreeNFS("10.0.0.1", "/exports/a"), withClaimRef("default", "pv-1-claim"), withMigratedFields),
+		newTestPV("pv-2", "", withInTreeNFS("10.0.0.1", "/exports/b"), withClaimRef("default", "pv-2-claim"), withMigratedFields),
+		csiPV,
+	)
+	opts := &InTreeMigrationOptions{DriverName: DefaultDriverName, DryRun: true, Timeout: time.Second}
+
+	// dry run only lists in-tree PVs
+	var out bytes.Buffer
+	assert.NoError(t, migrateInTreePVs(context.TODO(), &out, client, opts))
+	assert.Empty(t, client.actions)
+	assert.Contains(t, out.String(), "[dry-run] pv pv-1(10.0.0.1:/exports/a) would be migrated to nfs.csi.k8s.io")
+	assert.Contains(t, out.String(), "[dry-run] pv pv-2(10.0.0.1:/exports/b) would be migrated to nfs.csi.k8s.io")
+	assert.NotContains(t, out.String(), "pv-csi")
+
+	// selected PVs are migrated, unknown and CSI PVs are reported
+	opts.DryRun = false
+	opts.PersistentVolumes = []string{"pv-1", "pv-csi", "pv-unknown"}
+	out.Reset()
+	err := migrateInTreePVs(context.TODO(), &out, client, opts)
+	assert.EqualError(t, err, "2 persistent volumes failed to migrate")
+	assert.Equal(t, []string{
+		`patch pv-1 {"spec":{"persistentVolumeReclaimPolicy":"Retain"}}`,
+		"delete pv-1",
+		`patch pv-1 {"metadata":{"finalizers":null}}`,
+		"create pv-1",
+	}, client.actions)
+	assert.Contains(t, out.String(), "[OK] pv pv-1(10.0.0.1:/exports/a) is migrated to nfs.csi.k8s.io")
+	assert.Contains(t, out.String(), "[FAIL] pv pv-csi is not an in-tree nfs persistent volume")
+	assert.Contains(t, out.String(), "[FAIL] pv pv-unknown is not an in-tree nfs persistent volume")
+	assert.Contains(t, out.String(), "1 persistent volumes migrated, 2 failed")
+	pv, err := client.getPersistentVolume(context.TODO(), "pv-1")
+	assert.NoError(t, err)
+	assert.Nil(t, pv.Spec.NFS)
+	assert.Equal(t, "10.0.0.1:/exports/a", pv.Spec.CSI.VolumeHandle)
+	assert.Equal(t, "pv-1-claim", pv.Spec.ClaimRef.Name)
+	pv, err = client.getPersistentVolume(context.TODO(), "pv-2")
+	assert.NoError(t, err)
+	assert.NotNil(t, pv.Spec.NFS)
+
+	// original manifest is printed to recreate the in-tree PV if the CSI PV could not be created
+	client.actions = nil
+	client.createErr = apierrors.NewForbidden(schema.GroupResource{Resource: "persistentvolumes"}, "pv-2", nil)
+	opts.PersistentVolumes = nil
+	out.Reset()
+	err = migrateInTreePVs(context.TODO(), &out, client, opts)
+	assert.EqualError(t, err, "1 persistent volumes failed to migrate")
+	assert.Contains(t, out.String(), `migrating pv pv-2, original manifest: {"metadata":{"name":"pv-2"`)
+	assert.True(t, strings.Contains(out.String(), "[FAIL] pv pv-2: failed to create csi pv"), out.String())
+	assert.Equal(t, []string{
+		`patch pv-2 {"spec":{"persistentVolumeReclaimPolicy":"Retain"}}`,
+		"delete pv-2",
+		`patch pv-2 {"metadata":{"finalizers":null}}`,
+		"create pv-2",
+	}, client.actions)
+}
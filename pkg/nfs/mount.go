@@ -0,0 +1,104 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+var (
+	errMountTimeout = errors.New("mount timed out")
+
+	// mountBackoff is the backoff of retrying mount on transient errors, could be replaced in unit tests
+	mountBackoff = wait.Backoff{
+		Duration: time.Second,
+		Factor:   2,
+		Steps:    4,
+	}
+
+	// errors of mount.nfs which could be recovered by retrying
+	transientMountErrors = []string{
+		"connection refused",
+		"no route to host",
+		"network is unreachable",
+		"temporary failure in name resolution",
+	}
+)
+
+// isTransientMountError returns true if mount could succeed on retry
+func isTransientMountError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	for _, e := range transientMountErrors {
+		if strings.Contains(msg, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// mountWithTimeout returns errMountTimeout if mount does not finish in timeout,
+// the mount process is left running and target would be checked again on next NodePublishVolume.
+// There is no timeout if timeout is not positive.
+func mountWithTimeout(ctx context.Context, mounter mount.Interface, source, target, fstype string, options []string, timeout time.Duration) error {
+	if timeout <= 0 {
+		return mounter.Mount(source, target, fstype, options)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- mounter.Mount(source, target, fstype, options)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("%w: %s on %s after %v", errMountTimeout, source, target, timeout)
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %s on %s: %v", errMountTimeout, source, target, ctx.Err())
+	}
+}
+
+// mountWithRetry runs mountFunc and retries with exponential backoff on transient errors,
+// the error of last mount attempt is returned if all attempts fail
+func mountWithRetry(ctx context.Context, mountFunc func() error) error {
+	var mountErr error
+	attempted := false
+	err := wait.ExponentialBackoffWithContext(ctx, mountBackoff, func() (bool, error) {
+		attempted = true
+		mountErr = mountFunc()
+		if isTransientMountError(mountErr) {
+			klog.FromContext(ctx).Info("mount failed with transient error, retrying", "err", mountErr)
+			return false, nil
+		}
+		return true, nil
+	})
+	if !attempted {
+		return err
+	}
+	return mountErr
+}
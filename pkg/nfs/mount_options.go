@@ -0,0 +1,119 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// knownMountOptions are keys of generic mount options and nfs mount options in nfs(5),
+// SELinux context options are added by kubelet if SELinuxMountReadWriteOncePod is enabled
+var knownMountOptions = sets.NewString( //nolint:staticcheck
+	// generic
+	"ro", "rw", "sync", "async", "atime", "noatime", "diratime", "nodiratime", "relatime", "norelatime",
+	"strictatime", "nostrictatime", "lazytime", "nolazytime", "suid", "nosuid", "dev", "nodev", "exec", "noexec",
+	"defaults", "_netdev", "nofail",
+	"context", "fscontext", "defcontext", "rootcontext",
+	// nfs
+	"nfsvers", "vers", "minorversion", "soft", "softerr", "softreval", "nosoftreval", "hard", "intr", "nointr",
+	"timeo", "retrans", "retry", "rsize", "wsize", "bsize", "namlen",
+	"ac", "noac", "acregmin", "acregmax", "acdirmin", "acdirmax", "actimeo", "lookupcache",
+	"bg", "fg", "nconnect", "max_connect", "rdirplus", "nordirplus", "sec", "sharecache", "nosharecache",
+	"resvport", "noresvport", "fsc", "nofsc", "sloppy", "proto", "udp", "tcp", "rdma", "port", "clientaddr",
+	"mountport", "mountproto", "mounthost", "mountvers", "addr", "mountaddr",
+	"lock", "nolock", "local_lock", "cto", "nocto", "acl", "noacl",
+	"migration", "nomigration", "trunkdiscovery", "notrunkdiscovery", "xprtsec", "write",
+)
+
+// mountOptionPolicy validates mount options of volumes against options allowed and forbidden by the operator.
+// Policy entries are either option keys(e.g. sec), which match the option with any value, or full options(e.g. sec=sys).
+type mountOptionPolicy struct {
+	// only these options are allowed if it's not empty, it could allow options unknown to the driver
+	allowed sets.String //nolint:staticcheck
+	// forbidden options take precedence over allowed options
+	forbidden sets.String //nolint:staticcheck
+}
+
+// newMountOptionPolicy returns policy of comma separated allowed and forbidden mount options
+func newMountOptionPolicy(allowed, forbidden string) *mountOptionPolicy {
+	p := &mountOptionPolicy{allowed: sets.NewString(), forbidden: sets.NewString()} //nolint:staticcheck
+	for _, option := range splitMountOptions([]string{allowed}) {
+		p.allowed.Insert(normalizePolicyOption(option))
+	}
+	for _, option := range splitMountOptions([]string{forbidden}) {
+		p.forbidden.Insert(normalizePolicyOption(option))
+	}
+	return p
+}
+
+func normalizePolicyOption(option string) string {
+	key, value, found := strings.Cut(strings.TrimSpace(option), "=")
+	key = strings.ToLower(strings.TrimSpace(key))
+	if !found {
+		return key
+	}
+	return key + "=" + strings.TrimSpace(value)
+}
+
+// policyMatches returns true if the key or the full option is in the set
+func policyMatches(set sets.String, option string) bool { //nolint:staticcheck
+	return set.Has(mountOptionKey(option)) || set.Has(normalizePolicyOption(option))
+}
+
+// validate returns error of the first option which is unknown, not allowed or forbidden.
+// Only unknown options are rejected if the policy is nil.
+func (p *mountOptionPolicy) validate(mountOptions []string) error {
+	for _, option := range splitMountOptions(mountOptions) {
+		key := mountOptionKey(option)
+		if key == "" {
+			return fmt.Errorf("invalid empty mount option in %q", strings.Join(mountOptions, ","))
+		}
+		if p != nil && policyMatches(p.forbidden, option) {
+			return fmt.Errorf("mount option %q is forbidden by the driver", option)
+		}
+		if p != nil && p.allowed.Len() > 0 {
+			if !policyMatches(p.allowed, option) {
+				return fmt.Errorf("mount option %q is not allowed by the driver", option)
+			}
+			continue
+		}
+		if !knownMountOptions.Has(key) && !strings.HasPrefix(key, "x-") {
+			return fmt.Errorf("unknown mount option %q, see nfs(5) for supported options", option)
+		}
+	}
+	return nil
+}
+
+// normalizeMountOptions removes duplicated and conflicting mount options, the last one takes precedence
+// as mount(8) does, e.g. [soft, nfsvers=3, hard, nfsvers=4.1] -> [hard, nfsvers=4.1]
+func normalizeMountOptions(mountOptions []string) []string {
+	options := splitMountOptions(mountOptions)
+	keys := sets.NewString() //nolint:staticcheck
+	var normalized []string
+	for i := len(options) - 1; i >= 0; i-- {
+		key := mountOptionKey(options[i])
+		if keys.Has(key) || keys.Has(conflictingMountOptions[key]) {
+			continue
+		}
+		keys.Insert(key)
+		normalized = append([]string{options[i]}, normalized...)
+	}
+	return normalized
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestMountOptionPolicyValidate(t *testing.T) {
+	tests := []struct {
+		desc         string
+		policy       *mountOptionPolicy
+		mountOptions []string
+		expectedErr  error
+	}{
+		{
+			desc:         "known options without policy",
+			mountOptions: []string{"nfsvers=4.1,hard", "noatime", "x-systemd.automount", "context=\"system_u:object_r:container_file_t:s0\""},
+		},
+		{
+			desc:         "unknown option without policy",
+			mountOptions: []string{"nfsvers=4.1,nolcok"},
+			expectedErr:  fmt.Errorf(`unknown mount option "nolcok", see nfs(5) for supported options`),
+		},
+		{
+			desc:         "empty key",
+			policy:       newMountOptionPolicy("", ""),
+			mountOptions: []string{"=4.1"},
+			expectedErr:  fmt.Errorf(`invalid empty mount option in "=4.1"`),
+		},
+		{
+			desc:         "forbidden key",
+			policy:       newMountOptionPolicy("", "nolock, sec=sys"),
+			mountOptions: []string{"hard", "NoLock"},
+			expectedErr:  fmt.Errorf(`mount option "NoLock" is forbidden by the driver`),
+		},
+		{
+			desc:         "forbidden full option",
+			policy:       newMountOptionPolicy("", "nolock,sec=sys"),
+			mountOptions: []string{"sec=sys"},
+			expectedErr:  fmt.Errorf(`mount option "sec=sys" is forbidden by the driver`),
+		},
+		{
+			desc:         "other value of forbidden full option",
+			policy:       newMountOptionPolicy("", "nolock,sec=sys"),
+			mountOptions: []string{"sec=krb5p"},
+		},
+		{
+			desc:         "allowed options",
+			policy:       newMountOptionPolicy("nfsvers,hard,sec=krb5p,newopt", ""),
+			mountOptions: []string{"nfsvers=4.1,hard,sec=krb5p", "newopt"},
+		},
+		{
+			desc:         "not allowed option",
+			policy:       newMountOptionPolicy("nfsvers,hard,sec=krb5p", ""),
+			mountOptions: []string{"nfsvers=4.1,sec=krb5"},
+			expectedErr:  fmt.Errorf(`mount option "sec=krb5" is not allowed by the driver`),
+		},
+		{
+			desc:         "forbidden option takes precedence over allowed option",
+			policy:       newMountOptionPolicy("nfsvers,nolock", "nolock"),
+			mountOptions: []string{"nolock"},
+			expectedErr:  fmt.Errorf(`mount option "nolock" is forbidden by the driver`),
+		},
+	}
+	for _, test := range tests {
+		if err := test.policy.validate(test.mountOptions); !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+	}
+}
+
+func TestNormalizeMountOptions(t *testing.T) {
+	tests := []struct {
+		mountOptions []string
+		expected     []string
+	}{
+		{
+			mountOptions: nil,
+			expected:     nil,
+		},
+		{
+			mountOptions: []string{"nfsvers=4.1,hard", "noatime"},
+			expected:     []string{"nfsvers=4.1", "hard", "noatime"},
+		},
+		{
+			mountOptions: []string{"soft,nfsvers=3", "hard", "nfsvers=4.1"},
+			expected:     []string{"hard", "nfsvers=4.1"},
+		},
+		{
+			mountOptions: []string{"rw,noatime", "noatime", "ro"},
+			expected:     []string{"noatime", "ro"},
+		},
+	}
+	for _, test := range tests {
+		if result := normalizeMountOptions(test.mountOptions); !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("normalizeMountOptions(%v) = %v, expected %v", test.mountOptions, result, test.expected)
+		}
+	}
+}
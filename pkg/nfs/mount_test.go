@@ -0,0 +1,171 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"k8s.io/apimachinery/pkg/util/wait"
+	mount "k8s.io/mount-utils"
+)
+
+// blockingMounter blocks Mount until unblock is closed
+type blockingMounter struct {
+	*mount.FakeMounter
+	unblock chan struct{}
+}
+
+func (b *blockingMounter) Mount(source string, target string, fstype string, options []string) error {
+	<-b.unblock
+	return nil
+}
+
+func TestIsTransientMountError(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{
+			err:      nil,
+			expected: false,
+		},
+		{
+			err:      fmt.Errorf("mount failed: exit status 32\nOutput: mount.nfs: Connection refused"),
+			expected: true,
+		},
+		{
+			err:      fmt.Errorf("mount failed: exit status 32\nOutput: mount.nfs: No route to host"),
+			expected: true,
+		},
+		{
+			err:      fmt.Errorf("mount failed: exit status 32\nOutput: mount.nfs: access denied by server while mounting"),
+			expected: false,
+		},
+	}
+
+	for _, test := range tests {
+		result := isTransientMountError(test.err)
+		if result != test.expected {
+			t.Errorf("isTransientMountError(%v) = %v, expected: %v", test.err, result, test.expected)
+		}
+	}
+}
+
+func TestMountWithTimeout(t *testing.T) {
+	mounter := &blockingMounter{FakeMounter: mount.NewFakeMounter(nil), unblock: make(chan struct{})}
+	defer close(mounter.unblock)
+
+	err := mountWithTimeout(context.Background(), mounter, "server:/share", "/target", "nfs", nil, 10*time.Millisecond)
+	assert.True(t, errors.Is(err, errMountTimeout), "unexpected error: %v", err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = mountWithTimeout(ctx, mounter, "server:/share", "/target", "nfs", nil, time.Minute)
+	assert.True(t, errors.Is(err, errMountTimeout), "unexpected error: %v", err)
+
+	err = mountWithTimeout(context.Background(), mount.NewFakeMounter(nil), "server:/share", "/target", "nfs", nil, time.Minute)
+	assert.NoError(t, err)
+}
+
+func TestMountWithRetry(t *testing.T) {
+	origBackoff := mountBackoff
+	defer func() { mountBackoff = origBackoff }()
+	mountBackoff = wait.Backoff{Duration: time.Millisecond, Factor: 2, Steps: 3}
+
+	transientErr := fmt.Errorf("mount.nfs: Connection refused")
+	tests := []struct {
+		desc             string
+		errs             []error
+		expectedAttempts int
+		expectedErr      error
+	}{
+		{
+			desc:             "succeeded at first attempt",
+			errs:             []error{nil},
+			expectedAttempts: 1,
+		},
+		{
+			desc:             "succeeded after transient error",
+			errs:             []error{transientErr, nil},
+			expectedAttempts: 2,
+		},
+		{
+			desc:             "non transient error is not retried",
+			errs:             []error{fmt.Errorf("access denied")},
+			expectedAttempts: 1,
+			expectedErr:      fmt.Errorf("access denied"),
+		},
+		{
+			desc:             "transient error on all attempts",
+			errs:             []error{transientErr, transientErr, transientErr, nil},
+			expectedAttempts: 3,
+			expectedErr:      transientErr,
+		},
+	}
+
+	for _, test := range tests {
+		attempts := 0
+		err := mountWithRetry(context.Background(), func() error {
+			err := test.errs[attempts]
+			attempts++
+			return err
+		})
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		assert.Equal(t, test.expectedAttempts, attempts, test.desc)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := mountWithRetry(ctx, func() error { return nil })
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestGetMountSource(t *testing.T) {
+	tests := []struct {
+		server          string
+		sharePath       string
+		expected        string
+		expectedWindows string
+	}{
+		{
+			server:          "10.0.0.1",
+			sharePath:       "/share/subdir",
+			expected:        "10.0.0.1:/share/subdir",
+			expectedWindows: `\\10.0.0.1\share\subdir`,
+		},
+		{
+			server:          "[fe80::1]",
+			sharePath:       "/share",
+			expected:        "[fe80::1]:/share",
+			expectedWindows: `\\fe80--1.ipv6-literal.net\share`,
+		},
+	}
+
+	for _, test := range tests {
+		expected := test.expected
+		if runtime.GOOS == "windows" {
+			expected = test.expectedWindows
+		}
+		assert.Equal(t, expected, getMountSource(test.server, test.sharePath))
+	}
+}
@@ -0,0 +1,75 @@
+//go:build !windows
+// +build !windows
+
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	mount "k8s.io/mount-utils"
+)
+
+// getMountSource returns the source of mounting sharePath exported by server
+func getMountSource(server, sharePath string) string {
+	return fmt.Sprintf("%s:%s", server, sharePath)
+}
+
+// getServerOfMountSource returns the server of mount source in format of {server}:{path}
+func getServerOfMountSource(source string) string {
+	if i := strings.Index(source, ":/"); i > 0 {
+		return source[:i]
+	}
+	return ""
+}
+
+// listNFSMounts returns nfs mounts in mount table of the node, mount point -> source
+func listNFSMounts() (map[string]string, error) {
+	mis, err := mount.ParseMountInfo("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	mounts := map[string]string{}
+	for _, mi := range mis {
+		if strings.HasPrefix(mi.FsType, "nfs") {
+			mounts[mi.MountPoint] = mi.Source
+		}
+	}
+	return mounts, nil
+}
+
+// mountNFS mounts source on target with fsType and mount options, nfs is used if fsType is empty,
+// e.g. volumes recorded in node state file before fsType is recorded
+func mountNFS(ctx context.Context, mounter mount.Interface, source, target, fsType string, options []string, timeout time.Duration) error {
+	if fsType == "" {
+		fsType = fsTypeNFS
+	}
+	return mountWithTimeout(ctx, mounter, source, target, fsType, options, timeout)
+}
+
+// bindMount bind mounts source on target, e.g. staging path of the volume on target path of the pod
+func bindMount(_ context.Context, mounter mount.Interface, source, target string, readOnly bool) error {
+	options := []string{"bind"}
+	if readOnly {
+		options = append(options, "ro")
+	}
+	return mounter.Mount(source, target, "", options)
+}
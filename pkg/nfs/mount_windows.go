@@ -0,0 +1,91 @@
+//go:build windows
+// +build windows
+
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+// getMountSource returns UNC path of sharePath exported by server, e.g. \\server\share\subdir,
+// IPv6 address is converted to ipv6-literal.net name since UNC path does not support colons
+func getMountSource(server, sharePath string) string {
+	if strings.HasPrefix(server, "[") && strings.HasSuffix(server, "]") {
+		server = strings.ReplaceAll(strings.Trim(server, "[]"), ":", "-") + ".ipv6-literal.net"
+	}
+	return `\\` + server + strings.ReplaceAll(sharePath, "/", `\`)
+}
+
+// getServerOfMountSource returns the server of UNC path, e.g. \\server\share
+func getServerOfMountSource(source string) string {
+	server, _, _ := strings.Cut(strings.TrimPrefix(source, `\\`), `\`)
+	return server
+}
+
+// listNFSMounts returns no mount since shares are linked instead of mounted on Windows
+func listNFSMounts() (map[string]string, error) {
+	return nil, nil
+}
+
+// runMklink links target to source by mklink /D, could be replaced in unit tests
+var runMklink = func(target, source string) ([]byte, error) {
+	return exec.Command("cmd", "/c", "mklink", "/D", target, source).CombinedOutput()
+}
+
+// mountNFS links target to UNC path of source, the share is accessed by Client for NFS on the node.
+// Mount options and fsType are not applied per link, options of Client for NFS are set by Set-NfsClientConfiguration on the node.
+// The link is created by mklink instead of bind mount of mounter, which prefixes source starting with \ by c:.
+// mklink does not access the server, timeout is not applied.
+func mountNFS(ctx context.Context, _ mount.Interface, source, target, _ string, options []string, _ time.Duration) error {
+	if len(options) > 0 {
+		klog.FromContext(ctx).Info("mount options are ignored on Windows", "options", options, "source", source)
+	}
+	// mklink fails if target exists, the empty directory created before mount is removed
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove target %s before linking to %s: %v", target, source, err)
+	}
+	// EvalSymlinks of containerd fails on UNC share root without trailing backslash, e.g. \\server\share
+	if !strings.HasSuffix(source, `\`) {
+		source += `\`
+	}
+	if out, err := runMklink(mount.NormalizeWindowsPath(target), source); err != nil {
+		return fmt.Errorf("mklink failed to link %s to %s: %v, output: %s", target, source, err, string(out))
+	}
+	klog.FromContext(ctx).V(2).Info("linked target to nfs share", "target", target, "source", source)
+	return nil
+}
+
+// bindMount links target to source, read-only is not supported by links
+func bindMount(ctx context.Context, mounter mount.Interface, source, target string, readOnly bool) error {
+	if readOnly {
+		klog.FromContext(ctx).Info("read-only is ignored when linking on Windows", "target", target, "source", source)
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove target %s before linking to %s: %v", target, source, err)
+	}
+	return mounter.Mount(source, target, "", []string{"bind"})
+}
@@ -0,0 +1,58 @@
+//go:build windows
+// +build windows
+
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	mount "k8s.io/mount-utils"
+)
+
+func TestMountNFSOnWindows(t *testing.T) {
+	origRunMklink := runMklink
+	defer func() { runMklink = origRunMklink }()
+	var linkedTarget, linkedSource string
+	runMklink = func(target, source string) ([]byte, error) {
+		linkedTarget, linkedSource = target, source
+		return nil, nil
+	}
+
+	target := filepath.Join(t.TempDir(), "mount")
+	assert.NoError(t, os.MkdirAll(target, 0750))
+	source := getMountSource("server", "/share/subdir")
+	assert.Equal(t, `\\server\share\subdir`, source)
+	err := mountNFS(context.TODO(), mount.NewFakeMounter(nil), source, target, "", []string{"nfsvers=4.1"}, 0)
+	assert.NoError(t, err)
+	// UNC path is linked as is instead of being normalized to c:\\server\share\subdir
+	assert.Equal(t, `\\server\share\subdir\`, linkedSource)
+	assert.Equal(t, target, linkedTarget)
+	assert.NoDirExists(t, target)
+
+	runMklink = func(target, source string) ([]byte, error) {
+		return []byte("Cannot create a file when that file already exists."), fmt.Errorf("exit status 1")
+	}
+	err = mountNFS(context.TODO(), mount.NewFakeMounter(nil), `\\server\share\`, target, "", nil, 0)
+	assert.ErrorContains(t, err, "mklink failed")
+}
@@ -17,22 +17,74 @@ limitations under the License.
 package nfs
 
 import (
+	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 	mount "k8s.io/mount-utils"
 )
 
 // DriverOptions defines driver parameters specified in driver deployment
 type DriverOptions struct {
-	NodeID                string
-	DriverName            string
-	Endpoint              string
-	MountPermissions      uint64
-	WorkingMountDir       string
-	DefaultOnDeletePolicy string
+	NodeID                       string
+	DriverName                   string
+	Endpoint                     string
+	MountPermissions             uint64
+	WorkingMountDir              string
+	DefaultOnDeletePolicy        string
+	QuotaMountDir                string
+	Krb5KeytabPath               string
+	MetricsAddress               string
+	UnmountTimeout               time.Duration
+	MountTimeout                 time.Duration
+	StaleMountCheckInterval      time.Duration
+	KataDirectVolumeRootPath     string
+	KataDirectVolumeGCInterval   time.Duration
+	EnableTopology               bool
+	Kubeconfig                   string
+	DefaultMountOptions          string
+	AllowedMountOptions          string
+	ForbiddenMountOptions        string
+	EnableOrphanGC               bool
+	OrphanGCInterval             time.Duration
+	OrphanGCGracePeriod          time.Duration
+	OrphanGCRemove               bool
+	VolumeStatsCacheTTL          time.Duration
+	LeaderElection               bool
+	LeaderElectionNamespace      string
+	LeaderElectionLeaseDuration  time.Duration
+	LeaderElectionRenewDeadline  time.Duration
+	LeaderElectionRetryPeriod    time.Duration
+	LeaderElectionHandoffTimeout time.Duration
+	EnableEvents                 bool
+	StaticVolumeAdoptionInterval time.Duration
+	VolumeIDVersion              int
+	TrashPurgeInterval           time.Duration
+	EnableMountHealthProbe       bool
+	NodeStateFile                string
+	GracefulShutdownTimeout      time.Duration
+	EnableNodeStage              bool
+	ShareCachePolicy             string
+	EncryptionMountDir           string
+	EnableEncryption             bool
+	MaxConcurrentCreate          int
+	MaxConcurrentDelete          int
+	UsageReportInterval          time.Duration
+	UsageReportMaxFilesPerSecond int
+	UsageReportConfigMap         string
+	EnableBlockVolume            bool
+	BlockVolumeMountDir          string
+	EnableInTreeMigration        bool
+	VolumeRegistryResyncInterval time.Duration
 }
 
 type Driver struct {
@@ -43,12 +95,97 @@ type Driver struct {
 	mountPermissions      uint64
 	workingMountDir       string
 	defaultOnDeletePolicy string
+	// path of the keytab merged from node stage secrets for kerberos mount
+	krb5KeytabPath string
+	// address of prometheus metrics endpoint, metrics are not served if empty
+	metricsAddress string
+	// time to wait for umount before falling back to force and lazy unmount
+	unmountTimeout time.Duration
+	// time to wait for a single mount attempt, no timeout if it's 0
+	mountTimeout time.Duration
+	// interval of checking stale mounts, stale mounts are not checked if it's 0
+	staleMountCheckInterval time.Duration
+	// root directory where kata direct volumes are registered
+	kataDirectVolumeRootPath string
+	// interval of removing orphaned kata direct volumes, orphaned kata direct volumes are not removed periodically if it's 0
+	kataDirectVolumeGCInterval time.Duration
+	// report zone of the node in NodeGetInfo
+	enableTopology bool
+	kubeconfig     string
+	// zone of the node, it's empty if topology is not enabled or node has no zone label
+	nodeZone string
+	// mount options applied on node publish if they are not specified in pv or volume context
+	defaultMountOptions []string
+	// where nfs shares of encrypted volumes are mounted before gocryptfs mounts their plaintext view on target paths
+	encryptionMountDir string
+	// encrypted volumes are published only if it's set, gocryptfs processes run in node plugin and their plaintext
+	// mounts are broken when node plugin restarts
+	enableEncryption bool
+	// whether mounts of the same server:export share the kernel superblock
+	shareCachePolicy string
+	// mount options of volumes are validated against options allowed and forbidden by the operator
+	mountOptionPolicy *mountOptionPolicy
+	// find subdirectories without persistent volume on shares of storage classes periodically,
+	// they are only reported unless orphanGCRemove is true
+	enableOrphanGC      bool
+	orphanGCInterval    time.Duration
+	orphanGCGracePeriod time.Duration
+	orphanGCRemove      bool
+	// time to cache NodeGetVolumeStats results, caching is disabled if 0
+	volumeStatsCacheTTL time.Duration
+	// controller loops(e.g. orphan garbage collection) only run in the leader replica
+	leaderElection               bool
+	leaderElectionNamespace      string
+	leaderElectionLeaseDuration  time.Duration
+	leaderElectionRenewDeadline  time.Duration
+	leaderElectionRetryPeriod    time.Duration
+	leaderElectionHandoffTimeout time.Duration
+	// emit events on pvc/pv of failed CSI calls
+	enableEvents  bool
+	eventRecorder record.EventRecorder
+	kubeClient    kubernetes.Interface
+	// interval of registering static volumes into volume registry, static volumes are not adopted if it's 0
+	staticVolumeAdoptionInterval time.Duration
+	// version of volume id of new volumes
+	volumeIDVersion int
+	// interval of removing expired subdirectories of volumes deleted with retainFor, trash is not purged if it's 0
+	trashPurgeInterval time.Duration
+	// Probe checks nfs mounts of volumes and their nfs servers
+	enableMountHealthProbe bool
+	// the share is mounted once per volume on staging path of the node, target paths of pods are bind mounted from it
+	enableNodeStage bool
+	// file where volumes published on the node are recorded, volumes are not recorded if it's empty
+	nodeStateFile string
+	// time to wait for in-flight operations on SIGTERM, node plugin exits immediately if it's 0
+	gracefulShutdownTimeout time.Duration
+	// project quota manager, nil if quota is not configured
+	quota *projectQuota
+	// cap concurrent CreateVolume and DeleteVolume calls, nil if there is no limit
+	createVolumeLimiter *operationLimiter
+	deleteVolumeLimiter *operationLimiter
+	// interval of computing used bytes of persistent volumes and namespaces, usage is not reported if it's 0
+	usageReportInterval time.Duration
+	// max number of files stat per second by usage report, no limit if it's 0
+	usageReportMaxFilesPerSecond int
+	// ConfigMap in the namespace of controller where usage report is written, it's only reported in metrics if empty
+	usageReportConfigMap string
+	// volumes with block volume capability are backed by a sparse file on the nfs share attached to a loop device on node
+	enableBlockVolume bool
+	// where nfs shares of block volumes are mounted before their sparse files are attached to loop devices
+	blockVolumeMountDir string
+	// in-tree nfs PVs translated by CSI migration are published with server and share read from volume handle {server}:{path}
+	enableInTreeMigration bool
+	// interval of rebuilding volume registry from persistent volumes, ListVolumes and ControllerGetVolume are not
+	// advertised if it's 0 since the registry is empty after controller restarts
+	volumeRegistryResyncInterval time.Duration
 
 	//ids *identityServer
 	ns          *NodeServer
 	cscap       []*csi.ControllerServiceCapability
 	nscap       []*csi.NodeServiceCapability
 	volumeLocks *VolumeLocks
+	// volumes known by controller, listed in ListVolumes
+	volumes *volumeRegistry
 }
 
 const (
@@ -59,78 +196,306 @@ const (
 	// The base directory must be a direct child of the root directory.
 	// The root directory is omitted from the string, for example:
 	//     "base" instead of "/base"
-	paramShare            = "share"
-	paramSubDir           = "subdir"
-	paramOnDelete         = "ondelete"
-	mountOptionsField     = "mountoptions"
-	mountPermissionsField = "mountpermissions"
-	pvcNameKey            = "csi.storage.k8s.io/pvc/name"
-	pvcNamespaceKey       = "csi.storage.k8s.io/pvc/namespace"
-	pvNameKey             = "csi.storage.k8s.io/pv/name"
-	pvcNameMetadata       = "${pvc.metadata.name}"
-	pvcNamespaceMetadata  = "${pvc.metadata.namespace}"
-	pvNameMetadata        = "${pv.metadata.name}"
+	paramShare               = "share"
+	paramSubDir              = "subdir"
+	paramOnDelete            = "ondelete"
+	mountOptionsField        = "mountoptions"
+	mountPermissionsField    = "mountpermissions"
+	paramEnableQuota         = "enablequota"
+	fsGroupChangePolicyField = "fsgroupchangepolicy"
+	paramKataDirectVolume    = "katadirectvolume"
+	paramServerMap           = "servermap"
+	paramExportManager       = "exportmanager"
+	paramSquash              = "squash"
+	paramRestoreServer       = "restoreserver"
+	paramRestoreShare        = "restoreshare"
+	paramSnapshotCompression = "snapshotcompression"
+	paramSnapshotFormat      = "snapshotformat"
+	paramThroughputLimit     = "throughputlimit"
+	paramIOPSLimit           = "iopslimit"
+	paramRetainFor           = "retainfor"
+	paramSubDirMaxDepth      = "subdirmaxdepth"
+	paramPruneEmptyParents   = "pruneemptyparents"
+	paramUID                 = "uid"
+	paramGID                 = "gid"
+	paramNConnect            = "nconnect"
+	paramServerAddressPolicy = "serveraddresspolicy"
+	paramEncrypted           = "encrypted"
+	paramExpectRootSquash    = "expectrootsquash"
+	paramAnonUID             = "anonuid"
+	paramAnonGID             = "anongid"
+	pvcNameKey               = "csi.storage.k8s.io/pvc/name"
+	pvcNamespaceKey          = "csi.storage.k8s.io/pvc/namespace"
+	pvNameKey                = "csi.storage.k8s.io/pv/name"
+	ephemeralField           = "csi.storage.k8s.io/ephemeral"
+	provisionerSecretNameKey = "csi.storage.k8s.io/provisioner-secret-name"
+	provisionerSecretNSKey   = "csi.storage.k8s.io/provisioner-secret-namespace"
+	pvcNameMetadata          = "${pvc.metadata.name}"
+	pvcNamespaceMetadata     = "${pvc.metadata.namespace}"
+	pvNameMetadata           = "${pv.metadata.name}"
 )
 
 func NewDriver(options *DriverOptions) *Driver {
-	klog.V(2).Infof("Driver: %v version: %v", options.DriverName, driverVersion)
+	klog.V(2).InfoS("Driver", "name", options.DriverName, "version", driverVersion)
 
 	n := &Driver{
-		name:             options.DriverName,
-		version:          driverVersion,
-		nodeID:           options.NodeID,
-		endpoint:         options.Endpoint,
-		mountPermissions: options.MountPermissions,
-		workingMountDir:  options.WorkingMountDir,
+		name:                         options.DriverName,
+		version:                      driverVersion,
+		nodeID:                       options.NodeID,
+		endpoint:                     options.Endpoint,
+		mountPermissions:             options.MountPermissions,
+		workingMountDir:              options.WorkingMountDir,
+		defaultOnDeletePolicy:        options.DefaultOnDeletePolicy,
+		krb5KeytabPath:               options.Krb5KeytabPath,
+		metricsAddress:               options.MetricsAddress,
+		unmountTimeout:               options.UnmountTimeout,
+		mountTimeout:                 options.MountTimeout,
+		staleMountCheckInterval:      options.StaleMountCheckInterval,
+		kataDirectVolumeRootPath:     options.KataDirectVolumeRootPath,
+		kataDirectVolumeGCInterval:   options.KataDirectVolumeGCInterval,
+		enableTopology:               options.EnableTopology,
+		kubeconfig:                   options.Kubeconfig,
+		enableOrphanGC:               options.EnableOrphanGC,
+		orphanGCInterval:             options.OrphanGCInterval,
+		orphanGCGracePeriod:          options.OrphanGCGracePeriod,
+		orphanGCRemove:               options.OrphanGCRemove,
+		volumeStatsCacheTTL:          options.VolumeStatsCacheTTL,
+		leaderElection:               options.LeaderElection,
+		leaderElectionNamespace:      options.LeaderElectionNamespace,
+		leaderElectionLeaseDuration:  options.LeaderElectionLeaseDuration,
+		leaderElectionRenewDeadline:  options.LeaderElectionRenewDeadline,
+		leaderElectionRetryPeriod:    options.LeaderElectionRetryPeriod,
+		leaderElectionHandoffTimeout: options.LeaderElectionHandoffTimeout,
+		enableEvents:                 options.EnableEvents,
+		staticVolumeAdoptionInterval: options.StaticVolumeAdoptionInterval,
+		trashPurgeInterval:           options.TrashPurgeInterval,
+		enableMountHealthProbe:       options.EnableMountHealthProbe,
+		nodeStateFile:                options.NodeStateFile,
+		gracefulShutdownTimeout:      options.GracefulShutdownTimeout,
+		enableNodeStage:              options.EnableNodeStage,
+		shareCachePolicy:             options.ShareCachePolicy,
+		encryptionMountDir:           options.EncryptionMountDir,
+		enableEncryption:             options.EnableEncryption,
+		volumeIDVersion:              options.VolumeIDVersion,
+		usageReportInterval:          options.UsageReportInterval,
+		usageReportMaxFilesPerSecond: options.UsageReportMaxFilesPerSecond,
+		usageReportConfigMap:         options.UsageReportConfigMap,
+		enableBlockVolume:            options.EnableBlockVolume,
+		blockVolumeMountDir:          options.BlockVolumeMountDir,
+		enableInTreeMigration:        options.EnableInTreeMigration,
+		volumeRegistryResyncInterval: options.VolumeRegistryResyncInterval,
 	}
+	if n.unmountTimeout <= 0 {
+		n.unmountTimeout = defaultUnmountTimeout
+	}
+	if n.kataDirectVolumeRootPath == "" {
+		n.kataDirectVolumeRootPath = DefaultKataDirectVolumeRootPath
+	}
+	if n.encryptionMountDir == "" {
+		n.encryptionMountDir = DefaultEncryptionMountDir
+	}
+	if n.blockVolumeMountDir == "" {
+		n.blockVolumeMountDir = DefaultBlockVolumeMountDir
+	}
+	if n.volumeIDVersion == 0 {
+		n.volumeIDVersion = DefaultVolumeIDVersion
+	}
+	if !isValidVolumeIDVersion(n.volumeIDVersion) {
+		klog.ErrorS(nil, "invalid volume-id-version", "version", n.volumeIDVersion, "supportedVersions", []int{volumeIDV2, volumeIDV3})
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
+	if err := validateOnDeleteValue(options.DefaultOnDeletePolicy); err != nil {
+		klog.ErrorS(err, "invalid default-ondelete-policy")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
+	if err := validateShareCachePolicy(n.shareCachePolicy); err != nil {
+		klog.ErrorS(err, "invalid share-cache-policy")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
+	if options.DefaultMountOptions != "" {
+		n.defaultMountOptions = splitMountOptions([]string{options.DefaultMountOptions})
+	}
+	n.mountOptionPolicy = newMountOptionPolicy(options.AllowedMountOptions, options.ForbiddenMountOptions)
+	if options.QuotaMountDir != "" {
+		n.quota = newProjectQuota(options.QuotaMountDir)
+	}
+	n.createVolumeLimiter = newOperationLimiter("CreateVolume", options.MaxConcurrentCreate)
+	n.deleteVolumeLimiter = newOperationLimiter("DeleteVolume", options.MaxConcurrentDelete)
 
-	n.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+	controllerCaps := []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
 		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
-	})
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+	}
+	if n.volumeRegistryResyncInterval > 0 {
+		controllerCaps = append(controllerCaps,
+			csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+			csi.ControllerServiceCapability_RPC_GET_VOLUME,
+			csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+		)
+	}
+	n.AddControllerServiceCapabilities(controllerCaps)
 
 	n.AddNodeServiceCapabilities([]csi.NodeServiceCapability_RPC_Type{
 		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
 		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+		csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
 		csi.NodeServiceCapability_RPC_UNKNOWN,
 	})
+	if n.enableNodeStage {
+		n.nscap = append(n.nscap, NewNodeServiceCapability(csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME))
+	}
 	n.volumeLocks = NewVolumeLocks()
+	n.volumes = newVolumeRegistry()
 	return n
 }
 
 func NewNodeServer(n *Driver, mounter mount.Interface) *NodeServer {
 	return &NodeServer{
-		Driver:  n,
-		mounter: mounter,
+		Driver:                n,
+		mounter:               mounter,
+		mountTracker:          newMountTracker(),
+		singleWriterVolumes:   &sync.Map{},
+		volumeStatsCache:      newVolumeStatsCache(n.volumeStatsCacheTTL),
+		nodeState:             newNodeState(n.nodeStateFile),
+		stagedTargets:         &sync.Map{},
+		serverAddresses:       &sync.Map{},
+		squashVerifiedVolumes: &sync.Map{},
 	}
 }
 
 func (n *Driver) Run(testMode bool) {
+	ctx := context.Background()
+	logger := klog.FromContext(ctx)
 	versionMeta, err := GetVersionYAML(n.name)
 	if err != nil {
-		klog.Fatalf("%v", err)
+		logger.Error(err, "failed to get version")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
-	klog.V(2).Infof("\nDRIVER INFORMATION:\n-------------------\n%s\n\nStreaming logs below:", versionMeta)
+	logger.V(2).Info("\nDRIVER INFORMATION:\n-------------------\n" + versionMeta + "\n\nStreaming logs below:")
 
 	mounter := mount.New("")
 	if runtime.GOOS == "linux" {
 		// MounterForceUnmounter is only implemented on Linux now
 		mounter = mounter.(mount.MounterForceUnmounter)
 	}
+	if n.enableEvents && !testMode {
+		recorder, client, err := newEventRecorder(n.kubeconfig, n.name, n.nodeID)
+		if err != nil {
+			logger.Error(err, "failed to create event recorder")
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		}
+		n.eventRecorder, n.kubeClient = recorder, client
+	}
+	if n.kubeClient == nil && !testMode {
+		// kube client reads undelete annotation of pvc and the pvc of deleted volume moved to trash
+		client, err := newKubeResourceClient(n.kubeconfig)
+		if err != nil {
+			logger.Info("failed to create kube client, undelete annotation is ignored", "annotation", undeleteFromAnnotation, "err", err)
+		} else {
+			n.kubeClient = client.client
+		}
+	}
 	n.ns = NewNodeServer(n, mounter)
+	if n.enableTopology && !testMode {
+		zone, err := getNodeZone(ctx, n.kubeconfig, n.nodeID)
+		if err != nil {
+			logger.Error(err, "failed to get zone of node", "node", n.nodeID)
+		} else if zone == "" {
+			logger.Info("node has no zone label, zone is not reported", "node", n.nodeID, "label", topologyKeyZone)
+		}
+		n.nodeZone = zone
+	}
+	if n.nodeStateFile != "" && !testMode {
+		if err := n.ns.nodeState.load(); err != nil {
+			logger.Error(err, "failed to load node state, volumes published before restart are not reconciled")
+		}
+		go n.ns.reconcileNodeState(ctx)
+	}
+	if n.staleMountCheckInterval > 0 {
+		go n.ns.runStaleMountReconciler(ctx, n.staleMountCheckInterval)
+	}
+	if n.kataDirectVolumeGCInterval > 0 {
+		go n.ns.runDirectVolumeGC(ctx, n.kataDirectVolumeGCInterval)
+	}
+	cs := NewControllerServer(n)
+	// registry is synced in all controller replicas, so it's ready when a standby replica becomes leader
+	if n.volumeRegistryResyncInterval > 0 && !testMode {
+		client, err := newKubeResourceClient(n.kubeconfig)
+		if err != nil {
+			logger.Error(err, "failed to start volume registry sync")
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		}
+		n.volumes.setSynced(false)
+		go cs.runVolumeRegistrySync(ctx, client, n.volumeRegistryResyncInterval)
+	}
+	// controller loops run in a single replica if leader election is enabled
+	runControllerLoops := func(ctx context.Context) {
+		if testMode || !(n.enableOrphanGC || n.staticVolumeAdoptionInterval > 0 || n.trashPurgeInterval > 0 || n.usageReportInterval > 0) {
+			return
+		}
+		client, err := newKubeResourceClient(n.kubeconfig)
+		if err != nil {
+			logger.Error(err, "failed to start controller loops")
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		}
+		if n.enableOrphanGC {
+			if n.orphanGCInterval <= 0 {
+				logger.Error(nil, "orphan-gc-interval must be positive")
+				klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+			}
+			go cs.runOrphanGC(ctx, client, n.orphanGCInterval, n.orphanGCGracePeriod, n.orphanGCRemove)
+		}
+		if n.staticVolumeAdoptionInterval > 0 {
+			go cs.runStaticVolumeAdoption(ctx, client, n.staticVolumeAdoptionInterval)
+		}
+		if n.trashPurgeInterval > 0 {
+			go cs.runTrashPurge(ctx, client, n.trashPurgeInterval)
+		}
+		if n.usageReportInterval > 0 {
+			go cs.runUsageReport(ctx, client, n.usageReportInterval)
+		}
+	}
+	if n.metricsAddress != "" {
+		if err := serveMetrics(ctx, n.metricsAddress); err != nil {
+			logger.Error(err, "failed to serve metrics", "address", n.metricsAddress)
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		}
+	}
 	s := NewNonBlockingGRPCServer()
 	s.Start(n.endpoint,
 		NewDefaultIdentityServer(n),
 		// NFS plugin has not implemented ControllerServer
 		// using default controllerserver.
-		NewControllerServer(n),
+		cs,
 		n.ns,
 		testMode)
+	if n.leaderElection && !testMode {
+		n.runWithLeaderElection(ctx, s, runControllerLoops)
+	} else {
+		if n.gracefulShutdownTimeout > 0 && !testMode {
+			go n.handleShutdownSignal(ctx, s)
+		}
+		runControllerLoops(ctx)
+	}
 	s.Wait()
 }
 
+// handleShutdownSignal drains in-flight operations on SIGTERM before exiting, so NodePublishVolume is not interrupted
+// in the middle of mount during rolling upgrade of node plugin
+func (n *Driver) handleShutdownSignal(ctx context.Context, s NonBlockingGRPCServer) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	klog.FromContext(ctx).V(2).Info("received signal, waiting for in-flight operations", "signal", sig, "timeout", n.gracefulShutdownTimeout)
+	stopGRPCServer(ctx, s, n.gracefulShutdownTimeout)
+	os.Exit(0)
+}
+
 func (n *Driver) AddControllerServiceCapabilities(cl []csi.ControllerServiceCapability_RPC_Type) {
 	var csc []*csi.ControllerServiceCapability
 	for _, c := range cl {
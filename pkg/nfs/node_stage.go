@@ -0,0 +1,166 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// NodeStageVolume mounts the nfs share of the volume on staging path once per node,
+// target paths of pods are bind mounted from the staging path in NodePublishVolume
+func (ns *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (_ *csi.NodeStageVolumeResponse, retErr error) {
+	logger := klog.FromContext(ctx)
+	defer func() {
+		ns.Driver.recordPVCEvent(req.GetVolumeContext(), eventReasonNodeStageVolumeFailed, retErr)
+	}()
+	volCap := req.GetVolumeCapability()
+	if volCap == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	stagingPath := req.GetStagingTargetPath()
+	if len(stagingPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path not provided")
+	}
+	lockKey := fmt.Sprintf("%s-%s", volumeID, stagingPath)
+	if acquired := ns.Driver.volumeLocks.TryAcquire(lockKey); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer ns.Driver.volumeLocks.Release(lockKey)
+
+	// ro of pods is applied on bind mounts, the share is mounted as read-only only if the access mode is read-only
+	readOnly := isReadOnlyAccessMode(volCap.GetAccessMode().GetMode())
+	cfg, err := ns.parseVolumeMountConfig(ctx, volCap, readOnly, ns.getMigratedVolumeContext(volumeID, req.GetVolumeContext()), req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	if cfg.kataDirectVolume {
+		// kata direct volume is registered on target path and mounted in the guest
+		logger.V(2).Info("NodeStageVolume: skip staging kata direct volume")
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+	if err := writeVolumeKeytab(ctx, volumeID, req.GetSecrets(), ns.Driver.krb5KeytabPath); err != nil {
+		return nil, err
+	}
+	if volCap.GetBlock() != nil {
+		// loop device of block volume is attached per target path in NodePublishVolume
+		logger.V(2).Info("NodeStageVolume: skip staging block volume")
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	notMnt, created, err := ns.prepareTargetPath(ctx, stagingPath, os.FileMode(cfg.mountPermissions))
+	if err != nil {
+		return nil, err
+	}
+	if !notMnt {
+		logger.V(2).Info("NodeStageVolume: volume is already staged", "stagingPath", stagingPath)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+	defer func() {
+		if retErr != nil {
+			removeCreatedTargetPath(ctx, stagingPath, created)
+		}
+	}()
+	ns.nodeState.set(ctx, nodeVolume{VolumeID: volumeID, TargetPath: stagingPath, Pending: true})
+	defer func() {
+		if retErr != nil {
+			ns.nodeState.remove(ctx, stagingPath)
+		}
+	}()
+
+	if err := ns.mountVolume(ctx, volumeID, stagingPath, volCap, cfg, readOnly, req.GetSecrets()); err != nil {
+		return nil, err
+	}
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// NodeUnstageVolume unmounts the staging path after the volume is unpublished from all target paths on the node
+func (ns *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	logger := klog.FromContext(ctx)
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	stagingPath := req.GetStagingTargetPath()
+	if len(stagingPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+	lockKey := fmt.Sprintf("%s-%s", volumeID, stagingPath)
+	if acquired := ns.Driver.volumeLocks.TryAcquire(lockKey); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer ns.Driver.volumeLocks.Release(lockKey)
+
+	if targets := ns.getStagedTargets(stagingPath); len(targets) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume(%s) staged on %s is still published on %v", volumeID, stagingPath, targets)
+	}
+
+	logger.V(2).Info("NodeUnstageVolume: unmounting staging path", "stagingPath", stagingPath)
+	if err := ns.cleanupMountPoint(ctx, stagingPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unmount staging path %q: %v", stagingPath, err)
+	}
+	ns.mountTracker.remove(stagingPath)
+	ns.nodeState.remove(ctx, stagingPath)
+	if err := removeVolumeKeytab(ctx, volumeID, ns.Driver.krb5KeytabPath); err != nil {
+		logger.Info("failed to remove keytab of volume", "err", err)
+	}
+	logger.V(2).Info("NodeUnstageVolume: unmount staging path successfully", "stagingPath", stagingPath)
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// bindStagingPath bind mounts the staging path on target path of NodePublishVolume, it's counted as
+// a reference of the staging path until the target path is unpublished
+func (ns *NodeServer) bindStagingPath(ctx context.Context, volumeID, stagingPath, targetPath string, readOnly bool) error {
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(stagingPath)
+	if err != nil && !os.IsNotExist(err) {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err != nil || notMnt {
+		return status.Errorf(codes.FailedPrecondition, "volume(%s) is not staged on %s", volumeID, stagingPath)
+	}
+	klog.FromContext(ctx).V(2).Info("NodePublishVolume: bind mounting staging path", "stagingPath", stagingPath, "readOnly", readOnly)
+	if err := bindMount(ctx, ns.mounter, stagingPath, targetPath, readOnly); err != nil {
+		return status.Errorf(codes.Internal, "failed to bind mount %s on %s: %v", stagingPath, targetPath, err)
+	}
+	ns.stagedTargets.Store(targetPath, stagingPath)
+	ns.nodeState.set(ctx, nodeVolume{VolumeID: volumeID, TargetPath: targetPath, StagingPath: stagingPath, ReadOnly: readOnly})
+	return nil
+}
+
+// getStagedTargets returns target paths bind mounted from the staging path
+func (ns *NodeServer) getStagedTargets(stagingPath string) []string {
+	var targets []string
+	ns.stagedTargets.Range(func(k, v interface{}) bool {
+		if v.(string) == stagingPath {
+			targets = append(targets, k.(string))
+		}
+		return true
+	})
+	sort.Strings(targets)
+	return targets
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+)
+
+func TestNodeStageVolume(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip on windows")
+	}
+	d := NewEmptyDriver("")
+	d.enableNodeStage = true
+	fakeMounter := mount.NewFakeMounter(nil)
+	ns := NewNodeServer(d, fakeMounter)
+
+	dir := t.TempDir()
+	stagingPath := filepath.Join(dir, "globalmount")
+	targets := []string{filepath.Join(dir, "pod-1", "mount"), filepath.Join(dir, "pod-2", "mount")}
+	volCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+	volumeContext := map[string]string{paramServer: "server", paramShare: "/share", paramSubDir: "subdir"}
+
+	publish := func(targetPath string, readOnly bool) error {
+		_, err := ns.NodePublishVolume(context.TODO(), &csi.NodePublishVolumeRequest{
+			VolumeId:          "vol_1",
+			StagingTargetPath: stagingPath,
+			TargetPath:        targetPath,
+			VolumeCapability:  volCap,
+			VolumeContext:     volumeContext,
+			Readonly:          readOnly,
+		})
+		return err
+	}
+	unstage := func() error {
+		_, err := ns.NodeUnstageVolume(context.TODO(), &csi.NodeUnstageVolumeRequest{VolumeId: "vol_1", StagingTargetPath: stagingPath})
+		return err
+	}
+
+	_, err := ns.NodeStageVolume(context.TODO(), &csi.NodeStageVolumeRequest{VolumeId: "vol_1", VolumeCapability: volCap})
+	assert.Equal(t, status.Error(codes.InvalidArgument, "Staging target path not provided"), err)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(publish(targets[0], false)), "volume is not staged")
+
+	for i := 0; i < 2; i++ {
+		// the share is mounted once
+		_, err = ns.NodeStageVolume(context.TODO(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1",
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  volCap,
+			VolumeContext:     volumeContext,
+		})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, publish(targets[0], false))
+	assert.NoError(t, publish(targets[1], true))
+	assert.Equal(t, []mount.FakeAction{
+		{Action: "mount", Target: stagingPath, Source: "server:/share/subdir", FSType: "nfs"},
+		{Action: "mount", Target: targets[0], Source: "server:/share/subdir"},
+		{Action: "mount", Target: targets[1], Source: "server:/share/subdir"},
+	}, fakeMounter.GetLog())
+	_, tracked := ns.mountTracker.list()[stagingPath]
+	assert.True(t, tracked, "nfs mount of staging path should be tracked")
+	assert.Len(t, ns.mountTracker.list(), 1)
+
+	assert.Equal(t, codes.FailedPrecondition, status.Code(unstage()), "volume is still published")
+	for _, target := range targets {
+		_, err = ns.NodeUnpublishVolume(context.TODO(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol_1", TargetPath: target})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, unstage())
+	_, err = os.Stat(stagingPath)
+	assert.True(t, os.IsNotExist(err), "staging path should be removed")
+	assert.Empty(t, ns.mountTracker.list())
+}
+
+func TestNodeStageKataDirectVolume(t *testing.T) {
+	ns, err := getTestNodeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stagingPath := filepath.Join(t.TempDir(), "globalmount")
+	_, err = ns.NodeStageVolume(context.TODO(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol_1",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}},
+		VolumeContext:     map[string]string{paramServer: "server", paramShare: "/share", paramKataDirectVolume: "true"},
+	})
+	assert.NoError(t, err)
+	_, err = os.Stat(stagingPath)
+	assert.True(t, os.IsNotExist(err), "kata direct volume should not be staged")
+}
@@ -0,0 +1,334 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/klog/v2"
+)
+
+const (
+	nodeStateVersion = 1
+	// DefaultGracefulShutdownTimeout is less than the default terminationGracePeriodSeconds(30s) of pods
+	DefaultGracefulShutdownTimeout = 25 * time.Second
+)
+
+// nodeVolume is a volume published on the node, it's kept in state file so it's reconciled after node plugin restarts
+type nodeVolume struct {
+	VolumeID   string   `json:"volumeID"`
+	TargetPath string   `json:"targetPath"`
+	Server     string   `json:"server,omitempty"`
+	Source     string   `json:"source,omitempty"`
+	FsType     string   `json:"fsType,omitempty"`
+	Options    []string `json:"options,omitempty"`
+	// staging path bind mounted on target path, the share is mounted on staging path
+	StagingPath string `json:"stagingPath,omitempty"`
+	// nfs share of encrypted volume mounted on cipher path, its plaintext view is mounted on target path by gocryptfs
+	CipherPath string `json:"cipherPath,omitempty"`
+	// nfs share of block volume mounted on block mount path, its sparse file is attached to loop device
+	BlockMountPath string `json:"blockMountPath,omitempty"`
+	LoopDevice     string `json:"loopDevice,omitempty"`
+	ReadOnly       bool   `json:"readOnly,omitempty"`
+	// mount info of kata direct volume, target path is not mounted on host
+	KataMountInfo *kataMountInfo `json:"kataMountInfo,omitempty"`
+	// NodePublishVolume is in progress, target path may be created but not mounted
+	Pending bool `json:"pending,omitempty"`
+}
+
+// isLayered returns true if target path is mounted from another mount of the node instead of nfs server
+func (v nodeVolume) isLayered() bool {
+	return v.StagingPath != "" || v.CipherPath != "" || v.BlockMountPath != ""
+}
+
+type nodeStateContent struct {
+	Version int          `json:"version"`
+	Volumes []nodeVolume `json:"volumes"`
+}
+
+// nodeState records volumes published on the node in a state file, every change is written to the file,
+// so the state is not lost if node plugin is killed. All methods are no-op on nil nodeState.
+type nodeState struct {
+	path string
+	// serializes writes of state file
+	mu sync.Mutex
+	// target path -> nodeVolume
+	volumes sync.Map
+}
+
+func newNodeState(path string) *nodeState {
+	if path == "" {
+		return nil
+	}
+	return &nodeState{path: path}
+}
+
+// load reads volumes from state file, it's not an error if the file does not exist
+func (s *nodeState) load() error {
+	if s == nil {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	content := nodeStateContent{}
+	if err := json.Unmarshal(data, &content); err != nil {
+		return fmt.Errorf("failed to parse node state file %s: %v", s.path, err)
+	}
+	if content.Version != nodeStateVersion {
+		return fmt.Errorf("unsupported version %d of node state file %s", content.Version, s.path)
+	}
+	for _, v := range content.Volumes {
+		s.volumes.Store(v.TargetPath, v)
+	}
+	return nil
+}
+
+func (s *nodeState) set(ctx context.Context, v nodeVolume) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.volumes.Store(v.TargetPath, v)
+	s.save(ctx)
+}
+
+func (s *nodeState) remove(ctx context.Context, targetPath string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, loaded := s.volumes.LoadAndDelete(targetPath); loaded {
+		s.save(ctx)
+	}
+}
+
+func (s *nodeState) list() []nodeVolume {
+	if s == nil {
+		return nil
+	}
+	volumes := []nodeVolume{}
+	s.volumes.Range(func(_, v interface{}) bool {
+		volumes = append(volumes, v.(nodeVolume))
+		return true
+	})
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].TargetPath < volumes[j].TargetPath })
+	return volumes
+}
+
+// save writes volumes into a temporary file and renames it to state file, so the file is not truncated
+// if node plugin is killed in the middle. It's called with mu held, the error is only logged since
+// it should not fail CSI calls.
+func (s *nodeState) save(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+	content := nodeStateContent{Version: nodeStateVersion, Volumes: s.list()}
+	data, err := json.Marshal(content)
+	if err != nil {
+		logger.Error(err, "failed to marshal node state")
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		logger.Error(err, "failed to create directory of node state file", "path", s.path)
+		return
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		logger.Error(err, "failed to write node state file", "path", tmp)
+		return
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		logger.Error(err, "failed to rename node state file", "from", tmp, "to", s.path)
+	}
+}
+
+// reconcileNodeState checks volumes in state file against mount table and kata direct volumes after node plugin restarts:
+//   - volumes whose target path is removed are forgotten
+//   - kata direct volumes which are not registered are registered again
+//   - mounted volumes are tracked by stale mount reconciler and mount health probe
+//   - target paths left by NodePublishVolume interrupted before mount are removed if they are empty
+//   - published volumes which are not mounted are mounted again
+//
+// Staging paths and cipher paths are reconciled before target paths mounted from them.
+func (ns *NodeServer) reconcileNodeState(ctx context.Context) {
+	logger := klog.FromContext(ctx).WithName("node-state-reconciler")
+	ctx = klog.NewContext(ctx, logger)
+	volumes := ns.nodeState.list()
+	logger.V(2).Info("reconciling volumes in node state file", "volumes", len(volumes))
+	sort.SliceStable(volumes, func(i, j int) bool { return !volumes[i].isLayered() && volumes[j].isLayered() })
+	for _, v := range volumes {
+		lockKey := fmt.Sprintf("%s-%s", v.VolumeID, v.TargetPath)
+		if acquired := ns.Driver.volumeLocks.TryAcquire(lockKey); !acquired {
+			logger.V(2).Info("skip reconciling volume since there is an operation in progress", "volumeID", v.VolumeID, "targetPath", v.TargetPath)
+			continue
+		}
+		ns.reconcileNodeVolume(klog.NewContext(ctx, logger.WithValues("volumeID", v.VolumeID, "targetPath", v.TargetPath)), v)
+		ns.Driver.volumeLocks.Release(lockKey)
+	}
+}
+
+func (ns *NodeServer) reconcileNodeVolume(ctx context.Context, v nodeVolume) {
+	logger := klog.FromContext(ctx)
+	err := probeMount(v.TargetPath, mountProbeTimeout)
+	if os.IsNotExist(err) {
+		logger.V(2).Info("volume is forgotten since target path does not exist")
+		if v.KataMountInfo != nil {
+			if err := removeDirectVolume(ctx, ns.Driver.kataDirectVolumeRootPath, v.TargetPath); err != nil {
+				logger.Error(err, "failed to remove kata direct volume")
+			}
+		}
+		ns.nodeState.remove(ctx, v.TargetPath)
+		return
+	}
+
+	if v.KataMountInfo != nil {
+		if _, err := getDirectVolume(ns.Driver.kataDirectVolumeRootPath, v.TargetPath); os.IsNotExist(err) {
+			logger.V(2).Info("registering kata direct volume again")
+			if err := addDirectVolume(ctx, ns.Driver.kataDirectVolumeRootPath, v.TargetPath, v.KataMountInfo); err != nil {
+				logger.Error(err, "failed to register kata direct volume")
+			}
+		}
+		return
+	}
+
+	if v.BlockMountPath != "" {
+		ns.reconcileBlockTarget(ctx, v)
+		return
+	}
+	if v.CipherPath != "" {
+		ns.reconcileEncryptedTarget(ctx, v, err)
+		return
+	}
+	if v.StagingPath != "" {
+		ns.reconcileStagedTarget(ctx, v, err)
+		return
+	}
+
+	m := publishedMount{volumeID: v.VolumeID, server: v.Server, source: v.Source, fsType: v.FsType, options: v.Options}
+	if err != nil {
+		// corrupted mount is remounted by stale mount reconciler, hung mount is reported by mount health probe
+		logger.Info("volume is not accessible", "err", err)
+		ns.mountTracker.add(v.TargetPath, m)
+		return
+	}
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(v.TargetPath)
+	if err != nil {
+		logger.Error(err, "failed to check mount point")
+		return
+	}
+	if !notMnt {
+		if v.Pending {
+			// mount succeeded before node plugin stopped
+			v.Pending = false
+			ns.nodeState.set(ctx, v)
+		}
+		ns.mountTracker.add(v.TargetPath, m)
+		return
+	}
+	if v.Pending || v.Source == "" {
+		logger.V(2).Info("removing target path left by interrupted NodePublishVolume")
+		if err := os.Remove(v.TargetPath); err != nil && !os.IsNotExist(err) {
+			// target path is not empty, it's left for kubelet
+			logger.Info("failed to remove target path", "err", err)
+		}
+		ns.nodeState.remove(ctx, v.TargetPath)
+		return
+	}
+	logger.Info("volume is not mounted, mounting it again", "source", v.Source)
+	if err := mountNFS(ctx, ns.mounter, v.Source, v.TargetPath, v.FsType, v.Options, ns.Driver.mountTimeout); err != nil {
+		logger.Error(err, "failed to mount volume", "source", v.Source)
+		return
+	}
+	ns.mountTracker.add(v.TargetPath, m)
+}
+
+// reconcileStagedTarget bind mounts the staging path on target path again if it's not mounted,
+// bind mounts are not tracked by stale mount reconciler since the nfs mount of staging path is tracked
+func (ns *NodeServer) reconcileStagedTarget(ctx context.Context, v nodeVolume, probeErr error) {
+	logger := klog.FromContext(ctx)
+	if probeErr != nil {
+		logger.Info("volume is not accessible", "err", probeErr)
+		ns.stagedTargets.Store(v.TargetPath, v.StagingPath)
+		return
+	}
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(v.TargetPath)
+	if err != nil {
+		logger.Error(err, "failed to check mount point")
+		return
+	}
+	if !notMnt {
+		if v.Pending {
+			v.Pending = false
+			ns.nodeState.set(ctx, v)
+		}
+		ns.stagedTargets.Store(v.TargetPath, v.StagingPath)
+		return
+	}
+	if v.Pending {
+		logger.V(2).Info("removing target path left by interrupted NodePublishVolume")
+		if err := os.Remove(v.TargetPath); err != nil && !os.IsNotExist(err) {
+			logger.Info("failed to remove target path", "err", err)
+		}
+		ns.nodeState.remove(ctx, v.TargetPath)
+		return
+	}
+	logger.Info("volume is not mounted, bind mounting staging path again", "stagingPath", v.StagingPath)
+	if err := bindMount(ctx, ns.mounter, v.StagingPath, v.TargetPath, v.ReadOnly); err != nil {
+		logger.Error(err, "failed to bind mount staging path", "stagingPath", v.StagingPath)
+		return
+	}
+	ns.stagedTargets.Store(v.TargetPath, v.StagingPath)
+}
+
+// reconcileEncryptedTarget checks plaintext view of encrypted volume, gocryptfs exits with node plugin,
+// the plaintext view could not be mounted again since the key is only provided in NodePublishVolume
+func (ns *NodeServer) reconcileEncryptedTarget(ctx context.Context, v nodeVolume, probeErr error) {
+	logger := klog.FromContext(ctx)
+	if probeErr == nil {
+		if notMnt, err := ns.mounter.IsLikelyNotMountPoint(v.TargetPath); err == nil && !notMnt {
+			if v.Pending {
+				v.Pending = false
+				ns.nodeState.set(ctx, v)
+			}
+			if v.StagingPath != "" {
+				ns.stagedTargets.Store(v.TargetPath, v.StagingPath)
+			}
+			return
+		}
+	}
+	if v.Pending {
+		logger.V(2).Info("removing target path left by interrupted NodePublishVolume")
+		if err := os.Remove(v.TargetPath); err != nil && !os.IsNotExist(err) {
+			logger.Info("failed to remove target path", "err", err)
+		}
+	} else {
+		logger.Info("encrypted volume is not accessible after node plugin restarts, restart the pod to publish it again", "err", probeErr)
+	}
+	ns.nodeState.remove(ctx, v.TargetPath)
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	mount "k8s.io/mount-utils"
+)
+
+func TestNodeState(t *testing.T) {
+	var nilState *nodeState
+	nilState.set(context.TODO(), nodeVolume{TargetPath: "/target"})
+	nilState.remove(context.TODO(), "/target")
+	assert.Nil(t, nilState.list())
+	assert.Nil(t, nilState.load())
+	assert.Nil(t, newNodeState(""))
+
+	path := filepath.Join(t.TempDir(), "state", "node-state.json")
+	s := newNodeState(path)
+	assert.NoError(t, s.load(), "state file does not exist")
+	s.set(context.TODO(), nodeVolume{VolumeID: "vol_1", TargetPath: "/target-1", Pending: true})
+	s.set(context.TODO(), nodeVolume{VolumeID: "vol_1", TargetPath: "/target-1", Server: "server", Source: "server:/share", Options: []string{"nfsvers=4.1"}})
+	s.set(context.TODO(), nodeVolume{VolumeID: "vol_2", TargetPath: "/target-2"})
+	s.remove(context.TODO(), "/target-2")
+
+	loaded := newNodeState(path)
+	assert.NoError(t, loaded.load())
+	assert.Equal(t, []nodeVolume{{VolumeID: "vol_1", TargetPath: "/target-1", Server: "server", Source: "server:/share", Options: []string{"nfsvers=4.1"}}}, loaded.list())
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{"version":2,"volumes":[]}`), 0600))
+	assert.Error(t, newNodeState(path).load(), "unsupported version")
+}
+
+func TestReconcileNodeState(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip on windows")
+	}
+	dir := t.TempDir()
+	const source = "server:/share"
+	mounted := filepath.Join(dir, "mounted")
+	pendingMounted := filepath.Join(dir, "pending-mounted")
+	pending := filepath.Join(dir, "pending")
+	unmounted := filepath.Join(dir, "unmounted")
+	removed := filepath.Join(dir, "removed")
+	kata := filepath.Join(dir, "kata")
+	staged := filepath.Join(dir, "staged")
+	for _, p := range []string{mounted, pendingMounted, pending, unmounted, kata, staged} {
+		assert.NoError(t, os.MkdirAll(p, 0755))
+	}
+
+	fakeMounter := mount.NewFakeMounter([]mount.MountPoint{
+		{Device: source, Path: mounted, Type: "nfs"},
+		{Device: source, Path: pendingMounted, Type: "nfs"},
+	})
+	d := NewEmptyDriver("")
+	d.kataDirectVolumeRootPath = t.TempDir()
+	d.nodeStateFile = filepath.Join(t.TempDir(), "node-state.json")
+	ns := NewNodeServer(d, fakeMounter)
+	mountInfo := &kataMountInfo{VolumeType: "nfs", Device: source, FsType: "nfs"}
+	for _, v := range []nodeVolume{
+		{VolumeID: "vol_0", TargetPath: staged, StagingPath: mounted, ReadOnly: true},
+		{VolumeID: "vol_1", TargetPath: mounted, Server: "server", Source: source},
+		{VolumeID: "vol_2", TargetPath: pendingMounted, Pending: true},
+		{VolumeID: "vol_3", TargetPath: pending, Pending: true},
+		{VolumeID: "vol_4", TargetPath: unmounted, Server: "server", Source: source, Options: []string{"nfsvers=4.1"}},
+		{VolumeID: "vol_5", TargetPath: removed, Server: "server", Source: source},
+		{VolumeID: "vol_6", TargetPath: kata, Server: "server", Source: source, KataMountInfo: mountInfo},
+	} {
+		ns.nodeState.set(context.TODO(), v)
+	}
+
+	ns.reconcileNodeState(context.Background())
+
+	tracked := ns.mountTracker.list()
+	for _, p := range []string{mounted, pendingMounted, unmounted} {
+		_, ok := tracked[p]
+		assert.True(t, ok, "%s should be tracked", p)
+	}
+	assert.Len(t, tracked, 3)
+	// staging path is reconciled before the target path bind mounted from it
+	assert.Equal(t, []mount.FakeAction{
+		{Action: "mount", Target: unmounted, Source: source, FSType: "nfs"},
+		{Action: "mount", Target: staged, Source: source},
+	}, fakeMounter.GetLog())
+	assert.Equal(t, []string{staged}, ns.getStagedTargets(mounted))
+
+	_, err := os.Stat(pending)
+	assert.True(t, os.IsNotExist(err), "empty target path of interrupted publish should be removed")
+	registered, err := getDirectVolume(d.kataDirectVolumeRootPath, kata)
+	assert.NoError(t, err)
+	assert.Equal(t, mountInfo, registered)
+
+	var remaining []string
+	for _, v := range ns.nodeState.list() {
+		assert.False(t, v.Pending, "%s should not be pending", v.TargetPath)
+		remaining = append(remaining, v.TargetPath)
+	}
+	assert.Equal(t, []string{kata, mounted, pendingMounted, staged, unmounted}, remaining)
+}
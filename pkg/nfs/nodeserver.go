@@ -17,11 +17,12 @@ limitations under the License.
 package nfs
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"golang.org/x/net/context"
@@ -36,10 +37,33 @@ import (
 type NodeServer struct {
 	Driver  *Driver
 	mounter mount.Interface
+	// mounts checked by stale mount reconciler
+	mountTracker *mountTracker
+	// volume id -> target path of published volumes with SINGLE_NODE_SINGLE_WRITER access mode
+	singleWriterVolumes *sync.Map
+	// NodeGetVolumeStats results by volume path
+	volumeStatsCache *volumeStatsCache
+	// result of the last mount health check in Probe
+	mountHealth mountHealthCache
+	// volumes published on the node, they are reconciled after node plugin restarts, nil if state file is not set
+	nodeState *nodeState
+	// target path -> staging path of volumes bind mounted from staging path
+	stagedTargets *sync.Map
+	// hostname -> address of nfs servers resolved with serverAddressPolicy
+	serverAddresses *sync.Map
+	// volume IDs whose squash configuration of the export is verified on the node
+	squashVerifiedVolumes *sync.Map
 }
 
 // NodePublishVolume mount the volume
-func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (_ *csi.NodePublishVolumeResponse, retErr error) {
+	logger := klog.FromContext(ctx)
+	defer func() {
+		// pv events are not visible to app teams without cluster scope permission, pvc is preferred
+		if !ns.Driver.recordPVCEvent(req.GetVolumeContext(), eventReasonNodePublishVolumeFailed, retErr) {
+			ns.Driver.recordPVEvent(getPVNameOfPublish(req.GetVolumeContext(), req.GetTargetPath()), eventReasonNodePublishVolumeFailed, retErr)
+		}
+	}()
 	volCap := req.GetVolumeCapability()
 	if volCap == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
@@ -52,16 +76,128 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	if len(targetPath) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Target path not provided")
 	}
+	// locked by volume ID and target path since CreateVolume/DeleteVolume hold the lock of volume ID while mounting internally
+	lockKey := fmt.Sprintf("%s-%s", volumeID, targetPath)
+	if acquired := ns.Driver.volumeLocks.TryAcquire(lockKey); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer ns.Driver.volumeLocks.Release(lockKey)
+
+	if getKeytab(req.GetSecrets()) != "" {
+		// keytab is shared by all pods on the node, it's written once per volume in NodeStageVolume
+		return nil, status.Error(codes.InvalidArgument, "keytab should be provided by nodeStageSecretRef, which requires --enable-node-stage")
+	}
+	accessMode := volCap.GetAccessMode().GetMode()
+	readOnly := req.GetReadonly() || isReadOnlyAccessMode(accessMode)
+	cfg, err := ns.parseVolumeMountConfig(ctx, volCap, readOnly, ns.getMigratedVolumeContext(volumeID, req.GetVolumeContext()), req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
+	if volCap.GetBlock() != nil {
+		logger.V(2).Info("NodePublishVolume: publishing block volume", "targetPath", targetPath, "readOnly", readOnly)
+		if err := ns.publishBlockVolume(ctx, volumeID, targetPath, volCap, cfg, readOnly, req.GetSecrets()); err != nil {
+			return nil, err
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+	if cfg.kataDirectVolume {
+		// kata agent mounts the share with a single server, failover servers are not used
+		source := fmt.Sprintf("%s:%s", cfg.servers[0], cfg.sharePath)
+		logger.V(2).Info("NodePublishVolume: mounting as kata direct volume", "source", source, "mountflags", cfg.mountOptions)
+		mountInfo, err := ns.publishDirectVolume(ctx, volumeID, source, targetPath, cfg.fsType, cfg.mountOptions, cfg.kataMetadata, cfg.mountPermissions)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to add kata direct volume on %s: %v", targetPath, err)
+		}
+		ns.nodeState.set(ctx, nodeVolume{VolumeID: volumeID, TargetPath: targetPath, Server: cfg.servers[0], Source: source, KataMountInfo: mountInfo})
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	notMnt, created, err := ns.prepareTargetPath(ctx, targetPath, os.FileMode(cfg.mountPermissions))
+	if err != nil {
+		return nil, err
+	}
+	if !notMnt {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+	defer func() {
+		if retErr != nil {
+			removeCreatedTargetPath(ctx, targetPath, created)
+		}
+	}()
+	// staging path is bind mounted if the volume is staged, the share is mounted once per volume on the node
+	var stagingPath string
+	if ns.Driver.enableNodeStage {
+		stagingPath = req.GetStagingTargetPath()
+	}
+	// empty target path is removed after restart if node plugin stops before mount
+	ns.nodeState.set(ctx, nodeVolume{VolumeID: volumeID, TargetPath: targetPath, StagingPath: stagingPath, Pending: true})
+	defer func() {
+		if retErr != nil {
+			ns.nodeState.remove(ctx, targetPath)
+		}
+	}()
+
+	if accessMode == csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER {
+		// ReadWriteOncePod volume could only be published on one target path
+		if published, loaded := ns.singleWriterVolumes.LoadOrStore(volumeID, targetPath); loaded && published.(string) != targetPath {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume(%s) with access mode %s is already published on %s", volumeID, accessMode, published)
+		}
+	}
+
+	switch {
+	case cfg.encrypted:
+		err = ns.publishEncryptedVolume(ctx, volumeID, stagingPath, targetPath, volCap, cfg, readOnly, req.GetSecrets())
+	case stagingPath != "":
+		err = ns.bindStagingPath(ctx, volumeID, stagingPath, targetPath, readOnly)
+	default:
+		err = ns.mountVolume(ctx, volumeID, targetPath, volCap, cfg, readOnly, req.GetSecrets())
+	}
+	if err != nil {
+		ns.singleWriterVolumes.CompareAndDelete(volumeID, targetPath)
+		return nil, err
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// volumeMountConfig is how the nfs share of a volume is mounted, it's parsed from volume context of NodeStageVolume or NodePublishVolume
+type volumeMountConfig struct {
+	servers             []string
+	baseDir             string
+	subDir              string
+	sharePath           string
+	fsType              string
+	mountOptions        []string
+	mountPermissions    uint64
+	fsGroupChangePolicy string
+	kataDirectVolume    bool
+	encrypted           bool
+	serverAddressPolicy string
+	kataMetadata        map[string]string
+	// squash configuration of the export expected by the volume, nil if it's not verified
+	squash *squashExpectation
+}
+
+// parseVolumeMountConfig parses volume context, server and share in node secrets override volume context
+func (ns *NodeServer) parseVolumeMountConfig(ctx context.Context, volCap *csi.VolumeCapability, readOnly bool, volumeContext, secrets map[string]string) (*volumeMountConfig, error) {
+	logger := klog.FromContext(ctx)
+	fsType, err := getFSType(volCap.GetMount().GetFsType())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 	mountOptions := volCap.GetMount().GetMountFlags()
-	if req.GetReadonly() {
+	if readOnly {
 		mountOptions = append(mountOptions, "ro")
 	}
 
 	var server, baseDir, subDir string
+	var ephemeral, kataDirectVolume, encrypted bool
+	kataMetadata := map[string]string{}
+	var fsGroupChangePolicy, serverAddressPolicy string
 	subDirReplaceMap := map[string]string{}
 
 	mountPermissions := ns.Driver.mountPermissions
-	for k, v := range req.GetVolumeContext() {
+	for k, v := range volumeContext {
 		switch strings.ToLower(k) {
 		case paramServer:
 			server = v
@@ -75,10 +211,17 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			subDirReplaceMap[pvcNameMetadata] = v
 		case pvNameKey:
 			subDirReplaceMap[pvNameMetadata] = v
+		case ephemeralField:
+			ephemeral = strings.EqualFold(v, "true")
 		case mountOptionsField:
 			if v != "" {
 				mountOptions = append(mountOptions, v)
 			}
+		case fsGroupChangePolicyField:
+			if err := validateFSGroupChangePolicy(v); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			fsGroupChangePolicy = v
 		case mountPermissionsField:
 			if v != "" {
 				var err error
@@ -86,65 +229,195 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 					return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("invalid mountPermissions %s", v))
 				}
 			}
+		case paramKataDirectVolume:
+			var err error
+			if kataDirectVolume, err = strconv.ParseBool(v); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("invalid kataDirectVolume %s", v))
+			}
+		case paramEncrypted:
+			var err error
+			if encrypted, err = strconv.ParseBool(v); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid encrypted %s", v)
+			}
+		case paramServerAddressPolicy:
+			if err := validateServerAddressPolicy(v); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			serverAddressPolicy = v
+		default:
+			if strings.HasPrefix(strings.ToLower(k), kataMetadataPrefix) {
+				kataMetadata[k[len(kataMetadataPrefix):]] = v
+			}
+		}
+	}
+	if encrypted && !ns.Driver.enableEncryption {
+		return nil, status.Errorf(codes.InvalidArgument, "%s volume requires --enable-encryption on node driver", paramEncrypted)
+	}
+	if encrypted && kataDirectVolume {
+		return nil, status.Errorf(codes.InvalidArgument, "%s is not supported by kata direct volume", paramEncrypted)
+	}
+	// default mount options, options of QoS limits and connection policy are set by the operator and not validated
+	if err := ns.Driver.mountOptionPolicy.validate(mountOptions); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := validateFSTypeMountOptions(fsType, mountOptions); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	limits, err := parseQoSLimits(volumeContext)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	mountOptions = applyQoSMountOptions(mountOptions, limits)
+	nconnect, err := parseNConnect(volumeContext)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	mountOptions = applyConnectionMountOptions(mountOptions, nconnect, ns.Driver.shareCachePolicy)
+	squash, err := parseSquashExpectation(volumeContext)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	mountOptions = normalizeMountOptions(mergeMountOptions(mountOptions, ns.Driver.defaultMountOptions))
+	if secretServer, secretShare := getServerShareFromSecrets(secrets); secretServer != "" || secretShare != "" {
+		logger.V(2).Info("server or share of volume is read from secret")
+		if secretServer != "" {
+			server = secretServer
+		}
+		if secretShare != "" {
+			baseDir = secretShare
 		}
 	}
 
-	if server == "" {
+	servers := getServerList(server)
+	if len(servers) == 0 {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%v is a required parameter", paramServer))
 	}
 	if baseDir == "" {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%v is a required parameter", paramShare))
 	}
-	server = getServerFromSource(server)
-	source := fmt.Sprintf("%s:%s", server, baseDir)
+	sharePath := baseDir
 	if subDir != "" {
 		// replace pv/pvc name namespace metadata in subDir
 		subDir = replaceWithMap(subDir, subDirReplaceMap)
+		// there is no pv/pvc behind inline volume, metadata would be left as is in subDir
+		if ephemeral && (strings.Contains(subDir, pvcNameMetadata) || strings.Contains(subDir, pvcNamespaceMetadata) || strings.Contains(subDir, pvNameMetadata)) {
+			return nil, status.Errorf(codes.InvalidArgument, "pv/pvc metadata in %v(%s) is not supported by inline volume", paramSubDir, subDir)
+		}
 
-		source = strings.TrimRight(source, "/")
-		source = fmt.Sprintf("%s/%s", source, subDir)
+		sharePath = strings.TrimRight(sharePath, "/")
+		sharePath = fmt.Sprintf("%s/%s", sharePath, subDir)
 	}
+	return &volumeMountConfig{
+		servers:             servers,
+		baseDir:             baseDir,
+		subDir:              subDir,
+		sharePath:           sharePath,
+		fsType:              fsType,
+		mountOptions:        mountOptions,
+		mountPermissions:    mountPermissions,
+		fsGroupChangePolicy: fsGroupChangePolicy,
+		kataDirectVolume:    kataDirectVolume,
+		encrypted:           encrypted,
+		serverAddressPolicy: serverAddressPolicy,
+		kataMetadata:        kataMetadata,
+		squash:              squash,
+	}, nil
+}
 
-	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			if err := os.MkdirAll(targetPath, os.FileMode(mountPermissions)); err != nil {
-				return nil, status.Error(codes.Internal, err.Error())
-			}
-			notMnt = true
-		} else {
-			return nil, status.Error(codes.Internal, err.Error())
+// mountVolume mounts the nfs share on targetPath, which is the target path of NodePublishVolume
+// or the staging path of NodeStageVolume, and applies mountPermissions and fsGroup on it
+func (ns *NodeServer) mountVolume(ctx context.Context, volumeID, targetPath string, volCap *csi.VolumeCapability, cfg *volumeMountConfig, readOnly bool, secrets map[string]string) error {
+	logger := klog.FromContext(ctx)
+	if flavor := getKerberosSecFlavor(cfg.mountOptions); flavor != "" {
+		if err := checkKerberosMount(flavor); err != nil {
+			return err
 		}
 	}
-	if !notMnt {
-		return &csi.NodePublishVolumeResponse{}, nil
-	}
 
-	klog.V(2).Infof("NodePublishVolume: volumeID(%v) source(%s) targetPath(%s) mountflags(%v)", volumeID, source, targetPath, mountOptions)
-	err = ns.mounter.Mount(source, targetPath, "nfs", mountOptions)
+	// try servers in order, the first one mounted successfully is used,
+	// hostnames are resolved on each attempt if serverAddressPolicy is set
+	var source, mountedServer string
+	var mountedOptions []string
+	err := mountWithRetry(ctx, func() error {
+		var mountErr error
+		for i, server := range cfg.servers {
+			mountedServer = server
+			var address string
+			if address, mountedOptions, mountErr = ns.resolveServerAddress(ctx, server, cfg.mountOptions, cfg.serverAddressPolicy); mountErr == nil {
+				source = getMountSource(address, cfg.sharePath)
+				logger.V(2).Info("mounting", "source", source, "mountflags", mountedOptions)
+				if mountErr = mountNFS(ctx, ns.mounter, source, targetPath, cfg.fsType, mountedOptions, ns.Driver.mountTimeout); mountErr == nil {
+					return nil
+				}
+			}
+			if i < len(cfg.servers)-1 {
+				logger.Info("failed to mount, trying next server", "err", mountErr, "source", source)
+			}
+		}
+		return mountErr
+	})
 	if err != nil {
+		if errors.Is(err, errMountTimeout) {
+			return status.Error(codes.DeadlineExceeded, err.Error())
+		}
+		if errors.Is(err, errServerAddressMismatch) {
+			return status.Error(codes.FailedPrecondition, err.Error())
+		}
+		if cfg.subDir != "" {
+			if srcErr := ns.validateVolumeSource(ctx, cfg.servers, cfg.baseDir, cfg.subDir, cfg.fsType, cfg.mountOptions); srcErr != nil {
+				logger.Error(err, "failed to mount", "source", source)
+				return srcErr
+			}
+		}
 		if os.IsPermission(err) {
-			return nil, status.Error(codes.PermissionDenied, err.Error())
+			return status.Error(codes.PermissionDenied, err.Error())
 		}
 		if strings.Contains(err.Error(), "invalid argument") {
-			return nil, status.Error(codes.InvalidArgument, err.Error())
+			return status.Error(codes.InvalidArgument, err.Error())
 		}
-		return nil, status.Error(codes.Internal, err.Error())
+		return status.Error(codes.Internal, err.Error())
 	}
 
-	if mountPermissions > 0 {
-		if err := chmodIfPermissionMismatch(targetPath, os.FileMode(mountPermissions)); err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
+	if cfg.squash != nil {
+		// probe before chmod, which fails with EPERM on a squashed export
+		if err := ns.verifySquashOnFirstPublish(ctx, volumeID, targetPath, cfg.squash, readOnly); err != nil {
+			// the mount is not reused by the retry of kubelet
+			if unmountErr := ns.mounter.Unmount(targetPath); unmountErr != nil {
+				logger.Info("failed to unmount after squash verification failed", "err", unmountErr)
+			}
+			return err
+		}
+	}
+
+	if readOnly {
+		logger.V(2).Info("skip chmod on targetPath since volume is mounted as read-only")
+	} else if cfg.mountPermissions > 0 {
+		if err := chmodIfPermissionMismatch(ctx, targetPath, os.FileMode(cfg.mountPermissions)); err != nil {
+			return status.Error(codes.Internal, err.Error())
 		}
 	} else {
-		klog.V(2).Infof("skip chmod on targetPath(%s) since mountPermissions is set as 0", targetPath)
+		logger.V(2).Info("skip chmod on targetPath since mountPermissions is set as 0")
 	}
-	klog.V(2).Infof("volume(%s) mount %s on %s succeeded", volumeID, source, targetPath)
-	return &csi.NodePublishVolumeResponse{}, nil
+
+	if mountGroup := volCap.GetMount().GetVolumeMountGroup(); mountGroup != "" && !readOnly {
+		if cfg.fsGroupChangePolicy == fsGroupChangePolicyNone {
+			logger.V(2).Info("skip applying fsGroup on targetPath", "fsGroup", mountGroup, "fsGroupChangePolicy", fsGroupChangePolicyNone)
+		} else {
+			logger.V(2).Info("set gid of targetPath", "gid", mountGroup, "fsGroupChangePolicy", cfg.fsGroupChangePolicy)
+			if err := setVolumeOwnership(targetPath, mountGroup, cfg.fsGroupChangePolicy); err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+		}
+	}
+	ns.mountTracker.add(targetPath, publishedMount{volumeID: volumeID, server: mountedServer, source: source, fsType: cfg.fsType, options: mountedOptions})
+	ns.nodeState.set(ctx, nodeVolume{VolumeID: volumeID, TargetPath: targetPath, Server: mountedServer, Source: source, FsType: cfg.fsType, Options: mountedOptions})
+	logger.V(2).Info("volume mount succeeded", "source", source)
+	return nil
 }
 
 // NodeUnpublishVolume unmount the volume
 func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	logger := klog.FromContext(ctx)
 	volumeID := req.GetVolumeId()
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
@@ -153,30 +426,61 @@ func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	if len(targetPath) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
+	lockKey := fmt.Sprintf("%s-%s", volumeID, targetPath)
+	if acquired := ns.Driver.volumeLocks.TryAcquire(lockKey); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer ns.Driver.volumeLocks.Release(lockKey)
 
-	klog.V(2).Infof("NodeUnpublishVolume: unmounting volume %s on %s", volumeID, targetPath)
-	var err error
-	extensiveMountPointCheck := true
-	forceUnmounter, ok := ns.mounter.(mount.MounterForceUnmounter)
-	if ok {
-		klog.V(2).Infof("force unmount %s on %s", volumeID, targetPath)
-		err = mount.CleanupMountWithForce(targetPath, forceUnmounter, extensiveMountPointCheck, 30*time.Second)
-	} else {
-		err = mount.CleanupMountPoint(targetPath, ns.mounter, extensiveMountPointCheck)
+	if err := removeDirectVolume(ctx, ns.Driver.kataDirectVolumeRootPath, targetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to remove kata direct volume on %s: %v", targetPath, err)
 	}
-	if err != nil {
+
+	logger.V(2).Info("NodeUnpublishVolume: unmounting volume")
+	if err := ns.cleanupMountPoint(ctx, targetPath); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to unmount target %q: %v", targetPath, err)
 	}
-	klog.V(2).Infof("NodeUnpublishVolume: unmount volume %s on %s successfully", volumeID, targetPath)
+	if err := ns.unpublishEncryptedVolume(ctx, targetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unmount nfs share of encrypted volume on %q: %v", targetPath, err)
+	}
+	if err := ns.unpublishBlockVolume(ctx, volumeID, targetPath); err != nil {
+		return nil, err
+	}
+	ns.mountTracker.remove(targetPath)
+	ns.nodeState.remove(ctx, targetPath)
+	ns.volumeStatsCache.remove(targetPath)
+	ns.singleWriterVolumes.CompareAndDelete(volumeID, targetPath)
+	ns.stagedTargets.Delete(targetPath)
+	logger.V(2).Info("NodeUnpublishVolume: unmount volume successfully")
+	// kata direct volumes of other target paths could be left if previous NodeUnpublishVolume was not called
+	if err := gcDirectVolumes(ctx, ns.Driver.kataDirectVolumeRootPath); err != nil {
+		logger.Info("failed to remove orphaned kata direct volumes", "err", err)
+	}
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
+// cleanupMountPoint unmounts and removes the mount point, unmount falls back to force and lazy unmount on timeout if it's supported
+func (ns *NodeServer) cleanupMountPoint(ctx context.Context, path string) error {
+	extensiveMountPointCheck := true
+	if forceUnmounter, ok := ns.mounter.(mount.MounterForceUnmounter); ok {
+		klog.FromContext(ctx).V(2).Info("force unmount")
+		return cleanupMountWithFallback(ctx, path, forceUnmounter, extensiveMountPointCheck, ns.Driver.unmountTimeout)
+	}
+	return mount.CleanupMountPoint(path, ns.mounter, extensiveMountPointCheck)
+}
+
 // NodeGetInfo return info of the node on which this plugin is running
 func (ns *NodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	return &csi.NodeGetInfoResponse{
+	resp := &csi.NodeGetInfoResponse{
 		NodeId: ns.Driver.nodeID,
-	}, nil
+	}
+	if ns.Driver.nodeZone != "" {
+		resp.AccessibleTopology = &csi.Topology{
+			Segments: map[string]string{topologyKeyZone: ns.Driver.nodeZone},
+		}
+	}
+	return resp, nil
 }
 
 // NodeGetCapabilities return the capabilities of the Node plugin
@@ -195,6 +499,11 @@ func (ns *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats volume path was empty")
 	}
 
+	if usage, ok := ns.volumeStatsCache.get(req.VolumePath); ok {
+		klog.FromContext(ctx).V(6).Info("NodeGetVolumeStats: return cached stats of volume", "volumePath", req.VolumePath)
+		return &csi.NodeGetVolumeStatsResponse{Usage: usage}, nil
+	}
+
 	if _, err := os.Lstat(req.VolumePath); err != nil {
 		if os.IsNotExist(err) {
 			return nil, status.Errorf(codes.NotFound, "path %s does not exist", req.VolumePath)
@@ -202,6 +511,17 @@ func (ns *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 		return nil, status.Errorf(codes.Internal, "failed to stat file %s: %v", req.VolumePath, err)
 	}
 
+	if ns.Driver.enableBlockVolume {
+		usage, ok, err := ns.getBlockVolumeStats(req.VolumeId)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get stats of block volume: %v", err)
+		}
+		if ok {
+			ns.volumeStatsCache.set(req.VolumePath, usage)
+			return &csi.NodeGetVolumeStatsResponse{Usage: usage}, nil
+		}
+	}
+
 	volumeMetrics, err := volume.NewMetricsStatFS(req.VolumePath).GetMetrics()
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to get metrics: %v", err)
@@ -233,32 +553,22 @@ func (ns *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 		return nil, status.Errorf(codes.Internal, "failed to transform disk inodes used(%v)", volumeMetrics.InodesUsed)
 	}
 
-	return &csi.NodeGetVolumeStatsResponse{
-		Usage: []*csi.VolumeUsage{
-			{
-				Unit:      csi.VolumeUsage_BYTES,
-				Available: available,
-				Total:     capacity,
-				Used:      used,
-			},
-			{
-				Unit:      csi.VolumeUsage_INODES,
-				Available: inodesFree,
-				Total:     inodes,
-				Used:      inodesUsed,
-			},
+	usage := []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Available: available,
+			Total:     capacity,
+			Used:      used,
 		},
-	}, nil
-}
-
-// NodeUnstageVolume unstage volume
-func (ns *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
-}
-
-// NodeStageVolume stage volume
-func (ns *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Available: inodesFree,
+			Total:     inodes,
+			Used:      inodesUsed,
+		},
+	}
+	ns.volumeStatsCache.set(req.VolumePath, usage)
+	return &csi.NodeGetVolumeStatsResponse{Usage: usage}, nil
 }
 
 // NodeExpandVolume node expand volume
@@ -19,9 +19,14 @@ package nfs
 import (
 	"context"
 	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -29,6 +34,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
 )
 
 const (
@@ -58,6 +64,56 @@ func TestNodePublishVolume(t *testing.T) {
 		"share":               "share",
 		mountPermissionsField: "0",
 	}
+	inlineParams := map[string]string{
+		"server":          "server",
+		"share":           "share",
+		"subDir":          "scratch",
+		mountOptionsField: "nfsvers=4.1",
+		ephemeralField:    "true",
+	}
+	inlineParamsWithMetadata := map[string]string{
+		"server":       "server",
+		"share":        "share",
+		"subDir":       "${pvc.metadata.name}",
+		ephemeralField: "true",
+	}
+
+	paramsWithFSGroupChangePolicy := map[string]string{
+		"server":                 "server",
+		"share":                  "share",
+		fsGroupChangePolicyField: "OnRootMismatch",
+	}
+	paramsWithInvalidFSGroupChangePolicy := map[string]string{
+		"server":                 "server",
+		"share":                  "share",
+		fsGroupChangePolicyField: "invalid",
+	}
+
+	paramsWithKerberos := map[string]string{
+		"server":          "server",
+		"share":           "share",
+		mountOptionsField: "nfsvers=4.1,sec=krb5p",
+	}
+
+	paramsWithUnknownMountOption := map[string]string{
+		"server":          "server",
+		"share":           "share",
+		mountOptionsField: "nfsvers=4.1,nolcok",
+	}
+
+	paramsWithMultipleServers := map[string]string{
+		"server": "error_mount,server",
+		"share":  "share",
+	}
+	paramsWithFailedServers := map[string]string{
+		"server": "error_mount1,error_mount2",
+		"share":  "share",
+	}
+	paramsWithMissingSubDir := map[string]string{
+		"server": "server",
+		"share":  "share",
+		"subDir": "error_mount",
+	}
 
 	invalidParams := map[string]string{
 		"server":              "server",
@@ -132,6 +188,15 @@ func TestNodePublishVolume(t *testing.T) {
 				Readonly:         true},
 			expectedErr: nil,
 		},
+		{
+			desc: "[Success] Valid writable request with mountPermissions",
+			req: csi.NodePublishVolumeRequest{
+				VolumeContext:    params,
+				VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap},
+				VolumeId:         "vol_1",
+				TargetPath:       targetTest},
+			expectedErr: nil,
+		},
 		{
 			desc: "[Success] Valid request with pv/pvc metadata",
 			req: csi.NodePublishVolumeRequest{
@@ -152,6 +217,126 @@ func TestNodePublishVolume(t *testing.T) {
 				Readonly:         true},
 			expectedErr: nil,
 		},
+		{
+			desc: "[Success] Valid inline volume request",
+			req: csi.NodePublishVolumeRequest{
+				VolumeContext:    inlineParams,
+				VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap},
+				VolumeId:         "csi-inline-vol",
+				TargetPath:       targetTest,
+				Readonly:         true},
+			expectedErr: nil,
+		},
+		{
+			desc: "[Error] inline volume with pvc metadata in subDir",
+			req: csi.NodePublishVolumeRequest{
+				VolumeContext:    inlineParamsWithMetadata,
+				VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap},
+				VolumeId:         "csi-inline-vol",
+				TargetPath:       targetTest,
+				Readonly:         true},
+			expectedErr: status.Error(codes.InvalidArgument, "pv/pvc metadata in subdir(${pvc.metadata.name}) is not supported by inline volume"),
+		},
+		{
+			desc: "[Success] Valid request with volume mount group",
+			req: csi.NodePublishVolumeRequest{
+				VolumeContext: paramsWithFSGroupChangePolicy,
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{VolumeMountGroup: strconv.Itoa(os.Getgid())},
+					},
+					AccessMode: &volumeCap,
+				},
+				VolumeId:   "vol_1",
+				TargetPath: targetTest},
+			skipOnWindows: true,
+			expectedErr:   nil,
+		},
+		{
+			desc: "[Error] invalid fsGroupChangePolicy",
+			req: csi.NodePublishVolumeRequest{
+				VolumeContext:    paramsWithInvalidFSGroupChangePolicy,
+				VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap},
+				VolumeId:         "vol_1",
+				TargetPath:       targetTest},
+			expectedErr: status.Error(codes.InvalidArgument, fmt.Sprintf("invalid value invalid for fsGroupChangePolicy, supported values are %v", supportedFSGroupChangePolicyList)),
+		},
+		{
+			desc: "[Error] kerberos mount without rpc.gssd",
+			req: csi.NodePublishVolumeRequest{
+				VolumeContext:    paramsWithKerberos,
+				VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap},
+				VolumeId:         "vol_1",
+				TargetPath:       targetTest},
+			setup: func() {
+				procDir = t.TempDir()
+			},
+			expectedErr: status.Error(codes.FailedPrecondition, "rpc.gssd is not running, it's required by mount option sec=krb5p"),
+			cleanup: func() {
+				procDir = "/proc"
+			},
+		},
+		{
+			desc: "[Error] unknown mount option",
+			req: csi.NodePublishVolumeRequest{
+				VolumeContext:    paramsWithUnknownMountOption,
+				VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap},
+				VolumeId:         "vol_1",
+				TargetPath:       targetTest},
+			expectedErr: status.Error(codes.InvalidArgument, `unknown mount option "nolcok", see nfs(5) for supported options`),
+		},
+		{
+			desc: "[Success] Valid request with multiple servers",
+			req: csi.NodePublishVolumeRequest{
+				VolumeContext:    paramsWithMultipleServers,
+				VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap},
+				VolumeId:         "vol_1",
+				TargetPath:       targetTest},
+			expectedErr: nil,
+		},
+		{
+			desc: "[Error] all servers failed to mount",
+			req: csi.NodePublishVolumeRequest{
+				VolumeContext:    paramsWithFailedServers,
+				VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap},
+				VolumeId:         "vol_1",
+				TargetPath:       targetTest},
+			expectedErr: status.Error(codes.Internal, "fake Mount: source error"),
+		},
+		{
+			desc: "[Error] subDir does not exist on share",
+			req: csi.NodePublishVolumeRequest{
+				VolumeContext:    paramsWithMissingSubDir,
+				VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap},
+				VolumeId:         "vol_1",
+				TargetPath:       targetTest},
+			expectedErr: status.Error(codes.NotFound, "subDir error_mount does not exist on share server:share, check subDir of the volume"),
+		},
+		{
+			desc: "[Success] server in secret overrides volume context",
+			req: csi.NodePublishVolumeRequest{
+				VolumeContext:    paramsWithFailedServers,
+				VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap},
+				VolumeId:         "vol_1",
+				TargetPath:       targetTest,
+				Secrets:          map[string]string{"Server": "server"}},
+			expectedErr: nil,
+		},
+		{
+			desc: "[Error] Volume operation in progress",
+			setup: func() {
+				ns.Driver.volumeLocks.TryAcquire(fmt.Sprintf("%s-%s", "vol_1", targetTest))
+			},
+			req: csi.NodePublishVolumeRequest{
+				VolumeContext:    params,
+				VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap},
+				VolumeId:         "vol_1",
+				TargetPath:       targetTest},
+			expectedErr: status.Error(codes.Aborted, fmt.Sprintf(volumeOperationAlreadyExistsFmt, "vol_1")),
+			cleanup: func() {
+				ns.Driver.volumeLocks.Release(fmt.Sprintf("%s-%s", "vol_1", targetTest))
+			},
+		},
 		{
 			desc: "[Error] invalid mountPermissions",
 			req: csi.NodePublishVolumeRequest{
@@ -169,6 +354,9 @@ func TestNodePublishVolume(t *testing.T) {
 	_ = makeDir(targetTest)
 
 	for _, tc := range tests {
+		if tc.skipOnWindows && runtime.GOOS == "windows" {
+			continue
+		}
 		if tc.setup != nil {
 			tc.setup()
 		}
@@ -189,6 +377,100 @@ func TestNodePublishVolume(t *testing.T) {
 
 }
 
+func TestNodePublishVolumeAccessMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip on windows")
+	}
+	ns, err := getTestNodeServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	volumeContext := map[string]string{"server": "server", "share": "share"}
+	volCap := func(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		}
+	}
+
+	// read-only access mode is mounted as read-only
+	readerTarget := filepath.Join(t.TempDir(), "reader")
+	_, err = ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "vol_1",
+		TargetPath:       readerTarget,
+		VolumeContext:    volumeContext,
+		VolumeCapability: volCap(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ro"}, ns.mountTracker.list()[readerTarget].options)
+
+	// ReadWriteOncePod volume could not be published on another target path
+	singleWriterTarget := filepath.Join(t.TempDir(), "writer")
+	otherTarget := filepath.Join(t.TempDir(), "other")
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:         "vol_2",
+		TargetPath:       singleWriterTarget,
+		VolumeContext:    volumeContext,
+		VolumeCapability: volCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER),
+	}
+	_, err = ns.NodePublishVolume(context.Background(), req)
+	assert.NoError(t, err)
+	req.TargetPath = otherTarget
+	_, err = ns.NodePublishVolume(context.Background(), req)
+	assert.Equal(t, status.Errorf(codes.FailedPrecondition, "volume(%s) with access mode %s is already published on %s", "vol_2", csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER, singleWriterTarget), err)
+
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol_2", TargetPath: singleWriterTarget})
+	assert.NoError(t, err)
+	_, err = ns.NodePublishVolume(context.Background(), req)
+	assert.NoError(t, err)
+}
+
+func TestNodePublishVolumeFSType(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip on windows")
+	}
+	d := NewEmptyDriver("")
+	d.kataDirectVolumeRootPath = t.TempDir()
+	fakeMounter := mount.NewFakeMounter(nil)
+	ns := NewNodeServer(d, fakeMounter)
+	volCap := func(fsType string, mountFlags ...string) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType, MountFlags: mountFlags}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		}
+	}
+	publish := func(targetPath string, volumeCapability *csi.VolumeCapability, kataDirectVolume bool) error {
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:         "vol_1",
+			TargetPath:       targetPath,
+			VolumeContext:    map[string]string{paramServer: "server", paramShare: "/share", paramKataDirectVolume: strconv.FormatBool(kataDirectVolume)},
+			VolumeCapability: volumeCapability,
+		})
+		return err
+	}
+
+	dir := t.TempDir()
+	nfsTarget, nfs4Target, kataTarget := filepath.Join(dir, "nfs"), filepath.Join(dir, "nfs4"), filepath.Join(dir, "kata")
+	assert.NoError(t, publish(nfsTarget, volCap(""), false))
+	assert.NoError(t, publish(nfs4Target, volCap("nfs4", "nfsvers=4.1"), false))
+	assert.Equal(t, []mount.FakeAction{
+		{Action: "mount", Target: nfsTarget, Source: "server:/share", FSType: "nfs"},
+		{Action: "mount", Target: nfs4Target, Source: "server:/share", FSType: "nfs4"},
+	}, fakeMounter.GetLog())
+	// fsType is kept for remount of stale mount
+	assert.Equal(t, fsTypeNFS4, ns.mountTracker.list()[nfs4Target].fsType)
+
+	assert.NoError(t, publish(kataTarget, volCap("nfs4"), true))
+	mountInfo, err := getDirectVolume(d.kataDirectVolumeRootPath, kataTarget)
+	assert.NoError(t, err)
+	assert.Equal(t, fsTypeNFS4, mountInfo.FsType)
+
+	err = publish(filepath.Join(dir, "ext4"), volCap("ext4"), false)
+	assert.Equal(t, status.Error(codes.InvalidArgument, "invalid fsType ext4, supported values are [nfs nfs4]"), err)
+	err = publish(filepath.Join(dir, "nfs3"), volCap("nfs4", "nfsvers=3"), false)
+	assert.Equal(t, status.Error(codes.InvalidArgument, "nfsvers=3 in mount options is not supported by fsType nfs4"), err)
+}
+
 func TestNodeUnpublishVolume(t *testing.T) {
 	ns, err := getTestNodeServer()
 	if err != nil {
@@ -220,6 +502,17 @@ func TestNodeUnpublishVolume(t *testing.T) {
 			desc: "[Success] Volume not mounted",
 			req:  csi.NodeUnpublishVolumeRequest{TargetPath: targetFile, VolumeId: "vol_1"},
 		},
+		{
+			desc: "[Error] Volume operation in progress",
+			setup: func() {
+				ns.Driver.volumeLocks.TryAcquire(fmt.Sprintf("%s-%s", "vol_1", targetFile))
+			},
+			req:         csi.NodeUnpublishVolumeRequest{TargetPath: targetFile, VolumeId: "vol_1"},
+			expectedErr: status.Error(codes.Aborted, fmt.Sprintf(volumeOperationAlreadyExistsFmt, "vol_1")),
+			cleanup: func() {
+				ns.Driver.volumeLocks.Release(fmt.Sprintf("%s-%s", "vol_1", targetFile))
+			},
+		},
 	}
 
 	// Setup
@@ -256,6 +549,12 @@ func TestNodeGetInfo(t *testing.T) {
 	resp, err := ns.NodeGetInfo(context.Background(), &req)
 	assert.NoError(t, err)
 	assert.Equal(t, resp.GetNodeId(), fakeNodeID)
+	assert.Nil(t, resp.GetAccessibleTopology())
+
+	ns.Driver.nodeZone = "zone-a"
+	resp, err = ns.NodeGetInfo(context.Background(), &req)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{topologyKeyZone: "zone-a"}, resp.GetAccessibleTopology().GetSegments())
 }
 
 func TestNodeGetCapabilities(t *testing.T) {
@@ -290,8 +589,14 @@ func getTestNodeServer() (NodeServer, error) {
 		return NodeServer{}, errors.New("failed to get fake mounter")
 	}
 	return NodeServer{
-		Driver:  d,
-		mounter: mounter,
+		Driver:                d,
+		mounter:               mounter,
+		mountTracker:          newMountTracker(),
+		singleWriterVolumes:   &sync.Map{},
+		volumeStatsCache:      newVolumeStatsCache(0),
+		stagedTargets:         &sync.Map{},
+		serverAddresses:       &sync.Map{},
+		squashVerifiedVolumes: &sync.Map{},
 	}, nil
 }
 
@@ -0,0 +1,67 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// operationLimiter caps concurrent calls of a controller operation, calls over the limit wait in queue
+// until a running call finishes, so a burst of calls does not open too many mounts against nfs servers.
+// All methods are no-op on nil operationLimiter, which means no limit.
+type operationLimiter struct {
+	method string
+	slots  chan struct{}
+}
+
+// newOperationLimiter returns limiter of method with max concurrent calls, nil is returned if max is not positive
+func newOperationLimiter(method string, max int) *operationLimiter {
+	if max <= 0 {
+		return nil
+	}
+	operationConcurrencyLimit.WithLabelValues(method).Set(float64(max))
+	return &operationLimiter{method: method, slots: make(chan struct{}, max)}
+}
+
+// acquire waits for a free slot, it returns ResourceExhausted if ctx is done before a slot is released,
+// release must be called after the operation finishes
+func (l *operationLimiter) acquire(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	default:
+	}
+
+	queueDepth := operationQueueDepth.WithLabelValues(l.method)
+	queueDepth.Inc()
+	defer queueDepth.Dec()
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	case <-ctx.Done():
+		return nil, status.Errorf(codes.ResourceExhausted, "%s: too many concurrent operations(max %d), %v", l.method, cap(l.slots), ctx.Err())
+	}
+}
+
+func (l *operationLimiter) release() {
+	<-l.slots
+}
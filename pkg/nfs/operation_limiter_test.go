@@ -0,0 +1,81 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestOperationLimiter(t *testing.T) {
+	var nilLimiter *operationLimiter
+	release, err := nilLimiter.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	release()
+	if l := newOperationLimiter("TestOperation", 0); l != nil {
+		t.Errorf("expected nil limiter without limit")
+	}
+
+	l := newOperationLimiter("TestOperation", 1)
+	release, err = l.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(ctx); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("got %v, expected ResourceExhausted", err)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		r, err := l.acquire(context.Background())
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+			return
+		}
+		r()
+		close(acquired)
+	}()
+	// wait for the call in queue
+	for i := 0; i < 100 && testutil.ToFloat64(operationQueueDepth.WithLabelValues("TestOperation")) != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if depth := testutil.ToFloat64(operationQueueDepth.WithLabelValues("TestOperation")); depth != 1 {
+		t.Errorf("unexpected queue depth %v", depth)
+	}
+	release()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("queued call is not released")
+	}
+	if depth := testutil.ToFloat64(operationQueueDepth.WithLabelValues("TestOperation")); depth != 0 {
+		t.Errorf("unexpected queue depth %v after release", depth)
+	}
+	if limit := testutil.ToFloat64(operationConcurrencyLimit.WithLabelValues("TestOperation")); limit != 1 {
+		t.Errorf("unexpected concurrency limit %v", limit)
+	}
+}
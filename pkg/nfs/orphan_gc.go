@@ -0,0 +1,353 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// orphaned subdirectories are named after pv names generated by external-provisioner
+	orphanSubDirPrefix = "pvc-"
+	// file in subdirectory retained by DeleteVolume with onDelete retain, the subdirectory is never treated as orphan
+	retainedMarkerName = ".csi-nfs-retained"
+	// file in share root listing orphans found by the last collection when removal is enabled
+	orphanReportName = ".csi-nfs-orphans"
+	// file in share root written by operator listing orphans reviewed to be removed, e.g. a copy of the report,
+	// subdirectories retained by releases which do not write the retained marker are only removed if listed
+	orphanAcknowledgedName = ".csi-nfs-orphans-acknowledged"
+)
+
+var orphanedSubDirs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "orphaned_subdirectories",
+	Help:      "Number of subdirectories without persistent volume found by the last orphan garbage collection",
+}, []string{"server", "share"})
+
+func init() {
+	prometheus.MustRegister(orphanedSubDirs)
+}
+
+// orphanGCLister lists storage classes and persistent volumes, it could be replaced in unit tests
+type orphanGCLister interface {
+	listStorageClasses(ctx context.Context) ([]storagev1.StorageClass, error)
+	listPersistentVolumes(ctx context.Context) ([]v1.PersistentVolume, error)
+}
+
+// orphanGCShare is a share configured in storage classes of the driver
+type orphanGCShare struct {
+	server       string
+	baseDir      string
+	mountOptions []string
+}
+
+// getOrphanGCShares returns shares in storage classes of the driver, each server in serverMap is a share
+func getOrphanGCShares(ctx context.Context, driverName string, storageClasses []storagev1.StorageClass) []orphanGCShare {
+	shares := map[string]orphanGCShare{}
+	for _, sc := range storageClasses {
+		if sc.Provisioner != driverName {
+			continue
+		}
+		var servers []string
+		var baseDir string
+		for k, v := range sc.Parameters {
+			switch strings.ToLower(k) {
+			case paramServer:
+				servers = append(servers, v)
+			case paramShare:
+				baseDir = v
+			case paramServerMap:
+				serverMap, err := parseServerMap(v)
+				if err != nil {
+					klog.FromContext(ctx).Info("skip invalid serverMap of storage class", "storageClass", sc.Name, "err", err)
+					continue
+				}
+				for _, server := range serverMap {
+					servers = append(servers, server)
+				}
+			}
+		}
+		for _, server := range servers {
+			share := orphanGCShare{server: server, baseDir: baseDir, mountOptions: sc.MountOptions}
+			key := strings.Trim(server, "/") + separator + strings.Trim(baseDir, "/")
+			if _, ok := shares[key]; !ok {
+				shares[key] = share
+			}
+		}
+	}
+	keys := make([]string, 0, len(shares))
+	for k := range shares {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := make([]orphanGCShare, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, shares[k])
+	}
+	return result
+}
+
+// getPersistentVolumePaths returns paths of persistent volumes on each server, and names of the persistent volumes.
+// Paths of in-tree nfs pvs, volume handles(including in-tree volume handles of migrated pvs) and volume attributes of
+// static pvs of the driver are all returned, so subdirectories of any pv are not treated as orphans.
+func getPersistentVolumePaths(driverName string, pvs []v1.PersistentVolume) (map[string][]string, map[string]bool) {
+	paths := map[string][]string{}
+	add := func(server, p string) {
+		for _, s := range getServerList(server) {
+			paths[s] = append(paths[s], strings.Trim(path.Clean("/"+p), "/"))
+		}
+	}
+	pvNames := map[string]bool{}
+	for _, pv := range pvs {
+		if pv.Spec.NFS != nil {
+			pvNames[pv.Name] = true
+			add(pv.Spec.NFS.Server, pv.Spec.NFS.Path)
+			continue
+		}
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName {
+			continue
+		}
+		pvNames[pv.Name] = true
+		if vol, err := getNfsVolFromID(pv.Spec.CSI.VolumeHandle); err == nil {
+			add(vol.server, path.Join(vol.baseDir, vol.subDir))
+		}
+		var server, share, subDir string
+		for k, v := range pv.Spec.CSI.VolumeAttributes {
+			switch strings.ToLower(k) {
+			case paramServer:
+				server = v
+			case paramShare:
+				share = v
+			case paramSubDir:
+				subDir = v
+			}
+		}
+		// pv/pvc metadata in subDir is only known on node, the whole share is protected
+		if strings.Contains(subDir, "${") {
+			subDir = ""
+		}
+		if server != "" {
+			add(server, path.Join(share, subDir))
+		}
+	}
+	return paths, pvNames
+}
+
+// isPersistentVolumePath returns true if a persistent volume is in subdirectory p of server,
+// or a persistent volume contains p, e.g. a static pv of the share root
+func isPersistentVolumePath(paths map[string][]string, server, p string) bool {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	for _, s := range getServerList(server) {
+		for _, pvPath := range paths[s] {
+			if pvPath == "" || pvPath == p || strings.HasPrefix(pvPath, p+"/") || strings.HasPrefix(p, pvPath+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func getOrphanGCKey(server, baseDir, subDir string) string {
+	return strings.Join([]string{strings.Trim(server, "/"), strings.Trim(baseDir, "/"), strings.Trim(subDir, "/")}, separator)
+}
+
+// writeRetainedMarker marks the subdirectory of volume retained on deletion, so it's not treated as orphan
+func writeRetainedMarker(volumePath, volumeID string) error {
+	if fi, err := os.Stat(volumePath); os.IsNotExist(err) || (err == nil && !fi.IsDir()) {
+		return nil
+	}
+	return os.WriteFile(filepath.Join(volumePath, retainedMarkerName), []byte(volumeID+"\n"), 0644)
+}
+
+// readOrphanList returns subdirectory names in the orphan report or acknowledged orphans, one name per line
+func readOrphanList(p string) (map[string]bool, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if name := strings.TrimSpace(line); name != "" {
+			names[name] = true
+		}
+	}
+	return names, nil
+}
+
+func writeOrphanList(p string, names []string) error {
+	var data string
+	if len(names) > 0 {
+		data = strings.Join(names, "\n") + "\n"
+	}
+	return os.WriteFile(p, []byte(data), 0644)
+}
+
+// runOrphanGC finds subdirectories without persistent volume on shares of storage classes periodically
+func (cs *ControllerServer) runOrphanGC(ctx context.Context, lister orphanGCLister, interval, gracePeriod time.Duration, remove bool) {
+	logger := klog.FromContext(ctx).WithName("orphan-gc")
+	ctx = klog.NewContext(ctx, logger)
+	logger.V(2).Info("starting orphan garbage collection", "interval", interval, "gracePeriod", gracePeriod, "remove", remove)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	reported := map[string]bool{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var err error
+			if reported, err = cs.collectOrphans(ctx, lister, gracePeriod, remove, reported); err != nil {
+				logger.Error(err, "orphan garbage collection failed")
+			}
+		}
+	}
+}
+
+// collectOrphans reports subdirectories which have no persistent volume and are not modified in grace period, returns
+// keys of the reported orphans. If remove is true, orphans reported by the previous collection and acknowledged by operator
+// are removed, so each orphan is reported for at least one interval before it's removed.
+func (cs *ControllerServer) collectOrphans(ctx context.Context, lister orphanGCLister, gracePeriod time.Duration, remove bool, reported map[string]bool) (map[string]bool, error) {
+	storageClasses, err := lister.listStorageClasses(ctx)
+	if err != nil {
+		return reported, fmt.Errorf("failed to list storage classes: %v", err)
+	}
+	// subdirectory of a volume being provisioned has no persistent volume yet, it's protected by grace period
+	pvs, err := lister.listPersistentVolumes(ctx)
+	if err != nil {
+		return reported, fmt.Errorf("failed to list persistent volumes: %v", err)
+	}
+	paths, pvNames := getPersistentVolumePaths(cs.Driver.name, pvs)
+	current := map[string]bool{}
+	for _, share := range getOrphanGCShares(ctx, cs.Driver.name, storageClasses) {
+		orphans, err := cs.collectOrphansOnShare(ctx, share, paths, pvNames, gracePeriod, remove, reported, current)
+		if err != nil {
+			klog.FromContext(ctx).Error(err, "failed to collect orphans", "server", share.server, "share", share.baseDir)
+			continue
+		}
+		orphanedSubDirs.WithLabelValues(share.server, share.baseDir).Set(float64(orphans))
+	}
+	return current, nil
+}
+
+func (cs *ControllerServer) collectOrphansOnShare(ctx context.Context, share orphanGCShare, paths map[string][]string, pvNames map[string]bool, gracePeriod time.Duration, remove bool, reported, current map[string]bool) (int, error) {
+	var volCap *csi.VolumeCapability
+	if len(share.mountOptions) > 0 {
+		volCap = &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{
+					MountFlags: share.mountOptions,
+				},
+			},
+		}
+	}
+	shareVol := &nfsVolume{
+		server:  share.server,
+		baseDir: share.baseDir,
+	}
+	shareVol.id = getVolumeIDFromNfsVol(shareVol)
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(shareVol.id))
+	shareVol.uuid = fmt.Sprintf("orphan-gc-%x", h.Sum32())
+	logger := klog.FromContext(ctx).WithValues("server", share.server, "share", share.baseDir)
+
+	if err := cs.internalMount(ctx, shareVol, nil, volCap); err != nil {
+		return 0, fmt.Errorf("failed to mount nfs server: %v", err)
+	}
+	defer func() {
+		if err := cs.internalUnmount(ctx, shareVol); err != nil {
+			logger.Info("failed to unmount nfs server after orphan garbage collection", "err", err)
+		}
+	}()
+
+	sharePath := getInternalMountPath(cs.Driver.workingMountDir, shareVol)
+	entries, err := os.ReadDir(sharePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read directory %s: %v", sharePath, err)
+	}
+	var acknowledged map[string]bool
+	if remove {
+		if acknowledged, err = readOrphanList(filepath.Join(sharePath, orphanAcknowledgedName)); err != nil && !os.IsNotExist(err) {
+			logger.Info("failed to read acknowledged orphans, no orphan is removed", "file", orphanAcknowledgedName, "err", err)
+		}
+	}
+	var found []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !strings.HasPrefix(name, orphanSubDirPrefix) {
+			continue
+		}
+		if pvNames[name] || isPersistentVolumePath(paths, share.server, path.Join(share.baseDir, name)) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(sharePath, name, retainedMarkerName)); err == nil {
+			logger.V(4).Info("skip subdirectory retained on deletion", "subDir", name)
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			logger.Info("failed to get info of subdirectory", "subDir", name, "err", err)
+			continue
+		}
+		if time.Since(info.ModTime()) < gracePeriod {
+			logger.V(4).Info("skip subdirectory modified in grace period", "subDir", name)
+			continue
+		}
+		found = append(found, name)
+		key := getOrphanGCKey(share.server, share.baseDir, name)
+		current[key] = true
+		if !remove || !reported[key] {
+			logger.Info("subdirectory has no persistent volume", "subDir", name, "modTime", info.ModTime())
+			continue
+		}
+		// subdirectory retained by older releases has no marker, it's only removed after operator reviews the report
+		if !acknowledged[name] {
+			logger.Info("skip removing subdirectory which is not acknowledged", "subDir", name, "report", orphanReportName, "acknowledged", orphanAcknowledgedName)
+			continue
+		}
+		// volume is being created if the lock of pv name is held
+		if acquired := cs.Driver.volumeLocks.TryAcquire(name); !acquired {
+			logger.V(2).Info("skip removing subdirectory since operation of volume is in progress", "subDir", name)
+			continue
+		}
+		logger.Info("removing subdirectory which has no persistent volume", "subDir", name, "modTime", info.ModTime())
+		err = os.RemoveAll(filepath.Join(sharePath, name))
+		cs.Driver.volumeLocks.Release(name)
+		if err != nil {
+			logger.Error(err, "failed to remove subdirectory", "subDir", name)
+		}
+	}
+	if remove {
+		if err := writeOrphanList(filepath.Join(sharePath, orphanReportName), found); err != nil {
+			logger.Error(err, "failed to write orphan report", "file", orphanReportName)
+		}
+	}
+	return len(found), nil
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetOrphanGCShares(t *testing.T) {
+	storageClasses := []storagev1.StorageClass{
+		{
+			ObjectMeta:   metav1.ObjectMeta{Name: "nfs-a"},
+			Provisioner:  DefaultDriverName,
+			Parameters:   map[string]string{"server": "10.0.0.1", "share": "/export"},
+			MountOptions: []string{"nfsvers=4.1"},
+		},
+		{
+			ObjectMeta:  metav1.ObjectMeta{Name: "nfs-a-duplicate"},
+			Provisioner: DefaultDriverName,
+			Parameters:  map[string]string{"server": "10.0.0.1", "share": "/export/"},
+		},
+		{
+			ObjectMeta:  metav1.ObjectMeta{Name: "nfs-zones"},
+			Provisioner: DefaultDriverName,
+			Parameters:  map[string]string{"serverMap": "zone-1=10.0.0.3", "share": "/export"},
+		},
+		{
+			ObjectMeta:  metav1.ObjectMeta{Name: "other-driver"},
+			Provisioner: "other.csi.k8s.io",
+			Parameters:  map[string]string{"server": "10.0.0.2", "share": "/export"},
+		},
+	}
+	expected := []orphanGCShare{
+		{server: "10.0.0.1", baseDir: "/export", mountOptions: []string{"nfsvers=4.1"}},
+		{server: "10.0.0.3", baseDir: "/export"},
+	}
+	if shares := getOrphanGCShares(context.TODO(), DefaultDriverName, storageClasses); !reflect.DeepEqual(shares, expected) {
+		t.Errorf("unexpected shares %v, expected %v", shares, expected)
+	}
+}
+
+func TestCollectOrphans(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.name = DefaultDriverName
+	cs.Driver.workingMountDir = t.TempDir()
+	lister := &fakeKubeResourceClient{
+		storageClasses: []storagev1.StorageClass{
+			{
+				ObjectMeta:  metav1.ObjectMeta{Name: "nfs"},
+				Provisioner: DefaultDriverName,
+				Parameters:  map[string]string{"server": testServer, "share": testBaseDir},
+			},
+		},
+		pvs: []v1.PersistentVolume{
+			newTestPV("pvc-bound", fmt.Sprintf("%s#%s#pvc-bound##", testServer, testBaseDir)),
+			// subDir of volume is not named after pv
+			newTestPV("pv-static", fmt.Sprintf("%s#%s#pvc-renamed##", testServer, testBaseDir)),
+			// in-tree volume handle of migrated pv
+			newTestPV("pv-migrated", fmt.Sprintf("%s:/%s/pvc-migrated", testServer, testBaseDir)),
+			newTestPV("pv-attributes", "static-volume", withVolumeAttributes(map[string]string{"server": testServer, "share": "/" + testBaseDir, "subDir": "pvc-attributes/data"})),
+			newTestPV("pv-in-tree", "", withInTreeNFS(testServer, "/"+testBaseDir+"/pvc-in-tree/")),
+		},
+	}
+
+	shareVol := &nfsVolume{server: testServer, baseDir: testBaseDir}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(getVolumeIDFromNfsVol(shareVol)))
+	sharePath := filepath.Join(cs.Driver.workingMountDir, fmt.Sprintf("orphan-gc-%x", h.Sum32()))
+	old := time.Now().Add(-48 * time.Hour)
+	dirs := []string{"pvc-bound", "pvc-renamed", "pvc-migrated", "pvc-attributes", "pvc-in-tree", "pvc-retained", "pvc-unacknowledged", "pvc-orphan", "pvc-recent", "pvc-locked", "other"}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(filepath.Join(sharePath, dir), 0755); err != nil {
+			t.Fatalf("failed to create %s: %v", dir, err)
+		}
+		if dir == "pvc-retained" {
+			if err := writeRetainedMarker(filepath.Join(sharePath, dir), "volume-id"); err != nil {
+				t.Fatalf("failed to mark %s: %v", dir, err)
+			}
+		}
+		if dir != "pvc-recent" {
+			if err := os.Chtimes(filepath.Join(sharePath, dir), old, old); err != nil {
+				t.Fatalf("failed to change time of %s: %v", dir, err)
+			}
+		}
+	}
+
+	// orphans are only reported
+	reported, err := cs.collectOrphans(context.TODO(), lister, 24*time.Hour, false, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(sharePath, "pvc-orphan")); err != nil {
+		t.Errorf("orphan is removed without remove option: %v", err)
+	}
+	orphanKey := getOrphanGCKey(testServer, testBaseDir, "pvc-orphan")
+	lockedKey := getOrphanGCKey(testServer, testBaseDir, "pvc-locked")
+	unacknowledgedKey := getOrphanGCKey(testServer, testBaseDir, "pvc-unacknowledged")
+	if !reflect.DeepEqual(reported, map[string]bool{orphanKey: true, lockedKey: true, unacknowledgedKey: true}) {
+		t.Errorf("unexpected orphans %v", reported)
+	}
+	if _, err := os.Stat(filepath.Join(sharePath, orphanReportName)); !os.IsNotExist(err) {
+		t.Errorf("orphan report is written without remove option: %v", err)
+	}
+
+	// orphans not reported by the previous collection are not removed
+	if _, err := cs.collectOrphans(context.TODO(), lister, 24*time.Hour, true, nil); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(sharePath, "pvc-orphan")); err != nil {
+		t.Errorf("orphan is removed before it's reported: %v", err)
+	}
+	report, err := os.ReadFile(filepath.Join(sharePath, orphanReportName))
+	if err != nil || string(report) != "pvc-locked\npvc-orphan\npvc-unacknowledged\n" {
+		t.Errorf("got orphan report %q %v", report, err)
+	}
+	// reported orphans are not removed until they are acknowledged
+	if _, err := cs.collectOrphans(context.TODO(), lister, 24*time.Hour, true, reported); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(sharePath, "pvc-orphan")); err != nil {
+		t.Errorf("orphan is removed before it's acknowledged: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(sharePath, orphanAcknowledgedName), []byte("pvc-orphan\npvc-locked\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cs.Driver.volumeLocks.TryAcquire("pvc-locked")
+	defer cs.Driver.volumeLocks.Release("pvc-locked")
+	if _, err := cs.collectOrphans(context.TODO(), lister, 24*time.Hour, true, reported); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for dir, expectExist := range map[string]bool{
+		"pvc-bound":          true,
+		"pvc-renamed":        true,
+		"pvc-migrated":       true,
+		"pvc-attributes":     true,
+		"pvc-in-tree":        true,
+		"pvc-retained":       true,
+		"pvc-unacknowledged": true,
+		"pvc-orphan":         false,
+		"pvc-recent":         true,
+		"pvc-locked":         true,
+		"other":              true,
+	} {
+		_, err := os.Stat(filepath.Join(sharePath, dir))
+		if exist := err == nil; exist != expectExist {
+			t.Errorf("unexpected existence %v of %s, expected %v", exist, dir, expectExist)
+		}
+	}
+}
+
+func TestIsPersistentVolumePath(t *testing.T) {
+	paths := map[string][]string{"10.0.0.1": {"export/pvc-1", "export/team-a/pvc-2"}, "10.0.0.2": {""}}
+	cases := []struct {
+		server   string
+		path     string
+		expected bool
+	}{
+		{server: "10.0.0.1", path: "/export/pvc-1", expected: true},
+		{server: "10.0.0.1", path: "/export/team-a", expected: true},
+		{server: "10.0.0.1", path: "/export/pvc-1/data", expected: true},
+		{server: "10.0.0.1", path: "/export/pvc-10", expected: false},
+		{server: "10.0.0.3,10.0.0.1", path: "/export/pvc-1", expected: true},
+		{server: "10.0.0.3", path: "/export/pvc-1", expected: false},
+		// pv of share root
+		{server: "10.0.0.2", path: "/export/pvc-1", expected: true},
+	}
+	for _, test := range cases {
+		if result := isPersistentVolumePath(paths, test.server, test.path); result != test.expected {
+			t.Errorf("got %v for %s:%s, expected %v", result, test.server, test.path, test.expected)
+		}
+	}
+}
+
+func TestDeleteVolumeRetainedMarker(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.workingMountDir = t.TempDir()
+	volumeID := fmt.Sprintf("%s#%s#pvc-1#pvc-1#retain", testServer, testBaseDir)
+	volumePath := filepath.Join(cs.Driver.workingMountDir, "pvc-1", "pvc-1")
+	if err := os.MkdirAll(volumePath, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.DeleteVolume(context.TODO(), &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(volumePath, retainedMarkerName))
+	if err != nil || string(data) != volumeID+"\n" {
+		t.Errorf("got marker %q %v of retained subdirectory", data, err)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// testPVOption changes the persistent volume built by newTestPV
+type testPVOption func(*v1.PersistentVolume)
+
+// newTestPV returns a 10Gi persistent volume of the default driver with volumeHandle, options are applied in order
+func newTestPV(name, volumeHandle string, opts ...testPVOption) v1.PersistentVolume {
+	pv := v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{v1.ResourceStorage: resource.MustParse("10Gi")},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: DefaultDriverName, VolumeHandle: volumeHandle},
+			},
+		},
+	}
+	for _, opt := range opts {
+		opt(&pv)
+	}
+	return pv
+}
+
+// withDriver sets the csi driver of the persistent volume
+func withDriver(driver string) testPVOption {
+	return func(pv *v1.PersistentVolume) {
+		pv.Spec.CSI.Driver = driver
+	}
+}
+
+// withVolumeAttributes sets the csi volume attributes of the persistent volume
+func withVolumeAttributes(attributes map[string]string) testPVOption {
+	return func(pv *v1.PersistentVolume) {
+		pv.Spec.CSI.VolumeAttributes = attributes
+	}
+}
+
+// withClaimRef binds the persistent volume to the pvc
+func withClaimRef(namespace, pvcName string) testPVOption {
+	return func(pv *v1.PersistentVolume) {
+		pv.Spec.ClaimRef = &v1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: namespace, Name: pvcName}
+	}
+}
+
+// withInTreeNFS replaces the csi source of the persistent volume by a read only in-tree nfs source
+func withInTreeNFS(server, path string) testPVOption {
+	return func(pv *v1.PersistentVolume) {
+		pv.Spec.PersistentVolumeSource = v1.PersistentVolumeSource{
+			NFS: &v1.NFSVolumeSource{Server: server, Path: path, ReadOnly: true},
+		}
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// minimum and maximum rsize/wsize supported by linux nfs client
+	minQoSIOSize = 4 * 1024
+	maxQoSIOSize = 1024 * 1024
+	// rpcs per second used to derive rsize/wsize if iopsLimit is not set
+	defaultQoSIOPS = 100
+)
+
+// qosLimits are throughputLimit(bytes per second) and iopsLimit of a volume, 0 means no limit, iopsLimit requires throughputLimit.
+// cgroup io.max only throttles block devices, nfs mounts are not throttled by it, so the limits are applied
+// as rsize/wsize tuning profile on node and throttled clone and snapshot restore in controller
+type qosLimits struct {
+	throughput int64
+	iops       int64
+}
+
+// parseQoSLimits returns throughputLimit and iopsLimit in parameters, nil is returned if no limit is set
+func parseQoSLimits(parameters map[string]string) (*qosLimits, error) {
+	limits := &qosLimits{}
+	for k, v := range parameters {
+		switch strings.ToLower(k) {
+		case paramThroughputLimit:
+			if v == "" {
+				continue
+			}
+			quantity, err := resource.ParseQuantity(v)
+			if err != nil || quantity.Value() <= 0 {
+				return nil, fmt.Errorf("invalid %s %s, it should be a positive quantity of bytes per second, e.g. 100Mi", paramThroughputLimit, v)
+			}
+			limits.throughput = quantity.Value()
+		case paramIOPSLimit:
+			if v == "" {
+				continue
+			}
+			iops, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || iops <= 0 {
+				return nil, fmt.Errorf("invalid %s %s, it should be a positive integer", paramIOPSLimit, v)
+			}
+			limits.iops = iops
+		}
+	}
+	if limits.throughput == 0 && limits.iops == 0 {
+		return nil, nil
+	}
+	return limits, nil
+}
+
+// validateQoSLimits checks limits in parameters of new volumes, iopsLimit only derives rsize/wsize from
+// throughputLimit and limits nothing alone, it's ignored in volume context of existing volumes
+func validateQoSLimits(parameters map[string]string) error {
+	limits, err := parseQoSLimits(parameters)
+	if err != nil {
+		return err
+	}
+	if limits != nil && limits.throughput == 0 {
+		return fmt.Errorf("%s requires %s", paramIOPSLimit, paramThroughputLimit)
+	}
+	return nil
+}
+
+// ioSize returns rsize/wsize which transfers throughputLimit in iopsLimit rpcs per second,
+// rounded down to power of two in [4Ki, 1Mi], 0 is returned if no limit is set
+func (q *qosLimits) ioSize() int64 {
+	if q == nil || q.throughput == 0 {
+		return 0
+	}
+	iops := q.iops
+	if iops == 0 {
+		iops = defaultQoSIOPS
+	}
+	size := int64(minQoSIOSize)
+	for size*2 <= q.throughput/iops && size < maxQoSIOSize {
+		size *= 2
+	}
+	return size
+}
+
+// applyQoSMountOptions adds rsize and wsize of the tuning profile, rsize and wsize in mount options take precedence
+func applyQoSMountOptions(mountOptions []string, q *qosLimits) []string {
+	size := q.ioSize()
+	if size == 0 {
+		return mountOptions
+	}
+	return mergeMountOptions(mountOptions, []string{fmt.Sprintf("rsize=%d", size), fmt.Sprintf("wsize=%d", size)})
+}
+
+// newCopyLimiter returns the limiter of data copied into the volume by controller, nil if throughputLimit is not set
+func (q *qosLimits) newCopyLimiter() *rate.Limiter {
+	if q == nil || q.throughput == 0 {
+		return nil
+	}
+	burst := q.ioSize()
+	if burst > q.throughput {
+		burst = q.throughput
+	}
+	return rate.NewLimiter(rate.Limit(q.throughput), int(burst))
+}
+
+// rateLimitedReader waits for the limiter before returning data read from r
+type rateLimitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func newRateLimitedReader(ctx context.Context, r io.Reader, limiter *rate.Limiter) io.Reader {
+	if limiter == nil {
+		return r
+	}
+	return &rateLimitedReader{ctx: ctx, r: r, limiter: limiter}
+}
+
+func (l *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > l.limiter.Burst() {
+		p = p[:l.limiter.Burst()]
+	}
+	n, err := l.r.Read(p)
+	if n > 0 {
+		if waitErr := l.limiter.WaitN(l.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+)
+
+func TestParseQoSLimits(t *testing.T) {
+	tests := []struct {
+		desc       string
+		parameters map[string]string
+		expected   *qosLimits
+		expectErr  bool
+	}{
+		{
+			desc:       "no limits",
+			parameters: map[string]string{paramServer: "server"},
+		},
+		{
+			desc:       "throughput and iops",
+			parameters: map[string]string{"throughputLimit": "100Mi", "iopsLimit": "1000"},
+			expected:   &qosLimits{throughput: 100 * 1024 * 1024, iops: 1000},
+		},
+		{
+			desc:       "invalid throughput",
+			parameters: map[string]string{"throughputLimit": "fast"},
+			expectErr:  true,
+		},
+		{
+			desc:       "negative iops",
+			parameters: map[string]string{"iopsLimit": "-1"},
+			expectErr:  true,
+		},
+	}
+	for _, test := range tests {
+		limits, err := parseQoSLimits(test.parameters)
+		if (err != nil) != test.expectErr {
+			t.Errorf("test[%s]: unexpected error %v", test.desc, err)
+		}
+		if !reflect.DeepEqual(limits, test.expected) {
+			t.Errorf("test[%s]: unexpected limits %v, expected %v", test.desc, limits, test.expected)
+		}
+	}
+}
+
+func TestValidateQoSLimits(t *testing.T) {
+	tests := []struct {
+		desc       string
+		parameters map[string]string
+		expectErr  bool
+	}{
+		{
+			desc:       "no limits",
+			parameters: map[string]string{paramServer: "server"},
+		},
+		{
+			desc:       "throughput and iops",
+			parameters: map[string]string{"throughputLimit": "100Mi", "iopsLimit": "1000"},
+		},
+		{
+			desc:       "iops without throughput",
+			parameters: map[string]string{"iopsLimit": "1000"},
+			expectErr:  true,
+		},
+		{
+			desc:       "invalid throughput",
+			parameters: map[string]string{"throughputLimit": "fast"},
+			expectErr:  true,
+		},
+	}
+	for _, test := range tests {
+		if err := validateQoSLimits(test.parameters); (err != nil) != test.expectErr {
+			t.Errorf("test[%s]: unexpected error %v", test.desc, err)
+		}
+	}
+}
+
+func TestApplyQoSMountOptions(t *testing.T) {
+	tests := []struct {
+		desc         string
+		mountOptions []string
+		limits       *qosLimits
+		expected     []string
+	}{
+		{
+			desc:         "no limits",
+			mountOptions: []string{"nfsvers=4.1"},
+			expected:     []string{"nfsvers=4.1"},
+		},
+		{
+			desc:         "io size of throughput and iops",
+			mountOptions: []string{"nfsvers=4.1"},
+			limits:       &qosLimits{throughput: 100 * 1024 * 1024, iops: 1000},
+			expected:     []string{"nfsvers=4.1", "rsize=65536", "wsize=65536"},
+		},
+		{
+			desc:     "io size capped at 1Mi",
+			limits:   &qosLimits{throughput: 10 * 1024 * 1024 * 1024},
+			expected: []string{"rsize=1048576", "wsize=1048576"},
+		},
+		{
+			desc:     "io size at least 4Ki",
+			limits:   &qosLimits{throughput: 1024, iops: 10},
+			expected: []string{"rsize=4096", "wsize=4096"},
+		},
+		{
+			desc:         "rsize in mount options takes precedence",
+			mountOptions: []string{"rsize=32768"},
+			limits:       &qosLimits{throughput: 100 * 1024 * 1024, iops: 1000},
+			expected:     []string{"rsize=32768", "wsize=65536"},
+		},
+		{
+			desc:         "iops only",
+			mountOptions: []string{"hard"},
+			limits:       &qosLimits{iops: 1000},
+			expected:     []string{"hard"},
+		},
+	}
+	for _, test := range tests {
+		if result := applyQoSMountOptions(test.mountOptions, test.limits); !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("test[%s]: unexpected mount options %v, expected %v", test.desc, result, test.expected)
+		}
+	}
+}
+
+func TestRateLimitedReader(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 4096)
+	limiter := rate.NewLimiter(rate.Limit(8192), 1024)
+	// burst is consumed at once, the rest 3072 bytes take about 375ms
+	start := time.Now()
+	n, err := io.Copy(io.Discard, newRateLimitedReader(context.TODO(), bytes.NewReader(data), limiter))
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("unexpected copy result %d, error %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("copy is not throttled, it takes %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	if _, err := io.Copy(io.Discard, newRateLimitedReader(ctx, bytes.NewReader(data), rate.NewLimiter(rate.Limit(1), 1024))); err == nil {
+		t.Errorf("expected error of cancelled context")
+	}
+}
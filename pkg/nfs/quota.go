@@ -0,0 +1,283 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	"k8s.io/klog/v2"
+)
+
+// projectIDFileName is the file under root of quota mount dir where project ids allocated to volume subdirectories are
+// recorded, in the same "name:id" format as /etc/projid with subdirectory relative to quota mount dir as name
+const projectIDFileName = ".csi-nfs-projid"
+
+// systemProjectIDFile lists projects defined by the administrator, ids in it are not allocated to volumes.
+// It could be replaced in unit tests.
+var systemProjectIDFile = "/etc/projid"
+
+// projectQuota manages project quotas of volume subdirectories on the backing filesystem of nfs exports.
+// Project quota could not be set through nfs, so the backing filesystem(xfs, or ext4 with project quota feature)
+// must be mounted locally on mountDir, its root should be the root of nfs exports.
+type projectQuota struct {
+	mountDir string
+	// execCommand runs a command and returns its combined output, could be replaced in unit tests
+	execCommand func(name string, args ...string) ([]byte, error)
+	// project ids are allocated and released by concurrent CreateVolume and DeleteVolume
+	mutex sync.Mutex
+}
+
+func newProjectQuota(mountDir string) *projectQuota {
+	return &projectQuota{
+		mountDir: mountDir,
+		execCommand: func(name string, args ...string) ([]byte, error) {
+			return exec.Command(name, args...).CombinedOutput()
+		},
+	}
+}
+
+// getQuotaPath returns the path of volume subdirectory on the backing filesystem
+func (q *projectQuota) getQuotaPath(vol *nfsVolume) string {
+	return filepath.Join(q.mountDir, vol.baseDir, vol.subDir)
+}
+
+// setQuota assigns project of the volume to its subdirectory and sets the hard block limit of the project
+func (q *projectQuota) setQuota(ctx context.Context, vol *nfsVolume, sizeBytes int64) error {
+	path := q.getQuotaPath(vol)
+	projectID, err := q.allocateProjectID(vol)
+	if err != nil {
+		return err
+	}
+	klog.FromContext(ctx).V(2).Info("setting project", "projectID", projectID, "path", path)
+	// -f is required by xfs_quota on non-xfs filesystems, e.g. ext4
+	if out, err := q.execCommand("xfs_quota", "-f", "-x", "-c", fmt.Sprintf("project -s -p %s %d", path, projectID), q.mountDir); err != nil {
+		return fmt.Errorf("failed to set project(%d) on %s: %v, output: %s", projectID, path, err, string(out))
+	}
+	return q.setLimit(ctx, projectID, sizeBytes)
+}
+
+// resizeQuota updates the hard block limit of the volume project,
+// it returns false if project quota is not set on the volume subdirectory
+func (q *projectQuota) resizeQuota(ctx context.Context, vol *nfsVolume, sizeBytes int64) (bool, error) {
+	projectID, ok, err := q.getVolumeProject(ctx, vol)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, q.setLimit(ctx, projectID, sizeBytes)
+}
+
+// clearQuota removes the hard block limit of the volume project before its subdirectory is deleted, archived or moved
+// to trash, it returns false if project quota is not set on the volume subdirectory. Project id is kept since files
+// left in archived or trashed subdirectory still belong to the project, it's released after the subdirectory is removed.
+func (q *projectQuota) clearQuota(ctx context.Context, vol *nfsVolume) (bool, error) {
+	projectID, ok, err := q.getVolumeProject(ctx, vol)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, q.setLimit(ctx, projectID, 0)
+}
+
+// getVolumeProject returns the project id of the volume, false is returned if the subdirectory does not exist on quota
+// mount dir or its project is not the one allocated to the volume
+func (q *projectQuota) getVolumeProject(ctx context.Context, vol *nfsVolume) (uint32, bool, error) {
+	path := q.getQuotaPath(vol)
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			klog.FromContext(ctx).V(2).Info("skip updating quota since path does not exist on quota mount dir", "path", path)
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	projectID, err := q.lookupProjectID(vol)
+	if err != nil {
+		return 0, false, err
+	}
+	out, err := q.execCommand("lsattr", "-p", "-d", path)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to get project of %s: %v, output: %s", path, err, string(out))
+	}
+	// output format: "<project id> <flags> <path>"
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return 0, false, fmt.Errorf("unexpected output of lsattr on %s: %s", path, string(out))
+	}
+	if fields[0] != strconv.FormatUint(uint64(projectID), 10) {
+		klog.FromContext(ctx).V(2).Info("skip updating quota since project is not set on path", "projectID", projectID, "path", path, "currentProject", fields[0])
+		return 0, false, nil
+	}
+	return projectID, true, nil
+}
+
+func (q *projectQuota) setLimit(ctx context.Context, projectID uint32, sizeBytes int64) error {
+	// round up to KiB, 0 removes the limit
+	limit := fmt.Sprintf("%dk", (sizeBytes+1023)/1024)
+	klog.FromContext(ctx).V(2).Info("setting hard block limit", "limit", limit, "projectID", projectID)
+	if out, err := q.execCommand("xfs_quota", "-f", "-x", "-c", fmt.Sprintf("limit -p bhard=%s %d", limit, projectID), q.mountDir); err != nil {
+		return fmt.Errorf("failed to set hard block limit(%s) on project(%d): %v, output: %s", limit, projectID, err, string(out))
+	}
+	return nil
+}
+
+func (q *projectQuota) getProjectIDFile() string {
+	return filepath.Join(q.mountDir, projectIDFileName)
+}
+
+// getProjectName returns the name of volume project in project id file
+func (q *projectQuota) getProjectName(vol *nfsVolume) string {
+	return strings.Trim(filepath.Join(vol.baseDir, vol.subDir), "/")
+}
+
+// allocateProjectID returns the project id recorded for the volume, or allocates a new one starting from the id derived
+// from volume id, ids recorded for other volumes or defined in /etc/projid are skipped
+func (q *projectQuota) allocateProjectID(vol *nfsVolume) (uint32, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	name := q.getProjectName(vol)
+	projects, err := readProjectIDFile(q.getProjectIDFile())
+	if err != nil {
+		return 0, err
+	}
+	if id, ok := projects[name]; ok {
+		return id, nil
+	}
+	systemProjects, err := readProjectIDFile(systemProjectIDFile)
+	if err != nil {
+		return 0, err
+	}
+	used := map[uint32]bool{}
+	for _, m := range []map[string]uint32{projects, systemProjects} {
+		for _, id := range m {
+			used[id] = true
+		}
+	}
+	id := getProjectID(vol)
+	for used[id] {
+		// next non-zero id
+		id = id%(math.MaxUint32-1) + 1
+	}
+	f, err := os.OpenFile(q.getProjectIDFile(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s:%d\n", name, id); err != nil {
+		return 0, fmt.Errorf("failed to record project(%d) of %s: %v", id, name, err)
+	}
+	return id, nil
+}
+
+// lookupProjectID returns the project id recorded for the volume, id derived from volume id is returned for volumes
+// created before project ids are recorded
+func (q *projectQuota) lookupProjectID(vol *nfsVolume) (uint32, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	projects, err := readProjectIDFile(q.getProjectIDFile())
+	if err != nil {
+		return 0, err
+	}
+	if id, ok := projects[q.getProjectName(vol)]; ok {
+		return id, nil
+	}
+	return getProjectID(vol), nil
+}
+
+// releaseProjectID removes the project id of the volume from project id file
+func (q *projectQuota) releaseProjectID(vol *nfsVolume) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	path := q.getProjectIDFile()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var lines []string
+	prefix := q.getProjectName(vol) + ":"
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line != "" && !strings.HasPrefix(line, prefix) {
+			lines = append(lines, line)
+		}
+	}
+	f, err := os.CreateTemp(q.mountDir, projectIDFileName+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	content := strings.Join(lines, "\n")
+	if content != "" {
+		content += "\n"
+	}
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// readProjectIDFile reads "name:id" lines of project id file, returns name -> id, empty map is returned if the file
+// does not exist
+func readProjectIDFile(path string) (map[string]uint32, error) {
+	projects := map[string]uint32{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return projects, nil
+		}
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, ":")
+		if i < 0 {
+			continue
+		}
+		id, err := strconv.ParseUint(line[i+1:], 10, 32)
+		if err != nil {
+			klog.InfoS("skip invalid line in project id file", "line", line, "path", path)
+			continue
+		}
+		projects[line[:i]] = uint32(id)
+	}
+	return projects, nil
+}
+
+// getProjectID derives a non-zero project id from volume id, it's the first id tried when allocating project id
+func getProjectID(vol *nfsVolume) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(vol.id))
+	return h.Sum32()%(math.MaxUint32-1) + 1
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestSetQuota(t *testing.T) {
+	vol := &nfsVolume{
+		id:      "test-server#test-base-dir#volume-name##",
+		server:  "test-server",
+		baseDir: "test-base-dir",
+		subDir:  "volume-name",
+	}
+	projectID := getProjectID(vol)
+	mountDir := t.TempDir()
+	systemProjectIDFile = filepath.Join(mountDir, "projid")
+	defer func() { systemProjectIDFile = "/etc/projid" }()
+
+	cases := []struct {
+		desc             string
+		size             int64
+		failedCommand    string
+		expectedCommands []string
+		expectErr        bool
+	}{
+		{
+			desc: "set quota",
+			size: 1024*1024 + 1,
+			expectedCommands: []string{
+				fmt.Sprintf("xfs_quota -f -x -c project -s -p %s/test-base-dir/volume-name %d %s", mountDir, projectID, mountDir),
+				fmt.Sprintf("xfs_quota -f -x -c limit -p bhard=1025k %d %s", projectID, mountDir),
+			},
+		},
+		{
+			desc:          "failed to set project",
+			size:          1024,
+			failedCommand: "project",
+			expectedCommands: []string{
+				fmt.Sprintf("xfs_quota -f -x -c project -s -p %s/test-base-dir/volume-name %d %s", mountDir, projectID, mountDir),
+			},
+			expectErr: true,
+		},
+		{
+			desc:          "failed to set limit",
+			size:          1024,
+			failedCommand: "limit",
+			expectedCommands: []string{
+				fmt.Sprintf("xfs_quota -f -x -c project -s -p %s/test-base-dir/volume-name %d %s", mountDir, projectID, mountDir),
+				fmt.Sprintf("xfs_quota -f -x -c limit -p bhard=1k %d %s", projectID, mountDir),
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.desc, func(t *testing.T) {
+			var commands []string
+			q := newProjectQuota(mountDir)
+			q.execCommand = func(name string, args ...string) ([]byte, error) {
+				command := strings.Join(append([]string{name}, args...), " ")
+				commands = append(commands, command)
+				if test.failedCommand != "" && strings.Contains(command, test.failedCommand) {
+					return []byte("error"), fmt.Errorf("exit status 1")
+				}
+				return nil, nil
+			}
+
+			err := q.setQuota(context.TODO(), vol, test.size)
+			if (err != nil) != test.expectErr {
+				t.Errorf("unexpected error: %v, expected error: %v", err, test.expectErr)
+			}
+			assert.Equal(t, test.expectedCommands, commands)
+		})
+	}
+}
+
+func TestGetProjectID(t *testing.T) {
+	vol := &nfsVolume{id: "test-server#test-base-dir#volume-name##"}
+	otherVol := &nfsVolume{id: "test-server#test-base-dir#other-volume-name##"}
+
+	assert.NotZero(t, getProjectID(vol))
+	assert.Equal(t, getProjectID(vol), getProjectID(&nfsVolume{id: vol.id}))
+	assert.NotEqual(t, getProjectID(vol), getProjectID(otherVol))
+}
+
+func TestResizeQuota(t *testing.T) {
+	mountDir := t.TempDir()
+	vol := &nfsVolume{
+		id:      "test-server#test-base-dir#volume-name##",
+		server:  "test-server",
+		baseDir: "test-base-dir",
+		subDir:  "volume-name",
+	}
+	if err := os.MkdirAll(filepath.Join(mountDir, vol.baseDir, vol.subDir), 0777); err != nil {
+		t.Fatal(err)
+	}
+	projectID := getProjectID(vol)
+
+	cases := []struct {
+		desc            string
+		vol             *nfsVolume
+		lsattrOutput    string
+		expectedResized bool
+		expectedLimit   string
+		expectErr       bool
+	}{
+		{
+			desc:            "resize quota",
+			vol:             vol,
+			lsattrOutput:    fmt.Sprintf("%d --------------e------P-- %s", projectID, filepath.Join(mountDir, vol.baseDir, vol.subDir)),
+			expectedResized: true,
+			expectedLimit:   fmt.Sprintf("limit -p bhard=2k %d", projectID),
+		},
+		{
+			desc:         "project quota not set",
+			vol:          vol,
+			lsattrOutput: fmt.Sprintf("0 --------------e------- %s", filepath.Join(mountDir, vol.baseDir, vol.subDir)),
+		},
+		{
+			desc: "subdirectory does not exist",
+			vol:  &nfsVolume{id: "test-server#test-base-dir#nonexisting##", baseDir: "test-base-dir", subDir: "nonexisting"},
+		},
+		{
+			desc:      "unexpected lsattr output",
+			vol:       vol,
+			expectErr: true,
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.desc, func(t *testing.T) {
+			var limit string
+			q := newProjectQuota(mountDir)
+			q.execCommand = func(name string, args ...string) ([]byte, error) {
+				if name == "lsattr" {
+					return []byte(test.lsattrOutput), nil
+				}
+				limit = args[len(args)-2]
+				return nil, nil
+			}
+
+			resized, err := q.resizeQuota(context.TODO(), test.vol, 2048)
+			if (err != nil) != test.expectErr {
+				t.Errorf("unexpected error: %v, expected error: %v", err, test.expectErr)
+			}
+			assert.Equal(t, test.expectedResized, resized)
+			assert.Equal(t, test.expectedLimit, limit)
+		})
+	}
+}
+
+func TestAllocateProjectID(t *testing.T) {
+	mountDir := t.TempDir()
+	systemProjectIDFile = filepath.Join(mountDir, "projid")
+	defer func() { systemProjectIDFile = "/etc/projid" }()
+	vol := &nfsVolume{id: "test-server#test-base-dir#volume-name##", baseDir: "test-base-dir", subDir: "volume-name"}
+	otherVol := &nfsVolume{id: "test-server#test-base-dir#other-volume-name##", baseDir: "test-base-dir", subDir: "other-volume-name"}
+	// id derived from volume id is defined by administrator
+	if err := os.WriteFile(systemProjectIDFile, []byte(fmt.Sprintf("# projects\nbackup:%d\n", getProjectID(vol))), 0644); err != nil {
+		t.Fatal(err)
+	}
+	q := newProjectQuota(mountDir)
+
+	id, err := q.allocateProjectID(vol)
+	assert.NoError(t, err)
+	assert.Equal(t, getProjectID(vol)%(math.MaxUint32-1)+1, id)
+	again, err := q.allocateProjectID(vol)
+	assert.NoError(t, err)
+	assert.Equal(t, id, again)
+	lookup, err := q.lookupProjectID(vol)
+	assert.NoError(t, err)
+	assert.Equal(t, id, lookup)
+
+	otherID, err := q.allocateProjectID(otherVol)
+	assert.NoError(t, err)
+	assert.NotEqual(t, id, otherID)
+
+	assert.NoError(t, q.releaseProjectID(vol))
+	projects, err := readProjectIDFile(filepath.Join(mountDir, projectIDFileName))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]uint32{"test-base-dir/other-volume-name": otherID}, projects)
+	// volume created before project ids are recorded
+	lookup, err = q.lookupProjectID(vol)
+	assert.NoError(t, err)
+	assert.Equal(t, getProjectID(vol), lookup)
+}
+
+func TestClearQuota(t *testing.T) {
+	mountDir := t.TempDir()
+	vol := &nfsVolume{id: "test-server#test-base-dir#volume-name##", baseDir: "test-base-dir", subDir: "volume-name"}
+	path := filepath.Join(mountDir, vol.baseDir, vol.subDir)
+	if err := os.MkdirAll(path, 0777); err != nil {
+		t.Fatal(err)
+	}
+	var commands []string
+	q := newProjectQuota(mountDir)
+	q.execCommand = func(name string, args ...string) ([]byte, error) {
+		if name == "lsattr" {
+			return []byte(fmt.Sprintf("%d --------------e------P-- %s", getProjectID(vol), path)), nil
+		}
+		commands = append(commands, args[len(args)-2])
+		return nil, nil
+	}
+
+	cleared, err := q.clearQuota(context.TODO(), vol)
+	assert.NoError(t, err)
+	assert.True(t, cleared)
+	assert.Equal(t, []string{fmt.Sprintf("limit -p bhard=0k %d", getProjectID(vol))}, commands)
+}
@@ -23,6 +23,7 @@ import (
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"k8s.io/klog/v2"
 )
@@ -68,27 +69,45 @@ func (s *nonBlockingGRPCServer) ForceStop() {
 	s.server.Stop()
 }
 
+// stopGRPCServer stops s gracefully to finish in-flight operations, s is stopped forcefully after timeout
+func stopGRPCServer(ctx context.Context, s NonBlockingGRPCServer, timeout time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		klog.FromContext(ctx).Info("in-flight operations are not finished in timeout, stopping grpc server forcefully", "timeout", timeout)
+		s.ForceStop()
+	}
+}
+
 func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer, testMode bool) {
 
 	proto, addr, err := ParseEndpoint(endpoint)
 	if err != nil {
-		klog.Fatal(err.Error())
+		klog.ErrorS(err, "failed to parse endpoint", "endpoint", endpoint)
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
 
 	if proto == "unix" {
 		addr = "/" + addr
 		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
-			klog.Fatalf("Failed to remove %s, error: %s", addr, err.Error())
+			klog.ErrorS(err, "Failed to remove unix socket", "address", addr)
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 		}
 	}
 
 	listener, err := net.Listen(proto, addr)
 	if err != nil {
-		klog.Fatalf("Failed to listen: %v", err)
+		klog.ErrorS(err, "Failed to listen")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
 
 	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logGRPC),
+		grpc.ChainUnaryInterceptor(logGRPC, metricsGRPC, recoverGRPC),
 	}
 	server := grpc.NewServer(opts...)
 	s.server = server
@@ -98,6 +117,9 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 	}
 	if cs != nil {
 		csi.RegisterControllerServer(server, cs)
+		if gcs, ok := cs.(csi.GroupControllerServer); ok {
+			csi.RegisterGroupControllerServer(server, gcs)
+		}
 	}
 	if ns != nil {
 		csi.RegisterNodeServer(server, ns)
@@ -114,10 +136,11 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 		}()
 	}
 
-	klog.Infof("Listening for connections on address: %#v", listener.Addr())
+	klog.InfoS("Listening for connections", "address", listener.Addr())
 
 	err = server.Serve(listener)
 	if err != nil {
-		klog.Fatalf("Failed to serve grpc server: %v", err)
+		klog.ErrorS(err, "Failed to serve grpc server")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
 }
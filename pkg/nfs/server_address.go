@@ -0,0 +1,137 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ServerAddressPolicyPinned resolves hostname of nfs server on each mount and mounts the address with addr option
+	ServerAddressPolicyPinned = "pinned"
+	// ServerAddressPolicyStrict is ServerAddressPolicyPinned, and the mount fails if none of the addresses
+	// of nfs server is the address of existing mounts of the server on the node
+	ServerAddressPolicyStrict = "strict"
+)
+
+var errServerAddressMismatch = errors.New("addresses of nfs server do not match existing mounts")
+
+// lookupServerAddresses resolves hostname of nfs server, could be replaced in unit tests
+var lookupServerAddresses = func(ctx context.Context, host string) ([]string, error) {
+	return net.DefaultResolver.LookupHost(ctx, host)
+}
+
+func validateServerAddressPolicy(policy string) error {
+	switch policy {
+	case "", ServerAddressPolicyPinned, ServerAddressPolicyStrict:
+		return nil
+	default:
+		return fmt.Errorf("invalid serverAddressPolicy %s, supported values are %s, %s", policy, ServerAddressPolicyPinned, ServerAddressPolicyStrict)
+	}
+}
+
+// isServerAddress returns true if server is an IP address, IPv6 address could be in brackets
+func isServerAddress(server string) bool {
+	return net.ParseIP(strings.Trim(server, "[]")) != nil
+}
+
+// getMountOptionValue returns value of the last option of key in comma separated mount options
+func getMountOptionValue(mountOptions []string, key string) string {
+	var value string
+	for _, option := range splitMountOptions(mountOptions) {
+		if k, v, found := strings.Cut(option, "="); found && strings.EqualFold(strings.TrimSpace(k), key) {
+			value = strings.TrimSpace(v)
+		}
+	}
+	return value
+}
+
+// resolveServerAddress resolves hostname of nfs server according to policy and returns the server and mount options to mount,
+// the address is pinned in the mount source and addr option so that mount.nfs does not use the address cached on the node.
+// server and mountOptions are returned as is if policy is empty, server is an address or addr is set in mount options.
+func (ns *NodeServer) resolveServerAddress(ctx context.Context, server string, mountOptions []string, policy string) (string, []string, error) {
+	if policy == "" || isServerAddress(server) || getMountOptionValue(mountOptions, "addr") != "" {
+		return server, mountOptions, nil
+	}
+	logger := klog.FromContext(ctx)
+	addresses, err := lookupServerAddresses(ctx, server)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to resolve nfs server %s: %w", server, err)
+	}
+	if len(addresses) == 0 {
+		return "", nil, fmt.Errorf("no address of nfs server %s", server)
+	}
+	sort.Strings(addresses)
+
+	// address of existing mounts is preferred, so that they share the nfs client if there are multiple records
+	address := addresses[0]
+	existing := ns.getServerMountAddresses(ctx, server)
+	if existing.Len() > 0 {
+		found := false
+		for _, a := range addresses {
+			if existing.Has(a) {
+				address, found = a, true
+				break
+			}
+		}
+		if !found {
+			if policy == ServerAddressPolicyStrict {
+				return "", nil, fmt.Errorf("%w: server %s resolves to %v, existing mounts use %v", errServerAddressMismatch, server, addresses, existing.List())
+			}
+			logger.Info("address of nfs server differs from existing mounts", "server", server, "address", address, "existingAddresses", existing.List())
+		}
+	}
+	if previous, loaded := ns.serverAddresses.Swap(server, address); loaded && previous.(string) != address {
+		logger.Info("address of nfs server changed", "server", server, "previousAddress", previous, "address", address, "resolvedAddresses", addresses)
+	} else {
+		logger.V(2).Info("resolved nfs server", "server", server, "address", address, "resolvedAddresses", addresses)
+	}
+
+	pinned := address
+	if strings.Contains(address, ":") {
+		pinned = "[" + address + "]"
+	}
+	return pinned, append(append([]string{}, mountOptions...), "addr="+address), nil
+}
+
+// getServerMountAddresses returns addresses in mount table of nfs mounts of server published by the driver
+func (ns *NodeServer) getServerMountAddresses(ctx context.Context, server string) sets.String { //nolint:staticcheck
+	tracked := ns.mountTracker.list()
+	mountPoints, err := ns.mounter.List()
+	if err != nil {
+		klog.FromContext(ctx).Info("failed to list mounts", "err", err)
+		return nil
+	}
+	addresses := sets.NewString() //nolint:staticcheck
+	for _, mp := range mountPoints {
+		if m, ok := tracked[mp.Path]; !ok || m.server != server {
+			continue
+		}
+		if address := getMountOptionValue(mp.Opts, "addr"); address != "" {
+			addresses.Insert(address)
+		}
+	}
+	return addresses
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+	mount "k8s.io/mount-utils"
+)
+
+func TestResolveServerAddress(t *testing.T) {
+	records := map[string][]string{
+		"filer":      {"10.0.0.2", "10.0.0.1"},
+		"filer-v6":   {"fd00::1"},
+		"mounted":    {"10.0.1.2", "10.0.1.1"},
+		"failedover": {"10.0.2.2"},
+	}
+	origLookup := lookupServerAddresses
+	defer func() { lookupServerAddresses = origLookup }()
+	lookupServerAddresses = func(_ context.Context, host string) ([]string, error) {
+		if addresses, ok := records[host]; ok {
+			return append([]string{}, addresses...), nil
+		}
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+
+	ns := NewNodeServer(NewEmptyDriver(""), mount.NewFakeMounter([]mount.MountPoint{
+		{Device: "10.0.1.2:/share", Path: "/mounted", Type: "nfs4", Opts: []string{"rw", "addr=10.0.1.2"}},
+		{Device: "failedover:/share", Path: "/failedover", Type: "nfs4", Opts: []string{"rw", "addr=10.0.2.1"}},
+	}))
+	ns.mountTracker.add("/mounted", publishedMount{server: "mounted", source: "10.0.1.2:/share"})
+	ns.mountTracker.add("/failedover", publishedMount{server: "failedover", source: "failedover:/share"})
+
+	tests := []struct {
+		desc            string
+		server          string
+		mountOptions    []string
+		policy          string
+		expectedServer  string
+		expectedOptions []string
+		expectedErr     error
+	}{
+		{
+			desc:            "no policy",
+			server:          "filer",
+			mountOptions:    []string{"nfsvers=4.1"},
+			expectedServer:  "filer",
+			expectedOptions: []string{"nfsvers=4.1"},
+		},
+		{
+			desc:            "server is an address",
+			server:          "[fd00::2]",
+			policy:          ServerAddressPolicyPinned,
+			expectedServer:  "[fd00::2]",
+			expectedOptions: nil,
+		},
+		{
+			desc:            "addr in mount options",
+			server:          "filer",
+			mountOptions:    []string{"addr=10.0.0.3"},
+			policy:          ServerAddressPolicyStrict,
+			expectedServer:  "filer",
+			expectedOptions: []string{"addr=10.0.0.3"},
+		},
+		{
+			desc:            "pinned",
+			server:          "filer",
+			mountOptions:    []string{"nfsvers=4.1"},
+			policy:          ServerAddressPolicyPinned,
+			expectedServer:  "10.0.0.1",
+			expectedOptions: []string{"nfsvers=4.1", "addr=10.0.0.1"},
+		},
+		{
+			desc:            "pinned ipv6",
+			server:          "filer-v6",
+			policy:          ServerAddressPolicyPinned,
+			expectedServer:  "[fd00::1]",
+			expectedOptions: []string{"addr=fd00::1"},
+		},
+		{
+			desc:            "address of existing mount is preferred",
+			server:          "mounted",
+			policy:          ServerAddressPolicyStrict,
+			expectedServer:  "10.0.1.2",
+			expectedOptions: []string{"addr=10.0.1.2"},
+		},
+		{
+			desc:            "pinned after failover",
+			server:          "failedover",
+			policy:          ServerAddressPolicyPinned,
+			expectedServer:  "10.0.2.2",
+			expectedOptions: []string{"addr=10.0.2.2"},
+		},
+		{
+			desc:        "strict after failover",
+			server:      "failedover",
+			policy:      ServerAddressPolicyStrict,
+			expectedErr: errServerAddressMismatch,
+		},
+		{
+			desc:        "unknown host",
+			server:      "unknown",
+			policy:      ServerAddressPolicyPinned,
+			expectedErr: errors.New("failed to resolve nfs server unknown: no such host unknown"),
+		},
+	}
+	for _, test := range tests {
+		server, mountOptions, err := ns.resolveServerAddress(context.Background(), test.server, test.mountOptions, test.policy)
+		if test.expectedErr != nil {
+			if err == nil || (!errors.Is(err, test.expectedErr) && err.Error() != test.expectedErr.Error()) {
+				t.Errorf("test[%s]: unexpected error %v, expected %v", test.desc, err, test.expectedErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test[%s]: unexpected error %v", test.desc, err)
+		}
+		if server != test.expectedServer || !reflect.DeepEqual(mountOptions, test.expectedOptions) {
+			t.Errorf("test[%s]: resolved %s %v, expected %s %v", test.desc, server, mountOptions, test.expectedServer, test.expectedOptions)
+		}
+	}
+
+	// the address changed since the last publish is recorded
+	records["filer"] = []string{"10.0.0.3"}
+	if server, _, _ := ns.resolveServerAddress(context.Background(), "filer", nil, ServerAddressPolicyPinned); server != "10.0.0.3" {
+		t.Errorf("unexpected server %s after address changed", server)
+	}
+	if address, _ := ns.serverAddresses.Load("filer"); address != "10.0.0.3" {
+		t.Errorf("unexpected recorded address %v", address)
+	}
+}
+
+func TestValidateServerAddressPolicy(t *testing.T) {
+	for _, policy := range []string{"", ServerAddressPolicyPinned, ServerAddressPolicyStrict} {
+		if err := validateServerAddressPolicy(policy); err != nil {
+			t.Errorf("unexpected error %v for policy %q", err, policy)
+		}
+	}
+	if err := validateServerAddressPolicy("dns"); err == nil {
+		t.Errorf("expected error for invalid policy")
+	}
+}
@@ -0,0 +1,103 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+	"golang.org/x/time/rate"
+	mount "k8s.io/mount-utils"
+)
+
+// max bytes of a single copy_file_range call
+const maxCopyFileRangeSize = 1 << 30
+
+// copyFileRange copies length bytes at srcOffset of src to the current offset of dst by copy_file_range,
+// nfs client sends COPY to server on NFSv4.2 mounts so data is not transferred through the client.
+// Copy is throttled by limiter if it's not nil, errServerSideCopyNotSupported is returned if nothing is copied
+// and the file system does not support it.
+func copyFileRange(ctx context.Context, dst, src *os.File, srcOffset, length int64, limiter *rate.Limiter) (int64, error) {
+	var copied int64
+	for copied < length {
+		size := int(length - copied)
+		if size > maxCopyFileRangeSize {
+			size = maxCopyFileRangeSize
+		}
+		if limiter != nil {
+			if size > limiter.Burst() {
+				size = limiter.Burst()
+			}
+			if err := limiter.WaitN(ctx, size); err != nil {
+				return copied, err
+			}
+		}
+		off := srcOffset + copied
+		n, err := unix.CopyFileRange(int(src.Fd()), &off, int(dst.Fd()), nil, size, 0)
+		if err != nil {
+			if copied == 0 && (errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EXDEV) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EINVAL)) {
+				return 0, errServerSideCopyNotSupported
+			}
+			return copied, &os.SyscallError{Syscall: "copy_file_range", Err: err}
+		}
+		if n == 0 {
+			// src is truncated during copy
+			break
+		}
+		copied += int64(n)
+	}
+	return copied, nil
+}
+
+// supportsServerSideCopy returns true if path is on a NFSv4.2(or later) mount
+func supportsServerSideCopy(path string) bool {
+	mis, err := mount.ParseMountInfo("/proc/self/mountinfo")
+	if err != nil {
+		return false
+	}
+	path = filepath.Clean(path)
+	for _, mi := range mis {
+		if mi.MountPoint != path || !strings.HasPrefix(mi.FsType, "nfs") {
+			continue
+		}
+		for _, opt := range mi.SuperOptions {
+			if v, ok := strings.CutPrefix(opt, "vers="); ok {
+				return isServerSideCopyVersion(v)
+			}
+		}
+	}
+	return false
+}
+
+// isServerSideCopyVersion returns true if COPY operation is in nfs version, it's added in NFSv4.2
+func isServerSideCopyVersion(version string) bool {
+	major, minor, _ := strings.Cut(version, ".")
+	majorVersion, err := strconv.Atoi(major)
+	if err != nil {
+		return false
+	}
+	minorVersion, _ := strconv.Atoi(minor)
+	return majorVersion > 4 || (majorVersion == 4 && minorVersion >= 2)
+}
@@ -0,0 +1,44 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import "testing"
+
+func TestIsServerSideCopyVersion(t *testing.T) {
+	tests := map[string]bool{
+		"3":   false,
+		"4":   false,
+		"4.1": false,
+		"4.2": true,
+		"5":   true,
+		"":    false,
+	}
+	for version, expected := range tests {
+		if result := isServerSideCopyVersion(version); result != expected {
+			t.Errorf("unexpected result %v of %s, expected %v", result, version, expected)
+		}
+	}
+}
+
+func TestSupportsServerSideCopy(t *testing.T) {
+	if supportsServerSideCopy(t.TempDir()) {
+		t.Errorf("temp directory is not on nfs mount")
+	}
+}
@@ -0,0 +1,37 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"os"
+
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+)
+
+// copyFileRange is only supported on Linux
+func copyFileRange(_ context.Context, _, _ *os.File, _, _ int64, _ *rate.Limiter) (int64, error) {
+	return 0, errServerSideCopyNotSupported
+}
+
+// supportsServerSideCopy is only supported on Linux
+func supportsServerSideCopy(_ string) bool {
+	return false
+}
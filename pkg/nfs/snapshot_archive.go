@@ -0,0 +1,369 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+	"k8s.io/klog/v2"
+)
+
+const (
+	snapshotCompressionNone = "none"
+	snapshotCompressionGzip = "gzip"
+	snapshotCompressionZstd = "zstd"
+	// archives of snapshots created before snapshotCompression parameter are gzip compressed
+	defaultSnapshotCompression = snapshotCompressionGzip
+	// source volume id of snapshot archive is written next to the archive
+	snapshotSourceVolumeIDExt = ".source"
+)
+
+var supportedSnapshotCompressions = []string{snapshotCompressionGzip, snapshotCompressionZstd, snapshotCompressionNone}
+
+func validateSnapshotCompression(compression string) error {
+	for _, v := range supportedSnapshotCompressions {
+		if compression == v {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid value %s for snapshotCompression, supported values are %v", compression, supportedSnapshotCompressions)
+}
+
+// getSnapshotArchiveExtension returns file extension of snapshot archive with compression
+func getSnapshotArchiveExtension(compression string) string {
+	switch compression {
+	case snapshotCompressionNone:
+		return ".tar"
+	case snapshotCompressionZstd:
+		return ".tar.zst"
+	default:
+		return ".tar.gz"
+	}
+}
+
+// getTarCompressionArgs returns tar arguments of compression
+func getTarCompressionArgs(compression string) []string {
+	switch compression {
+	case snapshotCompressionNone:
+		return nil
+	case snapshotCompressionZstd:
+		return []string{"--zstd"}
+	default:
+		return []string{"-z"}
+	}
+}
+
+// findSnapshotArchive searches archive of the snapshot in dir with all supported compressions,
+// compression of the snapshot is set if archive is found, otherwise error satisfying os.IsNotExist is returned
+func findSnapshotArchive(dir string, snap *nfsSnapshot) (os.FileInfo, error) {
+	for _, compression := range supportedSnapshotCompressions {
+		archive := *snap
+		archive.compression = compression
+		fi, err := os.Stat(filepath.Join(dir, archive.archiveName()))
+		if err == nil {
+			snap.compression = compression
+			return fi, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, &os.PathError{Op: "stat", Path: filepath.Join(dir, snap.src+".tar*"), Err: os.ErrNotExist}
+}
+
+// sourceVolumeIDName is the file next to the archive where its source volume id is recorded,
+// so the snapshot is listed with its source volume when ListSnapshots is called without source volume id
+func (snap nfsSnapshot) sourceVolumeIDName() string {
+	return snap.src + snapshotSourceVolumeIDExt
+}
+
+func writeSnapshotSourceVolumeID(dir string, snap *nfsSnapshot, volumeID string) error {
+	return os.WriteFile(filepath.Join(dir, snap.sourceVolumeIDName()), []byte(volumeID), 0644)
+}
+
+func readSnapshotSourceVolumeID(dir string, snap *nfsSnapshot) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, snap.sourceVolumeIDName()))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// getSnapshotArchiveSource returns source name and compression of snapshot archive file name, ok is false if name is not
+// an archive name
+func getSnapshotArchiveSource(name string) (string, string, bool) {
+	for _, compression := range supportedSnapshotCompressions {
+		if src := strings.TrimSuffix(name, getSnapshotArchiveExtension(compression)); src != name && src != "" {
+			return src, compression, true
+		}
+	}
+	return "", "", false
+}
+
+// isSnapshotArchiveOf returns true if name is an archive of the snapshot in any supported compression
+func isSnapshotArchiveOf(name string, snap *nfsSnapshot) bool {
+	ext := strings.TrimPrefix(name, snap.src)
+	if ext == name {
+		return false
+	}
+	for _, compression := range supportedSnapshotCompressions {
+		if ext == getSnapshotArchiveExtension(compression) {
+			return true
+		}
+	}
+	return false
+}
+
+// createSnapshotArchive archives srcPath to archivePath, the archive is written to the nfs share directly by tar.
+// Files are not listed in output since the output of large volumes is kept in memory.
+func createSnapshotArchive(srcPath, archivePath, compression string) error {
+	args := append([]string{"-C", srcPath, "-cf", archivePath}, getTarCompressionArgs(compression)...)
+	if out, err := exec.Command("tar", append(args, ".")...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %v", err, string(out))
+	}
+	return nil
+}
+
+// extractSnapshotArchive extracts archivePath to dstPath, the archive is read from the nfs share by the driver and
+// piped to tar, so reading the archive is throttled by limiter
+func extractSnapshotArchive(ctx context.Context, archivePath, dstPath, compression string, limiter *rate.Limiter) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	args := append([]string{"-xf", "-"}, getTarCompressionArgs(compression)...)
+	cmd := exec.Command("tar", append(args, "-C", dstPath)...)
+	cmd.Stdin = newRateLimitedReader(ctx, f, limiter)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %v", err, string(out))
+	}
+	return nil
+}
+
+// offsetReader tracks the offset of the archive read by tar reader, so data of files in uncompressed archive
+// could be copied by copy_file_range. It implements io.Seeker so tar reader skips data by seeking.
+type offsetReader struct {
+	f      *os.File
+	offset int64
+}
+
+func (r *offsetReader) Read(p []byte) (int, error) {
+	n, err := r.f.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *offsetReader) Seek(offset int64, whence int) (int64, error) {
+	n, err := r.f.Seek(offset, whence)
+	if err == nil {
+		r.offset = n
+	}
+	return n, err
+}
+
+// extractSnapshotArchiveOnServer extracts uncompressed archivePath to dstPath, data of regular files is copied
+// from the archive by copy_file_range, so it's copied on nfs server if archive and dstPath are in the same NFSv4.2 export,
+// data of files is throttled by limiter
+func extractSnapshotArchiveOnServer(ctx context.Context, archivePath, dstPath string, limiter *rate.Limiter) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := &offsetReader{f: f}
+	tr := tar.NewReader(r)
+	var dirs []*tar.Header
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive %s: %v", archivePath, err)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		target, err := getArchiveEntryPath(dstPath, hdr.Name)
+		if err != nil {
+			return err
+		}
+		// symlinks extracted before are never followed, so entries could not be written out of dstPath through them
+		if err := checkArchiveEntryParent(dstPath, target); err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := removeSymlink(target); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(target, 0777); err != nil {
+				return err
+			}
+			dirs = append(dirs, hdr)
+		case tar.TypeReg, tar.TypeRegA:
+			if err := removeSymlink(target); err != nil {
+				return err
+			}
+			if err := extractArchiveFile(ctx, r, tr, hdr, target, limiter); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+			if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+				klog.FromContext(ctx).Info("failed to preserve ownership", "path", target, "err", err)
+			}
+		case tar.TypeLink:
+			linkTarget, err := getArchiveEntryPath(dstPath, hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := checkArchiveEntryParent(dstPath, linkTarget); err != nil {
+				return err
+			}
+			if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Link(linkTarget, target); err != nil {
+				return err
+			}
+		default:
+			klog.FromContext(ctx).Info("skip extracting archive entry since file type is not supported", "name", hdr.Name, "type", hdr.Typeflag)
+		}
+	}
+	// directory attributes are applied after all files are extracted since extracting files changes directory modification time
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target, _ := getArchiveEntryPath(dstPath, dirs[i].Name)
+		// directory could be replaced by a symlink of a later entry
+		if fi, err := os.Lstat(target); err != nil || !fi.IsDir() {
+			continue
+		}
+		if err := checkArchiveEntryParent(dstPath, target); err != nil {
+			return err
+		}
+		if err := applyArchiveAttributes(ctx, target, dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkArchiveEntryParent checks the parent directory of target resolves in dstPath, the deepest existing ancestor is
+// resolved since the parent may not be extracted yet, missing ancestors are created as directories by MkdirAll
+func checkArchiveEntryParent(dstPath, target string) error {
+	// root entry of the archive is dstPath itself
+	if filepath.Clean(target) == filepath.Clean(dstPath) {
+		return nil
+	}
+	realDstPath, err := filepath.EvalSymlinks(dstPath)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(target)
+	for {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	// dangling symlink could not be resolved, it's rejected
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve parent of archive entry %s: %v", target, err)
+	}
+	rel, err := filepath.Rel(realDstPath, realDir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("archive entry %s is out of %s through symlink %s", target, dstPath, dir)
+	}
+	return nil
+}
+
+// removeSymlink removes path if it's a symlink, so it's not followed when path is created as file or directory
+func removeSymlink(path string) error {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return os.Remove(path)
+	}
+	return nil
+}
+
+// getArchiveEntryPath returns path of the archive entry under dstPath, entries out of dstPath are rejected
+func getArchiveEntryPath(dstPath, name string) (string, error) {
+	target := filepath.Join(dstPath, name)
+	rel, err := filepath.Rel(dstPath, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("archive entry %s is out of %s", name, dstPath)
+	}
+	return target, nil
+}
+
+func extractArchiveFile(ctx context.Context, r *offsetReader, tr *tar.Reader, hdr *tar.Header, target string, limiter *rate.Limiter) error {
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+	if err != nil {
+		return err
+	}
+	// data of sparse file is not contiguous in archive
+	_, sparse := hdr.PAXRecords["GNU.sparse.map"]
+	if hdr.Typeflag != tar.TypeGNUSparse && !sparse {
+		_, err = copyFileRange(ctx, out, r.f, r.offset, hdr.Size, limiter)
+	} else {
+		err = errServerSideCopyNotSupported
+	}
+	if errors.Is(err, errServerSideCopyNotSupported) {
+		klog.FromContext(ctx).V(4).Info("server-side copy is not supported, copying through the controller", "name", hdr.Name)
+		_, err = io.Copy(out, newRateLimitedReader(ctx, tr, limiter))
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to extract %s: %v", hdr.Name, err)
+	}
+	return applyArchiveAttributes(ctx, target, hdr)
+}
+
+// applyArchiveAttributes applies mode, ownership and modification time of the archive entry on path
+func applyArchiveAttributes(ctx context.Context, path string, hdr *tar.Header) error {
+	// ownership could not be preserved on nfs share with root squash, it's not fatal
+	if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+		klog.FromContext(ctx).Info("failed to preserve ownership", "path", path, "err", err)
+	}
+	if err := os.Chmod(path, hdr.FileInfo().Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+}
@@ -0,0 +1,277 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestValidateSnapshotCompression(t *testing.T) {
+	for _, compression := range []string{"none", "gzip", "zstd"} {
+		if err := validateSnapshotCompression(compression); err != nil {
+			t.Errorf("unexpected error %v of %s", err, compression)
+		}
+	}
+	for _, compression := range []string{"", "bzip2", "GZIP"} {
+		if err := validateSnapshotCompression(compression); err == nil {
+			t.Errorf("expected error of %s", compression)
+		}
+	}
+}
+
+func TestFindSnapshotArchive(t *testing.T) {
+	dir := t.TempDir()
+	snap := &nfsSnapshot{uuid: "snapshot-name", src: "src-pv-name"}
+	if _, err := findSnapshotArchive(dir, snap); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "src-pv-name.tar.zst"), []byte("archive"), 0644); err != nil {
+		t.Fatalf("failed to write archive: %v", err)
+	}
+	fi, err := findSnapshotArchive(dir, snap)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if fi.Name() != "src-pv-name.tar.zst" || snap.compression != snapshotCompressionZstd || snap.archiveName() != "src-pv-name.tar.zst" {
+		t.Errorf("unexpected archive %s with compression %s", fi.Name(), snap.compression)
+	}
+}
+
+func TestIsSnapshotArchiveOf(t *testing.T) {
+	snap := &nfsSnapshot{src: "src-pv-name"}
+	tests := map[string]bool{
+		"src-pv-name.tar":     true,
+		"src-pv-name.tar.gz":  true,
+		"src-pv-name.tar.zst": true,
+		"src-pv-name.zip":     false,
+		"other-pv.tar.gz":     false,
+	}
+	for name, expected := range tests {
+		if result := isSnapshotArchiveOf(name, snap); result != expected {
+			t.Errorf("unexpected result %v of %s, expected %v", result, name, expected)
+		}
+	}
+}
+
+func TestSnapshotArchive(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	compressions := []string{snapshotCompressionNone, snapshotCompressionGzip}
+	if _, err := exec.LookPath("zstd"); err == nil {
+		compressions = append(compressions, snapshotCompressionZstd)
+	}
+	for _, compression := range compressions {
+		srcPath, snapPath, dstPath := t.TempDir(), t.TempDir(), t.TempDir()
+		if err := os.WriteFile(filepath.Join(srcPath, "test.txt"), []byte("test file"), 0644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+		archivePath := filepath.Join(snapPath, "src-pv-name"+getSnapshotArchiveExtension(compression))
+		if err := createSnapshotArchive(srcPath, archivePath, compression); err != nil {
+			t.Fatalf("failed to create archive with compression %s: %v", compression, err)
+		}
+		if err := extractSnapshotArchive(context.TODO(), archivePath, dstPath, compression, nil); err != nil {
+			t.Fatalf("failed to extract archive with compression %s: %v", compression, err)
+		}
+		data, err := os.ReadFile(filepath.Join(dstPath, "test.txt"))
+		if err != nil || string(data) != "test file" {
+			t.Errorf("unexpected file content %q with compression %s, error: %v", string(data), compression, err)
+		}
+	}
+}
+
+func TestExtractSnapshotArchiveThrottled(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	srcPath, snapPath, dstPath := t.TempDir(), t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcPath, "test.txt"), bytes.Repeat([]byte("a"), 8192), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	archivePath := filepath.Join(snapPath, "src-pv-name.tar")
+	if err := createSnapshotArchive(srcPath, archivePath, snapshotCompressionNone); err != nil {
+		t.Fatalf("failed to create archive: %v", err)
+	}
+	// archive of more than 10Ki takes at least 200ms to be read in 40Ki per second after burst
+	start := time.Now()
+	if err := extractSnapshotArchive(context.TODO(), archivePath, dstPath, snapshotCompressionNone, rate.NewLimiter(rate.Limit(40*1024), 1024)); err != nil {
+		t.Fatalf("failed to extract archive: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("extraction is not throttled, it takes %v", elapsed)
+	}
+	if data, err := os.ReadFile(filepath.Join(dstPath, "test.txt")); err != nil || len(data) != 8192 {
+		t.Errorf("unexpected file of %d bytes, error: %v", len(data), err)
+	}
+}
+
+func TestExtractSnapshotArchiveOnServer(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	srcPath, snapPath, dstPath := t.TempDir(), t.TempDir(), t.TempDir()
+	if err := os.MkdirAll(filepath.Join(srcPath, "dir"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"test.txt": "test file", "dir/nested.txt": "nested file", "empty": ""} {
+		if err := os.WriteFile(filepath.Join(srcPath, name), []byte(content), 0640); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+	if err := os.Symlink("dir/nested.txt", filepath.Join(srcPath, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(srcPath, "test.txt"), filepath.Join(srcPath, "hardlink")); err != nil {
+		t.Fatal(err)
+	}
+	archivePath := filepath.Join(snapPath, "src-pv-name.tar")
+	if err := createSnapshotArchive(srcPath, archivePath, snapshotCompressionNone); err != nil {
+		t.Fatalf("failed to create archive: %v", err)
+	}
+	// extract twice since it's retried if CreateVolume fails
+	for i := 0; i < 2; i++ {
+		if err := extractSnapshotArchiveOnServer(context.TODO(), archivePath, dstPath, nil); err != nil {
+			t.Fatalf("failed to extract archive: %v", err)
+		}
+	}
+	for name, expected := range map[string]string{"test.txt": "test file", "dir/nested.txt": "nested file", "empty": "", "link": "nested file", "hardlink": "test file"} {
+		data, err := os.ReadFile(filepath.Join(dstPath, name))
+		if err != nil || string(data) != expected {
+			t.Errorf("unexpected content %q of %s, error: %v", string(data), name, err)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(dstPath, "dir")); err != nil || fi.Mode().Perm() != 0750 {
+		t.Errorf("unexpected directory %v, error: %v", fi, err)
+	}
+}
+
+func TestGetArchiveEntryPath(t *testing.T) {
+	if _, err := getArchiveEntryPath("/dst", "./dir/file"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"../file", "dir/../../file"} {
+		if _, err := getArchiveEntryPath("/dst", name); err == nil {
+			t.Errorf("expected error of %s", name)
+		}
+	}
+}
+
+func TestExtractSnapshotArchiveOnServerSymlinkEscape(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip test on Windows")
+	}
+	writeArchive := func(t *testing.T, path string, entries []*tar.Header) {
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		tw := tar.NewWriter(f)
+		for _, hdr := range entries {
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				if _, err := tw.Write(make([]byte, hdr.Size)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		desc      string
+		entries   func(outside string) []*tar.Header
+		expectErr bool
+	}{
+		{
+			desc: "file under symlink to outside directory",
+			entries: func(outside string) []*tar.Header {
+				return []*tar.Header{
+					{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: outside, Mode: 0777},
+					{Name: "escape/evil", Typeflag: tar.TypeReg, Size: 4, Mode: 0644},
+				}
+			},
+			expectErr: true,
+		},
+		{
+			desc: "directory under symlink to outside directory",
+			entries: func(outside string) []*tar.Header {
+				return []*tar.Header{
+					{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: outside, Mode: 0777},
+					{Name: "escape/evil/", Typeflag: tar.TypeDir, Mode: 0755},
+				}
+			},
+			expectErr: true,
+		},
+		{
+			desc: "file under dangling symlink",
+			entries: func(outside string) []*tar.Header {
+				return []*tar.Header{
+					{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: filepath.Join(outside, "missing"), Mode: 0777},
+					{Name: "escape/evil", Typeflag: tar.TypeReg, Size: 4, Mode: 0644},
+				}
+			},
+			expectErr: true,
+		},
+		{
+			desc: "hard link through symlink",
+			entries: func(outside string) []*tar.Header {
+				return []*tar.Header{
+					{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: outside, Mode: 0777},
+					{Name: "evil", Typeflag: tar.TypeLink, Linkname: "escape/evil"},
+				}
+			},
+			expectErr: true,
+		},
+		{
+			desc: "file replaces symlink to outside file",
+			entries: func(outside string) []*tar.Header {
+				return []*tar.Header{
+					{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: filepath.Join(outside, "evil"), Mode: 0777},
+					{Name: "evil", Typeflag: tar.TypeReg, Size: 4, Mode: 0644},
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			outside, snapPath, dstPath := t.TempDir(), t.TempDir(), t.TempDir()
+			archivePath := filepath.Join(snapPath, "src-pv-name.tar")
+			writeArchive(t, archivePath, test.entries(outside))
+			err := extractSnapshotArchiveOnServer(context.TODO(), archivePath, dstPath, nil)
+			if (err != nil) != test.expectErr {
+				t.Errorf("unexpected error %v", err)
+			}
+			if entries, _ := os.ReadDir(outside); len(entries) > 0 {
+				t.Errorf("archive entries are written out of %s: %v", dstPath, entries)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// snapshotFormatArchive archives the volume into a tar file, which is the default format
+	snapshotFormatArchive = "archive"
+	// snapshotFormatIncremental copies the volume into a directory tree with rsync, unchanged files are hard linked
+	// from the previous snapshot of the same volume, so only changed files are stored
+	snapshotFormatIncremental = "incremental"
+	// metadata of incremental snapshot is written after the tree is copied, the snapshot is not ready without metadata
+	incrementalSnapshotMetadataExt = ".snapshot.json"
+	// incremental snapshot tree is copied to a partial directory and renamed after rsync succeeds
+	incrementalSnapshotPartialExt = ".partial"
+)
+
+// incrementalSnapshotMetadata is written next to the tree of incremental snapshot
+type incrementalSnapshotMetadata struct {
+	SourceVolumeID string `json:"sourceVolumeID"`
+	// snapshot whose unchanged files are hard linked, empty if it's the first snapshot of the volume
+	Parent       string    `json:"parent,omitempty"`
+	CreationTime time.Time `json:"creationTime"`
+	// total size of files in the snapshot, which is the size required to restore it
+	SizeBytes int64 `json:"sizeBytes"`
+	// size of files copied from the volume, files linked from parent snapshot are not counted
+	StoredBytes int64 `json:"storedBytes"`
+}
+
+// snapshotInfo is size and creation time of a snapshot found on the nfs server
+type snapshotInfo struct {
+	sizeBytes    int64
+	creationTime time.Time
+	// empty if source volume of archive is not recorded, e.g. archive created before source volume is recorded
+	sourceVolumeID string
+}
+
+// runRsync runs rsync and returns its combined output, could be replaced in unit tests
+var runRsync = func(args ...string) ([]byte, error) {
+	return exec.Command("rsync", args...).CombinedOutput()
+}
+
+var rsyncStatsRegexp = regexp.MustCompile(`(?m)^(Total file size|Total transferred file size): ([0-9.,]+) bytes`)
+
+func validateSnapshotFormat(format string) error {
+	switch format {
+	case snapshotFormatArchive, snapshotFormatIncremental:
+		return nil
+	default:
+		return fmt.Errorf("invalid value %s for snapshotFormat, supported values are %s, %s", format, snapshotFormatArchive, snapshotFormatIncremental)
+	}
+}
+
+func (snap nfsSnapshot) treeName() string {
+	return snap.src
+}
+
+func (snap nfsSnapshot) metadataName() string {
+	return snap.src + incrementalSnapshotMetadataExt
+}
+
+// isIncrementalSnapshotEntryOf returns true if name is the tree, metadata or temporary file of incremental snapshot
+func isIncrementalSnapshotEntryOf(name string, snap *nfsSnapshot) bool {
+	switch name {
+	case snap.treeName(), snap.treeName() + incrementalSnapshotPartialExt, snap.metadataName(), snap.metadataName() + ".tmp":
+		return true
+	}
+	return false
+}
+
+// readIncrementalSnapshotMetadata reads metadata of incremental snapshot in dir, error satisfying os.IsNotExist
+// is returned if the snapshot is not an incremental snapshot or it's not ready
+func readIncrementalSnapshotMetadata(dir string, snap *nfsSnapshot) (*incrementalSnapshotMetadata, error) {
+	data, err := os.ReadFile(filepath.Join(dir, snap.metadataName()))
+	if err != nil {
+		return nil, err
+	}
+	metadata := &incrementalSnapshotMetadata{}
+	if err := json.Unmarshal(data, metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata of snapshot %s: %v", snap.uuid, err)
+	}
+	return metadata, nil
+}
+
+// findSnapshot searches incremental snapshot and archive of the snapshot in dir, format and compression of snap are set
+// if it's found, otherwise error satisfying os.IsNotExist is returned. Source volume is read from metadata of incremental
+// snapshot or the file next to the archive.
+func findSnapshot(dir string, snap *nfsSnapshot) (*snapshotInfo, error) {
+	metadata, err := readIncrementalSnapshotMetadata(dir, snap)
+	if err == nil {
+		snap.format = snapshotFormatIncremental
+		return &snapshotInfo{sizeBytes: metadata.SizeBytes, creationTime: metadata.CreationTime, sourceVolumeID: metadata.SourceVolumeID}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	fi, err := findSnapshotArchive(dir, snap)
+	if err != nil {
+		return nil, err
+	}
+	snap.format = snapshotFormatArchive
+	srcVolumeID, err := readSnapshotSourceVolumeID(dir, snap)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return &snapshotInfo{sizeBytes: fi.Size(), creationTime: fi.ModTime(), sourceVolumeID: srcVolumeID}, nil
+}
+
+// findParentSnapshot returns the tree path and name of the latest incremental snapshot of the source volume under shareRoot,
+// empty strings are returned if there is no previous snapshot
+func findParentSnapshot(ctx context.Context, shareRoot string, snap *nfsSnapshot, srcVolumeID string) (string, string, error) {
+	entries, err := os.ReadDir(shareRoot)
+	if err != nil {
+		return "", "", err
+	}
+	var parentPath, parentName string
+	var latest time.Time
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == snap.uuid {
+			continue
+		}
+		dir := filepath.Join(shareRoot, entry.Name())
+		metadata, err := readIncrementalSnapshotMetadata(dir, snap)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				klog.FromContext(ctx).Info("skip snapshot as parent", "snapshot", entry.Name(), "err", err)
+			}
+			continue
+		}
+		if metadata.SourceVolumeID != srcVolumeID || !metadata.CreationTime.After(latest) {
+			continue
+		}
+		parentPath, parentName, latest = filepath.Join(dir, snap.treeName()), entry.Name(), metadata.CreationTime
+	}
+	return parentPath, parentName, nil
+}
+
+// createIncrementalSnapshot copies srcPath into the tree of the snapshot in snapPath, unchanged files are hard linked
+// from the latest incremental snapshot of the same volume under shareRoot. Metadata is written at last,
+// so a snapshot interrupted in rsync is not used as parent or restored.
+func createIncrementalSnapshot(ctx context.Context, srcPath, shareRoot, snapPath string, snap *nfsSnapshot, srcVolumeID string) (*incrementalSnapshotMetadata, error) {
+	logger := klog.FromContext(ctx)
+	parentPath, parentName, err := findParentSnapshot(ctx, shareRoot, snap, srcVolumeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find parent snapshot: %v", err)
+	}
+
+	partialPath := filepath.Join(snapPath, snap.treeName()+incrementalSnapshotPartialExt)
+	// permissions, owners, hard links and symlinks are preserved, files left by interrupted rsync are removed
+	args := []string{"-a", "-H", "--numeric-ids", "--delete", "--stats"}
+	if parentPath != "" {
+		args = append(args, "--link-dest="+parentPath)
+	}
+	args = append(args, strings.TrimRight(srcPath, "/")+"/", partialPath)
+	logger.V(2).Info("copying volume with rsync", "srcPath", srcPath, "dstPath", partialPath, "parent", parentName)
+	out, err := runRsync(args...)
+	if err != nil {
+		return nil, fmt.Errorf("rsync failed: %v, output: %s", err, string(out))
+	}
+	metadata := &incrementalSnapshotMetadata{
+		SourceVolumeID: srcVolumeID,
+		Parent:         parentName,
+		CreationTime:   time.Now().UTC(),
+	}
+	for _, m := range rsyncStatsRegexp.FindAllStringSubmatch(string(out), -1) {
+		// numbers are printed with thousands separators of the locale
+		n, err := strconv.ParseInt(strings.NewReplacer(",", "", ".", "").Replace(m[2]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse rsync stats %q: %v", m[0], err)
+		}
+		if m[1] == "Total file size" {
+			metadata.SizeBytes = n
+		} else {
+			metadata.StoredBytes = n
+		}
+	}
+
+	treePath := filepath.Join(snapPath, snap.treeName())
+	if err := os.RemoveAll(treePath); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(partialPath, treePath); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	tmp := filepath.Join(snapPath, snap.metadataName()+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, filepath.Join(snapPath, snap.metadataName())); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
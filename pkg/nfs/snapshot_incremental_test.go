@@ -0,0 +1,132 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeRsync copies regular files of the source directory, files with the same content in link-dest are hard linked
+func fakeRsync(args ...string) ([]byte, error) {
+	var linkDest string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--link-dest=") {
+			linkDest = strings.TrimPrefix(arg, "--link-dest=")
+		}
+	}
+	src, dst := args[len(args)-2], args[len(args)-1]
+	var total, transferred int64
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode())
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		if linkDest != "" {
+			if old, err := os.ReadFile(filepath.Join(linkDest, rel)); err == nil && bytes.Equal(old, data) {
+				return os.Link(filepath.Join(linkDest, rel), target)
+			}
+		}
+		transferred += info.Size()
+		return os.WriteFile(target, data, info.Mode())
+	})
+	return []byte(fmt.Sprintf("Number of files: 3\nTotal file size: %d bytes\nTotal transferred file size: %d bytes\n", total, transferred)), err
+}
+
+func TestCreateIncrementalSnapshot(t *testing.T) {
+	origRunRsync := runRsync
+	defer func() { runRsync = origRunRsync }()
+	runRsync = fakeRsync
+
+	const srcVolumeID = "server#share#subdir#src-pv-name"
+	srcPath := t.TempDir()
+	shareRoot := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(srcPath, "unchanged"), []byte("1234567890"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(srcPath, "changed"), []byte("v1"), 0644))
+
+	create := func(name string) (*nfsSnapshot, *incrementalSnapshotMetadata) {
+		snap := &nfsSnapshot{uuid: name, src: "src-pv-name", format: snapshotFormatIncremental}
+		snapPath := filepath.Join(shareRoot, name)
+		assert.NoError(t, os.MkdirAll(snapPath, 0777))
+		assert.NoError(t, validateSnapshot(snapPath, snap))
+		metadata, err := createIncrementalSnapshot(context.Background(), srcPath, shareRoot, snapPath, snap, srcVolumeID)
+		assert.NoError(t, err)
+		return snap, metadata
+	}
+
+	_, first := create("snapshot-1")
+	assert.Equal(t, "", first.Parent)
+	assert.Equal(t, int64(12), first.SizeBytes)
+	assert.Equal(t, int64(12), first.StoredBytes)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(srcPath, "changed"), []byte("v2"), 0644))
+	snap, second := create("snapshot-2")
+	assert.Equal(t, "snapshot-1", second.Parent)
+	assert.Equal(t, int64(12), second.SizeBytes)
+	assert.Equal(t, int64(2), second.StoredBytes, "only changed file is stored")
+	fi1, err := os.Stat(filepath.Join(shareRoot, "snapshot-1", "src-pv-name", "unchanged"))
+	assert.NoError(t, err)
+	fi2, err := os.Stat(filepath.Join(shareRoot, "snapshot-2", "src-pv-name", "unchanged"))
+	assert.NoError(t, err)
+	assert.True(t, os.SameFile(fi1, fi2), "unchanged file should be hard linked")
+	_, err = os.Stat(filepath.Join(shareRoot, "snapshot-2", "src-pv-name"+incrementalSnapshotPartialExt))
+	assert.True(t, os.IsNotExist(err), "partial tree should be renamed")
+
+	// the latest snapshot is the parent, deleting a snapshot does not break others
+	assert.NoError(t, os.RemoveAll(filepath.Join(shareRoot, "snapshot-1")))
+	_, third := create("snapshot-3")
+	assert.Equal(t, "snapshot-2", third.Parent)
+	assert.Equal(t, int64(0), third.StoredBytes)
+
+	found := &nfsSnapshot{uuid: "snapshot-2", src: "src-pv-name"}
+	info, err := findSnapshot(filepath.Join(shareRoot, "snapshot-2"), found)
+	assert.NoError(t, err)
+	assert.Equal(t, snapshotFormatIncremental, found.format)
+	assert.Equal(t, int64(12), info.sizeBytes)
+	assert.Equal(t, second.CreationTime, info.creationTime)
+
+	// snapshot with the same name in archive format
+	snap.format = snapshotFormatArchive
+	snap.compression = snapshotCompressionGzip
+	err = validateSnapshot(filepath.Join(shareRoot, "snapshot-2"), snap)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+}
+
+func TestValidateSnapshotFormat(t *testing.T) {
+	for _, format := range []string{snapshotFormatArchive, snapshotFormatIncremental} {
+		assert.NoError(t, validateSnapshotFormat(format))
+	}
+	assert.Error(t, validateSnapshotFormat("snar"))
+}
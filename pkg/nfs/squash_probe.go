@@ -0,0 +1,138 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// probe file created in the mounted share to find out how the nfs server maps the user of node plugin
+const squashProbeFilePrefix = ".csi-nfs-squash-probe-"
+
+// squashExpectation is the squash configuration of the export expected by the volume
+type squashExpectation struct {
+	// root of node plugin is expected to be squashed if true, or kept if false, it's not checked if nil
+	rootSquash *bool
+	// anonuid and anongid of the export, they are not checked if -1
+	anonUID int
+	anonGID int
+}
+
+// parseSquashExpectation parses expectRootSquash, anonUID and anonGID in parameters, nil is returned if none of them is set
+func parseSquashExpectation(parameters map[string]string) (*squashExpectation, error) {
+	e := &squashExpectation{anonUID: -1, anonGID: -1}
+	for k, v := range parameters {
+		var err error
+		switch strings.ToLower(k) {
+		case paramExpectRootSquash:
+			if v == "" {
+				continue
+			}
+			rootSquash, parseErr := strconv.ParseBool(v)
+			if parseErr != nil {
+				return nil, fmt.Errorf("invalid %s %s, it should be true or false", paramExpectRootSquash, v)
+			}
+			e.rootSquash = &rootSquash
+		case paramAnonUID:
+			e.anonUID, err = parseOwnerID(paramAnonUID, v)
+		case paramAnonGID:
+			e.anonGID, err = parseOwnerID(paramAnonGID, v)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if e.rootSquash != nil && !*e.rootSquash && (e.anonUID >= 0 || e.anonGID >= 0) {
+		return nil, fmt.Errorf("%s or %s could not be set with %s false, root is not mapped to anonymous user without root squash", paramAnonUID, paramAnonGID, paramExpectRootSquash)
+	}
+	if e.rootSquash == nil && e.anonUID < 0 && e.anonGID < 0 {
+		return nil, nil
+	}
+	return e, nil
+}
+
+// verifySquash creates a probe file in dir of the mounted share and checks its owner against e,
+// the probe file is removed after check
+func verifySquash(ctx context.Context, dir string, e *squashExpectation) error {
+	uid := os.Geteuid()
+	f, err := os.CreateTemp(dir, squashProbeFilePrefix)
+	if err != nil {
+		if !os.IsPermission(err) {
+			return fmt.Errorf("failed to create probe file in %s: %v", dir, err)
+		}
+		// the share is not writable by the anonymous user if root is squashed
+		if e.rootSquash != nil && !*e.rootSquash {
+			return fmt.Errorf("uid %d is squashed by nfs server, probe file could not be created in %s: %v, %s false requires no_root_squash in the export", uid, dir, err, paramExpectRootSquash)
+		}
+		if e.anonUID >= 0 || e.anonGID >= 0 {
+			return fmt.Errorf("probe file could not be created in %s: %v, %s and %s could only be verified if the share is writable by the anonymous user", dir, err, paramAnonUID, paramAnonGID)
+		}
+		return nil
+	}
+	name := f.Name()
+	f.Close()
+	defer os.Remove(name)
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		return fmt.Errorf("failed to stat probe file %s: %v", name, err)
+	}
+	fileUID, fileGID, ok := getFileOwner(fi)
+	if !ok {
+		klog.FromContext(ctx).V(2).Info("skip verifying squash since owner of files is unknown on the platform", "path", dir)
+		return nil
+	}
+	squashed := fileUID != uid
+	switch {
+	case e.rootSquash != nil && *e.rootSquash && !squashed:
+		return fmt.Errorf("uid %d is not squashed by nfs server, probe file in %s is owned by uid %d, %s true requires root_squash or all_squash in the export", uid, dir, fileUID, paramExpectRootSquash)
+	case e.rootSquash != nil && !*e.rootSquash && squashed:
+		return fmt.Errorf("uid %d is squashed by nfs server, probe file in %s is owned by uid %d, %s false requires no_root_squash in the export", uid, dir, fileUID, paramExpectRootSquash)
+	case e.anonUID >= 0 && fileUID != e.anonUID:
+		return fmt.Errorf("probe file in %s is owned by uid %d, %s %d is expected, check anonuid and root_squash of the export", dir, fileUID, paramAnonUID, e.anonUID)
+	case e.anonGID >= 0 && fileGID != e.anonGID:
+		return fmt.Errorf("probe file in %s is owned by gid %d, %s %d is expected, check anongid and root_squash of the export", dir, fileGID, paramAnonGID, e.anonGID)
+	}
+	return nil
+}
+
+// verifySquashOnFirstPublish verifies squash configuration of the export mounted on targetPath, it's only verified once
+// per volume on the node, read-only volumes are not verified since the probe file could not be created
+func (ns *NodeServer) verifySquashOnFirstPublish(ctx context.Context, volumeID, targetPath string, e *squashExpectation, readOnly bool) error {
+	logger := klog.FromContext(ctx)
+	if _, verified := ns.squashVerifiedVolumes.Load(volumeID); verified {
+		return nil
+	}
+	if readOnly {
+		logger.V(2).Info("skip verifying squash of read-only volume")
+		return nil
+	}
+	if err := verifySquash(ctx, targetPath, e); err != nil {
+		return status.Errorf(codes.FailedPrecondition, "squash configuration of the export does not match volume(%s): %v", volumeID, err)
+	}
+	logger.V(2).Info("squash configuration of the export is verified", "targetPath", targetPath)
+	ns.squashVerifiedVolumes.Store(volumeID, struct{}{})
+	return nil
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+)
+
+func TestParseSquashExpectation(t *testing.T) {
+	rootSquash := true
+	tests := []struct {
+		parameters map[string]string
+		expected   *squashExpectation
+		expectErr  error
+	}{
+		{
+			parameters: map[string]string{paramServer: "server"},
+		},
+		{
+			parameters: map[string]string{"expectRootSquash": "true", "anonUID": "65534", "anonGID": ""},
+			expected:   &squashExpectation{rootSquash: &rootSquash, anonUID: 65534, anonGID: -1},
+		},
+		{
+			parameters: map[string]string{"anonGID": "100"},
+			expected:   &squashExpectation{anonUID: -1, anonGID: 100},
+		},
+		{
+			parameters: map[string]string{"expectRootSquash": "yes"},
+			expectErr:  fmt.Errorf("invalid expectrootsquash yes, it should be true or false"),
+		},
+		{
+			parameters: map[string]string{"anonUID": "-2"},
+			expectErr:  fmt.Errorf("invalid anonuid -2 in storage class, it should be a non-negative integer"),
+		},
+		{
+			parameters: map[string]string{"expectRootSquash": "false", "anonUID": "65534"},
+			expectErr:  fmt.Errorf("anonuid or anongid could not be set with expectrootsquash false, root is not mapped to anonymous user without root squash"),
+		},
+	}
+	for _, test := range tests {
+		e, err := parseSquashExpectation(test.parameters)
+		assert.Equal(t, test.expectErr, err, "parameters: %v", test.parameters)
+		assert.Equal(t, test.expected, e, "parameters: %v", test.parameters)
+	}
+}
+
+func TestVerifySquash(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip on windows")
+	}
+	// files created in a local directory are owned by the current user, which is the same as not squashed
+	dir := t.TempDir()
+	rootSquash, noRootSquash := true, false
+	tests := []struct {
+		e      *squashExpectation
+		errMsg string
+	}{
+		{e: &squashExpectation{rootSquash: &noRootSquash, anonUID: -1, anonGID: -1}},
+		{e: &squashExpectation{rootSquash: &rootSquash, anonUID: -1, anonGID: -1}, errMsg: "is not squashed by nfs server"},
+		{e: &squashExpectation{anonUID: os.Geteuid(), anonGID: os.Getegid()}},
+		{e: &squashExpectation{anonUID: os.Geteuid() + 1, anonGID: -1}, errMsg: "anonuid " + strconv.Itoa(os.Geteuid()+1) + " is expected"},
+		{e: &squashExpectation{anonUID: -1, anonGID: os.Getegid() + 1}, errMsg: "anongid " + strconv.Itoa(os.Getegid()+1) + " is expected"},
+	}
+	for _, test := range tests {
+		err := verifySquash(context.TODO(), dir, test.e)
+		if test.errMsg == "" {
+			assert.NoError(t, err)
+		} else {
+			assert.True(t, err != nil && strings.Contains(err.Error(), test.errMsg), "unexpected error %v, expected %q", err, test.errMsg)
+		}
+	}
+	// probe files are removed
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestNodePublishVolumeSquashMismatch(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip on windows")
+	}
+	fakeMounter := mount.NewFakeMounter(nil)
+	ns := NewNodeServer(NewEmptyDriver(""), fakeMounter)
+	targetPath := filepath.Join(t.TempDir(), "mount")
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:   "vol_1",
+		TargetPath: targetPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+		VolumeContext: map[string]string{paramServer: "server", paramShare: "/share", "expectRootSquash": "true"},
+	}
+
+	// the mount is removed so that the retry verifies again instead of reusing it
+	_, err := ns.NodePublishVolume(context.TODO(), req)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "squash configuration of the export does not match volume(vol_1)")
+	assert.Equal(t, []mount.FakeAction{
+		{Action: "mount", Target: targetPath, Source: "server:/share", FSType: "nfs"},
+		{Action: "unmount", Target: targetPath},
+	}, fakeMounter.GetLog())
+
+	// squash is verified once per volume on the node
+	req.VolumeContext["expectRootSquash"] = "false"
+	_, err = ns.NodePublishVolume(context.TODO(), req)
+	assert.NoError(t, err)
+	req.VolumeContext["expectRootSquash"] = "true"
+	req.TargetPath = filepath.Join(t.TempDir(), "mount")
+	_, err = ns.NodePublishVolume(context.TODO(), req)
+	assert.NoError(t, err)
+}
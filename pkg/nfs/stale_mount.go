@@ -0,0 +1,149 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+// time to wait for stat on a mount point, nfs server is considered unreachable if stat does not return in time
+const mountProbeTimeout = 10 * time.Second
+
+// publishedMount is the mount made by NodePublishVolume
+type publishedMount struct {
+	volumeID string
+	server   string
+	source   string
+	fsType   string
+	// mount options passed to mount, including addr= of resolved server address, the mount is remounted with them
+	options []string
+}
+
+// mountTracker records mounts made by NodePublishVolume, mounts made before node plugin restarts are not recorded
+type mountTracker struct {
+	// target path -> publishedMount
+	mounts sync.Map
+}
+
+func newMountTracker() *mountTracker {
+	return &mountTracker{}
+}
+
+func (t *mountTracker) add(targetPath string, m publishedMount) {
+	t.mounts.Store(targetPath, m)
+}
+
+func (t *mountTracker) remove(targetPath string) {
+	t.mounts.Delete(targetPath)
+}
+
+func (t *mountTracker) list() map[string]publishedMount {
+	mounts := map[string]publishedMount{}
+	t.mounts.Range(func(k, v interface{}) bool {
+		mounts[k.(string)] = v.(publishedMount)
+		return true
+	})
+	return mounts
+}
+
+// probeMount returns the error of stat on targetPath, returns error if stat does not return in timeout,
+// could be replaced in unit tests
+var probeMount = func(targetPath string, timeout time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := os.Stat(targetPath)
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("stat %s timed out after %v", targetPath, timeout)
+	}
+}
+
+// runStaleMountReconciler checks published mounts every interval until ctx is done
+func (ns *NodeServer) runStaleMountReconciler(ctx context.Context, interval time.Duration) {
+	logger := klog.FromContext(ctx).WithName("stale-mount-reconciler")
+	ctx = klog.NewContext(ctx, logger)
+	logger.V(2).Info("checking stale mounts", "interval", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ns.reconcileStaleMounts(ctx)
+		}
+	}
+}
+
+// reconcileStaleMounts remounts published mounts which are corrupted, e.g. stale file handle after nfs server reboot
+func (ns *NodeServer) reconcileStaleMounts(ctx context.Context) {
+	for targetPath, m := range ns.mountTracker.list() {
+		logger := klog.FromContext(ctx).WithValues("volumeID", m.volumeID, "targetPath", targetPath)
+		err := probeMount(targetPath, mountProbeTimeout)
+		if err == nil {
+			continue
+		}
+		if os.IsNotExist(err) {
+			logger.Info("stop checking target path since it does not exist")
+			ns.mountTracker.remove(targetPath)
+			continue
+		}
+		if !mount.IsCorruptedMnt(err) {
+			// remount would also hang if nfs server is unreachable
+			logger.Info("skip remounting volume", "err", err)
+			continue
+		}
+
+		lockKey := fmt.Sprintf("%s-%s", m.volumeID, targetPath)
+		if acquired := ns.Driver.volumeLocks.TryAcquire(lockKey); !acquired {
+			logger.V(2).Info("skip remounting volume since there is an operation in progress")
+			continue
+		}
+		logger.Info("mount is corrupted, remounting", "source", m.source, "err", err)
+		// pods on the volume may have seen errors, which are visible to users on the pv
+		pvName := getPVNameOfPublish(nil, targetPath)
+		if pvName == "" {
+			pvName = ns.Driver.getPVNameOfVolumeID(ctx, m.volumeID)
+		}
+		if remountErr := ns.remount(ctx, targetPath, m); remountErr != nil {
+			logger.Error(remountErr, "failed to remount volume", "source", m.source)
+			ns.Driver.recordPVWarning(pvName, eventReasonStaleMountRemountFailed, fmt.Sprintf("mount %s on %s is corrupted: %v, remount failed: %v", m.source, targetPath, err, remountErr))
+		} else {
+			logger.Info("volume is remounted", "source", m.source)
+			ns.Driver.recordPVWarning(pvName, eventReasonStaleMountRemounted, fmt.Sprintf("mount %s on %s was corrupted: %v, it's remounted", m.source, targetPath, err))
+		}
+		ns.Driver.volumeLocks.Release(lockKey)
+	}
+}
+
+func (ns *NodeServer) remount(ctx context.Context, targetPath string, m publishedMount) error {
+	if err := ns.forceUnmount(targetPath); err != nil {
+		return fmt.Errorf("unmount failed: %v", err)
+	}
+	return mountNFS(ctx, ns.mounter, m.source, targetPath, m.fsType, m.options, ns.Driver.mountTimeout)
+}
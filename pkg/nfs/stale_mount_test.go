@@ -0,0 +1,117 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"k8s.io/client-go/tools/record"
+	mount "k8s.io/mount-utils"
+)
+
+func TestReconcileStaleMounts(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip on windows")
+	}
+	const (
+		target = "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pv/mount"
+		source = "server:/share"
+	)
+	tests := []struct {
+		desc            string
+		probeErr        error
+		locked          bool
+		expectedActions []mount.FakeAction
+		expectTracked   bool
+		expectedEvent   string
+	}{
+		{
+			desc:          "healthy mount",
+			probeErr:      nil,
+			expectTracked: true,
+		},
+		{
+			desc:          "target path removed",
+			probeErr:      &os.PathError{Op: "stat", Path: target, Err: syscall.ENOENT},
+			expectTracked: false,
+		},
+		{
+			desc:          "nfs server unreachable",
+			probeErr:      fmt.Errorf("stat %s timed out after %v", target, mountProbeTimeout),
+			expectTracked: true,
+		},
+		{
+			desc:          "operation in progress",
+			probeErr:      &os.PathError{Op: "stat", Path: target, Err: syscall.ESTALE},
+			locked:        true,
+			expectTracked: true,
+		},
+		{
+			desc:     "stale file handle",
+			probeErr: &os.PathError{Op: "stat", Path: target, Err: syscall.ESTALE},
+			expectedActions: []mount.FakeAction{
+				{Action: "unmount", Target: target},
+				{Action: "mount", Target: target, Source: source, FSType: "nfs"},
+			},
+			expectTracked: true,
+			expectedEvent: "Warning StaleMountRemounted mount server:/share on " + target + " was corrupted: stat " + target + ": " + syscall.ESTALE.Error() + ", it's remounted",
+		},
+	}
+
+	origProbeMount := probeMount
+	defer func() { probeMount = origProbeMount }()
+	for _, test := range tests {
+		fakeMounter := mount.NewFakeMounter([]mount.MountPoint{{Device: source, Path: target, Type: "nfs"}})
+		recorder := record.NewFakeRecorder(10)
+		ns := NewNodeServer(NewEmptyDriver(""), fakeMounter)
+		ns.Driver.eventRecorder = recorder
+		// options of the mount, e.g. addr= of resolved server address, are used on remount
+		ns.mountTracker.add(target, publishedMount{volumeID: "vol_1", source: source, options: []string{"nfsvers=4.1", "addr=10.0.0.1"}})
+		lockKey := fmt.Sprintf("%s-%s", "vol_1", target)
+		if test.locked {
+			ns.Driver.volumeLocks.TryAcquire(lockKey)
+		}
+		probeMount = func(string, time.Duration) error {
+			return test.probeErr
+		}
+
+		ns.reconcileStaleMounts(context.Background())
+
+		assert.Equal(t, test.expectedActions, fakeMounter.GetLog(), test.desc)
+		_, tracked := ns.mountTracker.list()[target]
+		assert.Equal(t, test.expectTracked, tracked, test.desc)
+		assert.Equal(t, !test.locked, ns.Driver.volumeLocks.TryAcquire(lockKey), test.desc)
+		if test.expectedActions != nil {
+			mountPoints, err := fakeMounter.List()
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"nfsvers=4.1", "addr=10.0.0.1"}, mountPoints[len(mountPoints)-1].Opts, test.desc)
+		}
+		var event string
+		select {
+		case event = <-recorder.Events:
+		default:
+		}
+		assert.Equal(t, test.expectedEvent, event, test.desc)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// annotation set by external-provisioner on dynamically provisioned pv
+const provisionedByAnnotation = "pv.kubernetes.io/provisioned-by"
+
+// staticVolumeLister lists persistent volumes, it could be replaced in unit tests
+type staticVolumeLister interface {
+	listPersistentVolumes(ctx context.Context) ([]v1.PersistentVolume, error)
+}
+
+// getStaticVolumes returns pre-provisioned volumes of the driver, i.e. pvs not created by external-provisioner,
+// server, share and subDir are read from volume attributes since volume handle of static pv is arbitrary
+func getStaticVolumes(ctx context.Context, driverName string, pvs []v1.PersistentVolume) []*nfsVolume {
+	logger := klog.FromContext(ctx)
+	var vols []*nfsVolume
+	for _, pv := range pvs {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName || pv.Spec.CSI.VolumeHandle == "" {
+			continue
+		}
+		if _, ok := pv.Annotations[provisionedByAnnotation]; ok {
+			continue
+		}
+		vol := &nfsVolume{id: pv.Spec.CSI.VolumeHandle, uuid: pv.Name}
+		for k, v := range pv.Spec.CSI.VolumeAttributes {
+			switch strings.ToLower(k) {
+			case paramServer:
+				if servers := getServerList(v); len(servers) > 0 {
+					vol.server = servers[0]
+				}
+			case paramShare:
+				vol.baseDir = v
+			case paramSubDir:
+				vol.subDir = v
+			}
+		}
+		if vol.server == "" || vol.baseDir == "" {
+			logger.V(4).Info("skip static volume without server or share", "pv", pv.Name)
+			continue
+		}
+		// pv/pvc metadata in subDir is only known on node
+		if strings.Contains(vol.subDir, "${") {
+			logger.V(4).Info("skip static volume with metadata in subDir", "pv", pv.Name, "subDir", vol.subDir)
+			continue
+		}
+		if capacity, ok := pv.Spec.Capacity[v1.ResourceStorage]; ok {
+			vol.size = capacity.Value()
+		}
+		vols = append(vols, vol)
+	}
+	return vols
+}
+
+// runStaticVolumeAdoption registers static volumes into volume registry periodically,
+// so they are listed with their conditions in ListVolumes like provisioned volumes
+func (cs *ControllerServer) runStaticVolumeAdoption(ctx context.Context, lister staticVolumeLister, interval time.Duration) {
+	logger := klog.FromContext(ctx).WithName("static-volume-adoption")
+	ctx = klog.NewContext(ctx, logger)
+	logger.V(2).Info("starting static volume adoption", "interval", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	adopted := map[string]bool{}
+	for {
+		var err error
+		if adopted, err = cs.adoptStaticVolumes(ctx, lister, adopted); err != nil {
+			logger.Error(err, "static volume adoption failed")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// adoptStaticVolumes adds static volumes into volume registry and removes volumes adopted before whose pv is deleted,
+// returns ids of adopted volumes
+func (cs *ControllerServer) adoptStaticVolumes(ctx context.Context, lister staticVolumeLister, adopted map[string]bool) (map[string]bool, error) {
+	pvs, err := lister.listPersistentVolumes(ctx)
+	if err != nil {
+		return adopted, fmt.Errorf("failed to list persistent volumes: %v", err)
+	}
+	logger := klog.FromContext(ctx)
+	current := map[string]bool{}
+	for _, vol := range getStaticVolumes(ctx, cs.Driver.name, pvs) {
+		if !adopted[vol.id] {
+			logger.V(2).Info("adopting static volume", "volumeID", vol.id, "server", vol.server, "share", vol.baseDir, "subDir", vol.subDir)
+		}
+		cs.Driver.volumes.add(vol)
+		current[vol.id] = true
+	}
+	for id := range adopted {
+		if !current[id] {
+			logger.V(2).Info("static volume is removed", "volumeID", id)
+			cs.Driver.volumes.remove(id)
+		}
+	}
+	return current, nil
+}
+
+// validateVolumeSource is called after volume with subDir fails to mount, it mounts the share root to check whether
+// subDir exists, so typos of subDir in static pv are reported instead of the error of mount command
+func (ns *NodeServer) validateVolumeSource(ctx context.Context, servers []string, baseDir, subDir, fsType string, mountOptions []string) error {
+	logger := klog.FromContext(ctx)
+	tmpDir, err := os.MkdirTemp("", "nfs-validate-")
+	if err != nil {
+		logger.Info("failed to create directory to validate volume source", "err", err)
+		return nil
+	}
+	defer os.Remove(tmpDir)
+
+	var source string
+	for _, server := range servers {
+		source = getMountSource(server, baseDir)
+		if err = mountNFS(ctx, ns.mounter, source, tmpDir, fsType, mountOptions, ns.Driver.mountTimeout); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		logger.V(2).Info("share is not mountable either", "source", source, "err", err)
+		return nil
+	}
+	defer func() {
+		if err := ns.mounter.Unmount(tmpDir); err != nil {
+			logger.Info("failed to unmount after validating volume source", "path", tmpDir, "err", err)
+		}
+	}()
+
+	fi, err := os.Stat(filepath.Join(tmpDir, subDir))
+	switch {
+	case os.IsNotExist(err):
+		return status.Errorf(codes.NotFound, "subDir %s does not exist on share %s, check subDir of the volume", subDir, source)
+	case err != nil:
+		logger.Info("failed to stat subDir on share", "subDir", subDir, "source", source, "err", err)
+	case !fi.IsDir():
+		return status.Errorf(codes.InvalidArgument, "subDir %s is not a directory on share %s", subDir, source)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestGetStaticVolumes(t *testing.T) {
+	provisioned := newTestPV("pvc-1", "nfs-server#share#pvc-1", withVolumeAttributes(map[string]string{"server": "nfs-server", "share": "/share", "subdir": "pvc-1"}))
+	provisioned.Annotations = map[string]string{provisionedByAnnotation: DefaultDriverName}
+	otherDriver := newTestPV("pv-other", "other", withDriver("other.csi.k8s.io"), withVolumeAttributes(map[string]string{"server": "nfs-server", "share": "/share"}))
+	pvs := []v1.PersistentVolume{
+		newTestPV("pv-static", "static-handle", withVolumeAttributes(map[string]string{"Server": "nfs-server,nfs-server-2", "share": "/share", "subDir": "app/data"})),
+		newTestPV("pv-no-server", "no-server", withVolumeAttributes(map[string]string{"share": "/share"})),
+		newTestPV("pv-metadata", "metadata", withVolumeAttributes(map[string]string{"server": "nfs-server", "share": "/share", "subDir": "${pvc.metadata.name}"})),
+		provisioned,
+		otherDriver,
+	}
+	expected := []*nfsVolume{
+		{
+			id:      "static-handle",
+			server:  "nfs-server",
+			baseDir: "/share",
+			subDir:  "app/data",
+			uuid:    "pv-static",
+			size:    10 * 1024 * 1024 * 1024,
+		},
+	}
+	if vols := getStaticVolumes(context.TODO(), DefaultDriverName, pvs); !reflect.DeepEqual(vols, expected) {
+		t.Errorf("got %+v, expected %+v", vols, expected)
+	}
+}
+
+func TestAdoptStaticVolumes(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.name = DefaultDriverName
+	lister := &fakeKubeResourceClient{
+		pvs: []v1.PersistentVolume{
+			newTestPV("pv-a", "handle-a", withVolumeAttributes(map[string]string{"server": "nfs-server", "share": "/share", "subDir": "a"})),
+			newTestPV("pv-b", "handle-b", withVolumeAttributes(map[string]string{"server": "nfs-server", "share": "/share", "subDir": "b"})),
+		},
+	}
+	adopted, err := cs.adoptStaticVolumes(context.TODO(), lister, map[string]bool{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(adopted, map[string]bool{"handle-a": true, "handle-b": true}) {
+		t.Errorf("unexpected adopted volumes %v", adopted)
+	}
+	if vol := cs.Driver.volumes.get("handle-a"); vol == nil || vol.subDir != "a" {
+		t.Errorf("static volume handle-a is not registered: %+v", vol)
+	}
+	// volume id of static volume is not in the format of provisioned volume
+	cs.Driver.workingMountDir = t.TempDir()
+	resp, err := cs.ControllerGetVolume(context.TODO(), &csi.ControllerGetVolumeRequest{VolumeId: "handle-a"})
+	if err != nil || resp.Volume.VolumeId != "handle-a" {
+		t.Errorf("unexpected response %+v, error: %v", resp, err)
+	}
+
+	// pv-b is deleted
+	lister.pvs = lister.pvs[:1]
+	if adopted, err = cs.adoptStaticVolumes(context.TODO(), lister, adopted); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(adopted, map[string]bool{"handle-a": true}) {
+		t.Errorf("unexpected adopted volumes %v", adopted)
+	}
+	if vol := cs.Driver.volumes.get("handle-b"); vol != nil {
+		t.Errorf("static volume handle-b is not removed: %+v", vol)
+	}
+}
+
+func TestValidateVolumeSource(t *testing.T) {
+	ns, err := getTestNodeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// share is not mountable, the error of mount command is kept
+	if err := ns.validateVolumeSource(context.TODO(), []string{"error_mount"}, "share", "subdir", fsTypeNFS, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	expected := "rpc error: code = NotFound desc = subDir subdir does not exist on share server-2:share, check subDir of the volume"
+	if err := ns.validateVolumeSource(context.TODO(), []string{"error_mount", "server-2"}, "share", "subdir", fsTypeNFS, nil); err == nil || err.Error() != expected {
+		t.Errorf("got %v, expected %s", err, expected)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+// prepareTargetPath makes targetPath ready to be mounted, it returns whether targetPath is not a mount point
+// and the topmost directory created for it, which is empty if targetPath exists.
+// Missing parents of targetPath are created, a corrupted mount point(e.g. ENOTCONN or ESTALE on stat) left by
+// a previous mount is unmounted, so that the volume is mounted again instead of failing on every retry of kubelet.
+func (ns *NodeServer) prepareTargetPath(ctx context.Context, targetPath string, perm os.FileMode) (bool, string, error) {
+	logger := klog.FromContext(ctx)
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
+	if err == nil {
+		return notMnt, "", nil
+	}
+	switch {
+	case os.IsNotExist(err):
+		created := getTopmostMissingDir(targetPath)
+		if err := os.MkdirAll(targetPath, perm); err != nil {
+			return false, "", status.Error(codes.Internal, err.Error())
+		}
+		return true, created, nil
+	case mount.IsCorruptedMnt(err):
+		logger.Info("unmounting corrupted mount point", "targetPath", targetPath, "err", err.Error())
+		if err := ns.forceUnmount(targetPath); err != nil {
+			return false, "", status.Errorf(codes.Internal, "failed to unmount corrupted mount point %s: %v", targetPath, err)
+		}
+		if notMnt, err = ns.mounter.IsLikelyNotMountPoint(targetPath); err != nil {
+			return false, "", status.Error(codes.Internal, err.Error())
+		}
+		return notMnt, "", nil
+	default:
+		return false, "", status.Error(codes.Internal, err.Error())
+	}
+}
+
+// forceUnmount unmounts targetPath, force unmount is used if it's supported since a corrupted mount could hang
+func (ns *NodeServer) forceUnmount(targetPath string) error {
+	if forceUnmounter, ok := ns.mounter.(mount.MounterForceUnmounter); ok {
+		return forceUnmounter.UnmountWithForce(targetPath, ns.Driver.unmountTimeout)
+	}
+	return ns.mounter.Unmount(targetPath)
+}
+
+// removeCreatedTargetPath removes targetPath and its parents up to created after a failed publish, so that the retry
+// does not find a half-created target path. Only empty directories are removed, nothing is removed if created is empty.
+func removeCreatedTargetPath(ctx context.Context, targetPath, created string) {
+	if created == "" {
+		return
+	}
+	for dir := filepath.Clean(targetPath); ; dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+			klog.FromContext(ctx).Info("failed to remove directory created for failed publish", "path", dir, "err", err)
+			return
+		}
+		if dir == created || dir == filepath.Dir(dir) {
+			return
+		}
+	}
+}
+
+// getTopmostMissingDir returns the topmost missing directory of path, which is created by os.MkdirAll
+func getTopmostMissingDir(path string) string {
+	missing := filepath.Clean(path)
+	for dir := filepath.Dir(missing); dir != missing; dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil || !os.IsNotExist(err) {
+			break
+		}
+		missing = dir
+	}
+	return missing
+}
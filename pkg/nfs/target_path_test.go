@@ -0,0 +1,85 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+)
+
+func TestNodePublishVolumeTargetPath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip on windows")
+	}
+	dir := t.TempDir()
+	corrupted := filepath.Join(dir, "corrupted")
+	assert.NoError(t, os.MkdirAll(corrupted, 0750))
+	fakeMounter := mount.NewFakeMounter([]mount.MountPoint{{Device: "server:/share", Path: corrupted, Type: "nfs"}})
+	fakeMounter.MountCheckErrors = map[string]error{corrupted: &os.PathError{Op: "stat", Path: corrupted, Err: syscall.ENOTCONN}}
+	ns := NewNodeServer(NewEmptyDriver(""), fakeMounter)
+	publish := func(volumeID, targetPath string) error {
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:      volumeID,
+			TargetPath:    targetPath,
+			VolumeContext: map[string]string{paramServer: "server", paramShare: "/share"},
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER},
+			},
+		})
+		return err
+	}
+
+	// corrupted mount point is unmounted and mounted again
+	assert.NoError(t, publish("vol_1", corrupted))
+	assert.Equal(t, []mount.FakeAction{
+		{Action: "unmount", Target: corrupted},
+		{Action: "mount", Target: corrupted, Source: "server:/share", FSType: "nfs"},
+	}, fakeMounter.GetLog())
+
+	// parents of target path are created, and removed if publish fails
+	first := filepath.Join(dir, "pods", "pod-1", "mount")
+	assert.NoError(t, publish("vol_2", first))
+	assert.DirExists(t, first)
+	second := filepath.Join(dir, "pods", "pod-2", "volumes", "mount")
+	assert.Equal(t, codes.FailedPrecondition, status.Code(publish("vol_2", second)))
+	assert.NoDirExists(t, filepath.Join(dir, "pods", "pod-2"))
+	assert.DirExists(t, first)
+
+	// target path created by kubelet is left as is
+	existing := filepath.Join(dir, "existing")
+	assert.NoError(t, os.MkdirAll(existing, 0750))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(publish("vol_2", existing)))
+	assert.DirExists(t, existing)
+}
+
+func TestGetTopmostMissingDir(t *testing.T) {
+	dir := t.TempDir()
+	assert.Equal(t, filepath.Join(dir, "a"), getTopmostMissingDir(filepath.Join(dir, "a", "b", "c")))
+	assert.Equal(t, filepath.Join(dir, "a"), getTopmostMissingDir(filepath.Join(dir, "a")+"/"))
+	assert.Equal(t, dir, getTopmostMissingDir(dir))
+}
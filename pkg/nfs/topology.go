@@ -0,0 +1,83 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// topologyKeyZone is the well-known zone label of nodes, it's used as topology key of the driver
+// so that allowedTopologies in storage class could match the node label directly
+const topologyKeyZone = "topology.kubernetes.io/zone"
+
+// getNodeZone returns zone label of the node, in-cluster config is used if kubeconfig is empty
+func getNodeZone(ctx context.Context, kubeconfig, nodeName string) (string, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return "", fmt.Errorf("failed to get kube config: %v", err)
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return "", fmt.Errorf("failed to create kube client: %v", err)
+	}
+	node, err := client.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get node %s: %v", nodeName, err)
+	}
+	return node.Labels[topologyKeyZone], nil
+}
+
+// parseServerMap parses serverMap parameter in format of {zone}={server};{zone}={server}
+func parseServerMap(serverMap string) (map[string]string, error) {
+	servers := map[string]string{}
+	for _, entry := range strings.Split(serverMap, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		zone, server, found := strings.Cut(entry, "=")
+		zone, server = strings.TrimSpace(zone), strings.TrimSpace(server)
+		if !found || zone == "" || server == "" {
+			return nil, fmt.Errorf("invalid entry %q in %s, expected format is {zone}={server}", entry, paramServerMap)
+		}
+		servers[zone] = server
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("%s is empty", paramServerMap)
+	}
+	return servers, nil
+}
+
+// pickServerByTopology returns the zone and server of the first preferred, then requisite topology in serverMap
+func pickServerByTopology(serverMap map[string]string, requirement *csi.TopologyRequirement) (string, string, bool) {
+	topologies := append([]*csi.Topology{}, requirement.GetPreferred()...)
+	topologies = append(topologies, requirement.GetRequisite()...)
+	for _, topology := range topologies {
+		zone := topology.GetSegments()[topologyKeyZone]
+		if server, ok := serverMap[zone]; ok && zone != "" {
+			return zone, server, true
+		}
+	}
+	return "", "", false
+}
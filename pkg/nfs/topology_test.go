@@ -0,0 +1,111 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestParseServerMap(t *testing.T) {
+	tests := []struct {
+		serverMap   string
+		expected    map[string]string
+		expectedErr error
+	}{
+		{
+			serverMap: "zone-a=10.0.0.1;zone-b=nfs-b.example.com,10.0.1.2",
+			expected:  map[string]string{"zone-a": "10.0.0.1", "zone-b": "nfs-b.example.com,10.0.1.2"},
+		},
+		{
+			serverMap: " zone-a = 10.0.0.1 ; ",
+			expected:  map[string]string{"zone-a": "10.0.0.1"},
+		},
+		{
+			serverMap:   "zone-a",
+			expectedErr: fmt.Errorf("invalid entry %q in %s, expected format is {zone}={server}", "zone-a", paramServerMap),
+		},
+		{
+			serverMap:   ";",
+			expectedErr: fmt.Errorf("%s is empty", paramServerMap),
+		},
+	}
+
+	for _, test := range tests {
+		result, err := parseServerMap(test.serverMap)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("parseServerMap(%s) returned error %v, expected %v", test.serverMap, err, test.expectedErr)
+		}
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("parseServerMap(%s) = %v, expected %v", test.serverMap, result, test.expected)
+		}
+	}
+}
+
+func TestPickServerByTopology(t *testing.T) {
+	serverMap := map[string]string{"zone-a": "server-a", "zone-b": "server-b"}
+	zoneTopology := func(zone string) *csi.Topology {
+		return &csi.Topology{Segments: map[string]string{topologyKeyZone: zone}}
+	}
+	tests := []struct {
+		desc           string
+		requirement    *csi.TopologyRequirement
+		expectedZone   string
+		expectedServer string
+		expectedFound  bool
+	}{
+		{
+			desc: "no requirement",
+		},
+		{
+			desc: "preferred zone is picked",
+			requirement: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{zoneTopology("zone-a"), zoneTopology("zone-b")},
+				Preferred: []*csi.Topology{zoneTopology("zone-b")},
+			},
+			expectedZone:   "zone-b",
+			expectedServer: "server-b",
+			expectedFound:  true,
+		},
+		{
+			desc: "requisite zone is picked if preferred zone is not in server map",
+			requirement: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{zoneTopology("zone-c"), zoneTopology("zone-a")},
+				Preferred: []*csi.Topology{zoneTopology("zone-c")},
+			},
+			expectedZone:   "zone-a",
+			expectedServer: "server-a",
+			expectedFound:  true,
+		},
+		{
+			desc: "no zone in server map",
+			requirement: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{zoneTopology("zone-c"), {Segments: map[string]string{"other": "zone-a"}}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		zone, server, found := pickServerByTopology(serverMap, test.requirement)
+		if zone != test.expectedZone || server != test.expectedServer || found != test.expectedFound {
+			t.Errorf("%s: got (%s, %s, %v), expected (%s, %s, %v)", test.desc, zone, server, found, test.expectedZone, test.expectedServer, test.expectedFound)
+		}
+	}
+}
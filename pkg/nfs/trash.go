@@ -0,0 +1,336 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// directory under the share root where subdirectories of deleted volumes with retainFor are moved
+	trashDirName = ".trash"
+	// trash entry is named {subDir}@{pvcNamespace}@{pvcUID}@{expiry}, subDir with "/" is flattened with "_",
+	// pvc namespace and uid are empty if the pvc of deleted volume is unknown
+	trashEntrySeparator = "@"
+	trashTimeFormat     = "20060102T150405Z"
+	// annotation on pvc to restore the trashed subdirectory of a deleted volume into the new volume
+	undeleteFromAnnotation = "nfs.csi.k8s.io/undelete-from"
+)
+
+var trashedVolumes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "trashed_volumes",
+	Help:      "Number of deleted volumes retained in trash found by the last trash purge",
+}, []string{"server", "share"})
+
+func init() {
+	prometheus.MustRegister(trashedVolumes)
+}
+
+// validateRetainFor checks retainFor is a positive duration, subdirectory is only moved to trash instead of removal
+func validateRetainFor(retainFor, onDelete string) error {
+	d, err := time.ParseDuration(retainFor)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid %s %s, it should be a positive duration, e.g. 72h", paramRetainFor, retainFor)
+	}
+	if onDelete != "" && !strings.EqualFold(onDelete, delete) {
+		return fmt.Errorf("%s requires %s %s, got %s", paramRetainFor, paramOnDelete, delete, onDelete)
+	}
+	return nil
+}
+
+func getTrashName(subDir string) string {
+	return strings.ReplaceAll(strings.Trim(subDir, "/"), "/", "_")
+}
+
+// trashEntry is a subdirectory of deleted volume in trash
+type trashEntry struct {
+	// flattened subDir
+	name string
+	// namespace and uid of the pvc of deleted volume, only pvcs in the same namespace could restore the entry
+	pvcNamespace string
+	pvcUID       string
+	expiry       time.Time
+}
+
+// getTrashEntryName returns name of the trash entry of subDir which is purged after expiry
+func getTrashEntryName(subDir, pvcNamespace, pvcUID string, expiry time.Time) string {
+	return strings.Join([]string{getTrashName(subDir), pvcNamespace, pvcUID, expiry.UTC().Format(trashTimeFormat)}, trashEntrySeparator)
+}
+
+// parseTrashEntryName returns the trash entry of its name, pvc is unknown if it's not in the name
+func parseTrashEntryName(name string) (*trashEntry, error) {
+	elements := strings.Split(name, trashEntrySeparator)
+	last := len(elements) - 1
+	if last < 1 || elements[0] == "" {
+		return nil, fmt.Errorf("trash entry %s does not have expiry", name)
+	}
+	expiry, err := time.Parse(trashTimeFormat, elements[last])
+	if err != nil {
+		return nil, fmt.Errorf("invalid expiry of trash entry %s: %v", name, err)
+	}
+	entry := &trashEntry{expiry: expiry}
+	if last >= 3 {
+		entry.pvcNamespace, entry.pvcUID = elements[last-2], elements[last-1]
+		last -= 2
+	}
+	entry.name = strings.Join(elements[:last], trashEntrySeparator)
+	return entry, nil
+}
+
+// getPVCOfVolume returns namespace and uid of the pvc bound to pv of the provisioned volume, pv is named after uuid or
+// subDir of the volume, empty strings are returned if kube client is not created or pv of the volume is not found
+func (n *Driver) getPVCOfVolume(ctx context.Context, vol *nfsVolume) (string, string) {
+	pvName := vol.uuid
+	if pvName == "" && !strings.Contains(vol.subDir, "/") {
+		pvName = vol.subDir
+	}
+	if n.kubeClient == nil || pvName == "" {
+		return "", ""
+	}
+	pv, err := n.kubeClient.CoreV1().PersistentVolumes().Get(ctx, pvName, metav1.GetOptions{})
+	if err != nil {
+		klog.FromContext(ctx).V(4).Info("failed to get pv of volume", "pv", pvName, "err", err)
+		return "", ""
+	}
+	if pv.Spec.CSI == nil || pv.Spec.CSI.VolumeHandle != vol.id || pv.Spec.ClaimRef == nil {
+		return "", ""
+	}
+	return pv.Spec.ClaimRef.Namespace, string(pv.Spec.ClaimRef.UID)
+}
+
+// moveToTrash moves volumePath to trash of the share mounted on sharePath, it's retained for retainFor,
+// namespace and uid of the pvc are kept in the entry name so the entry is only restored in the same namespace
+func moveToTrash(ctx context.Context, sharePath, volumePath, subDir, pvcNamespace, pvcUID, retainFor string, now time.Time) error {
+	d, err := time.ParseDuration(retainFor)
+	if err != nil {
+		return fmt.Errorf("invalid %s %s: %v", paramRetainFor, retainFor, err)
+	}
+	if _, err := os.Stat(volumePath); os.IsNotExist(err) {
+		klog.FromContext(ctx).V(2).Info("subdirectory does not exist, it may have been moved to trash already", "path", volumePath)
+		return nil
+	}
+	trashPath := filepath.Join(sharePath, trashDirName)
+	if err := os.MkdirAll(trashPath, 0700); err != nil {
+		return fmt.Errorf("failed to create trash directory %s: %v", trashPath, err)
+	}
+	entryPath := filepath.Join(trashPath, getTrashEntryName(subDir, pvcNamespace, pvcUID, now.Add(d)))
+	klog.FromContext(ctx).V(2).Info("moving subdirectory to trash", "path", volumePath, "trashPath", entryPath)
+	return os.Rename(volumePath, entryPath)
+}
+
+// restoreFromTrash moves the trash entry of subDir deleted in pvcNamespace which expires last to volumePath,
+// it's no op if volumePath is not empty since the entry was restored on previous attempt
+func restoreFromTrash(ctx context.Context, sharePath, subDir, pvcNamespace, volumePath string) error {
+	logger := klog.FromContext(ctx)
+	if entries, err := os.ReadDir(volumePath); err == nil && len(entries) > 0 {
+		logger.V(2).Info("subdirectory is not empty, it may have been restored from trash already", "path", volumePath)
+		return nil
+	}
+	trashPath := filepath.Join(sharePath, trashDirName)
+	entries, err := os.ReadDir(trashPath)
+	if err != nil && !os.IsNotExist(err) {
+		return status.Errorf(codes.Internal, "failed to read trash directory %s: %v", trashPath, err)
+	}
+	name := getTrashName(subDir)
+	var latest string
+	var latestEntry *trashEntry
+	var denied bool
+	for _, e := range entries {
+		entry, err := parseTrashEntryName(e.Name())
+		if err != nil || entry.name != name {
+			continue
+		}
+		// entries of other namespaces or unknown pvc are never restored, so pvc could not read data of other tenants
+		if pvcNamespace == "" || entry.pvcNamespace != pvcNamespace {
+			denied = true
+			continue
+		}
+		if latestEntry == nil || entry.expiry.After(latestEntry.expiry) {
+			latest, latestEntry = e.Name(), entry
+		}
+	}
+	if latestEntry == nil {
+		if denied {
+			return status.Errorf(codes.PermissionDenied, "subdirectory %s in trash is not deleted from namespace %s", subDir, pvcNamespace)
+		}
+		return status.Errorf(codes.NotFound, "subdirectory %s is not found in trash, it may have been purged", subDir)
+	}
+	// volumePath is an empty directory if it's created on previous attempt
+	_ = os.Remove(volumePath)
+	if err := os.MkdirAll(filepath.Dir(volumePath), 0777); err != nil {
+		return status.Errorf(codes.Internal, "failed to make parent directory of %s: %v", volumePath, err)
+	}
+	logger.V(2).Info("restoring subdirectory from trash", "path", volumePath, "trashEntry", latest, "pvcUID", latestEntry.pvcUID)
+	if err := os.Rename(filepath.Join(trashPath, latest), volumePath); err != nil {
+		return status.Errorf(codes.Internal, "failed to restore %s from trash: %v", subDir, err)
+	}
+	return nil
+}
+
+// getUndeleteSource returns the subDir in undelete annotation of the pvc in parameters and namespace of the pvc, empty
+// strings are returned if pvc is unknown(e.g. --extra-create-metadata is not set on csi-provisioner) or kube client is not created
+func (n *Driver) getUndeleteSource(ctx context.Context, parameters map[string]string) (string, string, error) {
+	if n.kubeClient == nil {
+		return "", "", nil
+	}
+	var namespace, name string
+	for k, v := range parameters {
+		switch strings.ToLower(k) {
+		case pvcNamespaceKey:
+			namespace = v
+		case pvcNameKey:
+			name = v
+		}
+	}
+	if namespace == "" || name == "" {
+		return "", "", nil
+	}
+	pvc, err := n.kubeClient.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get pvc %s/%s: %v", namespace, name, err)
+	}
+	return pvc.Annotations[undeleteFromAnnotation], namespace, nil
+}
+
+// getTrashShares returns shares of storage classes with retainFor
+func getTrashShares(ctx context.Context, driverName string, storageClasses []storagev1.StorageClass) []orphanGCShare {
+	var filtered []storagev1.StorageClass
+	for _, sc := range storageClasses {
+		for k, v := range sc.Parameters {
+			if strings.ToLower(k) == paramRetainFor && v != "" {
+				filtered = append(filtered, sc)
+				break
+			}
+		}
+	}
+	return getOrphanGCShares(ctx, driverName, filtered)
+}
+
+// runTrashPurge removes expired trash entries on shares of storage classes with retainFor periodically
+func (cs *ControllerServer) runTrashPurge(ctx context.Context, lister orphanGCLister, interval time.Duration) {
+	logger := klog.FromContext(ctx).WithName("trash-purge")
+	ctx = klog.NewContext(ctx, logger)
+	logger.V(2).Info("starting trash purge", "interval", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := cs.purgeTrash(ctx, lister, time.Now()); err != nil {
+				logger.Error(err, "trash purge failed")
+			}
+		}
+	}
+}
+
+func (cs *ControllerServer) purgeTrash(ctx context.Context, lister orphanGCLister, now time.Time) error {
+	storageClasses, err := lister.listStorageClasses(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list storage classes: %v", err)
+	}
+	for _, share := range getTrashShares(ctx, cs.Driver.name, storageClasses) {
+		retained, err := cs.purgeTrashOnShare(ctx, share, now)
+		if err != nil {
+			klog.FromContext(ctx).Error(err, "failed to purge trash", "server", share.server, "share", share.baseDir)
+			continue
+		}
+		trashedVolumes.WithLabelValues(share.server, share.baseDir).Set(float64(retained))
+	}
+	return nil
+}
+
+// purgeTrashOnShare removes trash entries expired before now, returns number of retained entries
+func (cs *ControllerServer) purgeTrashOnShare(ctx context.Context, share orphanGCShare, now time.Time) (int, error) {
+	var volCap *csi.VolumeCapability
+	if len(share.mountOptions) > 0 {
+		volCap = &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{
+					MountFlags: share.mountOptions,
+				},
+			},
+		}
+	}
+	shareVol := &nfsVolume{
+		server:  share.server,
+		baseDir: share.baseDir,
+	}
+	shareVol.id = getVolumeIDFromNfsVol(shareVol)
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(shareVol.id))
+	shareVol.uuid = fmt.Sprintf("trash-purge-%x", h.Sum32())
+	logger := klog.FromContext(ctx).WithValues("server", share.server, "share", share.baseDir)
+
+	if err := cs.internalMount(ctx, shareVol, nil, volCap); err != nil {
+		return 0, fmt.Errorf("failed to mount nfs server: %v", err)
+	}
+	defer func() {
+		if err := cs.internalUnmount(ctx, shareVol); err != nil {
+			logger.Info("failed to unmount nfs server after trash purge", "err", err)
+		}
+	}()
+
+	trashPath := filepath.Join(getInternalMountPath(cs.Driver.workingMountDir, shareVol), trashDirName)
+	entries, err := os.ReadDir(trashPath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read directory %s: %v", trashPath, err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	retained := 0
+	for _, name := range names {
+		entry, err := parseTrashEntryName(name)
+		if err != nil {
+			logger.Info("skip invalid entry in trash", "err", err)
+			continue
+		}
+		if now.Before(entry.expiry) {
+			retained++
+			continue
+		}
+		logger.V(2).Info("removing expired trash entry", "trashEntry", name, "expiry", entry.expiry)
+		if err := os.RemoveAll(filepath.Join(trashPath, name)); err != nil {
+			logger.Error(err, "failed to remove trash entry", "trashEntry", name)
+			retained++
+		}
+	}
+	return retained, nil
+}
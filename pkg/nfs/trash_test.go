@@ -0,0 +1,209 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseTrashEntryName(t *testing.T) {
+	expiry := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)
+	cases := []struct {
+		desc      string
+		entry     string
+		expected  *trashEntry
+		expectErr bool
+	}{
+		{
+			desc:     "valid entry",
+			entry:    getTrashEntryName("pvc-1", "ns", "uid-1", expiry),
+			expected: &trashEntry{name: "pvc-1", pvcNamespace: "ns", pvcUID: "uid-1", expiry: expiry},
+		},
+		{
+			desc:     "subDir with slash",
+			entry:    getTrashEntryName("/ns/pvc-1/", "ns", "uid-1", expiry),
+			expected: &trashEntry{name: "ns_pvc-1", pvcNamespace: "ns", pvcUID: "uid-1", expiry: expiry},
+		},
+		{
+			desc:     "subDir with separator",
+			entry:    getTrashEntryName("pvc@1", "ns", "uid-1", expiry),
+			expected: &trashEntry{name: "pvc@1", pvcNamespace: "ns", pvcUID: "uid-1", expiry: expiry},
+		},
+		{
+			desc:     "unknown pvc",
+			entry:    getTrashEntryName("pvc-1", "", "", expiry),
+			expected: &trashEntry{name: "pvc-1", expiry: expiry},
+		},
+		{
+			desc:     "entry without pvc",
+			entry:    "pvc-1@20230102T150405Z",
+			expected: &trashEntry{name: "pvc-1", expiry: expiry},
+		},
+		{
+			desc:      "no expiry",
+			entry:     "pvc-1",
+			expectErr: true,
+		},
+		{
+			desc:      "invalid expiry",
+			entry:     "pvc-1@yesterday",
+			expectErr: true,
+		},
+	}
+	for _, test := range cases {
+		t.Run(test.desc, func(t *testing.T) {
+			entry, err := parseTrashEntryName(test.entry)
+			if (err != nil) != test.expectErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err == nil && !reflect.DeepEqual(entry, test.expected) {
+				t.Errorf("got %+v, expected %+v", entry, test.expected)
+			}
+		})
+	}
+}
+
+func TestMoveToTrashAndRestore(t *testing.T) {
+	sharePath := t.TempDir()
+	volumePath := filepath.Join(sharePath, "pvc-1")
+	if err := os.MkdirAll(volumePath, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(volumePath, "data"), []byte("data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)
+	if err := moveToTrash(context.TODO(), sharePath, volumePath, "pvc-1", "ns", "uid-1", "72h", now); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entryPath := filepath.Join(sharePath, trashDirName, "pvc-1@ns@uid-1@20230105T150405Z")
+	if _, err := os.Stat(filepath.Join(entryPath, "data")); err != nil {
+		t.Errorf("volume is not moved to trash: %v", err)
+	}
+	// retry after subdirectory is moved
+	if err := moveToTrash(context.TODO(), sharePath, volumePath, "pvc-1", "ns", "uid-1", "72h", now); err != nil {
+		t.Errorf("unexpected error on retry: %v", err)
+	}
+
+	// empty subdirectory created on previous attempt is replaced
+	restoredPath := filepath.Join(sharePath, "pvc-2")
+	if err := os.MkdirAll(restoredPath, 0777); err != nil {
+		t.Fatal(err)
+	}
+	// pvc in other namespace could not restore the entry
+	err := restoreFromTrash(context.TODO(), sharePath, "pvc-1", "other", restoredPath)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("got %v, expected PermissionDenied", err)
+	}
+	err = restoreFromTrash(context.TODO(), sharePath, "pvc-1", "", restoredPath)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("got %v, expected PermissionDenied for unknown namespace", err)
+	}
+	if err := restoreFromTrash(context.TODO(), sharePath, "pvc-1", "ns", restoredPath); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(restoredPath, "data")); err != nil {
+		t.Errorf("volume is not restored from trash: %v", err)
+	}
+	// retry after the entry is restored
+	if err := restoreFromTrash(context.TODO(), sharePath, "pvc-1", "ns", restoredPath); err != nil {
+		t.Errorf("unexpected error on retry: %v", err)
+	}
+	err = restoreFromTrash(context.TODO(), sharePath, "pvc-1", "ns", filepath.Join(sharePath, "pvc-3"))
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("got %v, expected NotFound", err)
+	}
+}
+
+func TestDeleteVolumeWithRetainFor(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.workingMountDir = t.TempDir()
+	volumeID := fmt.Sprintf("%s#%s#pvc-1###retainFor=72h", testServer, testBaseDir)
+	if err := os.MkdirAll(filepath.Join(cs.Driver.workingMountDir, "pvc-1", "pvc-1"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.DeleteVolume(context.TODO(), &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Join(cs.Driver.workingMountDir, "pvc-1", trashDirName))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("got %v %v in trash, expected one entry", entries, err)
+	}
+	if entry, err := parseTrashEntryName(entries[0].Name()); err != nil || entry.name != "pvc-1" || time.Until(entry.expiry) < 71*time.Hour {
+		t.Errorf("unexpected trash entry %s", entries[0].Name())
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.name = DefaultDriverName
+	cs.Driver.workingMountDir = t.TempDir()
+	lister := &fakeKubeResourceClient{
+		storageClasses: []storagev1.StorageClass{
+			{
+				ObjectMeta:  metav1.ObjectMeta{Name: "nfs-retain"},
+				Provisioner: DefaultDriverName,
+				Parameters:  map[string]string{"server": testServer, "share": testBaseDir, "retainFor": "72h"},
+			},
+			{
+				ObjectMeta:  metav1.ObjectMeta{Name: "nfs"},
+				Provisioner: DefaultDriverName,
+				Parameters:  map[string]string{"server": testServer, "share": "other"},
+			},
+		},
+	}
+
+	shareVol := &nfsVolume{server: testServer, baseDir: testBaseDir}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(getVolumeIDFromNfsVol(shareVol)))
+	trashPath := filepath.Join(cs.Driver.workingMountDir, fmt.Sprintf("trash-purge-%x", h.Sum32()), trashDirName)
+	now := time.Now()
+	expired := getTrashEntryName("pvc-expired", "ns", "uid-1", now.Add(-time.Hour))
+	retained := getTrashEntryName("pvc-retained", "ns", "uid-2", now.Add(time.Hour))
+	for _, dir := range []string{expired, retained, "unknown"} {
+		if err := os.MkdirAll(filepath.Join(trashPath, dir), 0755); err != nil {
+			t.Fatalf("failed to create %s: %v", dir, err)
+		}
+	}
+
+	if err := cs.purgeTrash(context.TODO(), lister, now); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for dir, expectExist := range map[string]bool{
+		expired:   false,
+		retained:  true,
+		"unknown": true,
+	} {
+		_, err := os.Stat(filepath.Join(trashPath, dir))
+		if exist := err == nil; exist != expectExist {
+			t.Errorf("unexpected existence %v of %s, expected %v", exist, dir, expectExist)
+		}
+	}
+}
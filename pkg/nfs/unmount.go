@@ -0,0 +1,76 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+// defaultUnmountTimeout is the time to wait for umount before falling back to umount -f
+const defaultUnmountTimeout = 30 * time.Second
+
+// lazyUnmount detaches the mount point even if it's busy or the nfs server is unreachable,
+// could be replaced in unit tests
+var lazyUnmount = func(target string) error {
+	if out, err := exec.Command("umount", "-l", target).CombinedOutput(); err != nil {
+		return fmt.Errorf("umount -l %s failed: %v, output: %s", target, err, string(out))
+	}
+	return nil
+}
+
+// cleanupMountWithFallback unmounts target and removes the directory. umount is retried with -f after timeout,
+// if it still fails after timeout or hangs, e.g. stat on the mount point blocks since nfs server is down, target is
+// lazily unmounted. Errors returned before timeout, e.g. the mount point is busy, are returned as is since lazy unmount
+// would hide the mount from processes still using it.
+func cleanupMountWithFallback(ctx context.Context, target string, mounter mount.MounterForceUnmounter, extensiveMountPointCheck bool, timeout time.Duration) error {
+	errCh := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		errCh <- mount.CleanupMountWithForce(target, mounter, extensiveMountPointCheck, timeout)
+	}()
+
+	var err error
+	// umount -f is issued after timeout, wait for another timeout before falling back to lazy unmount
+	select {
+	case err = <-errCh:
+		if err == nil {
+			return nil
+		}
+		if elapsed := time.Since(start); elapsed < timeout {
+			return err
+		}
+	case <-time.After(2 * timeout):
+		err = fmt.Errorf("timed out after %v", 2*timeout)
+	}
+
+	klog.FromContext(ctx).Info("failed to unmount, falling back to lazy unmount", "target", target, "err", err)
+	if err := lazyUnmount(target); err != nil {
+		return err
+	}
+	// mount point is detached, the directory could be removed without touching nfs server
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	mount "k8s.io/mount-utils"
+)
+
+// fakeForceUnmounter is a mount.MounterForceUnmounter with configurable UnmountWithForce behavior
+type fakeForceUnmounter struct {
+	*mount.FakeMounter
+	unmountErr error
+	hang       chan struct{}
+	delay      time.Duration
+}
+
+func (f *fakeForceUnmounter) UnmountWithForce(target string, umountTimeout time.Duration) error {
+	if f.hang != nil {
+		<-f.hang
+	}
+	time.Sleep(f.delay)
+	if f.unmountErr != nil {
+		return f.unmountErr
+	}
+	return f.Unmount(target)
+}
+
+func TestCleanupMountWithFallback(t *testing.T) {
+	tests := []struct {
+		desc              string
+		unmountErr        error
+		hang              bool
+		delay             time.Duration
+		lazyUnmountErr    error
+		expectLazyUnmount bool
+		expectedErr       error
+	}{
+		{
+			desc: "unmount succeeded",
+		},
+		{
+			desc:        "unmount failed",
+			unmountErr:  fmt.Errorf("device is busy"),
+			expectedErr: fmt.Errorf("device is busy"),
+		},
+		{
+			desc:              "force unmount failed after timeout",
+			unmountErr:        fmt.Errorf("device is busy"),
+			delay:             15 * time.Millisecond,
+			expectLazyUnmount: true,
+		},
+		{
+			desc:              "unmount hung",
+			hang:              true,
+			expectLazyUnmount: true,
+		},
+		{
+			desc:              "lazy unmount failed",
+			hang:              true,
+			lazyUnmountErr:    fmt.Errorf("umount -l failed"),
+			expectLazyUnmount: true,
+			expectedErr:       fmt.Errorf("umount -l failed"),
+		},
+	}
+
+	origLazyUnmount := lazyUnmount
+	defer func() { lazyUnmount = origLazyUnmount }()
+	for _, test := range tests {
+		target := filepath.Join(t.TempDir(), "target")
+		if err := os.MkdirAll(target, 0755); err != nil {
+			t.Fatal(err)
+		}
+		mounter := &fakeForceUnmounter{
+			FakeMounter: mount.NewFakeMounter([]mount.MountPoint{{Device: "server:/share", Path: target, Type: "nfs"}}),
+			unmountErr:  test.unmountErr,
+			delay:       test.delay,
+		}
+		if test.hang {
+			mounter.hang = make(chan struct{})
+		}
+		lazyUnmounted := false
+		lazyUnmount = func(target string) error {
+			lazyUnmounted = true
+			return test.lazyUnmountErr
+		}
+
+		err := cleanupMountWithFallback(context.TODO(), target, mounter, true, 10*time.Millisecond)
+		if mounter.hang != nil {
+			close(mounter.hang)
+		}
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		assert.Equal(t, test.expectLazyUnmount, lazyUnmounted, test.desc)
+		if test.expectedErr == nil && test.expectLazyUnmount {
+			_, err := os.Stat(target)
+			assert.True(t, os.IsNotExist(err), test.desc)
+		}
+	}
+}
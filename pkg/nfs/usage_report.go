@@ -0,0 +1,375 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DefaultUsageReportMaxFilesPerSecond is the max number of files stat on nfs servers per second by usage report
+	DefaultUsageReportMaxFilesPerSecond = 1000
+	// key of the report in usage report ConfigMap
+	usageReportConfigMapKey = "usage.json"
+	// max bytes of the report in usage report ConfigMap, it's below the 1MiB limit of ConfigMap to leave room for metadata
+	usageReportMaxBytes = 900 * 1024
+)
+
+var (
+	volumeUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "volume_used_bytes",
+		Help:      "Bytes used by the subdirectory of persistent volume on nfs server computed by the last usage report",
+	}, []string{"namespace", "persistentvolumeclaim", "persistentvolume"})
+	namespaceUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "namespace_used_bytes",
+		Help:      "Bytes used by persistent volumes of the namespace on nfs servers computed by the last usage report",
+	}, []string{"namespace"})
+	usageReportTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "usage_report_timestamp_seconds",
+		Help:      "Unix time when the last usage report finished",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(volumeUsedBytes, namespaceUsedBytes, usageReportTimestamp)
+}
+
+// usageReporter lists persistent volumes and writes usage report to ConfigMap, it could be replaced in unit tests
+type usageReporter interface {
+	listPersistentVolumes(ctx context.Context) ([]v1.PersistentVolume, error)
+	updateConfigMap(ctx context.Context, namespace, name string, data map[string]string) error
+}
+
+// updateConfigMap creates the ConfigMap or replaces its data
+func (c *kubeResourceClient) updateConfigMap(ctx context.Context, namespace, name string, data map[string]string) error {
+	cm, err := c.client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}, Data: data}
+		_, err = c.client.CoreV1().ConfigMaps(namespace).Create(ctx, cm, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	cm.Data = data
+	_, err = c.client.CoreV1().ConfigMaps(namespace).Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
+
+// usageReport is written to the ConfigMap of usage report in json
+type usageReport struct {
+	GenerationTime time.Time        `json:"generationTime"`
+	Namespaces     []namespaceUsage `json:"namespaces"`
+	// number of reported volumes, volumes could be truncated while namespaces always count all of them
+	TotalVolumes int `json:"totalVolumes"`
+	// volumes using the most bytes are kept when the report exceeds usageReportMaxBytes
+	Truncated bool          `json:"truncated,omitempty"`
+	Volumes   []volumeUsage `json:"volumes"`
+}
+
+type namespaceUsage struct {
+	Namespace string `json:"namespace"`
+	UsedBytes int64  `json:"usedBytes"`
+	Volumes   int    `json:"volumes"`
+}
+
+type volumeUsage struct {
+	PersistentVolume      string `json:"persistentVolume"`
+	Namespace             string `json:"namespace,omitempty"`
+	PersistentVolumeClaim string `json:"persistentVolumeClaim,omitempty"`
+	Server                string `json:"server"`
+	Share                 string `json:"share"`
+	SubDir                string `json:"subDir"`
+	UsedBytes             int64  `json:"usedBytes"`
+}
+
+// usageVolume is a persistent volume whose subdirectory is walked by usage report
+type usageVolume struct {
+	vol          *nfsVolume
+	pvName       string
+	namespace    string
+	pvcName      string
+	mountOptions []string
+}
+
+// fileID identifies hard links of the same file, so they are counted once
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// getUsageVolumes returns persistent volumes of the driver with subdirectory, grouped by share
+func getUsageVolumes(driverName string, pvs []v1.PersistentVolume) map[string][]usageVolume {
+	shares := map[string][]usageVolume{}
+	for _, pv := range pvs {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName {
+			continue
+		}
+		vol, err := getNfsVolFromID(pv.Spec.CSI.VolumeHandle)
+		if err != nil || vol.subDir == "" {
+			continue
+		}
+		v := usageVolume{vol: vol, pvName: pv.Name, mountOptions: pv.Spec.MountOptions}
+		if ref := pv.Spec.ClaimRef; ref != nil {
+			v.namespace, v.pvcName = ref.Namespace, ref.Name
+		}
+		key := strings.Trim(vol.server, "/") + separator + strings.Trim(vol.baseDir, "/")
+		shares[key] = append(shares[key], v)
+	}
+	for _, vols := range shares {
+		sort.Slice(vols, func(i, j int) bool { return vols[i].pvName < vols[j].pvName })
+	}
+	return shares
+}
+
+// getDirUsage returns bytes allocated by files under root like du, stat of files is limited by limiter
+func getDirUsage(ctx context.Context, root string, limiter *rate.Limiter) (int64, error) {
+	var used int64
+	seen := map[fileID]bool{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// files could be removed by the workload while walking
+			if os.IsNotExist(err) && path != root {
+				return nil
+			}
+			return err
+		}
+		if limiter != nil {
+			if err := limiter.Wait(ctx); err != nil {
+				return err
+			}
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		bytes, id, linked := getFileDiskUsage(info)
+		if linked {
+			if seen[id] {
+				return nil
+			}
+			seen[id] = true
+		}
+		used += bytes
+		return nil
+	})
+	return used, err
+}
+
+// runUsageReport computes used bytes of persistent volumes and namespaces on start and every interval until ctx is done
+func (cs *ControllerServer) runUsageReport(ctx context.Context, reporter usageReporter, interval time.Duration) {
+	logger := klog.FromContext(ctx).WithName("usage-report")
+	ctx = klog.NewContext(ctx, logger)
+	logger.V(2).Info("starting usage report", "interval", interval, "maxFilesPerSecond", cs.Driver.usageReportMaxFilesPerSecond, "configMap", cs.Driver.usageReportConfigMap)
+	var limiter *rate.Limiter
+	if cs.Driver.usageReportMaxFilesPerSecond > 0 {
+		limiter = rate.NewLimiter(rate.Limit(cs.Driver.usageReportMaxFilesPerSecond), cs.Driver.usageReportMaxFilesPerSecond)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := cs.reportUsage(ctx, reporter, limiter); err != nil {
+			logger.Error(err, "usage report failed")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reportUsage walks subdirectories of persistent volumes, volumes which could not be walked are logged and left out of the report
+func (cs *ControllerServer) reportUsage(ctx context.Context, reporter usageReporter, limiter *rate.Limiter) error {
+	logger := klog.FromContext(ctx)
+	start := time.Now()
+	pvs, err := reporter.listPersistentVolumes(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list persistent volumes: %v", err)
+	}
+	shares := getUsageVolumes(cs.Driver.name, pvs)
+	keys := make([]string, 0, len(shares))
+	for k := range shares {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	report := &usageReport{}
+	for _, key := range keys {
+		volumes, err := cs.getShareUsage(ctx, shares[key], limiter)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			share := shares[key][0].vol
+			logger.Error(err, "failed to report usage of volumes", "server", share.server, "share", share.baseDir)
+			continue
+		}
+		report.Volumes = append(report.Volumes, volumes...)
+	}
+	report.GenerationTime = time.Now().UTC()
+
+	byNamespace := map[string]*namespaceUsage{}
+	volumeUsedBytes.Reset()
+	for _, v := range report.Volumes {
+		volumeUsedBytes.WithLabelValues(v.Namespace, v.PersistentVolumeClaim, v.PersistentVolume).Set(float64(v.UsedBytes))
+		if v.Namespace == "" {
+			continue
+		}
+		if byNamespace[v.Namespace] == nil {
+			byNamespace[v.Namespace] = &namespaceUsage{Namespace: v.Namespace}
+		}
+		byNamespace[v.Namespace].UsedBytes += v.UsedBytes
+		byNamespace[v.Namespace].Volumes++
+	}
+	namespaceUsedBytes.Reset()
+	for _, n := range byNamespace {
+		namespaceUsedBytes.WithLabelValues(n.Namespace).Set(float64(n.UsedBytes))
+		report.Namespaces = append(report.Namespaces, *n)
+	}
+	sort.Slice(report.Namespaces, func(i, j int) bool { return report.Namespaces[i].Namespace < report.Namespaces[j].Namespace })
+	report.TotalVolumes = len(report.Volumes)
+	usageReportTimestamp.Set(float64(report.GenerationTime.Unix()))
+	logger.V(2).Info("usage report finished", "volumes", len(report.Volumes), "namespaces", len(report.Namespaces), "duration", time.Since(start))
+
+	if cs.Driver.usageReportConfigMap == "" {
+		return nil
+	}
+	data, err := marshalUsageReport(report, usageReportMaxBytes)
+	if err != nil {
+		return err
+	}
+	if report.Truncated {
+		logger.Info("usage report exceeds max bytes, only volumes using the most bytes are written to configmap", "maxBytes", usageReportMaxBytes, "writtenVolumes", len(report.Volumes), "totalVolumes", report.TotalVolumes, "configMap", cs.Driver.usageReportConfigMap)
+	}
+	namespace := getLeaderElectionNamespace(cs.Driver.leaderElectionNamespace)
+	if err := reporter.updateConfigMap(ctx, namespace, cs.Driver.usageReportConfigMap, map[string]string{usageReportConfigMapKey: string(data)}); err != nil {
+		return fmt.Errorf("failed to update configmap %s/%s: %v", namespace, cs.Driver.usageReportConfigMap, err)
+	}
+	return nil
+}
+
+// marshalUsageReport returns the report in json, if it exceeds maxBytes, volumes of report are truncated to those using
+// the most bytes which fit in maxBytes and report is marked as truncated
+func marshalUsageReport(report *usageReport, maxBytes int) ([]byte, error) {
+	data, err := json.Marshal(report)
+	if err != nil || len(data) <= maxBytes {
+		return data, err
+	}
+	volumes := make([]volumeUsage, len(report.Volumes))
+	copy(volumes, report.Volumes)
+	sort.SliceStable(volumes, func(i, j int) bool { return volumes[i].UsedBytes > volumes[j].UsedBytes })
+	report.Truncated = true
+	// find the max number of volumes which fit in maxBytes
+	var fit []byte
+	low, high := 0, len(volumes)-1
+	for low <= high {
+		mid := (low + high) / 2
+		report.Volumes = volumes[:mid]
+		if data, err = json.Marshal(report); err != nil {
+			return nil, err
+		}
+		if len(data) <= maxBytes {
+			fit = data
+			low = mid + 1
+		} else {
+			high = mid - 1
+		}
+	}
+	if fit == nil {
+		return nil, fmt.Errorf("usage report of %d namespaces exceeds %d bytes", len(report.Namespaces), maxBytes)
+	}
+	report.Volumes = volumes[:high]
+	return fit, nil
+}
+
+// getShareUsage mounts the share of volumes and returns used bytes of their subdirectories
+func (cs *ControllerServer) getShareUsage(ctx context.Context, volumes []usageVolume, limiter *rate.Limiter) ([]volumeUsage, error) {
+	shareVol := &nfsVolume{
+		server:  volumes[0].vol.server,
+		baseDir: volumes[0].vol.baseDir,
+	}
+	shareVol.id = getVolumeIDFromNfsVol(shareVol)
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(shareVol.id))
+	shareVol.uuid = fmt.Sprintf("usage-report-%x", h.Sum32())
+	logger := klog.FromContext(ctx).WithValues("server", shareVol.server, "share", shareVol.baseDir)
+	var volCap *csi.VolumeCapability
+	if len(volumes[0].mountOptions) > 0 {
+		volCap = &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{
+					MountFlags: volumes[0].mountOptions,
+				},
+			},
+		}
+	}
+	if err := cs.internalMount(ctx, shareVol, nil, volCap); err != nil {
+		return nil, fmt.Errorf("failed to mount nfs server: %v", err)
+	}
+	defer func() {
+		if err := cs.internalUnmount(ctx, shareVol); err != nil {
+			logger.Info("failed to unmount nfs server after usage report", "err", err)
+		}
+	}()
+
+	sharePath := getInternalMountPath(cs.Driver.workingMountDir, shareVol)
+	var result []volumeUsage
+	for _, v := range volumes {
+		used, err := getDirUsage(ctx, filepath.Join(sharePath, v.vol.subDir), limiter)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			logger.Info("failed to get usage of volume", "pv", v.pvName, "subDir", v.vol.subDir, "err", err)
+			continue
+		}
+		result = append(result, volumeUsage{
+			PersistentVolume:      v.pvName,
+			Namespace:             v.namespace,
+			PersistentVolumeClaim: v.pvcName,
+			Server:                v.vol.server,
+			Share:                 v.vol.baseDir,
+			SubDir:                v.vol.subDir,
+			UsedBytes:             used,
+		})
+	}
+	return result, nil
+}
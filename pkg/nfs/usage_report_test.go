@@ -0,0 +1,141 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+)
+
+type fakeUsageReporter struct {
+	pvs        []v1.PersistentVolume
+	configMaps map[string]map[string]string
+}
+
+func (r *fakeUsageReporter) listPersistentVolumes(ctx context.Context) ([]v1.PersistentVolume, error) {
+	return r.pvs, nil
+}
+
+func (r *fakeUsageReporter) updateConfigMap(ctx context.Context, namespace, name string, data map[string]string) error {
+	r.configMaps[namespace+"/"+name] = data
+	return nil
+}
+
+func TestReportUsage(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.name = DefaultDriverName
+	cs.Driver.workingMountDir = t.TempDir()
+	cs.Driver.usageReportConfigMap = "nfs-usage"
+	cs.Driver.leaderElectionNamespace = "kube-system"
+	reporter := &fakeUsageReporter{
+		pvs: []v1.PersistentVolume{
+			newTestPV("pvc-1", fmt.Sprintf("%s#%s#pvc-1##", testServer, testBaseDir), withClaimRef("team-a", "data")),
+			newTestPV("pvc-2", fmt.Sprintf("%s#%s#pvc-2##", testServer, testBaseDir), withClaimRef("team-a", "logs")),
+			newTestPV("pvc-3", fmt.Sprintf("%s#%s#pvc-3##", testServer, testBaseDir), withClaimRef("team-b", "data")),
+			// subdirectory of the volume does not exist
+			newTestPV("pvc-missing", fmt.Sprintf("%s#%s#pvc-missing##", testServer, testBaseDir), withClaimRef("team-b", "missing")),
+			// volume of the whole share is not reported
+			newTestPV("pv-share", fmt.Sprintf("%s#%s##", testServer, testBaseDir), withClaimRef("team-b", "share")),
+			newTestPV("pvc-other", fmt.Sprintf("%s#%s#pvc-other##", testServer, testBaseDir), withDriver("other.csi.k8s.io")),
+		},
+		configMaps: map[string]map[string]string{},
+	}
+
+	shareVol := &nfsVolume{server: testServer, baseDir: testBaseDir}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(getVolumeIDFromNfsVol(shareVol)))
+	sharePath := filepath.Join(cs.Driver.workingMountDir, fmt.Sprintf("usage-report-%x", h.Sum32()))
+	data := make([]byte, 64*1024)
+	for _, subDir := range []string{"pvc-1", "pvc-2", "pvc-3"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(sharePath, subDir, "dir"), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(sharePath, subDir, "dir", "file"), data, 0644))
+	}
+	if runtime.GOOS != "windows" {
+		// hard link is counted once
+		assert.NoError(t, os.Link(filepath.Join(sharePath, "pvc-2", "dir", "file"), filepath.Join(sharePath, "pvc-2", "link")))
+	}
+
+	assert.NoError(t, cs.reportUsage(context.TODO(), reporter, nil))
+	used, err := getDirUsage(context.TODO(), filepath.Join(sharePath, "pvc-1"), nil)
+	assert.NoError(t, err)
+	assert.True(t, used >= int64(len(data)), "used bytes %d should include the file", used)
+
+	report := &usageReport{}
+	assert.NoError(t, json.Unmarshal([]byte(reporter.configMaps["kube-system/nfs-usage"][usageReportConfigMapKey]), report))
+	assert.Equal(t, []namespaceUsage{
+		{Namespace: "team-a", UsedBytes: 2 * used, Volumes: 2},
+		{Namespace: "team-b", UsedBytes: used, Volumes: 1},
+	}, report.Namespaces)
+	assert.Equal(t, []volumeUsage{
+		{PersistentVolume: "pvc-1", Namespace: "team-a", PersistentVolumeClaim: "data", Server: testServer, Share: testBaseDir, SubDir: "pvc-1", UsedBytes: used},
+		{PersistentVolume: "pvc-2", Namespace: "team-a", PersistentVolumeClaim: "logs", Server: testServer, Share: testBaseDir, SubDir: "pvc-2", UsedBytes: used},
+		{PersistentVolume: "pvc-3", Namespace: "team-b", PersistentVolumeClaim: "data", Server: testServer, Share: testBaseDir, SubDir: "pvc-3", UsedBytes: used},
+	}, report.Volumes)
+	assert.Equal(t, float64(2*used), testutil.ToFloat64(namespaceUsedBytes.WithLabelValues("team-a")))
+	assert.Equal(t, float64(used), testutil.ToFloat64(volumeUsedBytes.WithLabelValues("team-b", "data", "pvc-3")))
+
+	// metrics of deleted volumes are removed
+	reporter.pvs = reporter.pvs[:1]
+	assert.NoError(t, cs.reportUsage(context.TODO(), reporter, nil))
+	assert.NoError(t, json.Unmarshal([]byte(reporter.configMaps["kube-system/nfs-usage"][usageReportConfigMapKey]), report))
+	assert.Len(t, report.Volumes, 1)
+	assert.Equal(t, 1, testutil.CollectAndCount(namespaceUsedBytes))
+}
+
+func TestMarshalUsageReport(t *testing.T) {
+	report := &usageReport{
+		Namespaces:   []namespaceUsage{{Namespace: "team-a", UsedBytes: 60, Volumes: 3}},
+		TotalVolumes: 3,
+		Volumes: []volumeUsage{
+			{PersistentVolume: "pvc-1", Namespace: "team-a", UsedBytes: 10},
+			{PersistentVolume: "pvc-2", Namespace: "team-a", UsedBytes: 30},
+			{PersistentVolume: "pvc-3", Namespace: "team-a", UsedBytes: 20},
+		},
+	}
+	full, err := json.Marshal(report)
+	assert.NoError(t, err)
+	data, err := marshalUsageReport(report, len(full))
+	assert.NoError(t, err)
+	assert.Equal(t, full, data)
+	assert.False(t, report.Truncated)
+
+	// volumes using the most bytes are kept
+	data, err = marshalUsageReport(report, len(full)-1)
+	assert.NoError(t, err)
+	assert.True(t, len(data) < len(full))
+	result := &usageReport{}
+	assert.NoError(t, json.Unmarshal(data, result))
+	assert.True(t, result.Truncated)
+	assert.Equal(t, 3, result.TotalVolumes)
+	assert.Equal(t, report.Namespaces, result.Namespaces)
+	assert.Len(t, result.Volumes, 2)
+	assert.Equal(t, []string{"pvc-2", "pvc-3"}, []string{result.Volumes[0].PersistentVolume, result.Volumes[1].PersistentVolume})
+
+	// namespaces alone exceed max bytes
+	_, err = marshalUsageReport(report, 10)
+	assert.Error(t, err)
+}
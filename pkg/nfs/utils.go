@@ -19,16 +19,24 @@ package nfs
 import (
 	"fmt"
 	"os"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"github.com/pborman/uuid"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/sets"
 
 	"k8s.io/klog/v2"
+	"k8s.io/kubernetes/pkg/volume"
 	netutil "k8s.io/utils/net"
 )
 
@@ -37,6 +45,10 @@ const (
 	delete    = "delete"
 	retain    = "retain"
 	archive   = "archive"
+	// time format of the timestamp suffix in archived sub directory name
+	archiveTimeFormat = "20060102-150405"
+
+	volumeOperationAlreadyExistsFmt = "An operation with the given Volume ID %s already exists"
 )
 
 var supportedOnDeleteValues = []string{"", delete, retain, archive}
@@ -51,6 +63,75 @@ func validateOnDeleteValue(onDelete string) error {
 	return fmt.Errorf("invalid value %s for OnDelete, supported values are %v", onDelete, supportedOnDeleteValues)
 }
 
+// fsGroupChangePolicyNone skips applying fsGroup on the volume
+const fsGroupChangePolicyNone = "None"
+
+var supportedFSGroupChangePolicyList = []string{fsGroupChangePolicyNone, string(v1.FSGroupChangeAlways), string(v1.FSGroupChangeOnRootMismatch)}
+
+func validateFSGroupChangePolicy(policy string) error {
+	if policy == "" {
+		return nil
+	}
+	for _, v := range supportedFSGroupChangePolicyList {
+		if policy == v {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid value %s for fsGroupChangePolicy, supported values are %v", policy, supportedFSGroupChangePolicyList)
+}
+
+// fsType of the mount command, fsType in volume capability is used to select NFSv4 explicitly in mixed v3/v4 environments,
+// mount.nfs negotiates the version with nfs server if it's nfs
+const (
+	fsTypeNFS  = "nfs"
+	fsTypeNFS4 = "nfs4"
+)
+
+var supportedFSTypeList = []string{fsTypeNFS, fsTypeNFS4}
+
+// getFSType returns fsType of the mount command, nfs is returned if fsType is empty
+func getFSType(fsType string) (string, error) {
+	if fsType == "" {
+		return fsTypeNFS, nil
+	}
+	for _, v := range supportedFSTypeList {
+		if fsType == v {
+			return fsType, nil
+		}
+	}
+	return "", fmt.Errorf("invalid fsType %s, supported values are %v", fsType, supportedFSTypeList)
+}
+
+// validateFSTypeMountOptions checks that the protocol version in mount options is supported by fsType
+func validateFSTypeMountOptions(fsType string, mountOptions []string) error {
+	if fsType != fsTypeNFS4 {
+		return nil
+	}
+	for _, key := range []string{"nfsvers", "vers"} {
+		if v := getMountOptionValue(mountOptions, key); v != "" && !strings.HasPrefix(v, "4") {
+			return fmt.Errorf("%s=%s in mount options is not supported by fsType %s", key, v, fsTypeNFS4)
+		}
+	}
+	return nil
+}
+
+// parseOwnerID returns the uid or gid in storage class parameter, -1 is returned if it's empty so ownership is not changed
+func parseOwnerID(name, value string) (int, error) {
+	if value == "" {
+		return -1, nil
+	}
+	id, err := strconv.Atoi(value)
+	if err != nil || id < 0 {
+		return -1, fmt.Errorf("invalid %s %s in storage class, it should be a non-negative integer", name, value)
+	}
+	return id, nil
+}
+
+// isReadOnlyAccessMode returns true if volume could only be mounted as read-only with the access mode
+func isReadOnlyAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY || mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+}
+
 func NewDefaultIdentityServer(d *Driver) *IdentityServer {
 	return &IdentityServer{
 		Driver: d,
@@ -102,20 +183,37 @@ func getLogLevel(method string) int32 {
 	return 2
 }
 
+// logGRPC logs GRPC calls with a generated request id, secrets in request and response are stripped,
+// the request id is also added into the logger of ctx
 func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	level := klog.Level(getLogLevel(info.FullMethod))
-	klog.V(level).Infof("GRPC call: %s", info.FullMethod)
-	klog.V(level).Infof("GRPC request: %s", protosanitizer.StripSecrets(req))
+	level := getLogLevel(info.FullMethod)
+	// logger in context carries request id and volume of the call, so logs of a volume could be correlated across layers
+	logger := klog.FromContext(ctx).WithValues(append([]interface{}{"requestID", uuid.New(), "method", info.FullMethod}, getRequestLogValues(req)...)...)
+	ctx = klog.NewContext(ctx, logger)
+	logger.V(int(level)).Info("GRPC call", "request", protosanitizer.StripSecrets(req))
 
+	start := time.Now()
 	resp, err := handler(ctx, req)
+	latency := time.Since(start)
 	if err != nil {
-		klog.Errorf("GRPC error: %v", err)
+		logger.Error(err, "GRPC error", "latency", latency)
 	} else {
-		klog.V(level).Infof("GRPC response: %s", protosanitizer.StripSecrets(resp))
+		logger.V(int(level)).Info("GRPC response", "response", protosanitizer.StripSecrets(resp), "latency", latency)
 	}
 	return resp, err
 }
 
+// recoverGRPC returns codes.Internal error instead of crashing the driver if handler panics
+func recoverGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			klog.FromContext(ctx).Error(fmt.Errorf("%v", r), "GRPC call panicked", "method", info.FullMethod, "stack", string(debug.Stack()))
+			resp, err = nil, status.Errorf(codes.Internal, "panic in %s: %v", info.FullMethod, r)
+		}
+	}()
+	return handler(ctx, req)
+}
+
 type VolumeLocks struct {
 	locks sets.String //nolint:staticcheck
 	mux   sync.Mutex
@@ -154,20 +252,79 @@ func getMountOptions(context map[string]string) string {
 	return ""
 }
 
+// getServerShareFromSecrets returns server and share in secrets, they override server and share of storage class or volume context
+func getServerShareFromSecrets(secrets map[string]string) (string, string) {
+	var server, share string
+	for k, v := range secrets {
+		switch strings.ToLower(k) {
+		case paramServer:
+			server = v
+		case paramShare:
+			share = v
+		}
+	}
+	return server, share
+}
+
+// conflictingMountOptions are mount options which override each other
+var conflictingMountOptions = map[string]string{
+	"hard":         "soft",
+	"soft":         "hard",
+	"ro":           "rw",
+	"rw":           "ro",
+	"sharecache":   "nosharecache",
+	"nosharecache": "sharecache",
+}
+
+// mountOptionKey returns the key of a mount option, e.g. nfsvers of nfsvers=4.1
+func mountOptionKey(option string) string {
+	key, _, _ := strings.Cut(option, "=")
+	return strings.ToLower(strings.TrimSpace(key))
+}
+
+// mergeMountOptions appends default mount options which are not specified in mountOptions,
+// mountOptions take precedence over defaultMountOptions and duplicated options are removed
+func mergeMountOptions(mountOptions, defaultMountOptions []string) []string {
+	if len(defaultMountOptions) == 0 {
+		return mountOptions
+	}
+	var merged []string
+	specified := sets.NewString() //nolint:staticcheck
+	for _, option := range splitMountOptions(mountOptions) {
+		if !specified.Has(option) {
+			merged = append(merged, option)
+			specified.Insert(option)
+		}
+	}
+	keys := sets.NewString() //nolint:staticcheck
+	for _, option := range merged {
+		keys.Insert(mountOptionKey(option))
+	}
+	for _, option := range splitMountOptions(defaultMountOptions) {
+		key := mountOptionKey(option)
+		if keys.Has(key) || keys.Has(conflictingMountOptions[key]) {
+			continue
+		}
+		merged = append(merged, option)
+		keys.Insert(key)
+	}
+	return merged
+}
+
 // chmodIfPermissionMismatch only perform chmod when permission mismatches
-func chmodIfPermissionMismatch(targetPath string, mode os.FileMode) error {
+func chmodIfPermissionMismatch(ctx context.Context, targetPath string, mode os.FileMode) error {
 	info, err := os.Lstat(targetPath)
 	if err != nil {
 		return err
 	}
 	perm := info.Mode() & os.ModePerm
 	if perm != mode {
-		klog.V(2).Infof("chmod targetPath(%s, mode:0%o) with permissions(0%o)", targetPath, info.Mode(), mode)
+		klog.FromContext(ctx).V(2).Info("chmod targetPath", "targetPath", targetPath, "mode", fmt.Sprintf("0%o", info.Mode()), "permissions", fmt.Sprintf("0%o", mode))
 		if err := os.Chmod(targetPath, mode); err != nil {
 			return err
 		}
 	} else {
-		klog.V(2).Infof("skip chmod on targetPath(%s) since mode is already 0%o)", targetPath, info.Mode())
+		klog.FromContext(ctx).V(2).Info("skip chmod on targetPath since mode is already set", "targetPath", targetPath, "mode", fmt.Sprintf("0%o", info.Mode()))
 	}
 	return nil
 }
@@ -180,6 +337,17 @@ func getServerFromSource(server string) string {
 	return server
 }
 
+// getServerList splits comma separated server addresses, IPv6 address is returned as [IPv6]
+func getServerList(server string) []string {
+	var servers []string
+	for _, s := range strings.Split(server, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			servers = append(servers, getServerFromSource(s))
+		}
+	}
+	return servers
+}
+
 // setKeyValueInMap set key/value pair in map
 // key in the map is case insensitive, if key already exists, overwrite existing value
 func setKeyValueInMap(m map[string]string, key, value string) {
@@ -194,3 +362,39 @@ func setKeyValueInMap(m map[string]string, key, value string) {
 	}
 	m[key] = value
 }
+
+// setVolumeOwnership sets gid on path and its content recursively,
+// policy is one of Always(default) and OnRootMismatch
+func setVolumeOwnership(path, gid, policy string) error {
+	id, err := strconv.ParseInt(gid, 10, 64)
+	if err != nil {
+		return fmt.Errorf("convert %s to int failed with %v", gid, err)
+	}
+	fsGroupChangePolicy := v1.FSGroupChangeAlways
+	if policy != "" {
+		fsGroupChangePolicy = v1.PodFSGroupChangePolicy(policy)
+	}
+	return volume.SetVolumeOwnership(&volumeMounter{path: path}, path, &id, &fsGroupChangePolicy, nil)
+}
+
+// volumeMounter implements volume.Mounter, it's only used by setVolumeOwnership
+type volumeMounter struct {
+	volume.MetricsNil
+	path string
+}
+
+func (l *volumeMounter) GetPath() string {
+	return l.path
+}
+
+func (l *volumeMounter) GetAttributes() volume.Attributes {
+	return volume.Attributes{}
+}
+
+func (l *volumeMounter) SetUp(_ volume.MounterArgs) error {
+	return nil
+}
+
+func (l *volumeMounter) SetUpAt(_ string, _ volume.MounterArgs) error {
+	return nil
+}
@@ -19,9 +19,17 @@ package nfs
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strconv"
 	"strings"
 	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -194,7 +202,7 @@ func TestChmodIfPermissionMismatch(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		err := chmodIfPermissionMismatch(test.path, test.mode)
+		err := chmodIfPermissionMismatch(context.TODO(), test.path, test.mode)
 		if !reflect.DeepEqual(err, test.expectedError) {
 			if err == nil || test.expectedError == nil && !strings.Contains(err.Error(), test.expectedError.Error()) {
 				t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedError)
@@ -248,6 +256,37 @@ func TestGetServerFromSource(t *testing.T) {
 	}
 }
 
+func TestGetServerList(t *testing.T) {
+	tests := []struct {
+		desc   string
+		server string
+		result []string
+	}{
+		{
+			desc:   "empty server",
+			server: "",
+			result: nil,
+		},
+		{
+			desc:   "single server",
+			server: "10.127.0.1",
+			result: []string{"10.127.0.1"},
+		},
+		{
+			desc:   "multiple servers",
+			server: "10.127.0.1, 0:0:0:0:0:0:0:1,,bing.com",
+			result: []string{"10.127.0.1", "[0:0:0:0:0:0:0:1]", "bing.com"},
+		},
+	}
+
+	for _, test := range tests {
+		result := getServerList(test.server)
+		if !reflect.DeepEqual(result, test.result) {
+			t.Errorf("test[%s]: unexpected result: %v, expected: %v", test.desc, result, test.result)
+		}
+	}
+}
+
 func TestSetKeyValueInMap(t *testing.T) {
 	tests := []struct {
 		desc     string
@@ -357,3 +396,196 @@ func TestValidateOnDeleteValue(t *testing.T) {
 		}
 	}
 }
+
+func TestValidateFSGroupChangePolicy(t *testing.T) {
+	tests := []struct {
+		desc     string
+		policy   string
+		expected error
+	}{
+		{
+			desc:     "empty value",
+			policy:   "",
+			expected: nil,
+		},
+		{
+			desc:     "None value",
+			policy:   "None",
+			expected: nil,
+		},
+		{
+			desc:     "Always value",
+			policy:   "Always",
+			expected: nil,
+		},
+		{
+			desc:     "OnRootMismatch value",
+			policy:   "OnRootMismatch",
+			expected: nil,
+		},
+		{
+			desc:     "invalid value",
+			policy:   "onRootMismatch",
+			expected: fmt.Errorf("invalid value %s for fsGroupChangePolicy, supported values are %v", "onRootMismatch", supportedFSGroupChangePolicyList),
+		},
+	}
+
+	for _, test := range tests {
+		result := validateFSGroupChangePolicy(test.policy)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("test[%s]: unexpected output: %v, expected result: %v", test.desc, result, test.expected)
+		}
+	}
+}
+
+func TestParseOwnerID(t *testing.T) {
+	tests := []struct {
+		value     string
+		expected  int
+		expectErr bool
+	}{
+		{value: "", expected: -1},
+		{value: "0", expected: 0},
+		{value: "65534", expected: 65534},
+		{value: "-1", expected: -1, expectErr: true},
+		{value: "nobody", expected: -1, expectErr: true},
+	}
+	for _, test := range tests {
+		id, err := parseOwnerID(paramUID, test.value)
+		if id != test.expected || (err != nil) != test.expectErr {
+			t.Errorf("test[%q]: unexpected id %d, error %v, expected id %d, expected error %v", test.value, id, err, test.expected, test.expectErr)
+		}
+	}
+}
+
+func TestSetVolumeOwnership(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skip on windows")
+	}
+	gid := strconv.Itoa(os.Getgid())
+	tests := []struct {
+		desc        string
+		gid         string
+		policy      string
+		expectedErr bool
+	}{
+		{
+			desc:        "invalid gid",
+			gid:         "abc",
+			expectedErr: true,
+		},
+		{
+			desc: "default policy",
+			gid:  gid,
+		},
+		{
+			desc:   "Always policy",
+			gid:    gid,
+			policy: "Always",
+		},
+		{
+			desc:   "OnRootMismatch policy",
+			gid:    gid,
+			policy: "OnRootMismatch",
+		},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "file"), []byte("file"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		err := setVolumeOwnership(dir, test.gid, test.policy)
+		if (err != nil) != test.expectedErr {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+		if test.expectedErr {
+			continue
+		}
+		fi, err := os.Stat(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode()&os.ModeSetgid == 0 {
+			t.Errorf("test[%s]: setgid is not set on %s, mode: %v", test.desc, dir, fi.Mode())
+		}
+		if _, fileGid, ok := getFileOwner(fi); ok && strconv.Itoa(fileGid) != test.gid {
+			t.Errorf("test[%s]: unexpected gid %d, expected: %s", test.desc, fileGid, test.gid)
+		}
+	}
+}
+
+func TestLogGRPC(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodePublishVolume"}
+	resp, err := logGRPC(context.Background(), "request", info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "response", nil
+	})
+	if resp != "response" || err != nil {
+		t.Errorf("unexpected response %v, error %v", resp, err)
+	}
+
+	expectedErr := status.Error(codes.NotFound, "not found")
+	_, err = logGRPC(context.Background(), "request", info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, expectedErr
+	})
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("unexpected error %v, expected %v", err, expectedErr)
+	}
+}
+
+func TestRecoverGRPC(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodePublishVolume"}
+	resp, err := recoverGRPC(context.Background(), "request", info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("nil pointer")
+	})
+	expectedErr := status.Errorf(codes.Internal, "panic in %s: %v", info.FullMethod, "nil pointer")
+	if resp != nil || !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("unexpected response %v, error %v, expected error %v", resp, err, expectedErr)
+	}
+
+	resp, err = recoverGRPC(context.Background(), "request", info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "response", nil
+	})
+	if resp != "response" || err != nil {
+		t.Errorf("unexpected response %v, error %v", resp, err)
+	}
+}
+
+func TestMergeMountOptions(t *testing.T) {
+	tests := []struct {
+		desc                string
+		mountOptions        []string
+		defaultMountOptions []string
+		expected            []string
+	}{
+		{
+			desc:         "no default mount options",
+			mountOptions: []string{"nfsvers=3", "nfsvers=3"},
+			expected:     []string{"nfsvers=3", "nfsvers=3"},
+		},
+		{
+			desc:                "default mount options are applied if no mount options",
+			defaultMountOptions: []string{"nfsvers=4.1", "hard", "noatime"},
+			expected:            []string{"nfsvers=4.1", "hard", "noatime"},
+		},
+		{
+			desc:                "mount options take precedence",
+			mountOptions:        []string{"nfsvers=3,soft", "ro"},
+			defaultMountOptions: []string{"nfsvers=4.1", "hard", "noatime", "rw"},
+			expected:            []string{"nfsvers=3", "soft", "ro", "noatime"},
+		},
+		{
+			desc:                "duplicated mount options are removed",
+			mountOptions:        []string{"noatime", "hard,noatime"},
+			defaultMountOptions: []string{"hard", "noatime", "noatime"},
+			expected:            []string{"noatime", "hard"},
+		},
+	}
+
+	for _, test := range tests {
+		result := mergeMountOptions(test.mountOptions, test.defaultMountOptions)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("test[%s]: unexpected result %v, expected %v", test.desc, result, test.expected)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// volumeRegistry records volumes known by controller, it's rebuilt from persistent volumes of the driver when controller
+// starts and resynced periodically, volumes created, deleted or queried by controller are updated in place
+type volumeRegistry struct {
+	// volume id -> *nfsVolume
+	volumes sync.Map
+	// 1 until volumes are synced from persistent volumes for the first time
+	notSynced int32
+	// share key -> *nfsVolume of the share root where snapshots are created, snapshots are searched under these
+	// shares and shares of known volumes when ListSnapshots is called without snapshot id or source volume id
+	snapshotShares sync.Map
+}
+
+func newVolumeRegistry() *volumeRegistry {
+	return &volumeRegistry{}
+}
+
+// setSynced marks whether volumes of persistent volumes are registered, volumes are not listed until they are synced
+func (r *volumeRegistry) setSynced(synced bool) {
+	var notSynced int32
+	if !synced {
+		notSynced = 1
+	}
+	atomic.StoreInt32(&r.notSynced, notSynced)
+}
+
+func (r *volumeRegistry) synced() bool {
+	return atomic.LoadInt32(&r.notSynced) == 0
+}
+
+func (r *volumeRegistry) add(vol *nfsVolume) {
+	r.volumes.Store(vol.id, vol)
+}
+
+// get returns the known volume, nil if the volume is not known
+func (r *volumeRegistry) get(volumeID string) *nfsVolume {
+	if v, ok := r.volumes.Load(volumeID); ok {
+		return v.(*nfsVolume)
+	}
+	return nil
+}
+
+func (r *volumeRegistry) remove(volumeID string) {
+	r.volumes.Delete(volumeID)
+}
+
+// list returns known volumes sorted by volume id
+func (r *volumeRegistry) list() []*nfsVolume {
+	var vols []*nfsVolume
+	r.volumes.Range(func(_, v interface{}) bool {
+		vols = append(vols, v.(*nfsVolume))
+		return true
+	})
+	sort.Slice(vols, func(i, j int) bool {
+		return vols[i].id < vols[j].id
+	})
+	return vols
+}
+
+func getShareKey(server, baseDir string) string {
+	return fmt.Sprintf("%s:%s", server, strings.Trim(baseDir, "/"))
+}
+
+func (r *volumeRegistry) addSnapshotShare(server, baseDir string) {
+	r.snapshotShares.Store(getShareKey(server, baseDir), &nfsVolume{server: server, baseDir: strings.Trim(baseDir, "/")})
+}
+
+// listShares returns share roots of known volumes and snapshots sorted by share key, id of each share is its key
+func (r *volumeRegistry) listShares() []*nfsVolume {
+	shares := map[string]*nfsVolume{}
+	add := func(server, baseDir string) {
+		key := getShareKey(server, baseDir)
+		if _, ok := shares[key]; !ok {
+			shares[key] = &nfsVolume{id: key, server: server, baseDir: strings.Trim(baseDir, "/")}
+		}
+	}
+	for _, vol := range r.list() {
+		add(vol.server, vol.baseDir)
+	}
+	r.snapshotShares.Range(func(_, v interface{}) bool {
+		share := v.(*nfsVolume)
+		add(share.server, share.baseDir)
+		return true
+	})
+	var list []*nfsVolume
+	for _, share := range shares {
+		list = append(list, share)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].id < list[j].id
+	})
+	return list
+}
+
+// getVolumeConditions checks whether sub directories of vols exist on nfs server, returns volume id -> condition.
+// Each share is mounted once for all volumes under it, volumes are abnormal if their share could not be mounted.
+func (cs *ControllerServer) getVolumeConditions(ctx context.Context, vols []*nfsVolume) map[string]*csi.VolumeCondition {
+	shares := map[string][]*nfsVolume{}
+	var shareKeys []string
+	for _, vol := range vols {
+		key := fmt.Sprintf("%s:%s", vol.server, vol.baseDir)
+		if _, ok := shares[key]; !ok {
+			shareKeys = append(shareKeys, key)
+		}
+		shares[key] = append(shares[key], vol)
+	}
+
+	conditions := map[string]*csi.VolumeCondition{}
+	logger := klog.FromContext(ctx)
+	for _, key := range shareKeys {
+		shareVols := shares[key]
+		// mount the share root of the first volume, volume id of share volume is used as lock key of internal mount
+		shareVol := &nfsVolume{
+			id:      shareVols[0].id,
+			server:  shareVols[0].server,
+			baseDir: shareVols[0].baseDir,
+			uuid:    "volume-condition-" + getVolumeName(shareVols[0]),
+		}
+		if err := cs.internalMount(ctx, shareVol, nil, nil); err != nil {
+			logger.Info("failed to mount nfs server for volume condition", "share", key, "err", err)
+			for _, vol := range shareVols {
+				conditions[vol.id] = &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("failed to mount nfs server %s: %v", key, err)}
+			}
+			continue
+		}
+
+		sharePath := getInternalMountPath(cs.Driver.workingMountDir, shareVol)
+		for _, vol := range shareVols {
+			conditions[vol.id] = getSubDirCondition(filepath.Join(sharePath, vol.subDir), vol)
+		}
+		if err := cs.internalUnmount(ctx, shareVol); err != nil {
+			logger.Info("failed to unmount nfs server after checking volume condition", "share", key, "err", err)
+		}
+	}
+	return conditions
+}
+
+func getSubDirCondition(path string, vol *nfsVolume) *csi.VolumeCondition {
+	fi, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err):
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("subdirectory %s does not exist on nfs server %s:%s", vol.subDir, vol.server, vol.baseDir)}
+	case err != nil:
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("failed to stat subdirectory %s: %v", vol.subDir, err)}
+	case !fi.IsDir():
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("%s is not a directory on nfs server %s:%s", vol.subDir, vol.server, vol.baseDir)}
+	}
+	return &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}
+}
+
+// volumeRegistryLister lists persistent volumes, it could be replaced in unit tests
+type volumeRegistryLister interface {
+	listPersistentVolumes(ctx context.Context) ([]v1.PersistentVolume, error)
+}
+
+// getProvisionedVolumes returns volumes of pvs created by external-provisioner for the driver, pvs whose volume handle
+// could not be decoded are skipped, static pvs are registered by static volume adoption
+func getProvisionedVolumes(ctx context.Context, driverName string, pvs []v1.PersistentVolume) []*nfsVolume {
+	logger := klog.FromContext(ctx)
+	var vols []*nfsVolume
+	for _, pv := range pvs {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName {
+			continue
+		}
+		if _, ok := pv.Annotations[provisionedByAnnotation]; !ok {
+			continue
+		}
+		vol, err := getNfsVolFromID(pv.Spec.CSI.VolumeHandle)
+		if err != nil {
+			logger.V(4).Info("skip pv with invalid volume handle", "pv", pv.Name, "volumeHandle", pv.Spec.CSI.VolumeHandle, "err", err)
+			continue
+		}
+		if capacity, ok := pv.Spec.Capacity[v1.ResourceStorage]; ok {
+			vol.size = capacity.Value()
+		}
+		vols = append(vols, vol)
+	}
+	return vols
+}
+
+// runVolumeRegistrySync registers provisioned volumes into volume registry when controller starts and every interval,
+// so ListVolumes returns volumes created before controller restarts or by the previous leader
+func (cs *ControllerServer) runVolumeRegistrySync(ctx context.Context, lister volumeRegistryLister, interval time.Duration) {
+	logger := klog.FromContext(ctx).WithName("volume-registry-sync")
+	ctx = klog.NewContext(ctx, logger)
+	logger.V(2).Info("starting volume registry sync", "interval", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	synced := map[string]bool{}
+	for {
+		var err error
+		if synced, err = cs.syncProvisionedVolumes(ctx, lister, synced); err != nil {
+			logger.Error(err, "volume registry sync failed")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncProvisionedVolumes adds provisioned volumes into volume registry and removes volumes synced before whose pv is
+// deleted, returns ids of synced volumes. Volumes created after pvs are listed are kept since they are not synced before.
+func (cs *ControllerServer) syncProvisionedVolumes(ctx context.Context, lister volumeRegistryLister, synced map[string]bool) (map[string]bool, error) {
+	pvs, err := lister.listPersistentVolumes(ctx)
+	if err != nil {
+		return synced, fmt.Errorf("failed to list persistent volumes: %v", err)
+	}
+	logger := klog.FromContext(ctx)
+	current := map[string]bool{}
+	for _, vol := range getProvisionedVolumes(ctx, cs.Driver.name, pvs) {
+		cs.Driver.volumes.add(vol)
+		current[vol.id] = true
+	}
+	for id := range synced {
+		if !current[id] {
+			logger.V(4).Info("volume is removed from volume registry since its pv is deleted", "volumeID", id)
+			cs.Driver.volumes.remove(id)
+		}
+	}
+	if !cs.Driver.volumes.synced() {
+		logger.V(2).Info("volume registry is synced", "provisionedVolumes", len(current))
+		cs.Driver.volumes.setSynced(true)
+	}
+	return current, nil
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// versions of volume id, version of an existing volume id is detected by its format
+const (
+	// {server}:{path}, volume handle of in-tree nfs PV translated by CSI migration shim or rewritten by migrate-in-tree, it's only parsed
+	volumeIDInTree = 0
+	// {server}/{baseDir}/{subDir}, created by upstream driver before v3.0.0, it's only parsed
+	volumeIDV1 = 1
+	// {server}#{baseDir}#{subDir}, created by upstream driver before uuid and onDelete are added
+	volumeIDV2 = 2
+	// {server}#{baseDir}#{subDir}#{uuid}#{onDelete}[#retainFor={retainFor}][#prune], uuid and onDelete could be empty,
+	// retainFor and prune(pruneEmptyParents) are only added if they are set
+	volumeIDV3 = 3
+
+	DefaultVolumeIDVersion = volumeIDV3
+)
+
+// optional elements of volume id after onDelete, they are matched by key instead of position,
+// so elements unknown to the driver are ignored
+const (
+	// prefix of the element with retainFor
+	retainForIDKey = "retainFor="
+	// element if empty parent directories of subDir are pruned on deletion
+	pruneIDElement = "prune"
+)
+
+var volumeIDV1Regex = regexp.MustCompile("^([^/]+)/(.*)/([^/]+)$")
+
+// isValidVolumeIDVersion returns true if volume id of new volumes could be created in the version
+func isValidVolumeIDVersion(version int) bool {
+	return version == volumeIDV2 || version == volumeIDV3
+}
+
+// encodeVolumeID returns volume id of vol in the version, volume id of volumeIDV3 is returned
+// if uuid or onDelete of vol could not be kept in the version
+func encodeVolumeID(vol *nfsVolume, version int) string {
+	keepOnDelete := strings.EqualFold(vol.onDelete, retain) || strings.EqualFold(vol.onDelete, archive)
+	if version == volumeIDV2 && vol.uuid == "" && !keepOnDelete && vol.retainFor == "" && !vol.pruneParents {
+		return strings.Join([]string{strings.Trim(vol.server, "/"), strings.Trim(vol.baseDir, "/"), strings.Trim(vol.subDir, "/")}, separator)
+	}
+	if version == volumeIDV2 {
+		klog.V(4).InfoS("volume id version could not keep uuid, onDelete, retainFor and pruneEmptyParents", "version", version, "uuid", vol.uuid, "onDelete", vol.onDelete, "retainFor", vol.retainFor, "pruneEmptyParents", vol.pruneParents, "usingVersion", volumeIDV3)
+	}
+
+	idElements := make([]string, totalIDElements)
+	idElements[idServer] = strings.Trim(vol.server, "/")
+	idElements[idBaseDir] = strings.Trim(vol.baseDir, "/")
+	idElements[idSubDir] = strings.Trim(vol.subDir, "/")
+	idElements[idUUID] = vol.uuid
+	if keepOnDelete {
+		idElements[idOnDelete] = vol.onDelete
+	}
+	// optional elements are only appended if they are set, so ids of existing volumes are unchanged
+	if vol.retainFor != "" {
+		idElements = append(idElements, retainForIDKey+vol.retainFor)
+	}
+	if vol.pruneParents {
+		idElements = append(idElements, pruneIDElement)
+	}
+	return strings.Join(idElements, separator)
+}
+
+// decodeVolumeID returns the volume and version of volume id, volume ids of all versions
+// are parsed so that volumes created by upstream driver are handled after upgrade
+func decodeVolumeID(id string) (*nfsVolume, int, error) {
+	if server, path, ok := parseInTreeVolumeHandle(id); ok {
+		// the whole path is the share, data of in-tree PVs is never removed by DeleteVolume
+		return &nfsVolume{id: id, server: server, baseDir: strings.Trim(path, "/"), onDelete: retain}, volumeIDInTree, nil
+	}
+	vol := &nfsVolume{id: id}
+	segments := strings.Split(id, separator)
+	if len(segments) < 3 {
+		klog.V(2).InfoS("could not split volume id into server, baseDir and subDir", "volumeID", id, "separator", separator)
+		tokens := volumeIDV1Regex.FindStringSubmatch(id)
+		if tokens == nil || len(tokens) < 4 {
+			return nil, 0, fmt.Errorf("could not split %s into server, baseDir and subDir with separator(%s)", id, "/")
+		}
+		vol.server = tokens[1]
+		vol.baseDir = tokens[2]
+		vol.subDir = tokens[3]
+		return vol, volumeIDV1, nil
+	}
+
+	vol.server = segments[idServer]
+	vol.baseDir = segments[idBaseDir]
+	vol.subDir = segments[idSubDir]
+	if len(segments) == idUUID {
+		return vol, volumeIDV2, nil
+	}
+	vol.uuid = segments[idUUID]
+	if len(segments) > idOnDelete {
+		vol.onDelete = segments[idOnDelete]
+	}
+	if len(segments) <= totalIDElements {
+		return vol, volumeIDV3, nil
+	}
+	for _, element := range segments[totalIDElements:] {
+		switch {
+		case strings.HasPrefix(element, retainForIDKey):
+			vol.retainFor = strings.TrimPrefix(element, retainForIDKey)
+		case element == pruneIDElement:
+			vol.pruneParents = true
+		default:
+			klog.V(4).InfoS("ignore unknown element in volume id", "element", element, "volumeID", id)
+		}
+	}
+	return vol, volumeIDV3, nil
+}
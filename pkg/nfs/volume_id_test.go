@@ -0,0 +1,183 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEncodeVolumeID(t *testing.T) {
+	cases := []struct {
+		desc     string
+		vol      *nfsVolume
+		version  int
+		expected string
+	}{
+		{
+			desc:     "version 3",
+			vol:      &nfsVolume{server: "10.0.0.1", baseDir: "/share/", subDir: "pvc-1", onDelete: "delete"},
+			version:  volumeIDV3,
+			expected: "10.0.0.1#share#pvc-1##",
+		},
+		{
+			desc:     "version 3 with uuid and onDelete",
+			vol:      &nfsVolume{server: "10.0.0.1", baseDir: "/share", subDir: "ns/pvc", uuid: "pvc-1", onDelete: "retain"},
+			version:  volumeIDV3,
+			expected: "10.0.0.1#share#ns/pvc#pvc-1#retain",
+		},
+		{
+			desc:     "version 3 with retainFor",
+			vol:      &nfsVolume{server: "10.0.0.1", baseDir: "/share", subDir: "pvc-1", onDelete: "delete", retainFor: "72h"},
+			version:  volumeIDV3,
+			expected: "10.0.0.1#share#pvc-1###retainFor=72h",
+		},
+		{
+			desc:     "version 3 with pruneEmptyParents",
+			vol:      &nfsVolume{server: "10.0.0.1", baseDir: "/share", subDir: "team-a/ns/pvc", uuid: "pvc-1", onDelete: "delete", pruneParents: true},
+			version:  volumeIDV3,
+			expected: "10.0.0.1#share#team-a/ns/pvc#pvc-1##prune",
+		},
+		{
+			desc:     "version 2 could not keep retainFor",
+			vol:      &nfsVolume{server: "10.0.0.1", baseDir: "/share", subDir: "pvc-1", retainFor: "72h"},
+			version:  volumeIDV2,
+			expected: "10.0.0.1#share#pvc-1###retainFor=72h",
+		},
+		{
+			desc:     "version 2",
+			vol:      &nfsVolume{server: "10.0.0.1", baseDir: "/share", subDir: "pvc-1", onDelete: "delete"},
+			version:  volumeIDV2,
+			expected: "10.0.0.1#share#pvc-1",
+		},
+		{
+			desc:     "version 2 could not keep uuid",
+			vol:      &nfsVolume{server: "10.0.0.1", baseDir: "/share", subDir: "ns/pvc", uuid: "pvc-1"},
+			version:  volumeIDV2,
+			expected: "10.0.0.1#share#ns/pvc#pvc-1#",
+		},
+		{
+			desc:     "version 2 could not keep onDelete",
+			vol:      &nfsVolume{server: "10.0.0.1", baseDir: "/share", subDir: "pvc-1", onDelete: "archive"},
+			version:  volumeIDV2,
+			expected: "10.0.0.1#share#pvc-1##archive",
+		},
+	}
+	for _, test := range cases {
+		t.Run(test.desc, func(t *testing.T) {
+			id := encodeVolumeID(test.vol, test.version)
+			if id != test.expected {
+				t.Errorf("got %s, expected %s", id, test.expected)
+			}
+			// volume id is parsed back to the same volume
+			vol, _, err := decodeVolumeID(id)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if encodeVolumeID(vol, volumeIDV3) != encodeVolumeID(test.vol, volumeIDV3) {
+				t.Errorf("got volume %+v from %s, expected %+v", vol, id, test.vol)
+			}
+		})
+	}
+}
+
+func TestDecodeVolumeID(t *testing.T) {
+	cases := []struct {
+		desc      string
+		id        string
+		expected  *nfsVolume
+		version   int
+		expectErr bool
+	}{
+		{
+			desc:     "version 1 of upstream driver",
+			id:       "nfs-server.default.svc.cluster.local/share/pvc-1",
+			expected: &nfsVolume{id: "nfs-server.default.svc.cluster.local/share/pvc-1", server: "nfs-server.default.svc.cluster.local", baseDir: "share", subDir: "pvc-1"},
+			version:  volumeIDV1,
+		},
+		{
+			desc:     "version 1 with nested share",
+			id:       "10.0.0.1/exports/data/pvc-1",
+			expected: &nfsVolume{id: "10.0.0.1/exports/data/pvc-1", server: "10.0.0.1", baseDir: "exports/data", subDir: "pvc-1"},
+			version:  volumeIDV1,
+		},
+		{
+			desc:     "version 1 with root share",
+			id:       "10.0.0.1//pvc-1",
+			expected: &nfsVolume{id: "10.0.0.1//pvc-1", server: "10.0.0.1", baseDir: "", subDir: "pvc-1"},
+			version:  volumeIDV1,
+		},
+		{
+			desc:     "version 2 of upstream driver",
+			id:       "10.0.0.1#share#pvc-1",
+			expected: &nfsVolume{id: "10.0.0.1#share#pvc-1", server: "10.0.0.1", baseDir: "share", subDir: "pvc-1"},
+			version:  volumeIDV2,
+		},
+		{
+			desc:     "version 3 with uuid only",
+			id:       "10.0.0.1#share#ns/pvc#pvc-1",
+			expected: &nfsVolume{id: "10.0.0.1#share#ns/pvc#pvc-1", server: "10.0.0.1", baseDir: "share", subDir: "ns/pvc", uuid: "pvc-1"},
+			version:  volumeIDV3,
+		},
+		{
+			desc:     "version 3 with pruneEmptyParents",
+			id:       "10.0.0.1#share#team-a/ns/pvc#pvc-1##retainFor=72h#prune",
+			expected: &nfsVolume{id: "10.0.0.1#share#team-a/ns/pvc#pvc-1##retainFor=72h#prune", server: "10.0.0.1", baseDir: "share", subDir: "team-a/ns/pvc", uuid: "pvc-1", retainFor: "72h", pruneParents: true},
+			version:  volumeIDV3,
+		},
+		{
+			desc:     "version 3 with unknown elements",
+			id:       "10.0.0.1#share#pvc-1##retain#unknown",
+			expected: &nfsVolume{id: "10.0.0.1#share#pvc-1##retain#unknown", server: "10.0.0.1", baseDir: "share", subDir: "pvc-1", onDelete: "retain"},
+			version:  volumeIDV3,
+		},
+		{
+			desc:     "version 3 with unknown elements between optional elements",
+			id:       "10.0.0.1#share#pvc-1##delete#unknown#retainFor=72h",
+			expected: &nfsVolume{id: "10.0.0.1#share#pvc-1##delete#unknown#retainFor=72h", server: "10.0.0.1", baseDir: "share", subDir: "pvc-1", onDelete: "delete", retainFor: "72h"},
+			version:  volumeIDV3,
+		},
+		{
+			desc:     "in-tree volume handle",
+			id:       "10.0.0.1:/exports/data/pv-1",
+			expected: &nfsVolume{id: "10.0.0.1:/exports/data/pv-1", server: "10.0.0.1", baseDir: "exports/data/pv-1", onDelete: retain},
+			version:  volumeIDInTree,
+		},
+		{
+			desc:     "in-tree volume handle with ipv6 server",
+			id:       "[fd00::1]:/share",
+			expected: &nfsVolume{id: "[fd00::1]:/share", server: "[fd00::1]", baseDir: "share", onDelete: retain},
+			version:  volumeIDInTree,
+		},
+		{
+			desc:      "invalid volume id",
+			id:        "10.0.0.1#share",
+			expectErr: true,
+		},
+	}
+	for _, test := range cases {
+		t.Run(test.desc, func(t *testing.T) {
+			vol, version, err := decodeVolumeID(test.id)
+			if (err != nil) != test.expectErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(vol, test.expected) || version != test.version {
+				t.Errorf("got %+v version %d, expected %+v version %d", vol, version, test.expected, test.version)
+			}
+		})
+	}
+}
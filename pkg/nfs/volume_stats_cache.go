@@ -0,0 +1,70 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+type volumeStats struct {
+	usage    []*csi.VolumeUsage
+	expireAt time.Time
+}
+
+// volumeStatsCache caches NodeGetVolumeStats results by volume path, so that statfs is not issued
+// against nfs server on every kubelet poll, caching is disabled if ttl is 0
+type volumeStatsCache struct {
+	ttl time.Duration
+	// volume path -> volumeStats
+	stats sync.Map
+	// could be replaced in unit tests
+	now func() time.Time
+}
+
+func newVolumeStatsCache(ttl time.Duration) *volumeStatsCache {
+	return &volumeStatsCache{ttl: ttl, now: time.Now}
+}
+
+func (c *volumeStatsCache) get(volumePath string) ([]*csi.VolumeUsage, bool) {
+	if c.ttl <= 0 {
+		return nil, false
+	}
+	v, ok := c.stats.Load(volumePath)
+	if !ok {
+		return nil, false
+	}
+	stats := v.(volumeStats)
+	if c.now().After(stats.expireAt) {
+		c.stats.Delete(volumePath)
+		return nil, false
+	}
+	return stats.usage, true
+}
+
+func (c *volumeStatsCache) set(volumePath string, usage []*csi.VolumeUsage) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.stats.Store(volumePath, volumeStats{usage: usage, expireAt: c.now().Add(c.ttl)})
+}
+
+func (c *volumeStatsCache) remove(volumePath string) {
+	c.stats.Delete(volumePath)
+}
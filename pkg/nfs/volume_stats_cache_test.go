@@ -0,0 +1,84 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+)
+
+func TestVolumeStatsCache(t *testing.T) {
+	now := time.Now()
+	cache := newVolumeStatsCache(time.Minute)
+	cache.now = func() time.Time { return now }
+	usage := []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Available: 1, Total: 2, Used: 1}}
+
+	if _, ok := cache.get("/target"); ok {
+		t.Errorf("unexpected cached stats of /target")
+	}
+	cache.set("/target", usage)
+	if cached, ok := cache.get("/target"); !ok || !reflect.DeepEqual(cached, usage) {
+		t.Errorf("unexpected cached stats %v, expected %v", cached, usage)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, ok := cache.get("/target"); ok {
+		t.Errorf("expired stats of /target are returned")
+	}
+
+	cache.set("/target", usage)
+	cache.remove("/target")
+	if _, ok := cache.get("/target"); ok {
+		t.Errorf("removed stats of /target are returned")
+	}
+
+	disabled := newVolumeStatsCache(0)
+	disabled.set("/target", usage)
+	if _, ok := disabled.get("/target"); ok {
+		t.Errorf("stats are cached with ttl 0")
+	}
+}
+
+func TestNodeGetVolumeStatsWithCache(t *testing.T) {
+	ns, err := getTestNodeServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ns.volumeStatsCache = newVolumeStatsCache(time.Minute)
+	volumePath := t.TempDir()
+	req := &csi.NodeGetVolumeStatsRequest{VolumeId: "vol_1", VolumePath: volumePath}
+	resp, err := ns.NodeGetVolumeStats(context.Background(), req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// cached stats are returned without statfs on the volume path
+	if err := os.RemoveAll(volumePath); err != nil {
+		t.Fatalf("failed to remove %s: %v", volumePath, err)
+	}
+	cached, err := ns.NodeGetVolumeStats(context.Background(), req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(cached.Usage, resp.Usage) {
+		t.Errorf("unexpected cached stats %v, expected %v", cached.Usage, resp.Usage)
+	}
+}